@@ -0,0 +1,121 @@
+package branding
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the branding definition inside a branding directory.
+const FileName = "branding.yaml"
+
+// Branding themes the boot menus rendered for each machine.
+type Branding struct {
+	Title          string `yaml:"title"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+	Colors         Colors `yaml:"colors"`
+	// Logo is a PNG inside the branding directory that iPXE draws behind its
+	// menu with console --picture. Empty leaves the console plain.
+	Logo string `yaml:"logo"`
+}
+
+// Colors holds 24-bit "#rrggbb" colours for graphical menus and "fg/bg" VGA
+// colour names for text-mode menus.
+type Colors struct {
+	Foreground    string `yaml:"foreground"`
+	Background    string `yaml:"background"`
+	Highlight     string `yaml:"highlight"`
+	Text          string `yaml:"text"`
+	TextHighlight string `yaml:"textHighlight"`
+}
+
+// Default is used for any field branding.yaml leaves unset.
+func Default() Branding {
+	return Branding{
+		Title:          "goosed network boot",
+		TimeoutSeconds: 10,
+		Colors: Colors{
+			Foreground:    "#e5e9f0",
+			Background:    "#2e3440",
+			Highlight:     "#88c0d0",
+			Text:          "light-gray/blue",
+			TextHighlight: "black/light-cyan",
+		},
+	}
+}
+
+// Load reads branding.yaml from fsys, filling unset fields from Default. A
+// missing file yields the defaults.
+func Load(fsys fs.FS) (Branding, error) {
+	b := Default()
+	data, err := fs.ReadFile(fsys, FileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return Branding{}, fmt.Errorf("read %s: %w", FileName, err)
+	}
+
+	var file Branding
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return Branding{}, fmt.Errorf("parse %s: %w", FileName, err)
+	}
+	if file.Title != "" {
+		b.Title = file.Title
+	}
+	if file.TimeoutSeconds > 0 {
+		b.TimeoutSeconds = file.TimeoutSeconds
+	}
+	for _, c := range []struct {
+		dst *string
+		src string
+	}{
+		{&b.Colors.Foreground, file.Colors.Foreground},
+		{&b.Colors.Background, file.Colors.Background},
+		{&b.Colors.Highlight, file.Colors.Highlight},
+		{&b.Colors.Text, file.Colors.Text},
+		{&b.Colors.TextHighlight, file.Colors.TextHighlight},
+	} {
+		if c.src != "" {
+			*c.dst = c.src
+		}
+	}
+	if file.Logo != "" {
+		if !fs.ValidPath(file.Logo) {
+			return Branding{}, fmt.Errorf("%s: logo %q must be a relative path inside the branding directory", FileName, file.Logo)
+		}
+		b.Logo = file.Logo
+	}
+	for _, hex := range []string{b.Colors.Foreground, b.Colors.Background, b.Colors.Highlight} {
+		if !validHex(hex) {
+			return Branding{}, fmt.Errorf("%s: colour %q is not #rrggbb", FileName, hex)
+		}
+	}
+	return b, nil
+}
+
+// ARGB converts "#rrggbb" to the opaque "#aarrggbb" form syslinux menus use.
+func (Branding) ARGB(hex string) string {
+	return "#ff" + strings.TrimPrefix(strings.ToLower(hex), "#")
+}
+
+// RGB converts "#rrggbb" to the "0xrrggbb" form of iPXE's colour --rgb.
+func (Branding) RGB(hex string) string {
+	return "0x" + strings.TrimPrefix(strings.ToLower(hex), "#")
+}
+
+func validHex(s string) bool {
+	s, ok := strings.CutPrefix(s, "#")
+	if !ok || len(s) != 6 {
+		return false
+	}
+	for _, r := range strings.ToLower(s) {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+// Package profile builds the effective profile a machine is rendered with by
+// layering built-in defaults, its blueprint, matching overlays and its own
+// machine profile.
+package profile
+
+import (
+	"reflect"
+	"strings"
+)
+
+// AppendSuffix marks a list that extends the one from lower layers instead of
+// replacing it: `packages+: [vim]` adds vim to the blueprint's packages.
+const AppendSuffix = "+"
+
+// secretRefKey mirrors render.SecretRefKey; a secret reference is a value,
+// not a map to merge into.
+const secretRefKey = "secretRef"
+
+// Layer is one source of profile values, named for display in the effective
+// profile.
+type Layer struct {
+	Name    string
+	Profile map[string]any
+}
+
+// Merge combines layers from lowest to highest precedence and returns a new
+// map; the inputs are not modified. The rules are:
+//
+//   - maps merge key by key, recursively;
+//   - lists and scalars from a higher layer replace the lower value;
+//   - a key written as name+ appends its list to the lower name list,
+//     skipping items that are already present; a layer holding both name
+//     and name+ replaces the list with name and then appends name+;
+//   - a null value removes the key;
+//   - a {secretRef: ...} map is a single value and replaces whatever is below.
+func Merge(layers ...map[string]any) map[string]any {
+	out := map[string]any{}
+	for _, layer := range layers {
+		out = mergeMaps(out, layer)
+	}
+	return out
+}
+
+// Defaults are the values every machine starts from before its blueprint.
+func Defaults() map[string]any {
+	return map[string]any{
+		"kickstart": map[string]any{
+			"lang":     "en_US.UTF-8",
+			"keyboard": "us",
+			"timezone": "UTC",
+		},
+		"unattend": map[string]any{
+			"locale":   "en-US",
+			"timezone": "UTC",
+		},
+	}
+}
+
+func mergeMaps(dst, src map[string]any) map[string]any {
+	out := make(map[string]any, len(dst)+len(src))
+	for k, v := range dst {
+		out[k] = v
+	}
+	// Replacements first, so name+ appends to the name of the same layer
+	// whatever order the map yields them in.
+	for _, appending := range []bool{false, true} {
+		for rawKey, v := range src {
+			key, appendList := strings.CutSuffix(rawKey, AppendSuffix)
+			if key == "" {
+				key, appendList = rawKey, false
+			}
+			if appendList != appending {
+				continue
+			}
+			if v == nil {
+				delete(out, key)
+				continue
+			}
+			out[key] = mergeValue(out[key], v, appendList)
+		}
+	}
+	return out
+}
+
+func mergeValue(lower, upper any, appendList bool) any {
+	if um, ok := upper.(map[string]any); ok {
+		if lm, ok := lower.(map[string]any); ok && !isSecretRef(um) && !isSecretRef(lm) {
+			return mergeMaps(lm, um)
+		}
+		return mergeMaps(nil, um)
+	}
+	if ul, ok := upper.([]any); ok {
+		out := []any{}
+		if ll, ok := lower.([]any); ok && appendList {
+			out = append(out, ll...)
+		}
+		for _, item := range ul {
+			if appendList && containsValue(out, item) {
+				continue
+			}
+			out = append(out, copyValue(item))
+		}
+		return out
+	}
+	return upper
+}
+
+// copyValue detaches maps and lists from the layer they came from, dropping
+// null map entries as mergeMaps does.
+func copyValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		return mergeMaps(nil, t)
+	case []any:
+		return mergeValue(nil, t, false)
+	default:
+		return v
+	}
+}
+
+func isSecretRef(m map[string]any) bool {
+	_, ok := m[secretRefKey]
+	return ok
+}
+
+func containsValue(list []any, v any) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package profile
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	blueprint := map[string]any{
+		"packages": []any{"@^minimal", "chrony"},
+		"repos":    map[string]any{"baseos": "http://mirror/baseos", "appstream": "http://mirror/appstream"},
+		"kickstart": map[string]any{
+			"timezone":         "UTC",
+			"rootPasswordHash": "$6$blueprint",
+			"ntpServers":       []any{"time1", "time2"},
+		},
+		"install": map[string]any{"method": "cdrom"},
+	}
+	machine := map[string]any{
+		"packages+": []any{"chrony", "vim"},
+		"repos":     map[string]any{"epel": "http://mirror/epel", "appstream": nil},
+		"kickstart": map[string]any{
+			"rootPasswordHash": map[string]any{"secretRef": "lab-a/root"},
+			"ntpServers":       []any{"time3"},
+		},
+		"install": nil,
+	}
+
+	got := Merge(blueprint, machine)
+	want := map[string]any{
+		"packages": []any{"@^minimal", "chrony", "vim"},
+		"repos":    map[string]any{"baseos": "http://mirror/baseos", "epel": "http://mirror/epel"},
+		"kickstart": map[string]any{
+			"timezone":         "UTC",
+			"rootPasswordHash": map[string]any{"secretRef": "lab-a/root"},
+			"ntpServers":       []any{"time3"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Merge =\n%#v\nwant\n%#v", got, want)
+	}
+
+	got["packages"].([]any)[0] = "changed"
+	if blueprint["packages"].([]any)[0] != "@^minimal" {
+		t.Fatal("Merge aliased an input list")
+	}
+
+	// name replaces before name+ appends, whichever the map yields first.
+	both := map[string]any{"packages": []any{"tmux"}, "packages+": []any{"vim"}}
+	for i := 0; i < 20; i++ {
+		if got := Merge(blueprint, both)["packages"]; !reflect.DeepEqual(got, []any{"tmux", "vim"}) {
+			t.Fatalf("packages with packages+ = %v", got)
+		}
+	}
+}
+
+func TestSourceResolve(t *testing.T) {
+	root := t.TempDir()
+	write(t, root, "blueprints/rocky/9/base/blueprint.yaml", `
+apiVersion: goosed.io/v1alpha1
+kind: Blueprint
+metadata: {name: rocky-9-base}
+spec:
+  description: ignored
+  os: {family: rocky, version: "9"}
+  packages:
+    groups: ["@^minimal"]
+    extra: [chrony]
+  kickstart:
+    timezone: UTC
+`)
+	write(t, root, "blueprints/rhel/9/base/blueprint.yaml", blueprint("rhel"))
+	write(t, root, "overlays/org.yaml", `
+apiVersion: goosed.io/v1alpha1
+kind: ProfileOverlay
+metadata: {name: org}
+spec:
+  profile:
+    kickstart: {ntpServers: [time.org]}
+`)
+	write(t, root, "overlays/lab-a.yaml", `
+apiVersion: goosed.io/v1alpha1
+kind: ProfileOverlay
+metadata: {name: lab-a}
+spec:
+  selector: {site: lab-a}
+  profile:
+    kickstart: {ntpServers: [time.lab-a], timezone: Europe/Berlin}
+`)
+	write(t, root, "overlays/rack-02.yaml", `
+apiVersion: goosed.io/v1alpha1
+kind: ProfileOverlay
+metadata: {name: rack-02}
+spec:
+  selector: {site: lab-a, rack: rack-02}
+  profile:
+    hostname: wrong
+`)
+	write(t, root, "machine-profiles/lab-a/node.yaml", `
+apiVersion: goosed.io/v1alpha1
+kind: MachineProfile
+metadata:
+  name: node
+  labels: {site: lab-a, rack: rack-01}
+spec:
+  machine: {mac: "00:11:22:AA:BB:CC"}
+  blueprint: rocky/9/base
+  profile:
+    hostname: node-from-git
+    packages+: [vim]
+`)
+
+	src := &Source{Root: root}
+	eff, err := src.Resolve("00-11-22-aa-bb-cc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLayers := []string{"defaults", "blueprint:rocky/9/base", "overlay:org", "overlay:lab-a", "machine:machine-profiles/lab-a/node.yaml"}
+	if !reflect.DeepEqual(eff.Layers, wantLayers) {
+		t.Fatalf("layers = %v, want %v", eff.Layers, wantLayers)
+	}
+	if eff.Blueprint != "rocky/9/base" {
+		t.Fatalf("blueprint = %q", eff.Blueprint)
+	}
+	if got := eff.Profile["packages"]; !reflect.DeepEqual(got, []any{"@^minimal", "chrony", "vim"}) {
+		t.Fatalf("packages = %v", got)
+	}
+	ks := eff.Profile["kickstart"].(map[string]any)
+	if ks["timezone"] != "Europe/Berlin" || !reflect.DeepEqual(ks["ntpServers"], []any{"time.lab-a"}) || ks["lang"] != "en_US.UTF-8" {
+		t.Fatalf("kickstart = %v", ks)
+	}
+	if _, ok := eff.Profile["description"]; ok {
+		t.Fatal("blueprint description leaked into the profile")
+	}
+
+	// A stored profile is layered over the document's spec.profile.
+	eff, err = src.Resolve("00:11:22:aa:bb:cc", map[string]any{"hostname": "node-from-db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eff.Profile["hostname"] != "node-from-db" || !reflect.DeepEqual(eff.Layers[len(eff.Layers)-2:], []string{"machine:machine-profiles/lab-a/node.yaml", "machine"}) {
+		t.Fatalf("stored profile not applied: %v %v", eff.Profile["hostname"], eff.Layers)
+	}
+	if got := eff.Profile["packages"]; !reflect.DeepEqual(got, []any{"@^minimal", "chrony", "vim"}) {
+		t.Fatalf("packages = %v", got)
+	}
+
+	eff, err = src.Resolve("00:11:22:33:44:55", map[string]any{"blueprint": "rhel/9/base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(eff.Layers, []string{"defaults", "blueprint:rhel/9/base", "overlay:org", "machine"}) {
+		t.Fatalf("layers = %v", eff.Layers)
+	}
+
+	if _, err := src.Resolve("00:11:22:33:44:55", map[string]any{"blueprint": "../secrets"}); err == nil {
+		t.Fatal("expected an invalid blueprint reference to fail")
+	}
+}
+
+func TestSourceCompose(t *testing.T) {
+	root := t.TempDir()
+	write(t, root, "blueprints/rocky/9/base/blueprint.yaml", blueprint("rocky"))
+	write(t, root, "overlays/lab-a.yaml", `
+apiVersion: goosed.io/v1alpha1
+kind: ProfileOverlay
+metadata: {name: lab-a}
+spec:
+  selector: {site: lab-a}
+  profile:
+    kickstart: {timezone: Europe/Berlin}
+`)
+
+	src := &Source{Root: root}
+	eff, err := src.Compose("rocky/9/base", map[string]string{"site": "lab-a"}, map[string]any{"hostname": "draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(eff.Layers, []string{"defaults", "blueprint:rocky/9/base", "overlay:lab-a", "profile"}) {
+		t.Fatalf("layers = %v", eff.Layers)
+	}
+	if eff.Profile["hostname"] != "draft" || eff.Profile["kickstart"].(map[string]any)["timezone"] != "Europe/Berlin" {
+		t.Fatalf("profile = %v", eff.Profile)
+	}
+
+	eff, err = src.Compose("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(eff.Layers, []string{"defaults"}) {
+		t.Fatalf("layers = %v", eff.Layers)
+	}
+
+	if _, err := src.Compose("rocky/10/missing", nil, nil); err == nil {
+		t.Fatal("expected a missing blueprint to fail")
+	}
+}
+
+func TestSourceSkipsInvalidDocuments(t *testing.T) {
+	root := t.TempDir()
+	write(t, root, "blueprints/rocky/9/base/blueprint.yaml", blueprint("rocky"))
+	write(t, root, "blueprints/rocky/9/broken/blueprint.yaml", "spec: [\n")
+	write(t, root, "overlays/broken.yaml", "apiVersion: goosed.io/v1alpha1\nkind: ProfileOverlay\nmetadata: {name: broken}\nspec: {selector: [site], profile: {hostname: x}}\n")
+	write(t, root, "overlays/typo.yaml", "apiVersion: goosed.io/v1alpha1\nkind: ProfileOverlay\nmetadata: {name: typo}\nspec: {profile: {hostname: x}, selectr: {}}\n")
+	write(t, root, "overlays/misplaced.yaml", "apiVersion: goosed.io/v1alpha1\nkind: Blueprint\nmetadata: {name: misplaced}\nspec: {os: {family: rocky}}\n")
+	write(t, root, "machine-profiles/node.yaml", machineProfile("node", "rocky/9/base"))
+	write(t, root, "machine-profiles/other.yaml", machineProfile("other", ""))
+
+	var logs bytes.Buffer
+	src := &Source{Root: root, Logger: log.New(&logs, "", 0)}
+	eff, err := src.Resolve("00:11:22:aa:bb:cc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(eff.Layers, []string{"defaults", "blueprint:rocky/9/base", "machine:machine-profiles/node.yaml"}) {
+		t.Fatalf("layers = %v", eff.Layers)
+	}
+	for _, file := range []string{"blueprints/rocky/9/broken/blueprint.yaml", "overlays/broken.yaml", "overlays/typo.yaml", "overlays/misplaced.yaml", "machine-profiles/other.yaml"} {
+		if !strings.Contains(logs.String(), "skipping "+file) {
+			t.Errorf("%s not reported: %s", file, logs.String())
+		}
+	}
+	if _, err := src.Resolve("00:11:22:33:44:55", map[string]any{"blueprint": "rocky/9/broken"}); err == nil {
+		t.Fatal("expected the broken blueprint to fail the machine using it")
+	}
+
+	// The documents are parsed once per revision of the checkout.
+	logs.Reset()
+	if _, err := src.Resolve("00:11:22:aa:bb:cc", nil); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("unchanged checkout was read again: %s", logs.String())
+	}
+	write(t, root, "overlays/typo.yaml", "apiVersion: goosed.io/v1alpha1\nkind: ProfileOverlay\nmetadata: {name: typo}\nspec: {profile: {hostname: fixed}}\n")
+	eff, err = src.Resolve("00:11:22:aa:bb:cc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eff.Profile["hostname"] != "fixed" {
+		t.Fatalf("fixed overlay not picked up: %v", eff.Layers)
+	}
+}
+
+func TestSourceFollowsCheckoutSymlink(t *testing.T) {
+	dir := t.TempDir()
+	for _, tree := range []string{"a", "b"} {
+		write(t, dir, "trees/"+tree+"/blueprints/rocky/9/base/blueprint.yaml", blueprint("rocky"))
+		write(t, dir, "trees/"+tree+"/machine-profiles/node.yaml", machineProfile("node-"+tree, "rocky/9/base"))
+	}
+	link := filepath.Join(dir, "current")
+	swap := func(tree string) {
+		t.Helper()
+		if err := os.Symlink(filepath.Join("trees", tree), link+".tmp"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(link+".tmp", link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := &Source{Root: link}
+	for _, tree := range []string{"a", "b"} {
+		swap(tree)
+		layers, _, err := src.Layers("00:11:22:aa:bb:cc", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.index == nil || !strings.Contains(src.index.revision, filepath.Join("trees", tree)) {
+			t.Fatalf("tree %s: not read through the symlink (%v)", tree, layers)
+		}
+	}
+}
+
+func blueprint(family string) string {
+	return "apiVersion: goosed.io/v1alpha1\nkind: Blueprint\nmetadata: {name: " + family + "}\nspec:\n  os: {family: " + family + "}\n  kickstart: {timezone: UTC}\n"
+}
+
+func machineProfile(name, blueprint string) string {
+	return "apiVersion: goosed.io/v1alpha1\nkind: MachineProfile\nmetadata: {name: " + name + "}\nspec:\n  machine: {mac: \"00:11:22:aa:bb:cc\"}\n  blueprint: \"" + blueprint + "\"\n"
+}
+
+func write(t *testing.T, root, rel, content string) {
+	t.Helper()
+	p := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,441 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"goosed/pkg/schema"
+)
+
+const (
+	blueprintsDir = "blueprints"
+	overlaysDir   = "overlays"
+	profilesDir   = "machine-profiles"
+	blueprintFile = "blueprint.yaml"
+)
+
+// Source reads blueprints, overlays and machine profiles from an infra/
+// checkout. The parsed documents are cached until the checkout changes, so
+// Git updates apply to the next render without every render re-reading the
+// tree. Invalid documents are skipped and logged rather than failing every
+// machine.
+type Source struct {
+	Root string
+	// Logger receives the invalid documents, once per revision of the
+	// checkout. Defaults to log.Default().
+	Logger *log.Logger
+
+	mu    sync.Mutex
+	index *index
+}
+
+// index is the parsed content of one revision of the checkout.
+type index struct {
+	revision string
+	// blueprints holds the spec of each valid blueprint by reference, and
+	// invalidBlueprints why the others were skipped.
+	blueprints        map[string]map[string]any
+	invalidBlueprints map[string]error
+	// overlays are the valid ProfileOverlay documents in file order.
+	overlays []*schema.ProfileOverlay
+	// profiles are the valid MachineProfile documents by MAC.
+	profiles map[string]machineDoc
+}
+
+type machineDoc struct {
+	file    string
+	profile *schema.MachineProfile
+}
+
+// Effective is the merged profile of one machine and the layers it was
+// built from, lowest precedence first.
+type Effective struct {
+	Profile   map[string]any `json:"profile"`
+	Blueprint string         `json:"blueprint,omitempty"`
+	Layers    []string       `json:"layers"`
+}
+
+// Resolve merges the layers for the machine with the given MAC. machine is the
+// profile stored for it, which takes precedence over the spec.profile of its
+// infra/machine-profiles document; the document also supplies the blueprint
+// reference and the labels overlays are selected by.
+func (s *Source) Resolve(mac string, machine map[string]any) (Effective, error) {
+	layers, blueprint, err := s.Layers(mac, machine)
+	if err != nil {
+		return Effective{}, err
+	}
+	return effective(blueprint, layers), nil
+}
+
+// Layers returns the merge layers for a machine in precedence order:
+// defaults, blueprint, overlays, machine profile document, stored profile.
+func (s *Source) Layers(mac string, machine map[string]any) ([]Layer, string, error) {
+	layers := []Layer{{Name: "defaults", Profile: Defaults()}}
+
+	var found *machineDoc
+	if s.Root != "" {
+		want, err := net.ParseMAC(strings.TrimSpace(mac))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid mac %q: %w", mac, err)
+		}
+		idx, err := s.load()
+		if err != nil {
+			return nil, "", err
+		}
+		if m, ok := idx.profiles[want.String()]; ok {
+			found = &m
+		}
+	}
+
+	blueprint := stringValue(machine["blueprint"])
+	var labels map[string]string
+	if found != nil {
+		if blueprint == "" {
+			blueprint = found.profile.Spec.Blueprint
+		}
+		labels = found.profile.Metadata.Labels
+	}
+
+	shared, err := s.sharedLayers(blueprint, labels)
+	if err != nil {
+		return nil, "", err
+	}
+	layers = append(layers, shared...)
+
+	if found != nil {
+		layers = append(layers, Layer{Name: "machine:" + found.file, Profile: found.profile.Spec.Profile})
+	}
+	if len(machine) > 0 {
+		layers = append(layers, Layer{Name: "machine", Profile: machine})
+	}
+	return layers, blueprint, nil
+}
+
+// Compose merges profile over the defaults, the blueprint and the overlays
+// selected by labels, as Resolve would for a machine profile with that
+// blueprint and those labels. It backs render previews of profiles that are
+// not in infra/ yet.
+func (s *Source) Compose(blueprint string, labels map[string]string, profile map[string]any) (Effective, error) {
+	layers := []Layer{{Name: "defaults", Profile: Defaults()}}
+	shared, err := s.sharedLayers(blueprint, labels)
+	if err != nil {
+		return Effective{}, err
+	}
+	layers = append(layers, shared...)
+	if len(profile) > 0 {
+		layers = append(layers, Layer{Name: "profile", Profile: profile})
+	}
+
+	return effective(blueprint, layers), nil
+}
+
+func effective(blueprint string, layers []Layer) Effective {
+	eff := Effective{Blueprint: blueprint, Layers: make([]string, 0, len(layers))}
+	maps := make([]map[string]any, 0, len(layers))
+	for _, l := range layers {
+		eff.Layers = append(eff.Layers, l.Name)
+		maps = append(maps, l.Profile)
+	}
+	eff.Profile = Merge(maps...)
+	return eff
+}
+
+// sharedLayers returns the blueprint and overlay layers between the defaults
+// and a machine's own profile.
+func (s *Source) sharedLayers(blueprint string, labels map[string]string) ([]Layer, error) {
+	if s.Root == "" {
+		return nil, nil
+	}
+	idx, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var layers []Layer
+	if blueprint != "" {
+		p, err := idx.blueprint(blueprint)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, Layer{Name: "blueprint:" + blueprint, Profile: p})
+	}
+	return append(layers, idx.matchingOverlays(labels)...), nil
+}
+
+// blueprintProfile maps a Blueprint spec onto profile keys. Its packages
+// groups and extras become one packages list; the description is dropped.
+func blueprintProfile(spec schema.BlueprintSpec) map[string]any {
+	out := make(map[string]any, len(spec.Profile)+4)
+	for k, v := range spec.Profile {
+		out[k] = v
+	}
+	osValues := map[string]any{"family": spec.OS.Family, "architecture": spec.OS.Architecture}
+	for k, v := range map[string]string{"version": spec.OS.Version, "format": spec.OS.Format} {
+		if v != "" {
+			osValues[k] = v
+		}
+	}
+	out["os"] = osValues
+	if len(spec.Artifacts) > 0 {
+		out["artifacts"] = anyMap(spec.Artifacts)
+	}
+	if len(spec.Repos) > 0 {
+		out["repos"] = anyMap(spec.Repos)
+	}
+	if pkgs := append(slices.Clone(spec.Packages.Groups), spec.Packages.Extra...); len(pkgs) > 0 {
+		list := make([]any, len(pkgs))
+		for i, p := range pkgs {
+			list[i] = p
+		}
+		out["packages"] = list
+	}
+	return out
+}
+
+func anyMap(m map[string]string) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// blueprint returns the profile values of
+// infra/blueprints/<ref>/blueprint.yaml.
+func (idx *index) blueprint(ref string) (map[string]any, error) {
+	clean := strings.Trim(ref, "/")
+	if !fs.ValidPath(clean) || clean == "." {
+		return nil, fmt.Errorf("invalid blueprint reference %q", ref)
+	}
+	if err, ok := idx.invalidBlueprints[clean]; ok {
+		return nil, fmt.Errorf("blueprint %s: %w", ref, err)
+	}
+	spec, ok := idx.blueprints[clean]
+	if !ok {
+		return nil, fmt.Errorf("blueprint %s not found", ref)
+	}
+	return spec, nil
+}
+
+// matchingOverlays returns the overlays whose spec.selector labels all match,
+// broadest first: fewer selector labels sort earlier, so an org-wide overlay
+// (empty selector) precedes a site one, which precedes a rack one. Ties are
+// broken by metadata.name.
+func (idx *index) matchingOverlays(labels map[string]string) []Layer {
+	var matches []*schema.ProfileOverlay
+	for _, o := range idx.overlays {
+		if matchesSelector(o.Spec.Selector, labels) {
+			matches = append(matches, o)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if len(matches[i].Spec.Selector) != len(matches[j].Spec.Selector) {
+			return len(matches[i].Spec.Selector) < len(matches[j].Spec.Selector)
+		}
+		return matches[i].Metadata.Name < matches[j].Metadata.Name
+	})
+	layers := make([]Layer, 0, len(matches))
+	for _, m := range matches {
+		layers = append(layers, Layer{Name: "overlay:" + m.Metadata.Name, Profile: m.Spec.Profile})
+	}
+	return layers
+}
+
+func matchesSelector(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// load returns the parsed documents of the checkout, reading them again only
+// when its revision has changed. Root is resolved first: the blueprints
+// service points a symlink at a new directory for each commit rather than
+// changing files in place, so reading the resolved directory sees a single
+// commit even while the symlink moves on.
+func (s *Source) load() (*index, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root, err := filepath.EvalSymlinks(s.Root)
+	if errors.Is(err, fs.ErrNotExist) {
+		root = s.Root
+	} else if err != nil {
+		return nil, err
+	}
+	rev, err := revision(root)
+	if err != nil {
+		return nil, err
+	}
+	if s.index != nil && s.index.revision == rev {
+		return s.index, nil
+	}
+	idx, err := s.read(root, rev)
+	if err != nil {
+		return nil, err
+	}
+	s.index = idx
+	return idx, nil
+}
+
+// read parses the blueprints, overlays and machine profiles under root with
+// schema.Parse, as the blueprints service does. A document it rejects, or
+// that claims a name or MAC an earlier one did, is skipped and logged; only
+// the machines that use it are affected.
+func (s *Source) read(root, rev string) (*index, error) {
+	idx := &index{
+		revision:          rev,
+		blueprints:        map[string]map[string]any{},
+		invalidBlueprints: map[string]error{},
+		profiles:          map[string]machineDoc{},
+	}
+	skip := func(file string, err error) {
+		s.logger().Printf("WARN profile: skipping %s: %v", file, err)
+	}
+
+	err := walkYAML(root, blueprintsDir, schema.KindBlueprint, func(file string, doc *schema.Document, err error) {
+		ref := path.Dir(strings.TrimPrefix(file, blueprintsDir+"/"))
+		if err == nil && path.Base(file) != blueprintFile {
+			err = doc.Problem("", "blueprints are read from %s/<ref>/%s", blueprintsDir, blueprintFile)
+		}
+		if err != nil {
+			skip(file, err)
+			if path.Base(file) == blueprintFile {
+				idx.invalidBlueprints[ref] = err
+			}
+			return
+		}
+		idx.blueprints[ref] = blueprintProfile(doc.Object.(*schema.Blueprint).Spec)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	err = walkYAML(root, overlaysDir, schema.KindProfileOverlay, func(file string, doc *schema.Document, err error) {
+		if err == nil {
+			if prev, ok := names[doc.Name()]; ok {
+				err = doc.Problem("metadata.name", "overlay %s is also defined by %s", doc.Name(), prev)
+			}
+		}
+		if err != nil {
+			skip(file, err)
+			return
+		}
+		names[doc.Name()] = file
+		idx.overlays = append(idx.overlays, doc.Object.(*schema.ProfileOverlay))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = walkYAML(root, profilesDir, schema.KindMachineProfile, func(file string, doc *schema.Document, err error) {
+		var mp *schema.MachineProfile
+		if err == nil {
+			mp = doc.Object.(*schema.MachineProfile)
+			if prev, ok := idx.profiles[mp.Spec.Machine.MAC]; ok {
+				err = doc.Problem("spec.machine.mac", "mac %s is also declared by %s", mp.Spec.Machine.MAC, prev.file)
+			}
+		}
+		if err != nil {
+			skip(file, err)
+			return
+		}
+		idx.profiles[mp.Spec.Machine.MAC] = machineDoc{file: file, profile: mp}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (s *Source) logger() *log.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return log.Default()
+}
+
+// revision identifies what is checked out under root by the paths, sizes and
+// modification times of its YAML files, which is far cheaper than parsing
+// them.
+func revision(root string) (string, error) {
+	var stamp strings.Builder
+	for _, dir := range []string{blueprintsDir, overlaysDir, profilesDir} {
+		err := filepath.WalkDir(filepath.Join(root, dir), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !isYAML(p) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&stamp, "%s:%d:%d;", p, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("scan %s: %w", dir, err)
+		}
+	}
+	return stamp.String(), nil
+}
+
+// walkYAML parses every .yaml/.yml file under root/dir in lexical order with
+// schema.Parse and calls fn with its slash-separated path relative to root,
+// such as overlays/lab-a.yaml, and the document or why it was rejected.
+// Documents of another kind than kind are rejected. A missing directory is
+// empty; only errors reading the tree are returned.
+func walkYAML(root, dir, kind string, fn func(file string, doc *schema.Document, err error)) error {
+	base := filepath.Join(root, dir)
+	err := filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isYAML(p) {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		file := path.Join(dir, filepath.ToSlash(rel))
+		doc, err := schema.Parse(file, data)
+		if err == nil && doc.Kind() != kind {
+			err = doc.Problem("kind", "%s documents do not belong under %s/; want %s", doc.Kind(), dir, kind)
+		}
+		fn(file, doc, err)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func isYAML(p string) bool {
+	ext := strings.ToLower(filepath.Ext(p))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func stringValue(v any) string {
+	s, _ := v.(string)
+	return strings.TrimSpace(s)
+}
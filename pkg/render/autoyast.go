@@ -0,0 +1,68 @@
+package render
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AutoYaST is the profile mapped onto an AutoYaST control file for SLES and
+// openSUSE. Kickstart-style package groups (@base) become patterns.
+type AutoYaST struct {
+	System
+	// Language is the locale without its encoding, such as en_US.
+	Language string
+	Patterns []string
+	Repos    []YaSTRepo
+	// Network is nil when the installed system keeps the installer's DHCP
+	// network.
+	Network *YaSTNetwork
+}
+
+type YaSTRepo struct {
+	Name string
+	URL  string
+}
+
+// autoyast backs autoyast.xml.tmpl: {{ $y := autoyast .Profile }}.
+func autoyast(profile any) (*AutoYaST, error) {
+	m, _ := profile.(map[string]any)
+	s, err := ParseSystem(m, "autoyast")
+	if err != nil {
+		return nil, fmt.Errorf("autoyast: %w", err)
+	}
+	y := &AutoYaST{System: *s}
+	y.Language, _, _ = strings.Cut(s.Locale, ".")
+
+	var pkgs []string
+	for _, p := range s.Packages {
+		if group, ok := strings.CutPrefix(p, "@"); ok {
+			y.Patterns = append(y.Patterns, strings.TrimPrefix(group, "^"))
+			continue
+		}
+		pkgs = append(pkgs, p)
+	}
+	y.Packages = pkgs
+
+	if repos, ok := m["repos"].(map[string]any); ok {
+		for name, v := range repos {
+			url, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("autoyast: repos.%s must be a URL", name)
+			}
+			y.Repos = append(y.Repos, YaSTRepo{Name: name, URL: url})
+		}
+		sort.Slice(y.Repos, func(i, j int) bool { return y.Repos[i].Name < y.Repos[j].Name })
+	}
+
+	if storage, ok := m["storage"].(map[string]any); ok && len(storage) > 0 {
+		return nil, fmt.Errorf("autoyast: storage is not supported; YaST proposes the partitioning")
+	}
+
+	n, err := ParseNetwork(m["network"])
+	if err != nil {
+		return nil, err
+	}
+	y.Network = n.YaST()
+	return y, nil
+}
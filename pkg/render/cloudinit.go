@@ -0,0 +1,218 @@
+package render
+
+import (
+	"fmt"
+	"strings"
+)
+
+// agentInstall is the command that enrolls the goosed agent, run by each
+// Linux format at the end of the install or on first boot:
+// {{ $agent := agentInstall .APIBase .Token .Machine.ID .AgentInstallURL .Profile }}.
+// Without an install URL the agent comes from the API's installer for the
+// profile's OS family.
+func agentInstall(apiBase, token, machineID, installURL, profile any) (string, error) {
+	base := fmt.Sprint(apiBase)
+	url := strings.TrimSpace(stringOf(installURL))
+	if url == "" {
+		m, _ := profile.(map[string]any)
+		family, err := agentFamily(m)
+		if err != nil {
+			return "", err
+		}
+		url = base + "/v1/agents/" + family + "/install"
+	}
+	return fmt.Sprintf("curl -fsSL %s | bash -s -- --api %s --token %s --machine %s", url, base, stringOf(token), fmt.Sprint(machineID)), nil
+}
+
+// agentFamily names the agent installer for a profile's os.family. The
+// Kickstart families share the rhel agent; the others have their own.
+func agentFamily(profile map[string]any) (string, error) {
+	osSpec, _ := profile["os"].(map[string]any)
+	family := strings.ToLower(strings.TrimSpace(stringAt(osSpec, "family")))
+	if family == "" {
+		return "", fmt.Errorf("os.family is required to pick the agent installer; set it or AgentInstallURL")
+	}
+	switch familyFormats[family] {
+	case FormatKickstart:
+		return "rhel", nil
+	case "", FormatUnattend:
+		return "", fmt.Errorf("os.family %q has no agent installer; set AgentInstallURL", family)
+	}
+	return family, nil
+}
+
+func stringOf(v any) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// extra returns profile[section].extra, the raw additions merged over the
+// top level of a generated document.
+func extra(profile map[string]any, section string) (map[string]any, error) {
+	v := dig1(profile, section, "extra")
+	if v == nil {
+		return nil, nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s.extra must be a map", section)
+	}
+	return m, nil
+}
+
+// cloudUsers maps the system's users and root password onto cloud-config
+// users and chpasswd, and adds the hostname, NTP and agent.
+func cloudUsers(s *System, agent string) map[string]any {
+	cfg := map[string]any{}
+	if s.Hostname != "" {
+		cfg["hostname"] = s.ShortHostname()
+		if s.Hostname != s.ShortHostname() {
+			cfg["fqdn"] = s.Hostname
+		}
+		cfg["manage_etc_hosts"] = true
+	}
+	if len(s.Users) > 0 {
+		users := make([]any, 0, len(s.Users))
+		for _, u := range s.Users {
+			user := map[string]any{"name": u.Name, "shell": "/bin/bash", "lock_passwd": u.PasswordHash == ""}
+			if len(u.Groups) > 0 {
+				user["groups"] = strings.Join(u.Groups, ",")
+			}
+			if u.PasswordHash != "" {
+				user["passwd"] = u.PasswordHash
+			}
+			if len(u.SSHAuthorizedKeys) > 0 {
+				user["ssh_authorized_keys"] = anyList(u.SSHAuthorizedKeys)
+			}
+			users = append(users, user)
+		}
+		cfg["users"] = users
+	}
+	if s.RootPasswordHash != "" {
+		cfg["chpasswd"] = map[string]any{
+			"expire": false,
+			"users":  []any{map[string]any{"name": "root", "password": s.RootPasswordHash, "type": "hash"}},
+		}
+	}
+	if len(s.NTPServers) > 0 {
+		cfg["ntp"] = map[string]any{"enabled": true, "servers": anyList(s.NTPServers)}
+	}
+	if agent != "" {
+		cfg["runcmd"] = []any{agent}
+	}
+	return cfg
+}
+
+// cloudConfig builds the NoCloud user-data for the cloud-init format from
+// the profile's cloudInit section and shared settings.
+func cloudConfig(profile any, agent string) (map[string]any, error) {
+	m, _ := profile.(map[string]any)
+	s, err := ParseSystem(m, "cloudInit")
+	if err != nil {
+		return nil, fmt.Errorf("cloud-init: %w", err)
+	}
+	if err := s.noGroups(FormatCloudInit); err != nil {
+		return nil, fmt.Errorf("cloud-init: %w", err)
+	}
+	cfg := cloudUsers(s, agent)
+	cfg["locale"] = s.Locale
+	cfg["timezone"] = s.Timezone
+	cfg["keyboard"] = map[string]any{"layout": s.Keyboard}
+	if len(s.Packages) > 0 {
+		cfg["packages"] = anyList(s.Packages)
+	}
+	add, err := extra(m, "cloudInit")
+	if err != nil {
+		return nil, fmt.Errorf("cloud-init: %w", err)
+	}
+	for k, v := range add {
+		cfg[k] = v
+	}
+	return cfg, nil
+}
+
+// autoinstallLayouts maps storage.layout onto Subiquity's guided layouts.
+var autoinstallLayouts = map[string]string{"": "lvm", "lvm": "lvm", "plain": "direct"}
+
+// autoinstallConfig builds the Ubuntu autoinstall section. The shared
+// settings configure the installer; users, hostname, NTP and the agent go
+// to its user-data, which cloud-init applies on first boot.
+func autoinstallConfig(profile any, agent string) (map[string]any, error) {
+	m, _ := profile.(map[string]any)
+	s, err := ParseSystem(m, "autoinstall")
+	if err != nil {
+		return nil, fmt.Errorf("autoinstall: %w", err)
+	}
+	if err := s.noGroups(FormatAutoinstall); err != nil {
+		return nil, fmt.Errorf("autoinstall: %w", err)
+	}
+	doc := map[string]any{
+		"version":   1,
+		"locale":    s.Locale,
+		"timezone":  s.Timezone,
+		"keyboard":  map[string]any{"layout": s.Keyboard},
+		"ssh":       map[string]any{"install-server": true, "allow-pw": false},
+		"user-data": cloudUsers(s, agent),
+	}
+	if len(s.Packages) > 0 {
+		doc["packages"] = anyList(s.Packages)
+	}
+
+	storage, _ := m["storage"].(map[string]any)
+	for k := range storage {
+		if k != "layout" {
+			return nil, fmt.Errorf("autoinstall: storage.%s is not supported; autoinstall takes storage.layout (lvm or plain)", k)
+		}
+	}
+	layout, ok := autoinstallLayouts[stringAt(storage, "layout")]
+	if !ok {
+		return nil, fmt.Errorf("autoinstall: storage.layout %q is not supported; use lvm or plain", stringAt(storage, "layout"))
+	}
+	doc["storage"] = map[string]any{"layout": map[string]any{"name": layout}}
+
+	n, err := ParseNetwork(m["network"])
+	if err != nil {
+		return nil, err
+	}
+	netplan, err := n.Netplan()
+	if err != nil {
+		return nil, fmt.Errorf("network: %w", err)
+	}
+	if netplan != nil {
+		doc["network"] = netplan
+	}
+
+	add, err := extra(m, "autoinstall")
+	if err != nil {
+		return nil, fmt.Errorf("autoinstall: %w", err)
+	}
+	for k, v := range add {
+		doc[k] = v
+	}
+	return doc, nil
+}
+
+// networkConfig is the NoCloud network-config: the profile's network as
+// Netplan, or nil to keep cloud-init's DHCP default.
+func networkConfig(profile any) (map[string]any, error) {
+	m, _ := profile.(map[string]any)
+	n, err := ParseNetwork(m["network"])
+	if err != nil {
+		return nil, err
+	}
+	netplan, err := n.Netplan()
+	if err != nil {
+		return nil, fmt.Errorf("network: %w", err)
+	}
+	return netplan, nil
+}
+
+func anyList(items []string) []any {
+	out := make([]any, len(items))
+	for i, s := range items {
+		out[i] = s
+	}
+	return out
+}
@@ -0,0 +1,244 @@
+package render
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Install formats. Each is rendered by its own templates and fetched by the
+// installer from its own /v1/render endpoint.
+const (
+	FormatKickstart   = "kickstart"
+	FormatUnattend    = "unattend"
+	FormatCloudInit   = "cloud-init"
+	FormatAutoinstall = "autoinstall"
+	FormatAutoYaST    = "autoyast"
+	FormatIgnition    = "ignition"
+)
+
+// familyFormats maps a blueprint's os.family onto the format its installer
+// reads.
+var familyFormats = map[string]string{
+	"rhel":          FormatKickstart,
+	"rocky":         FormatKickstart,
+	"almalinux":     FormatKickstart,
+	"centos":        FormatKickstart,
+	"fedora":        FormatKickstart,
+	"windows":       FormatUnattend,
+	"ubuntu":        FormatAutoinstall,
+	"sles":          FormatAutoYaST,
+	"opensuse":      FormatAutoYaST,
+	"fedora-coreos": FormatIgnition,
+	"flatcar":       FormatIgnition,
+}
+
+// FormatTemplates names the template that renders each format's install
+// config; for the NoCloud formats it is the user-data.
+var FormatTemplates = map[string]string{
+	FormatKickstart:   "kickstart.tmpl",
+	FormatUnattend:    "unattend.xml.tmpl",
+	FormatCloudInit:   "cloud-init.user-data.tmpl",
+	FormatAutoinstall: "autoinstall.user-data.tmpl",
+	FormatAutoYaST:    "autoyast.xml.tmpl",
+	FormatIgnition:    "ignition.json.tmpl",
+}
+
+// FormatFor returns the install format for a profile: os.format when set,
+// otherwise the format of os.family. Profiles without an os section are
+// Kickstart, as every profile was before other formats existed.
+func FormatFor(profile map[string]any) (string, error) {
+	osSpec, _ := profile["os"].(map[string]any)
+	if f := strings.ToLower(stringAt(osSpec, "format")); f != "" {
+		if _, ok := FormatTemplates[f]; !ok {
+			return "", fmt.Errorf("os.format %q is not one of kickstart, unattend, cloud-init, autoinstall, autoyast or ignition", f)
+		}
+		return f, nil
+	}
+	family := strings.ToLower(strings.TrimSpace(stringAt(osSpec, "family")))
+	if family == "" {
+		return FormatKickstart, nil
+	}
+	f, ok := familyFormats[family]
+	if !ok {
+		return "", fmt.Errorf("os.family %q has no install format; set os.format", family)
+	}
+	return f, nil
+}
+
+// TemplateFor returns the format and install config template for profile:
+// format when it is set, otherwise FormatFor(profile).
+func TemplateFor(profile map[string]any, format string) (string, string, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		var err error
+		if format, err = FormatFor(profile); err != nil {
+			return "", "", err
+		}
+	}
+	tmpl, ok := FormatTemplates[format]
+	if !ok {
+		return "", "", fmt.Errorf("unknown format %q", format)
+	}
+	return format, tmpl, nil
+}
+
+// System is the part of a profile the Linux formats share. Each value is
+// read from the format's own section (such as autoinstall.timezone), then
+// from the top level (timezone), then from the kickstart section, so a
+// profile written for Kickstart renders the same system for other
+// installers.
+type System struct {
+	Hostname         string
+	Locale           string
+	Keyboard         string
+	Timezone         string
+	RootPasswordHash string
+	NTPServers       []string
+	Users            []User
+	Packages         []string
+}
+
+type User struct {
+	Name              string   `yaml:"name"`
+	Groups            Groups   `yaml:"groups"`
+	PasswordHash      string   `yaml:"passwordHash"`
+	SSHAuthorizedKeys []string `yaml:"sshAuthorizedKeys"`
+}
+
+// Groups decodes from a list of group names or, as Kickstart's user
+// --groups takes them, a single name or comma-separated string.
+type Groups []string
+
+func (g *Groups) UnmarshalYAML(n *yaml.Node) error {
+	var names []string
+	switch n.Kind {
+	case yaml.ScalarNode:
+		names = strings.Split(n.Value, ",")
+	case yaml.SequenceNode:
+		if err := n.Decode(&names); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("groups must be a list or a comma-separated string")
+	}
+	*g = nil
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			*g = append(*g, name)
+		}
+	}
+	return nil
+}
+
+// ParseSystem reads the shared Linux settings for the format whose profile
+// section is section.
+func ParseSystem(profile map[string]any, section string) (*System, error) {
+	lookup := func(key string) any {
+		for _, v := range []any{dig1(profile, section, key), profile[key], dig1(profile, "kickstart", key)} {
+			if v != nil {
+				return v
+			}
+		}
+		return nil
+	}
+	str := func(key, def string) (string, error) {
+		switch v := lookup(key).(type) {
+		case nil:
+			return def, nil
+		case string:
+			return strings.TrimSpace(v), nil
+		default:
+			return "", fmt.Errorf("%s must be a string", key)
+		}
+	}
+
+	s := &System{}
+	var err error
+	if s.Hostname, err = str("hostname", ""); err != nil {
+		return nil, err
+	}
+	if s.Locale, err = str("lang", "en_US.UTF-8"); err != nil {
+		return nil, err
+	}
+	if s.Keyboard, err = str("keyboard", "us"); err != nil {
+		return nil, err
+	}
+	if s.Timezone, err = str("timezone", "UTC"); err != nil {
+		return nil, err
+	}
+	if s.RootPasswordHash, err = str("rootPasswordHash", ""); err != nil {
+		return nil, err
+	}
+	if err := decodeStrict(lookup("ntpServers"), &s.NTPServers); err != nil {
+		return nil, fmt.Errorf("ntpServers: %w", err)
+	}
+	if err := decodeStrict(lookup("users"), &s.Users); err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+	for i, u := range s.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("users[%d].name is required", i)
+		}
+	}
+
+	// Packages are not inherited from the kickstart section's neighbours:
+	// the format section or the top-level list.
+	pkgs := dig1(profile, section, "packages")
+	if pkgs == nil {
+		pkgs = profile["packages"]
+	}
+	if err := decodeStrict(pkgs, &s.Packages); err != nil {
+		return nil, fmt.Errorf("packages: %w", err)
+	}
+	return s, nil
+}
+
+// ShortHostname is the first label of the hostname.
+func (s *System) ShortHostname() string {
+	name, _, _ := strings.Cut(s.Hostname, ".")
+	return name
+}
+
+// noGroups rejects Kickstart package groups (@^minimal) in formats that
+// install plain package names.
+func (s *System) noGroups(format string) error {
+	for _, p := range s.Packages {
+		if strings.HasPrefix(p, "@") {
+			return fmt.Errorf("package group %s is Kickstart syntax; %s takes package names", p, format)
+		}
+	}
+	return nil
+}
+
+// dig1 returns profile[section][key], or nil.
+func dig1(profile map[string]any, section, key string) any {
+	m, _ := profile[section].(map[string]any)
+	return m[key]
+}
+
+// InstallerNetworkArgs returns the kernel arguments that configure the
+// installer's network for format, in the syntax its initramfs reads:
+// dracut for Kickstart and Ignition, initramfs-tools for cloud-init and
+// autoinstall, linuxrc for AutoYaST. Windows takes none.
+func InstallerNetworkArgs(profile map[string]any, format string) (string, error) {
+	n, err := ParseNetwork(profile["network"])
+	if err != nil {
+		return "", err
+	}
+	hostname := profileHostname(profile)
+	var args []string
+	switch format {
+	case FormatKickstart, FormatIgnition:
+		if err := n.linux(); err != nil {
+			return "", err
+		}
+		args = n.Dracut(hostname)
+	case FormatCloudInit, FormatAutoinstall:
+		args = n.InitramfsTools(hostname)
+	case FormatAutoYaST:
+		args = n.Linuxrc(hostname)
+	}
+	return strings.Join(args, " "), nil
+}
@@ -0,0 +1,298 @@
+package render
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestFormatFor(t *testing.T) {
+	cases := map[string]string{
+		"":                                     FormatKickstart,
+		"{family: rocky}":                      FormatKickstart,
+		"{family: Windows}":                    FormatUnattend,
+		"{family: ubuntu}":                     FormatAutoinstall,
+		"{family: ubuntu, format: cloud-init}": FormatCloudInit,
+		"{family: opensuse}":                   FormatAutoYaST,
+		"{family: fedora-coreos}":              FormatIgnition,
+		"{family: plan9, format: kickstart}":   FormatKickstart,
+	}
+	for src, want := range cases {
+		profile := map[string]any{}
+		if src != "" {
+			profile["os"] = parseYAML(t, src)
+		}
+		got, err := FormatFor(profile)
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v; want %q", src, got, err, want)
+		}
+	}
+	for _, src := range []string{"{family: plan9}", "{format: preseed}"} {
+		if _, err := FormatFor(map[string]any{"os": parseYAML(t, src)}); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
+
+func TestParseSystem(t *testing.T) {
+	profile := parseYAML(t, `
+hostname: n1.lab
+timezone: Europe/Berlin
+packages: [vim]
+kickstart: {lang: de_DE.UTF-8, timezone: UTC, ntpServers: [ntp1], users: [{name: ops, groups: [wheel]}]}
+autoinstall: {keyboard: de, packages: [curl]}
+`).(map[string]any)
+	s, err := ParseSystem(profile, "autoinstall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ShortHostname() != "n1" || s.Locale != "de_DE.UTF-8" || s.Keyboard != "de" || s.Timezone != "Europe/Berlin" {
+		t.Fatalf("system = %+v", s)
+	}
+	if len(s.NTPServers) != 1 || len(s.Users) != 1 || s.Users[0].Groups[0] != "wheel" {
+		t.Fatalf("kickstart fallback = %+v", s)
+	}
+	if len(s.Packages) != 1 || s.Packages[0] != "curl" {
+		t.Fatalf("packages = %v", s.Packages)
+	}
+
+	if _, err := ParseSystem(map[string]any{"users": parseYAML(t, "[{groups: [wheel]}]")}, "cloudInit"); err == nil {
+		t.Fatal("expected a user without a name to be rejected")
+	}
+
+	// Kickstart takes groups as one comma-separated string.
+	for src, want := range map[string]string{
+		"wheel":        "wheel",
+		`"wheel, adm"`: "wheel adm",
+		"[wheel, adm]": "wheel adm",
+		`""`:           "",
+	} {
+		s, err := ParseSystem(map[string]any{"users": parseYAML(t, "[{name: ops, groups: "+src+"}]")}, "cloudInit")
+		if err != nil {
+			t.Fatalf("groups %s: %v", src, err)
+		}
+		if got := strings.Join(s.Users[0].Groups, " "); got != want {
+			t.Errorf("groups %s = %q, want %q", src, got, want)
+		}
+	}
+	if _, err := ParseSystem(map[string]any{"users": parseYAML(t, "[{name: ops, groups: {wheel: true}}]")}, "cloudInit"); err == nil {
+		t.Fatal("expected map groups to be rejected")
+	}
+}
+
+func TestAgentInstall(t *testing.T) {
+	for family, want := range map[string]string{
+		"rocky":         "http://api/v1/agents/rhel/install",
+		"Ubuntu":        "http://api/v1/agents/ubuntu/install",
+		"opensuse":      "http://api/v1/agents/opensuse/install",
+		"fedora-coreos": "http://api/v1/agents/fedora-coreos/install",
+	} {
+		profile := map[string]any{"os": map[string]any{"family": family}}
+		got, err := agentInstall("http://api", "tok", "m-1", nil, profile)
+		if err != nil || !strings.HasPrefix(got, "curl -fsSL "+want+" |") {
+			t.Errorf("%s: got %q, %v; want %s", family, got, err, want)
+		}
+	}
+	got, err := agentInstall("http://api", "tok", "m-1", "http://mirror/agent.sh", map[string]any{})
+	if err != nil || !strings.HasPrefix(got, "curl -fsSL http://mirror/agent.sh |") {
+		t.Fatalf("install URL: got %q, %v", got, err)
+	}
+	for _, profile := range []map[string]any{{}, {"os": map[string]any{"family": "windows"}}, {"os": map[string]any{"family": "plan9"}}} {
+		if _, err := agentInstall("http://api", "tok", "m-1", "", profile); err == nil {
+			t.Errorf("%v: expected an error without an install URL", profile)
+		}
+	}
+}
+
+func TestInstallerNetworkArgs(t *testing.T) {
+	static := map[string]any{
+		"hostname": "n1",
+		"network":  parseYAML(t, "{interface: eno1, ipv4: {address: 10.0.0.5/24, gateway: 10.0.0.1, dns: [10.0.0.53]}}"),
+	}
+	cases := []struct {
+		format  string
+		profile map[string]any
+		want    string
+	}{
+		{FormatAutoinstall, static, "ip=10.0.0.5::10.0.0.1:255.255.255.0:n1:eno1:off:10.0.0.53"},
+		{FormatCloudInit, map[string]any{}, "ip=dhcp"},
+		{FormatAutoYaST, static, "ifcfg=eno1=10.0.0.5/24,10.0.0.1,10.0.0.53 hostname=n1"},
+		{FormatAutoYaST, map[string]any{}, "ifcfg=*=dhcp"},
+		{FormatIgnition, static, "ip=10.0.0.5::10.0.0.1:255.255.255.0:n1:eno1:none nameserver=10.0.0.53"},
+		{FormatUnattend, static, ""},
+	}
+	for _, tc := range cases {
+		got, err := InstallerNetworkArgs(tc.profile, tc.format)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v\nwant %q", tc.format, got, err, tc.want)
+		}
+	}
+}
+
+func renderFormat(t *testing.T, tmpl string, profile map[string]any) string {
+	t.Helper()
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := e.Render(tmpl, map[string]any{
+		"Machine": map[string]any{"ID": "m-1", "Serial": "S1"},
+		"Profile": profile,
+		"APIBase": "http://api",
+		"Token":   "tok",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func formatProfile(t *testing.T) map[string]any {
+	return parseYAML(t, `
+hostname: n1.lab
+rootPasswordHash: $6$x
+users: [{name: ops, groups: "wheel, adm", sshAuthorizedKeys: [ssh-ed25519 AAA]}]
+network: {interface: eno1, ipv4: {address: 10.0.0.5/24, gateway: 10.0.0.1, dns: [10.0.0.53]}}
+`).(map[string]any)
+}
+
+func TestRenderCloudInit(t *testing.T) {
+	profile := formatProfile(t)
+	profile["os"] = map[string]any{"family": "ubuntu", "format": "cloud-init"}
+	profile["packages"] = []any{"vim"}
+	profile["cloudInit"] = parseYAML(t, "{extra: {package_upgrade: true}}")
+
+	out := renderFormat(t, "cloud-init.user-data.tmpl", profile)
+	first, body, _ := strings.Cut(out, "\n")
+	if first != "#cloud-config" {
+		t.Fatalf("user-data starts with %q", first)
+	}
+	var cfg map[string]any
+	if err := yaml.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatalf("user-data is not YAML: %v\n%s", err, out)
+	}
+	if cfg["hostname"] != "n1" || cfg["fqdn"] != "n1.lab" || cfg["package_upgrade"] != true {
+		t.Fatalf("user-data = %v", cfg)
+	}
+	if users, _ := cfg["users"].([]any); len(users) != 1 || users[0].(map[string]any)["groups"] != "wheel,adm" {
+		t.Fatalf("users = %v", cfg["users"])
+	}
+	if runcmd, _ := cfg["runcmd"].([]any); len(runcmd) != 1 || !strings.Contains(runcmd[0].(string), "/v1/agents/ubuntu/install | bash -s -- --api http://api --token tok --machine m-1") {
+		t.Fatalf("runcmd = %v", cfg["runcmd"])
+	}
+
+	var netcfg map[string]any
+	if err := yaml.Unmarshal([]byte(renderFormat(t, "cloud-init.network-config.tmpl", profile)), &netcfg); err != nil {
+		t.Fatal(err)
+	}
+	if netcfg["version"] != 2 || dig1(netcfg, "ethernets", "eno1") == nil {
+		t.Fatalf("network-config = %v", netcfg)
+	}
+	if out := renderFormat(t, "cloud-init.network-config.tmpl", map[string]any{}); strings.TrimSpace(out) != "" {
+		t.Fatalf("DHCP network-config = %q", out)
+	}
+
+	profile["packages"] = []any{"@core"}
+	if _, err := cloudConfig(profile, ""); err == nil {
+		t.Fatal("expected a package group to be rejected")
+	}
+}
+
+func TestRenderAutoinstall(t *testing.T) {
+	profile := formatProfile(t)
+	profile["os"] = map[string]any{"family": "ubuntu"}
+	profile["storage"] = map[string]any{"layout": "plain"}
+
+	out := renderFormat(t, "autoinstall.user-data.tmpl", profile)
+	var doc struct {
+		Autoinstall map[string]any `yaml:"autoinstall"`
+	}
+	if err := yaml.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("autoinstall is not YAML: %v\n%s", err, out)
+	}
+	a := doc.Autoinstall
+	if a["version"] != 1 || dig1(a, "storage", "layout") == nil || dig1(a, "network", "ethernets") == nil {
+		t.Fatalf("autoinstall = %v", a)
+	}
+	if layout := dig1(a, "storage", "layout").(map[string]any); layout["name"] != "direct" {
+		t.Fatalf("layout = %v", layout)
+	}
+	if dig1(a, "user-data", "users") == nil {
+		t.Fatalf("user-data = %v", a["user-data"])
+	}
+
+	profile["storage"] = parseYAML(t, "{partitions: [{mount: /, size: 10GiB}]}")
+	if _, err := autoinstallConfig(profile, ""); err == nil {
+		t.Fatal("expected storage partitions to be rejected")
+	}
+}
+
+func TestRenderAutoYaST(t *testing.T) {
+	profile := formatProfile(t)
+	profile["os"] = map[string]any{"family": "sles"}
+	profile["packages"] = []any{"@^minimal_base", "vim"}
+	profile["repos"] = map[string]any{"os": "http://mirror/os"}
+
+	out := renderFormat(t, "autoyast.xml.tmpl", profile)
+	if err := xml.Unmarshal([]byte(out), new(struct{})); err != nil {
+		t.Fatalf("autoyast is not XML: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"<pattern>minimal_base</pattern>",
+		"<package>vim</package>",
+		"<media_url>http://mirror/os</media_url>",
+		"<ipaddr>10.0.0.5</ipaddr>",
+		"<gateway>10.0.0.1</gateway>",
+		"<user_password>$6$x</user_password>",
+		"http://api/v1/agents/sles/install | bash -s -- --api http://api --token tok --machine m-1</source>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("autoyast lacks %q:\n%s", want, out)
+		}
+	}
+
+	profile["storage"] = map[string]any{"layout": "lvm"}
+	if _, err := autoyast(profile); err == nil {
+		t.Fatal("expected storage to be rejected")
+	}
+}
+
+func TestRenderIgnition(t *testing.T) {
+	profile := formatProfile(t)
+	profile["os"] = map[string]any{"family": "fedora-coreos"}
+	profile["ignition"] = parseYAML(t, "{extra: {kernelArguments: {shouldNotExist: [quiet]}}}")
+
+	var cfg struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+		Passwd struct {
+			Users []struct {
+				Name string `json:"name"`
+			} `json:"users"`
+		} `json:"passwd"`
+		Systemd struct {
+			Units []struct {
+				Name     string `json:"name"`
+				Contents string `json:"contents"`
+			} `json:"units"`
+		} `json:"systemd"`
+		KernelArguments map[string][]string `json:"kernelArguments"`
+	}
+	out := renderFormat(t, "ignition.json.tmpl", profile)
+	if err := json.Unmarshal([]byte(out), &cfg); err != nil {
+		t.Fatalf("ignition is not JSON: %v\n%s", err, out)
+	}
+	if cfg.Ignition.Version != ignitionVersion || len(cfg.Passwd.Users) != 2 || cfg.Passwd.Users[0].Name != "root" {
+		t.Fatalf("ignition = %+v", cfg)
+	}
+	if len(cfg.Systemd.Units) != 1 || !strings.Contains(cfg.Systemd.Units[0].Contents, "--token tok --machine m-1") {
+		t.Fatalf("units = %+v", cfg.Systemd.Units)
+	}
+	if len(cfg.KernelArguments["shouldNotExist"]) != 1 || cfg.KernelArguments["shouldExist"] != nil {
+		t.Fatalf("kernel arguments = %v", cfg.KernelArguments)
+	}
+}
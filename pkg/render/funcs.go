@@ -0,0 +1,344 @@
+package render
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// funcMap is the function library available to every template, built-in or
+// override.
+func (e *Engine) funcMap() template.FuncMap {
+	return template.FuncMap{
+		"secret":      e.secret,
+		"default":     defaultValue,
+		"empty":       isEmpty,
+		"dig":         dig,
+		"toYaml":      toYAML,
+		"toJson":      toJSON,
+		"indent":      indent,
+		"list":        list,
+		"join":        join,
+		"b64enc":      b64enc,
+		"xml":         xmlEscape,
+		"sha512crypt": sha512crypt,
+		"ipAddr":      ipAddr,
+		"ipPrefixLen": ipPrefixLen,
+		"ipNetmask":   ipNetmask,
+		"ipNetwork":   ipNetwork,
+		"ipBroadcast": ipBroadcast,
+
+		"kickstartStorage": kickstartStorage,
+		"unattendStorage":  unattendStorage,
+		"kickstartNetwork": kickstartNetwork,
+		"unattendNetwork":  unattendNetwork,
+		"unattend":         unattend,
+
+		"agentInstall":      agentInstall,
+		"cloudConfig":       cloudConfig,
+		"networkConfig":     networkConfig,
+		"autoinstallConfig": autoinstallConfig,
+		"autoyast":          autoyast,
+		"ignitionConfig":    ignitionConfig,
+	}
+}
+
+// defaultValue returns v, or def when v is empty: {{ default "UTC" .tz }}.
+func defaultValue(def, v any) any {
+	if isEmpty(v) {
+		return def
+	}
+	return v
+}
+
+// isEmpty reports whether v is nil, false, zero, or an empty string,
+// slice or map.
+func isEmpty(v any) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return rv.IsZero()
+	}
+}
+
+// dig walks nested maps by key and returns the value found, or the default
+// when any step is missing: {{ dig "kickstart" "lang" "en_US.UTF-8" .Profile }}.
+// The arguments are the keys, then the default, then the map.
+func dig(args ...any) (any, error) {
+	if len(args) < 3 {
+		return nil, errors.New("dig needs at least one key, a default and a map")
+	}
+	keys, def, cur := args[:len(args)-2], args[len(args)-2], args[len(args)-1]
+	for _, k := range keys {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("dig: key %v is not a string", k)
+		}
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return def, nil
+		}
+		if cur, ok = m[key]; !ok || cur == nil {
+			return def, nil
+		}
+	}
+	return cur, nil
+}
+
+// toYAML marshals v without the trailing newline, for use with indent.
+func toYAML(v any) (string, error) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// toJSON marshals v indented, for JSON formats such as Ignition.
+func toJSON(v any) (string, error) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// indent prefixes every line of s with n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// list builds a list for defaults and range: {{ list "@^minimal" "chrony" }}.
+func list(items ...any) []any {
+	return items
+}
+
+// join concatenates the elements of any list with sep: {{ join "," .groups }}.
+func join(sep string, list any) (string, error) {
+	if list == nil {
+		return "", nil
+	}
+	if s, ok := list.(string); ok {
+		return s, nil
+	}
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: %T is not a list", list)
+	}
+	parts := make([]string, rv.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
+
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// xmlEscape escapes s for XML text and attribute values: {{ xml .Command }}.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// IP helpers take an address in CIDR form, such as a profile's
+// network.ipv4.address of "192.168.110.21/24".
+
+func ipAddr(cidr string) (string, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return "", err
+	}
+	return p.Addr().String(), nil
+}
+
+func ipPrefixLen(cidr string) (int, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return 0, err
+	}
+	return p.Bits(), nil
+}
+
+func ipNetmask(cidr string) (string, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return "", err
+	}
+	mask := net.CIDRMask(p.Bits(), p.Addr().BitLen())
+	return net.IP(mask).String(), nil
+}
+
+func ipNetwork(cidr string) (string, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return "", err
+	}
+	return p.Masked().Addr().String(), nil
+}
+
+func ipBroadcast(cidr string) (string, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return "", err
+	}
+	if !p.Addr().Is4() {
+		return "", fmt.Errorf("ipBroadcast: %s is not IPv4", cidr)
+	}
+	b := p.Masked().Addr().As4()
+	host := ^uint32(0) >> p.Bits()
+	if p.Bits() == 32 {
+		host = 0
+	}
+	for i := 0; i < 4; i++ {
+		b[i] |= byte(host >> (24 - 8*i))
+	}
+	return netip.AddrFrom4(b).String(), nil
+}
+
+const (
+	cryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	sha512DefaultRound = 5000
+	sha512MaxSalt      = 16
+)
+
+// sha512crypt hashes password in the glibc "$6$" format accepted by
+// kickstart's rootpw --iscrypted. The salt is random unless one is given:
+// {{ sha512crypt "secret" }} or {{ sha512crypt "secret" "fixedsalt" }}.
+func sha512crypt(password string, salt ...string) (string, error) {
+	var s string
+	switch len(salt) {
+	case 0:
+		buf := make([]byte, sha512MaxSalt)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for i, b := range buf {
+			buf[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+		}
+		s = string(buf)
+	case 1:
+		s = salt[0]
+	default:
+		return "", errors.New("sha512crypt takes a password and an optional salt")
+	}
+	return sha512Crypt([]byte(password), s, sha512DefaultRound), nil
+}
+
+// sha512Crypt implements Ulrich Drepper's SHA-crypt specification.
+func sha512Crypt(password []byte, salt string, rounds int) string {
+	if len(salt) > sha512MaxSalt {
+		salt = salt[:sha512MaxSalt]
+	}
+	s := []byte(salt)
+
+	b := sha512.New()
+	b.Write(password)
+	b.Write(s)
+	b.Write(password)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write(s)
+	a.Write(repeatTo(sumB, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(password)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range password {
+		dp.Write(password)
+	}
+	p := repeatTo(dp.Sum(nil), len(password))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(s)
+	}
+	sp := repeatTo(ds.Sum(nil), len(s))
+
+	c := sumA
+	for i := 0; i < rounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sp)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+	var out strings.Builder
+	out.WriteString("$6$")
+	if rounds != sha512DefaultRound {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for _, o := range order {
+		encode24(&out, c[o[0]], c[o[1]], c[o[2]], 4)
+	}
+	encode24(&out, 0, 0, c[63], 2)
+	return out.String()
+}
+
+func repeatTo(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out)+len(sum) <= n {
+		out = append(out, sum...)
+	}
+	return append(out, sum[:n-len(out)]...)
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
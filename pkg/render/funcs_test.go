@@ -0,0 +1,135 @@
+package render
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	got, err := sha512crypt("Hello world!", "saltstring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	if got != want {
+		t.Fatalf("sha512crypt = %s, want %s", got, want)
+	}
+
+	random, err := sha512crypt("Hello world!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(random, "$")
+	if len(parts) != 4 || parts[1] != "6" || len(parts[2]) != sha512MaxSalt {
+		t.Fatalf("unexpected random-salt hash %s", random)
+	}
+	if again := sha512Crypt([]byte("Hello world!"), parts[2], sha512DefaultRound); again != random {
+		t.Fatalf("hash does not verify with its own salt")
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := map[string]any{
+		"hostname": "node-01",
+		"network": map[string]any{
+			"ipv4": map[string]any{"address": "192.168.110.21/22"},
+		},
+		"groups": []any{"wheel", "adm"},
+	}
+	cases := map[string]string{
+		`{{ dig "network" "ipv4" "address" "" . }}`:               "192.168.110.21/22",
+		`{{ dig "network" "ipv6" "address" "none" . }}`:           "none",
+		`{{ dig "hostname" "x" "y" . }}`:                          "y",
+		`{{ default "UTC" (dig "timezone" "" .) }}`:               "UTC",
+		`{{ default "UTC" .hostname }}`:                           "node-01",
+		`{{ join "," .groups }}`:                                  "wheel,adm",
+		`{{ b64enc .hostname }}`:                                  "bm9kZS0wMQ==",
+		`{{ .network | toYaml | indent 2 }}`:                      "  ipv4:\n      address: 192.168.110.21/22",
+		`{{ with .network.ipv4.address }}{{ ipAddr . }}{{ end }}`: "192.168.110.21",
+	}
+	ip := `{{ $a := .network.ipv4.address }}{{ ipPrefixLen $a }} {{ ipNetmask $a }} {{ ipNetwork $a }} {{ ipBroadcast $a }}`
+	cases[ip] = "22 255.255.252.0 192.168.108.0 192.168.111.255"
+
+	for src, want := range cases {
+		tmpl, err := e.base.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tmpl.New("case").Parse(src); err != nil {
+			t.Fatalf("parse %s: %v", src, err)
+		}
+		var b strings.Builder
+		if err := tmpl.ExecuteTemplate(&b, "case", profile); err != nil {
+			t.Fatalf("execute %s: %v", src, err)
+		}
+		if b.String() != want {
+			t.Errorf("%s = %q, want %q", src, b.String(), want)
+		}
+	}
+}
+
+func TestOverridesReplaceBlocksAndReload(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "partials"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "partials", "motd.tmpl"), `{{define "motd"}}echo "lab {{.Machine.ID}}" > /etc/motd{{end}}`)
+	writeFile(t, filepath.Join(dir, "post.tmpl"), `{{define "kickstart.post.extra"}}
+{{template "motd" .}}{{end}}`)
+
+	e, err := New(WithOverrides(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]any{
+		"Machine": map[string]any{"ID": "m-1", "MAC": "aa:bb:cc:dd:ee:ff"},
+		"Profile": map[string]any{},
+		"APIBase": "http://api",
+		"Token":   "tok",
+	}
+	out, err := e.Render("kickstart.tmpl", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "/root/provisioned\necho \"lab m-1\" > /etc/motd\ncurl") {
+		t.Fatalf("override block not rendered:\n%s", out)
+	}
+
+	writeFile(t, filepath.Join(dir, "post.tmpl"), `{{define "kickstart.locale"}}
+lang de_DE.UTF-8
+keyboard de
+timezone Europe/Berlin{{end}}`)
+	// Skip the reload interval and make sure the mtime moves on coarse filesystems.
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(filepath.Join(dir, "post.tmpl"), later, later)
+	e.checked = time.Time{}
+
+	out, err = e.Render("kickstart.tmpl", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "lang de_DE.UTF-8") || strings.Contains(out, "/etc/motd") {
+		t.Fatalf("override not reloaded:\n%s", out)
+	}
+
+	writeFile(t, filepath.Join(dir, "post.tmpl"), `{{define "kickstart.locale"}}{{end`)
+	_ = os.Chtimes(filepath.Join(dir, "post.tmpl"), later.Add(time.Minute), later.Add(time.Minute))
+	e.checked = time.Time{}
+	if _, err := e.Render("kickstart.tmpl", data); err == nil || !strings.Contains(err.Error(), "post.tmpl") {
+		t.Fatalf("expected parse error naming post.tmpl, got %v", err)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
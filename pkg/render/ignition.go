@@ -0,0 +1,109 @@
+package render
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// ignitionVersion is the Ignition config spec rendered for Fedora CoreOS
+// and Flatcar.
+const ignitionVersion = "3.4.0"
+
+const agentUnit = `[Unit]
+Description=Enroll the goosed agent
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!/var/lib/goosed/agent-enrolled
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/bin/sh -c 'mkdir -p /var/lib/goosed && %s && touch /var/lib/goosed/agent-enrolled'
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// ignitionConfig builds the Ignition config from the profile's ignition
+// section and shared settings. Ignition has no package manager, so packages
+// are not rendered; the network is passed as first-boot kernel arguments.
+func ignitionConfig(profile any, agent string) (map[string]any, error) {
+	m, _ := profile.(map[string]any)
+	s, err := ParseSystem(m, "ignition")
+	if err != nil {
+		return nil, fmt.Errorf("ignition: %w", err)
+	}
+
+	var users []any
+	if s.RootPasswordHash != "" {
+		users = append(users, map[string]any{"name": "root", "passwordHash": s.RootPasswordHash})
+	}
+	for _, u := range s.Users {
+		user := map[string]any{"name": u.Name}
+		if u.PasswordHash != "" {
+			user["passwordHash"] = u.PasswordHash
+		}
+		if len(u.Groups) > 0 {
+			user["groups"] = anyList(u.Groups)
+		}
+		if len(u.SSHAuthorizedKeys) > 0 {
+			user["sshAuthorizedKeys"] = anyList(u.SSHAuthorizedKeys)
+		}
+		users = append(users, user)
+	}
+
+	file := func(path, contents string) map[string]any {
+		return map[string]any{
+			"path":      path,
+			"mode":      0o644,
+			"overwrite": true,
+			"contents":  map[string]any{"source": "data:;base64," + base64.StdEncoding.EncodeToString([]byte(contents))},
+		}
+	}
+	files := []any{
+		file("/etc/locale.conf", "LANG="+s.Locale+"\n"),
+		file("/etc/vconsole.conf", "KEYMAP="+s.Keyboard+"\n"),
+	}
+	if s.Hostname != "" {
+		files = append([]any{file("/etc/hostname", s.Hostname+"\n")}, files...)
+	}
+
+	doc := map[string]any{
+		"ignition": map[string]any{"version": ignitionVersion},
+		"storage": map[string]any{
+			"files": files,
+			"links": []any{map[string]any{"path": "/etc/localtime", "target": "../usr/share/zoneinfo/" + s.Timezone, "overwrite": true}},
+		},
+	}
+	if users != nil {
+		doc["passwd"] = map[string]any{"users": users}
+	}
+	if agent != "" {
+		doc["systemd"] = map[string]any{"units": []any{map[string]any{
+			"name":     "goosed-agent-enroll.service",
+			"enabled":  true,
+			"contents": fmt.Sprintf(agentUnit, agent),
+		}}}
+	}
+
+	n, err := ParseNetwork(m["network"])
+	if err != nil {
+		return nil, err
+	}
+	if err := n.linux(); err != nil {
+		return nil, err
+	}
+	if args := n.Dracut(profileHostname(m)); len(args) > 0 && strings.Join(args, " ") != "ip=dhcp" {
+		doc["kernelArguments"] = map[string]any{"shouldExist": anyList(args)}
+	}
+
+	add, err := extra(m, "ignition")
+	if err != nil {
+		return nil, fmt.Errorf("ignition: %w", err)
+	}
+	for k, v := range add {
+		doc[k] = v
+	}
+	return doc, nil
+}
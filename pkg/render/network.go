@@ -0,0 +1,791 @@
+package render
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Network is the network section of a profile: one interface, optionally
+// bonded, VLAN-tagged or bridged, with static or dynamic addressing. It
+// renders to Kickstart network lines, dracut kernel arguments and Unattend
+// TCPIP settings.
+//
+//	network:
+//	  interface: eno1
+//	  ipv4: {address: 192.168.110.21/24, gateway: 192.168.110.1, dns: [192.168.110.11]}
+//	  ipv6: {address: 2001:db8:110::21/64, gateway: 2001:db8:110::1}
+//	  bond: {name: bond0, mode: 802.3ad, slaves: [eno1, eno2], options: miimon=100}
+//	  vlan: {id: 110}
+type Network struct {
+	// Interface is the physical device. With a bond it is unused; the bond's
+	// slaves are the physical devices.
+	Interface string   `yaml:"interface"`
+	MTU       int      `yaml:"mtu"`
+	IPv4      IPConfig `yaml:"ipv4"`
+	IPv6      IPConfig `yaml:"ipv6"`
+	// DNS servers, in addition to ipv4.dns and ipv6.dns.
+	DNS    []string `yaml:"dns"`
+	Bond   *Bond    `yaml:"bond"`
+	VLAN   *VLAN    `yaml:"vlan"`
+	Bridge *Bridge  `yaml:"bridge"`
+}
+
+// IPConfig addresses one IP family. Method is dhcp, static, auto (IPv6
+// SLAAC) or none; it is static when an address is given and otherwise
+// defaults to dhcp for IPv4 and to the installer's default for IPv6.
+type IPConfig struct {
+	Method  string   `yaml:"method"`
+	Address string   `yaml:"address"`
+	Gateway string   `yaml:"gateway"`
+	DNS     []string `yaml:"dns"`
+
+	prefix  netip.Prefix
+	gateway netip.Addr
+}
+
+type Bond struct {
+	Name    string   `yaml:"name"`
+	Mode    string   `yaml:"mode"`
+	Slaves  []string `yaml:"slaves"`
+	Options string   `yaml:"options"`
+}
+
+type VLAN struct {
+	ID int `yaml:"id"`
+	// Name defaults to <parent>.<id>, such as eno1.110.
+	Name string `yaml:"name"`
+}
+
+// Bridge puts the interface (not a bond or VLAN) into a bridge that carries
+// the addresses.
+type Bridge struct {
+	Name    string `yaml:"name"`
+	Options string `yaml:"options"`
+}
+
+var bondModes = map[string]bool{
+	"balance-rr": true, "active-backup": true, "balance-xor": true, "broadcast": true,
+	"802.3ad": true, "balance-tlb": true, "balance-alb": true,
+}
+
+// ParseNetwork decodes and validates a profile's network section. A missing
+// section is DHCP on the installer's default interface.
+func ParseNetwork(v any) (*Network, error) {
+	n := &Network{}
+	if err := decodeStrict(v, n); err != nil {
+		return nil, fmt.Errorf("network: %w", err)
+	}
+	if err := n.normalize(); err != nil {
+		return nil, fmt.Errorf("network: %w", err)
+	}
+	return n, nil
+}
+
+func (n *Network) normalize() error {
+	n.Interface = strings.TrimSpace(n.Interface)
+	if n.MTU != 0 && (n.MTU < 576 || n.MTU > 9216) {
+		return fmt.Errorf("mtu %d is outside 576-9216", n.MTU)
+	}
+	if err := n.IPv4.normalize("ipv4", true); err != nil {
+		return err
+	}
+	if err := n.IPv6.normalize("ipv6", false); err != nil {
+		return err
+	}
+	if n.IPv4.Method == "none" && (n.IPv6.Method == "" || n.IPv6.Method == "none") {
+		return errors.New("ipv4 and ipv6 cannot both be disabled")
+	}
+	for i, s := range n.DNS {
+		if _, err := netip.ParseAddr(strings.TrimSpace(s)); err != nil {
+			return fmt.Errorf("dns[%d]: %q is not an IP address", i, s)
+		}
+	}
+
+	if b := n.Bond; b != nil {
+		if b.Name == "" {
+			b.Name = "bond0"
+		}
+		if b.Mode == "" {
+			b.Mode = "active-backup"
+		}
+		if !bondModes[b.Mode] {
+			return fmt.Errorf("bond.mode %q is not a Linux bonding mode", b.Mode)
+		}
+		if len(b.Slaves) == 0 {
+			return errors.New("bond.slaves is required")
+		}
+		if n.Interface != "" && n.Interface != b.Name && !slices.Contains(b.Slaves, n.Interface) {
+			return fmt.Errorf("interface %s is not one of bond.slaves", n.Interface)
+		}
+		if strings.ContainsAny(b.Options, " :") {
+			return errors.New("bond.options is a comma-separated list such as miimon=100,lacp_rate=fast")
+		}
+	}
+	if v := n.VLAN; v != nil {
+		if v.ID < 1 || v.ID > 4094 {
+			return fmt.Errorf("vlan.id %d is outside 1-4094", v.ID)
+		}
+		if n.parent() == "" {
+			return errors.New("vlan needs an interface or a bond")
+		}
+		if v.Name == "" {
+			v.Name = n.parent() + "." + strconv.Itoa(v.ID)
+		}
+	}
+	if br := n.Bridge; br != nil {
+		if n.Bond != nil || n.VLAN != nil {
+			return errors.New("bridge can only enslave a plain interface, not a bond or vlan")
+		}
+		if n.Interface == "" {
+			return errors.New("bridge needs an interface")
+		}
+		if br.Name == "" {
+			br.Name = "br0"
+		}
+		if strings.ContainsAny(br.Options, " :") {
+			return errors.New("bridge.options is a comma-separated list such as stp=off")
+		}
+	}
+	return nil
+}
+
+func (c *IPConfig) normalize(family string, v4 bool) error {
+	c.Method = strings.ToLower(strings.TrimSpace(c.Method))
+	c.Address = strings.TrimSpace(c.Address)
+	c.Gateway = strings.TrimSpace(c.Gateway)
+	switch {
+	case c.Method == "" && c.Address != "":
+		c.Method = "static"
+	case c.Method == "" && v4:
+		c.Method = "dhcp"
+	}
+	switch c.Method {
+	case "", "dhcp", "none":
+	case "auto":
+		if v4 {
+			return errors.New("ipv4.method must be dhcp, static or none")
+		}
+	case "static":
+		if c.Address == "" {
+			return fmt.Errorf("%s.address is required for static addressing", family)
+		}
+	default:
+		return fmt.Errorf("%s.method %q must be dhcp, static, auto or none", family, c.Method)
+	}
+	if c.Method != "static" && (c.Address != "" || c.Gateway != "") {
+		return fmt.Errorf("%s.address and gateway only apply to static addressing", family)
+	}
+
+	for i, s := range c.DNS {
+		if _, err := netip.ParseAddr(strings.TrimSpace(s)); err != nil {
+			return fmt.Errorf("%s.dns[%d]: %q is not an IP address", family, i, s)
+		}
+	}
+	if c.Address == "" {
+		return nil
+	}
+	p, err := netip.ParsePrefix(c.Address)
+	if err != nil || p.Addr().Is4() != v4 {
+		return fmt.Errorf("%s.address %q is not an %s address in CIDR form", family, c.Address, family)
+	}
+	c.prefix = p
+	if c.Gateway != "" {
+		gw, err := netip.ParseAddr(c.Gateway)
+		if err != nil || gw.Is4() != v4 {
+			return fmt.Errorf("%s.gateway %q is not an %s address", family, c.Gateway, family)
+		}
+		if !p.Masked().Contains(gw) {
+			return fmt.Errorf("%s.gateway %s is outside %s", family, gw, p.Masked())
+		}
+		c.gateway = gw
+	}
+	return nil
+}
+
+// linux checks what Kickstart and dracut need beyond normalize: Windows
+// matches the adapter by MAC, but static addresses on Linux need a device.
+func (n *Network) linux() error {
+	if (n.IPv4.Method == "static" || n.IPv6.Method == "static") && n.Device() == "" {
+		return errors.New("network: static addressing needs an interface or a bond")
+	}
+	return nil
+}
+
+// parent is the device a VLAN is tagged on.
+func (n *Network) parent() string {
+	if n.Bond != nil {
+		return n.Bond.Name
+	}
+	return n.Interface
+}
+
+// Device is the device that carries the addresses.
+func (n *Network) Device() string {
+	switch {
+	case n.Bridge != nil:
+		return n.Bridge.Name
+	case n.VLAN != nil:
+		return n.VLAN.Name
+	default:
+		return n.parent()
+	}
+}
+
+// nameservers merges the DNS lists without duplicates.
+func (n *Network) nameservers() []string {
+	var out []string
+	for _, list := range [][]string{n.IPv4.DNS, n.IPv6.DNS, n.DNS} {
+		for _, s := range list {
+			s = strings.TrimSpace(s)
+			if !slices.Contains(out, s) {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+func (n *Network) bondOpts() string {
+	opts := "mode=" + n.Bond.Mode
+	if n.Bond.Options != "" {
+		opts += "," + n.Bond.Options
+	}
+	return opts
+}
+
+// Kickstart returns the network line for the installed system.
+func (n *Network) Kickstart(hostname string) []string {
+	var b strings.Builder
+	b.WriteString("network")
+	switch {
+	case n.Bridge != nil:
+		fmt.Fprintf(&b, " --device=%s --bridgeslaves=%s", n.Bridge.Name, n.Interface)
+		if n.Bridge.Options != "" {
+			b.WriteString(" --bridgeopts=" + n.Bridge.Options)
+		}
+	case n.parent() != "":
+		b.WriteString(" --device=" + n.parent())
+	}
+	if n.Bond != nil {
+		fmt.Fprintf(&b, " --bondslaves=%s --bondopts=%s", strings.Join(n.Bond.Slaves, ","), n.bondOpts())
+	}
+	if n.VLAN != nil {
+		fmt.Fprintf(&b, " --vlanid=%d --interfacename=%s", n.VLAN.ID, n.VLAN.Name)
+	}
+
+	switch n.IPv4.Method {
+	case "static":
+		mask := net.IP(net.CIDRMask(n.IPv4.prefix.Bits(), 32)).String()
+		fmt.Fprintf(&b, " --bootproto=static --ip=%s --netmask=%s", n.IPv4.prefix.Addr(), mask)
+		if n.IPv4.Gateway != "" {
+			b.WriteString(" --gateway=" + n.IPv4.Gateway)
+		}
+	case "none":
+		b.WriteString(" --noipv4")
+	default:
+		b.WriteString(" --bootproto=dhcp")
+	}
+	switch n.IPv6.Method {
+	case "static":
+		b.WriteString(" --ipv6=" + n.IPv6.Address)
+		if n.IPv6.Gateway != "" {
+			b.WriteString(" --ipv6gateway=" + n.IPv6.Gateway)
+		}
+	case "auto", "dhcp":
+		b.WriteString(" --ipv6=" + n.IPv6.Method)
+	case "none":
+		b.WriteString(" --noipv6")
+	}
+	if ns := n.nameservers(); len(ns) > 0 {
+		b.WriteString(" --nameserver=" + strings.Join(ns, ","))
+	}
+	if n.MTU != 0 {
+		fmt.Fprintf(&b, " --mtu=%d", n.MTU)
+	}
+	if hostname != "" {
+		b.WriteString(" --hostname=" + hostname)
+	}
+	if n.Device() != "" {
+		b.WriteString(" --activate")
+	}
+	return []string{b.String()}
+}
+
+// Dracut returns the kernel arguments that bring the network up in the
+// installer's initramfs, so it can fetch the Kickstart: ip=, nameserver=
+// and bond=, vlan= or bridge=.
+func (n *Network) Dracut(hostname string) []string {
+	var args []string
+	if b := n.Bond; b != nil {
+		args = append(args, fmt.Sprintf("bond=%s:%s:%s", b.Name, strings.Join(b.Slaves, ","), n.bondOpts()))
+	}
+	if v := n.VLAN; v != nil {
+		args = append(args, fmt.Sprintf("vlan=%s:%s", v.Name, n.parent()))
+	}
+	if br := n.Bridge; br != nil {
+		args = append(args, fmt.Sprintf("bridge=%s:%s", br.Name, n.Interface))
+	}
+
+	dev := n.Device()
+	mtu := ""
+	if n.MTU != 0 {
+		mtu = ":" + strconv.Itoa(n.MTU)
+	}
+	dynamic := func(method string) string {
+		if dev == "" {
+			return "ip=" + method
+		}
+		return "ip=" + dev + ":" + method + mtu
+	}
+
+	switch n.IPv4.Method {
+	case "static":
+		mask := net.IP(net.CIDRMask(n.IPv4.prefix.Bits(), 32)).String()
+		args = append(args, fmt.Sprintf("ip=%s::%s:%s:%s:%s:none%s", n.IPv4.prefix.Addr(), n.IPv4.Gateway, mask, hostname, dev, mtu))
+	case "dhcp":
+		args = append(args, dynamic("dhcp"))
+	}
+	switch n.IPv6.Method {
+	case "static":
+		gw := ""
+		if n.IPv6.Gateway != "" {
+			gw = "[" + n.IPv6.Gateway + "]"
+		}
+		args = append(args, fmt.Sprintf("ip=[%s]::%s:%d:%s:%s:none%s", n.IPv6.prefix.Addr(), gw, n.IPv6.prefix.Bits(), hostname, dev, mtu))
+	case "auto":
+		args = append(args, dynamic("auto6"))
+	case "dhcp":
+		args = append(args, dynamic("dhcp6"))
+	}
+	for _, ns := range n.nameservers() {
+		args = append(args, "nameserver="+ns)
+	}
+	return args
+}
+
+// WindowsNetwork is a static network mapped onto the Unattend
+// Microsoft-Windows-TCPIP and Microsoft-Windows-DNS-Client components.
+type WindowsNetwork struct {
+	// Identifier is the interface name, or its MAC address as Windows
+	// writes it (00-11-22-AA-BB-CC).
+	Identifier  string
+	DHCPv4      bool
+	DHCPv6      bool
+	Addresses   []WindowsValue
+	Routes      []WindowsRoute
+	Nameservers []WindowsValue
+}
+
+// WindowsValue is a list entry keyed by its 1-based position, as
+// wcm:keyValue requires.
+type WindowsValue struct {
+	Key   int
+	Value string
+}
+
+type WindowsRoute struct {
+	ID      int
+	Prefix  string
+	NextHop string
+}
+
+// Windows maps the network onto Unattend settings for the interface with
+// the given MAC. It returns nil when everything is left to DHCP, which is
+// Windows' default.
+func (n *Network) Windows(mac string) (*WindowsNetwork, error) {
+	if n.Bond != nil || n.VLAN != nil || n.Bridge != nil {
+		return nil, errors.New("bond, vlan and bridge are not supported for Windows")
+	}
+	if n.MTU != 0 {
+		return nil, errors.New("mtu is not supported for Windows")
+	}
+	if n.IPv4.Method == "none" || n.IPv6.Method == "none" {
+		return nil, errors.New("disabling an IP family is not supported for Windows")
+	}
+	ns := n.nameservers()
+	if n.IPv4.Method != "static" && n.IPv6.Method != "static" && len(ns) == 0 {
+		return nil, nil
+	}
+
+	w := &WindowsNetwork{
+		Identifier: n.Interface,
+		DHCPv4:     n.IPv4.Method != "static",
+		DHCPv6:     n.IPv6.Method != "static",
+	}
+	for i, s := range ns {
+		w.Nameservers = append(w.Nameservers, WindowsValue{Key: i + 1, Value: s})
+	}
+	if w.Identifier == "" {
+		hw, err := net.ParseMAC(strings.TrimSpace(mac))
+		if err != nil {
+			return nil, errors.New("set interface to the Windows adapter name; the machine MAC is not usable")
+		}
+		w.Identifier = strings.ToUpper(strings.ReplaceAll(hw.String(), ":", "-"))
+	}
+	for _, c := range []IPConfig{n.IPv4, n.IPv6} {
+		if c.Method != "static" {
+			continue
+		}
+		w.Addresses = append(w.Addresses, WindowsValue{Key: len(w.Addresses) + 1, Value: c.prefix.String()})
+		if c.gateway.IsValid() {
+			def := "0.0.0.0/0"
+			if c.gateway.Is6() {
+				def = "::/0"
+			}
+			w.Routes = append(w.Routes, WindowsRoute{ID: len(w.Routes) + 1, Prefix: def, NextHop: c.gateway.String()})
+		}
+	}
+	return w, nil
+}
+
+func profileHostname(profile any) string {
+	v, _ := dig("hostname", "", profile)
+	s, _ := v.(string)
+	return strings.TrimSpace(s)
+}
+
+// kickstartNetwork backs the kickstart.network block.
+func kickstartNetwork(profile any) ([]string, error) {
+	v, err := dig("network", nil, profile)
+	if err != nil {
+		return nil, err
+	}
+	n, err := ParseNetwork(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.linux(); err != nil {
+		return nil, err
+	}
+	return n.Kickstart(profileHostname(profile)), nil
+}
+
+// unattendNetwork maps the profile's network onto Unattend settings for the
+// machine's MAC; nil means DHCP.
+func unattendNetwork(profile, mac any) (*WindowsNetwork, error) {
+	v, err := dig("network", nil, profile)
+	if err != nil {
+		return nil, err
+	}
+	n, err := ParseNetwork(v)
+	if err != nil {
+		return nil, err
+	}
+	hw, _ := mac.(string)
+	w, err := n.Windows(hw)
+	if err != nil {
+		return nil, fmt.Errorf("network: %w", err)
+	}
+	return w, nil
+}
+
+// InitramfsTools returns the ip= argument of Ubuntu's initramfs-tools,
+// which brings up one device for the installer to reach the API. It has no
+// bonds, VLANs, bridges or static IPv6, so those installers use DHCP and
+// the installed system gets the full network from Netplan.
+func (n *Network) InitramfsTools(hostname string) []string {
+	if n.Bond != nil || n.VLAN != nil || n.Bridge != nil || n.IPv4.Method != "static" {
+		if n.Interface != "" && n.Bond == nil && n.VLAN == nil && n.Bridge == nil {
+			return []string{"ip=:::::" + n.Interface + ":dhcp"}
+		}
+		return []string{"ip=dhcp"}
+	}
+	mask := net.IP(net.CIDRMask(n.IPv4.prefix.Bits(), 32)).String()
+	arg := fmt.Sprintf("ip=%s::%s:%s:%s:%s:off", n.IPv4.prefix.Addr(), n.IPv4.Gateway, mask, hostname, n.Interface)
+	ns := n.nameservers()
+	for i := 0; i < len(ns) && i < 2; i++ {
+		arg += ":" + ns[i]
+	}
+	return []string{arg}
+}
+
+// Linuxrc returns the ifcfg= and hostname= arguments of the SUSE installer.
+// Like InitramfsTools it configures one device; bonds, VLANs and bridges
+// fall back to DHCP for the installer.
+func (n *Network) Linuxrc(hostname string) []string {
+	var args []string
+	dev := n.Interface
+	if dev == "" || n.Bond != nil || n.VLAN != nil || n.Bridge != nil {
+		dev = "*"
+	}
+	if n.IPv4.Method == "static" && dev != "*" {
+		arg := fmt.Sprintf("ifcfg=%s=%s", dev, n.IPv4.Address)
+		ns := n.nameservers()
+		if n.IPv4.Gateway != "" || len(ns) > 0 {
+			arg += "," + n.IPv4.Gateway
+		}
+		if len(ns) > 0 {
+			// Nameservers are space-separated, which a kernel argument cannot
+			// carry; the first reaches the API and the rest come from AutoYaST.
+			arg += "," + ns[0]
+		}
+		args = append(args, arg)
+	} else {
+		args = append(args, "ifcfg="+dev+"=dhcp")
+	}
+	if hostname != "" {
+		args = append(args, "hostname="+hostname)
+	}
+	return args
+}
+
+// netplanBondOptions maps bonding module options onto Netplan bond
+// parameters.
+var netplanBondOptions = map[string]string{
+	"miimon":           "mii-monitor-interval",
+	"lacp_rate":        "lacp-rate",
+	"xmit_hash_policy": "transmit-hash-policy",
+	"primary":          "primary",
+	"updelay":          "up-delay",
+	"downdelay":        "down-delay",
+	"ad_select":        "ad-select",
+	"arp_interval":     "arp-interval",
+}
+
+// netplanBridgeOptions maps bridge options onto Netplan bridge parameters.
+var netplanBridgeOptions = map[string]string{
+	"stp":           "stp",
+	"forward_delay": "forward-delay",
+	"priority":      "priority",
+	"hello_time":    "hello-time",
+	"max_age":       "max-age",
+}
+
+// Netplan returns the network as a Netplan version 2 document, for
+// cloud-init network-config and the autoinstall network section. It
+// returns nil for DHCP on the default interface, which both already do.
+func (n *Network) Netplan() (map[string]any, error) {
+	dev := n.Device()
+	if dev == "" && n.IPv4.Method == "dhcp" && n.IPv6.Method == "" && len(n.nameservers()) == 0 && n.MTU == 0 {
+		return nil, nil
+	}
+
+	cfg := map[string]any{}
+	switch n.IPv4.Method {
+	case "dhcp":
+		cfg["dhcp4"] = true
+	default:
+		cfg["dhcp4"] = false
+	}
+	switch n.IPv6.Method {
+	case "dhcp":
+		cfg["dhcp6"] = true
+	case "auto":
+		cfg["accept-ra"] = true
+	case "none":
+		cfg["link-local"] = []any{"ipv4"}
+	}
+	var addrs, routes []any
+	for _, c := range []IPConfig{n.IPv4, n.IPv6} {
+		if c.Method != "static" {
+			continue
+		}
+		addrs = append(addrs, c.prefix.String())
+		if c.gateway.IsValid() {
+			to := "0.0.0.0/0"
+			if c.gateway.Is6() {
+				to = "::/0"
+			}
+			routes = append(routes, map[string]any{"to": to, "via": c.gateway.String()})
+		}
+	}
+	if addrs != nil {
+		cfg["addresses"] = addrs
+	}
+	if routes != nil {
+		cfg["routes"] = routes
+	}
+	if ns := n.nameservers(); len(ns) > 0 {
+		list := make([]any, len(ns))
+		for i, s := range ns {
+			list[i] = s
+		}
+		cfg["nameservers"] = map[string]any{"addresses": list}
+	}
+	if n.MTU != 0 {
+		cfg["mtu"] = n.MTU
+	}
+
+	doc := map[string]any{"version": 2}
+	ethernets := map[string]any{}
+	doc["ethernets"] = ethernets
+	if dev == "" {
+		// No device named: configure every Ethernet interface.
+		cfg["match"] = map[string]any{"name": "e*"}
+		ethernets["all"] = cfg
+		return doc, nil
+	}
+
+	cleared := func() map[string]any {
+		return map[string]any{"dhcp4": false, "dhcp6": false}
+	}
+	switch {
+	case n.Bond != nil:
+		params, err := netplanParams(n.Bond.Options, netplanBondOptions, "bond.options")
+		if err != nil {
+			return nil, err
+		}
+		params["mode"] = n.Bond.Mode
+		ifaces := make([]any, len(n.Bond.Slaves))
+		for i, s := range n.Bond.Slaves {
+			ethernets[s] = cleared()
+			ifaces[i] = s
+		}
+		bond := cleared()
+		if n.VLAN == nil {
+			bond = cfg
+		}
+		bond["interfaces"] = ifaces
+		bond["parameters"] = params
+		doc["bonds"] = map[string]any{n.Bond.Name: bond}
+	case n.Bridge != nil:
+		params, err := netplanParams(n.Bridge.Options, netplanBridgeOptions, "bridge.options")
+		if err != nil {
+			return nil, err
+		}
+		ethernets[n.Interface] = cleared()
+		cfg["interfaces"] = []any{n.Interface}
+		if len(params) > 0 {
+			cfg["parameters"] = params
+		}
+		doc["bridges"] = map[string]any{n.Bridge.Name: cfg}
+	case n.VLAN == nil:
+		ethernets[n.Interface] = cfg
+	}
+	if n.VLAN != nil {
+		if n.Bond == nil {
+			ethernets[n.Interface] = cleared()
+		}
+		cfg["id"] = n.VLAN.ID
+		cfg["link"] = n.parent()
+		doc["vlans"] = map[string]any{n.VLAN.Name: cfg}
+	}
+	return doc, nil
+}
+
+// netplanParams converts comma-separated key=value options using names.
+func netplanParams(opts string, names map[string]string, field string) (map[string]any, error) {
+	params := map[string]any{}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt = strings.TrimSpace(opt); opt == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(opt, "=")
+		name, ok := names[k]
+		if !ok {
+			return nil, fmt.Errorf("%s: %s has no Netplan equivalent", field, k)
+		}
+		switch {
+		case v == "on" || v == "yes":
+			params[name] = true
+		case v == "off" || v == "no":
+			params[name] = false
+		default:
+			if i, err := strconv.Atoi(v); err == nil {
+				params[name] = i
+			} else {
+				params[name] = v
+			}
+		}
+	}
+	return params, nil
+}
+
+// YaSTInterface is one interface in an AutoYaST networking section.
+type YaSTInterface struct {
+	Device    string
+	BootProto string
+	IPAddr    string
+	Prefix    int
+	// IPv6 is a static IPv6 address in CIDR form, added as an alias.
+	IPv6        string
+	MTU         int
+	BondSlaves  []string
+	BondOptions string
+	EtherDevice string
+	VLANID      int
+	BridgePorts string
+}
+
+// YaSTNetwork is a network mapped onto AutoYaST interfaces, default
+// gateways and nameservers.
+type YaSTNetwork struct {
+	Interfaces  []YaSTInterface
+	Gateways    []string
+	Nameservers []string
+}
+
+// YaST maps the network onto AutoYaST. It returns nil for DHCP on the
+// default interface, so the installed system keeps the installer's network.
+func (n *Network) YaST() *YaSTNetwork {
+	dev := n.Device()
+	ns := n.nameservers()
+	if dev == "" {
+		if len(ns) == 0 {
+			return nil
+		}
+		return &YaSTNetwork{Nameservers: ns}
+	}
+
+	y := &YaSTNetwork{Nameservers: ns}
+	top := YaSTInterface{Device: dev, BootProto: "dhcp", MTU: n.MTU}
+	switch {
+	case n.IPv4.Method == "static":
+		top.BootProto = "static"
+		top.IPAddr = n.IPv4.prefix.Addr().String()
+		top.Prefix = n.IPv4.prefix.Bits()
+	case n.IPv4.Method == "none" && n.IPv6.Method == "static":
+		top.BootProto = "static"
+	case n.IPv4.Method == "none":
+		top.BootProto = "dhcp6"
+	}
+	if n.IPv6.Method == "static" {
+		if top.IPAddr == "" {
+			top.IPAddr = n.IPv6.prefix.Addr().String()
+			top.Prefix = n.IPv6.prefix.Bits()
+		} else {
+			top.IPv6 = n.IPv6.prefix.String()
+		}
+	}
+	for _, c := range []IPConfig{n.IPv4, n.IPv6} {
+		if c.gateway.IsValid() {
+			y.Gateways = append(y.Gateways, c.gateway.String())
+		}
+	}
+
+	enslaved := func(name string) YaSTInterface {
+		return YaSTInterface{Device: name, BootProto: "none"}
+	}
+	if b := n.Bond; b != nil {
+		for _, s := range b.Slaves {
+			y.Interfaces = append(y.Interfaces, enslaved(s))
+		}
+		bond := YaSTInterface{Device: b.Name, BootProto: "none", BondSlaves: b.Slaves, BondOptions: strings.ReplaceAll(n.bondOpts(), ",", " ")}
+		if n.VLAN == nil {
+			top.BondSlaves, top.BondOptions = bond.BondSlaves, bond.BondOptions
+			bond = top
+		}
+		y.Interfaces = append(y.Interfaces, bond)
+	}
+	if br := n.Bridge; br != nil {
+		y.Interfaces = append(y.Interfaces, enslaved(n.Interface))
+		top.BridgePorts = n.Interface
+		y.Interfaces = append(y.Interfaces, top)
+	}
+	if v := n.VLAN; v != nil {
+		if n.Bond == nil {
+			y.Interfaces = append(y.Interfaces, enslaved(n.Interface))
+		}
+		top.EtherDevice, top.VLANID = n.parent(), v.ID
+		y.Interfaces = append(y.Interfaces, top)
+	}
+	if n.Bond == nil && n.Bridge == nil && n.VLAN == nil {
+		y.Interfaces = append(y.Interfaces, top)
+	}
+	return y
+}
@@ -0,0 +1,150 @@
+package render
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNetworkRender(t *testing.T) {
+	cases := []struct {
+		name   string
+		src    string
+		ks     string
+		dracut string
+	}{
+		{
+			name:   "default",
+			ks:     "network --bootproto=dhcp --hostname=node1",
+			dracut: "ip=dhcp",
+		},
+		{
+			name:   "static ipv4",
+			src:    "{interface: eno1, ipv4: {address: 192.168.110.21/24, gateway: 192.168.110.1, dns: [192.168.110.11]}}",
+			ks:     "network --device=eno1 --bootproto=static --ip=192.168.110.21 --netmask=255.255.255.0 --gateway=192.168.110.1 --nameserver=192.168.110.11 --hostname=node1 --activate",
+			dracut: "ip=192.168.110.21::192.168.110.1:255.255.255.0:node1:eno1:none nameserver=192.168.110.11",
+		},
+		{
+			name: "bond vlan dual stack",
+			src: `
+mtu: 9000
+ipv4: {address: 10.0.0.5/16, gateway: 10.0.0.1}
+ipv6: {address: "2001:db8::5/64", gateway: "2001:db8::1", dns: ["2001:db8::53"]}
+bond: {mode: 802.3ad, slaves: [eno1, eno2], options: "miimon=100"}
+vlan: {id: 110}
+`,
+			ks: "network --device=bond0 --bondslaves=eno1,eno2 --bondopts=mode=802.3ad,miimon=100 --vlanid=110 --interfacename=bond0.110" +
+				" --bootproto=static --ip=10.0.0.5 --netmask=255.255.0.0 --gateway=10.0.0.1 --ipv6=2001:db8::5/64 --ipv6gateway=2001:db8::1" +
+				" --nameserver=2001:db8::53 --mtu=9000 --hostname=node1 --activate",
+			dracut: "bond=bond0:eno1,eno2:mode=802.3ad,miimon=100 vlan=bond0.110:bond0" +
+				" ip=10.0.0.5::10.0.0.1:255.255.0.0:node1:bond0.110:none:9000" +
+				" ip=[2001:db8::5]::[2001:db8::1]:64:node1:bond0.110:none:9000 nameserver=2001:db8::53",
+		},
+		{
+			name:   "bridge slaac",
+			src:    "{interface: eno1, bridge: {options: stp=off}, ipv6: {method: auto}}",
+			ks:     "network --device=br0 --bridgeslaves=eno1 --bridgeopts=stp=off --bootproto=dhcp --ipv6=auto --hostname=node1 --activate",
+			dracut: "bridge=br0:eno1 ip=br0:dhcp ip=br0:auto6",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			profile := map[string]any{"hostname": "node1"}
+			if tc.src != "" {
+				profile["network"] = parseYAML(t, tc.src)
+			}
+			ks, err := kickstartNetwork(profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ks, []string{tc.ks}) {
+				t.Fatalf("kickstart\n got %s\nwant %s", strings.Join(ks, "\n"), tc.ks)
+			}
+			dracut, err := InstallerNetworkArgs(profile, FormatKickstart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dracut != tc.dracut {
+				t.Fatalf("dracut\n got %s\nwant %s", dracut, tc.dracut)
+			}
+		})
+	}
+}
+
+func TestNetworkValidation(t *testing.T) {
+	cases := map[string]string{
+		"unknown key":        "{interface: eno1, ipv4: {adress: 10.0.0.5/24}}",
+		"no prefix":          "{interface: eno1, ipv4: {address: 10.0.0.5}}",
+		"v6 in ipv4":         "{interface: eno1, ipv4: {address: '2001:db8::5/64'}}",
+		"gateway off subnet": "{interface: eno1, ipv4: {address: 10.0.0.5/24, gateway: 10.0.1.1}}",
+		"bad dns":            "{dns: [resolver.lab]}",
+		"static no device":   "{ipv4: {address: 10.0.0.5/24}}",
+		"dhcp with address":  "{interface: eno1, ipv4: {method: dhcp, address: 10.0.0.5/24}}",
+		"ipv4 auto":          "{ipv4: {method: auto}}",
+		"bad bond mode":      "{bond: {mode: lacp, slaves: [eno1]}}",
+		"bond no slaves":     "{bond: {mode: 802.3ad}}",
+		"vlan range":         "{interface: eno1, vlan: {id: 4095}}",
+		"vlan no parent":     "{vlan: {id: 10}}",
+		"bridge over bond":   "{bond: {slaves: [eno1]}, bridge: {}}",
+		"mtu":                "{interface: eno1, mtu: 100000}",
+		"both disabled":      "{ipv4: {method: none}, ipv6: {method: none}}",
+	}
+	for name, src := range cases {
+		if _, err := kickstartNetwork(map[string]any{"network": parseYAML(t, src)}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.HasPrefix(err.Error(), "network: ") {
+			t.Errorf("%s: error %q lacks the network prefix", name, err)
+		}
+	}
+}
+
+func TestWindowsNetwork(t *testing.T) {
+	w, err := unattendNetwork(map[string]any{}, "00:aa:11:bb:22:cc")
+	if err != nil || w != nil {
+		t.Fatalf("dhcp = %+v, %v", w, err)
+	}
+
+	w, err = unattendNetwork(map[string]any{"network": parseYAML(t, `
+ipv4: {address: 192.168.110.30/24, gateway: 192.168.110.1}
+dns: [192.168.110.11, 192.168.110.12]
+`)}, "00:aa:11:bb:22:cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &WindowsNetwork{
+		Identifier:  "00-AA-11-BB-22-CC",
+		DHCPv6:      true,
+		Addresses:   []WindowsValue{{Key: 1, Value: "192.168.110.30/24"}},
+		Routes:      []WindowsRoute{{ID: 1, Prefix: "0.0.0.0/0", NextHop: "192.168.110.1"}},
+		Nameservers: []WindowsValue{{Key: 1, Value: "192.168.110.11"}, {Key: 2, Value: "192.168.110.12"}},
+	}
+	if !reflect.DeepEqual(w, want) {
+		t.Fatalf("static = %+v", w)
+	}
+
+	if _, err := unattendNetwork(map[string]any{"network": parseYAML(t, "{bond: {slaves: [a, b]}}")}, ""); err == nil {
+		t.Fatal("expected a bond to be rejected for Windows")
+	}
+
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := e.Render("unattend.xml.tmpl", map[string]any{
+		"Machine": map[string]any{"ID": "m-1", "Serial": "S1", "MAC": "00:aa:11:bb:22:cc"},
+		"APIBase": "http://api",
+		"Token":   "tok",
+		"Profile": map[string]any{"network": map[string]any{"interface": "Ethernet", "ipv4": map[string]any{"address": "192.168.110.30/24"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<settings pass="specialize">`, "<Identifier>Ethernet</Identifier>", `wcm:keyValue="1">192.168.110.30/24</IpAddress>`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("unattend lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "DNS-Client") {
+		t.Fatal("unattend has DNS settings without nameservers")
+	}
+}
@@ -0,0 +1,71 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// PreviewSecret is what a secretRef renders as in a preview.
+func PreviewSecret(ref string) string {
+	return "PREVIEW-SECRET(" + strings.TrimSpace(ref) + ")"
+}
+
+// Preview renders name like Render for review rather than for an installer:
+// secretRefs are not resolved but rendered as PreviewSecret placeholders, and
+// validation problems do not fail the render. Both come back as warnings
+// alongside the output. Errors raised while executing the template, such as
+// an invalid storage layout, still fail it.
+func (e *Engine) Preview(name string, data any) (string, []string, error) {
+	if e == nil || e.base == nil {
+		return "", nil, fmt.Errorf("nil engine")
+	}
+
+	t, err := e.current()
+	if err != nil {
+		return "", nil, err
+	}
+
+	refs := map[string]bool{}
+	placeholder := func(ref string) (string, error) {
+		refs[strings.TrimSpace(ref)] = true
+		return PreviewSecret(ref), nil
+	}
+	data, err = replaceSecretRefs(data, placeholder)
+	if err != nil {
+		return "", nil, err
+	}
+	t, err = t.Clone()
+	if err != nil {
+		return "", nil, fmt.Errorf("clone templates: %w", err)
+	}
+	t.Funcs(template.FuncMap{"secret": placeholder})
+
+	buf := bytes.NewBuffer(nil)
+	if err := t.ExecuteTemplate(buf, name, data); err != nil {
+		return "", nil, err
+	}
+
+	var warnings []string
+	sorted := make([]string, 0, len(refs))
+	for ref := range refs {
+		sorted = append(sorted, ref)
+	}
+	sort.Strings(sorted)
+	for _, ref := range sorted {
+		warnings = append(warnings, fmt.Sprintf("secretRef %s is not resolved in previews", ref))
+	}
+	if err := Validate(name, buf.String()); err != nil {
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			return "", nil, err
+		}
+		for _, p := range verr.Problems {
+			warnings = append(warnings, p.String())
+		}
+	}
+	return buf.String(), warnings, nil
+}
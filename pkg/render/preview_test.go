@@ -0,0 +1,54 @@
+package render
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPreview(t *testing.T) {
+	e, err := New(WithSecrets(failingSecrets{t}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := parseYAML(t, `
+hostname: n1.lab
+kickstart:
+  lang: en_US.UTF-8
+  keyboard: us
+  rootPasswordHash: {secretRef: lab-a/root}
+`).(map[string]any)
+
+	out, warnings, err := e.Preview("kickstart.tmpl", map[string]any{
+		// No MAC, so the output fails validation.
+		"Machine": map[string]any{"ID": "m-1"},
+		"Profile": profile,
+		"Token":   "PREVIEW-TOKEN",
+		"APIBase": "http://api",
+	})
+	if err != nil {
+		t.Fatalf("validation problems should not fail a preview: %v", err)
+	}
+	if !strings.Contains(out, PreviewSecret("lab-a/root")) {
+		t.Fatalf("secret placeholder missing:\n%s", out)
+	}
+	want := []string{
+		"secretRef lab-a/root is not resolved in previews",
+		"line 20: unresolved value (<no value>)",
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Fatalf("warnings = %q, want %q", warnings, want)
+	}
+
+	if _, _, err := e.Preview("missing.tmpl", nil); err == nil {
+		t.Fatal("expected an unknown template to fail")
+	}
+}
+
+// failingSecrets fails the test when a secretRef is resolved.
+type failingSecrets struct{ t *testing.T }
+
+func (s failingSecrets) Resolve(ref string) (string, error) {
+	s.t.Errorf("preview resolved secretRef %s", ref)
+	return "", nil
+}
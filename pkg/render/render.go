@@ -3,37 +3,224 @@ package render
 import (
 	"bytes"
 	"embed"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 //go:embed templates/*.tmpl
 var templatesFS embed.FS
 
-// Engine renders templates embedded in the package.
+// reloadInterval bounds how often the overrides directory is checked for
+// changes.
+const reloadInterval = time.Second
+
+// Engine renders templates embedded in the package, optionally overridden and
+// extended by templates on disk.
 type Engine struct {
+	base      *template.Template
+	secrets   SecretResolver
+	overrides string
+
+	mu        sync.Mutex
 	templates *template.Template
+	stamp     string
+	checked   time.Time
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithSecrets resolves secretRef values in the render data, and the secret
+// template function, through r.
+func WithSecrets(r SecretResolver) Option {
+	return func(e *Engine) { e.secrets = r }
+}
+
+// WithOverrides loads *.tmpl files from dir, including subdirectories such as
+// partials/, on top of the embedded templates. A file named after a built-in
+// template (kickstart.tmpl) replaces it; {{define}} blocks replace the named
+// sections of built-in templates or add partials. Changes are picked up
+// without a restart.
+func WithOverrides(dir string) Option {
+	return func(e *Engine) { e.overrides = dir }
+}
+
+// OptionsFromEnv configures secrets with SecretsFromEnv and overrides from
+// TEMPLATES_DIR.
+func OptionsFromEnv() ([]Option, error) {
+	var opts []Option
+	secrets, err := SecretsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if secrets != nil {
+		opts = append(opts, WithSecrets(secrets))
+	}
+	if dir := strings.TrimSpace(os.Getenv("TEMPLATES_DIR")); dir != "" {
+		opts = append(opts, WithOverrides(dir))
+	}
+	return opts, nil
 }
 
 // New initialises an Engine by parsing all embedded templates.
-func New() (*Engine, error) {
-	t, err := template.New("render").Funcs(template.FuncMap{}).ParseFS(templatesFS, "templates/*.tmpl")
+func New(opts ...Option) (*Engine, error) {
+	e := &Engine{}
+	for _, opt := range opts {
+		opt(e)
+	}
+	t, err := template.New("render").Funcs(e.funcMap()).ParseFS(templatesFS, "templates/*.tmpl")
 	if err != nil {
 		return nil, fmt.Errorf("parse templates: %w", err)
 	}
-	return &Engine{templates: t}, nil
+	e.base, e.templates = t, t
+	if _, err := e.current(); err != nil {
+		return nil, err
+	}
+	return e, nil
 }
 
-// Render executes the named template with the provided data and returns the rendered string.
+// Render executes the named template with the provided data and returns the
+// rendered string once Validate accepts it.
 func (e *Engine) Render(name string, data any) (string, error) {
-	if e == nil || e.templates == nil {
+	return e.render(name, data, true)
+}
+
+// RenderPublic renders name like Render for endpoints served without a
+// token, such as boot configs: secretRefs in data are left as they are and
+// the secret template function fails, so no secret reaches the output.
+func (e *Engine) RenderPublic(name string, data any) (string, error) {
+	return e.render(name, data, false)
+}
+
+func (e *Engine) render(name string, data any, secrets bool) (string, error) {
+	if e == nil || e.base == nil {
 		return "", fmt.Errorf("nil engine")
 	}
 
+	t, err := e.current()
+	if err != nil {
+		return "", err
+	}
+
+	if secrets {
+		data, err = e.resolveSecrets(data)
+		if err != nil {
+			return "", fmt.Errorf("resolve secrets: %w", err)
+		}
+	} else {
+		t, err = t.Clone()
+		if err != nil {
+			return "", fmt.Errorf("clone templates: %w", err)
+		}
+		t.Funcs(template.FuncMap{"secret": func(ref string) (string, error) {
+			return "", fmt.Errorf("secretRef %s: secrets are not rendered into %s", strings.TrimSpace(ref), name)
+		}})
+	}
+
 	buf := bytes.NewBuffer(nil)
-	if err := e.templates.ExecuteTemplate(buf, name, data); err != nil {
+	if err := t.ExecuteTemplate(buf, name, data); err != nil {
 		return "", err
 	}
 
+	// A broken install config fails here rather than minutes into the
+	// install.
+	if err := Validate(name, buf.String()); err != nil {
+		return "", err
+	}
 	return buf.String(), nil
 }
+
+// current returns the template set, reparsing the overrides directory when
+// its contents have changed. A broken override fails renders until it is
+// fixed rather than silently falling back to the built-in template.
+func (e *Engine) current() (*template.Template, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.overrides == "" || time.Since(e.checked) < reloadInterval {
+		return e.templates, nil
+	}
+	e.checked = time.Now()
+
+	files, stamp, err := scanOverrides(e.overrides)
+	if err != nil {
+		return nil, err
+	}
+	if stamp == e.stamp {
+		return e.templates, nil
+	}
+
+	t, err := e.base.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("clone templates: %w", err)
+	}
+	for _, rel := range files {
+		data, err := os.ReadFile(filepath.Join(e.overrides, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, fmt.Errorf("read template override %s: %w", rel, err)
+		}
+		if _, err := t.New(path.Base(rel)).Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("parse template override %s: %w", rel, err)
+		}
+	}
+	e.templates, e.stamp = t, stamp
+	return t, nil
+}
+
+// scanOverrides lists the *.tmpl files under dir in a stable order, with a
+// stamp that changes whenever one is added, removed or modified. A missing
+// directory has no overrides.
+func scanOverrides(dir string) ([]string, string, error) {
+	var (
+		files []string
+		stamp strings.Builder
+	)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			// Skip the ..data directories of ConfigMap mounts; the top-level
+			// symlinks into them are read instead.
+			if p != dir && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".tmpl") {
+			return nil
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		files = append(files, rel)
+		fmt.Fprintf(&stamp, "%s:%d:%d;", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("scan template overrides: %w", err)
+	}
+	// Root files parse last so a whole-file override wins over a partial of
+	// the same name.
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.Count(files[i], "/") > strings.Count(files[j], "/")
+	})
+	return files, stamp.String(), nil
+}
@@ -0,0 +1,331 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// SecretRefKey marks a profile value that is replaced by a secret at render
+// time, so Git only holds the reference:
+//
+//	rootPasswordHash:
+//	  secretRef: lab-a/root
+const SecretRefKey = "secretRef"
+
+// ErrSecretNotFound is returned by resolvers that do not hold a reference.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretResolver looks up secret values by reference. Implementations must
+// not include the value in errors.
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// AgeSecrets resolves ref to the age-encrypted file <Dir>/<ref>.age, such as
+// infra/secrets/lab-a/root.age, decrypting it with Identities. Files may be
+// binary or ASCII-armored.
+type AgeSecrets struct {
+	Dir        string
+	Identities []age.Identity
+}
+
+func (s AgeSecrets) Resolve(ref string) (string, error) {
+	f, err := openRef(s.Dir, ref+".age")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var src io.Reader = br
+	if head, _ := br.Peek(len(armor.Header)); string(head) == armor.Header {
+		src = armor.NewReader(br)
+	}
+	r, err := age.Decrypt(src, s.Identities...)
+	if err != nil {
+		return "", fmt.Errorf("decrypt %s.age: %w", ref, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("decrypt %s.age: %w", ref, err)
+	}
+	return trimValue(data), nil
+}
+
+// MountedSecrets resolves ref <name>/<key> to the file <Dir>/<name>/<key>,
+// the layout of Kubernetes secrets mounted one per subdirectory.
+type MountedSecrets struct {
+	Dir string
+}
+
+func (s MountedSecrets) Resolve(ref string) (string, error) {
+	f, err := openRef(s.Dir, ref)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("read secret %s: %w", ref, err)
+	}
+	return trimValue(data), nil
+}
+
+// FileSecrets resolves references from a local YAML file of ref: value
+// pairs. It is meant for development; the file is re-read on every lookup.
+type FileSecrets struct {
+	Path string
+}
+
+func (s FileSecrets) Resolve(ref string) (string, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return "", fmt.Errorf("read secrets file: %w", err)
+	}
+	var values map[string]string
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		// yaml errors can quote the offending line, so keep them out.
+		return "", fmt.Errorf("parse secrets file %s: invalid YAML", s.Path)
+	}
+	v, ok := values[ref]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return v, nil
+}
+
+// SecretChain tries each resolver in turn, moving on while they report
+// ErrSecretNotFound.
+type SecretChain []SecretResolver
+
+func (c SecretChain) Resolve(ref string) (string, error) {
+	for _, r := range c {
+		v, err := r.Resolve(ref)
+		if errors.Is(err, ErrSecretNotFound) {
+			continue
+		}
+		return v, err
+	}
+	return "", ErrSecretNotFound
+}
+
+// SecretsFromEnv builds the resolver chain from the environment, in order:
+// SECRETS_AGE_DIR decrypted with SECRETS_AGE_IDENTITY_FILE or AGE_SECRET_KEY,
+// SECRETS_MOUNT_DIR, then SECRETS_FILE. It returns nil when none are set.
+func SecretsFromEnv() (SecretResolver, error) {
+	var chain SecretChain
+
+	if dir := strings.TrimSpace(os.Getenv("SECRETS_AGE_DIR")); dir != "" {
+		ids, err := ageIdentitiesFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, AgeSecrets{Dir: dir, Identities: ids})
+	}
+	if dir := strings.TrimSpace(os.Getenv("SECRETS_MOUNT_DIR")); dir != "" {
+		chain = append(chain, MountedSecrets{Dir: dir})
+	}
+	if path := strings.TrimSpace(os.Getenv("SECRETS_FILE")); path != "" {
+		chain = append(chain, FileSecrets{Path: path})
+	}
+
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+func ageIdentitiesFromEnv() ([]age.Identity, error) {
+	if path := strings.TrimSpace(os.Getenv("SECRETS_AGE_IDENTITY_FILE")); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read SECRETS_AGE_IDENTITY_FILE: %w", err)
+		}
+		ids, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("parse SECRETS_AGE_IDENTITY_FILE: %w", err)
+		}
+		return ids, nil
+	}
+	if key := strings.TrimSpace(os.Getenv("AGE_SECRET_KEY")); key != "" {
+		id, err := age.ParseX25519Identity(key)
+		if err != nil {
+			return nil, errors.New("parse AGE_SECRET_KEY: not an age X25519 identity")
+		}
+		return []age.Identity{id}, nil
+	}
+	return nil, errors.New("SECRETS_AGE_DIR requires SECRETS_AGE_IDENTITY_FILE or AGE_SECRET_KEY")
+}
+
+// openRef opens name under dir, refusing references that escape it.
+func openRef(dir, name string) (*os.File, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, fmt.Errorf("invalid secret reference %q", name)
+	}
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrSecretNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open secret %s: %w", name, err)
+	}
+	return f, nil
+}
+
+// trimValue drops the trailing newline editors and `echo` leave behind.
+func trimValue(data []byte) string {
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+// resolveSecrets returns a copy of v with every {secretRef: ref} map replaced
+// by the secret's value.
+func (e *Engine) resolveSecrets(v any) (any, error) {
+	return replaceSecretRefs(v, e.secret)
+}
+
+// replaceSecretRefs returns a copy of v with every {secretRef: ref} map
+// replaced by resolve(ref). Maps, slices, pointers and the exported fields of
+// structs are walked, so refs in a Machine's Profile are found as well as
+// refs in a bare profile map.
+func replaceSecretRefs(v any, resolve func(string) (string, error)) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	out, err := replaceSecretRefsValue(reflect.ValueOf(v), resolve)
+	if err != nil {
+		return nil, err
+	}
+	return out.Interface(), nil
+}
+
+func replaceSecretRefsValue(v reflect.Value, resolve func(string) (string, error)) (reflect.Value, error) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return v, nil
+		}
+		elem, err := replaceSecretRefsValue(v.Elem(), resolve)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if v.Kind() == reflect.Interface {
+			return assignable(elem, v.Type())
+		}
+		out := reflect.New(elem.Type())
+		out.Elem().Set(elem)
+		return out, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return v, nil
+		}
+		if ref, ok := secretRef(v); ok {
+			resolved, err := resolve(ref)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(resolved), nil
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			elem, err := replaceSecretRefsValue(iter.Value(), resolve)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			if elem, err = assignable(elem, v.Type().Elem()); err != nil {
+				return reflect.Value{}, err
+			}
+			out.SetMapIndex(iter.Key(), elem)
+		}
+		return out, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return v, nil
+		}
+		out := reflect.New(v.Type()).Elem()
+		if v.Kind() == reflect.Slice {
+			out = reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		}
+		for i := 0; i < v.Len(); i++ {
+			elem, err := replaceSecretRefsValue(v.Index(i), resolve)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			if elem, err = assignable(elem, v.Type().Elem()); err != nil {
+				return reflect.Value{}, err
+			}
+			out.Index(i).Set(elem)
+		}
+		return out, nil
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if !out.Field(i).CanSet() {
+				continue
+			}
+			elem, err := replaceSecretRefsValue(v.Field(i), resolve)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			if elem, err = assignable(elem, v.Type().Field(i).Type); err != nil {
+				return reflect.Value{}, err
+			}
+			out.Field(i).Set(elem)
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// secretRef reports the reference held by v when it is a {secretRef: ref}
+// map whose values may be replaced by a string.
+func secretRef(v reflect.Value) (string, bool) {
+	if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.Interface || v.Len() != 1 {
+		return "", false
+	}
+	ref := v.MapIndex(reflect.ValueOf(SecretRefKey).Convert(v.Type().Key()))
+	if !ref.IsValid() || ref.IsNil() {
+		return "", false
+	}
+	s, ok := ref.Elem().Interface().(string)
+	return s, ok
+}
+
+// assignable returns v as a value of type t, failing when a secretRef was
+// replaced inside a field that cannot hold a string.
+func assignable(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	if !v.IsValid() {
+		return reflect.Zero(t), nil
+	}
+	if !v.Type().AssignableTo(t) {
+		return reflect.Value{}, fmt.Errorf("cannot replace a secretRef in a %s", t)
+	}
+	return v, nil
+}
+
+// secret resolves ref; it is also the template function of the same name.
+func (e *Engine) secret(ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	if e.secrets == nil {
+		return "", fmt.Errorf("secretRef %s: no secrets backend configured", ref)
+	}
+	v, err := e.secrets.Resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("secretRef %s: %w", ref, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,121 @@
+package render
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+func TestRenderResolvesSecretRefs(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ageDir, "lab-a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(ageDir, "lab-a", "root.age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw := armor.NewWriter(f)
+	w, err := age.Encrypt(aw, id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("$6$from-age\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = aw.Close()
+	_ = f.Close()
+
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "lab-a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "lab-a", "deploy"), []byte("$6$from-mount"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := New(WithSecrets(SecretChain{
+		AgeSecrets{Dir: ageDir, Identities: []age.Identity{id}},
+		MountedSecrets{Dir: mountDir},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := map[string]any{
+		"kickstart": map[string]any{
+			"rootPasswordHash": map[string]any{"secretRef": "lab-a/root"},
+			"users": []any{
+				map[string]any{"name": "deploy", "passwordHash": map[string]any{"secretRef": "lab-a/deploy"}},
+			},
+		},
+	}
+	out, err := engine.Render("kickstart.tmpl", map[string]any{
+		"Machine": map[string]any{"ID": "m1", "MAC": "aa:bb:cc:dd:ee:ff"},
+		"Profile": profile,
+		"Token":   "t",
+		"APIBase": "http://api",
+	})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	for _, want := range []string{"rootpw --iscrypted $6$from-age", "--password=$6$from-mount"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("rendered kickstart missing %q", want)
+		}
+	}
+	if _, ok := profile["kickstart"].(map[string]any)["rootPasswordHash"].(map[string]any); !ok {
+		t.Error("Render modified the caller's profile")
+	}
+
+	// The API passes its Machine struct, whose Profile holds the refs.
+	type machine struct {
+		ID, MAC string
+		Profile map[string]any
+	}
+	overrides := t.TempDir()
+	if err := os.WriteFile(filepath.Join(overrides, "echo.tmpl"), []byte(`{{ .Machine.Profile.kickstart.rootPasswordHash }}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(overrides, "secret.tmpl"), []byte(`{{ secret "lab-a/root" }}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engine, err = New(WithOverrides(overrides), WithSecrets(SecretChain{
+		AgeSecrets{Dir: ageDir, Identities: []age.Identity{id}},
+		MountedSecrets{Dir: mountDir},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := struct{ Machine machine }{machine{ID: "m1", Profile: profile}}
+	if out, err := engine.Render("echo.tmpl", data); err != nil || out != "$6$from-age" {
+		t.Fatalf("ref in a struct field: got %q, %v", out, err)
+	}
+	// Boot configs are served without a token and never see a secret.
+	if out, err := engine.RenderPublic("echo.tmpl", data); err != nil || strings.Contains(out, "from-age") {
+		t.Fatalf("RenderPublic resolved a ref: got %q, %v", out, err)
+	}
+	if _, err := engine.RenderPublic("secret.tmpl", data); err == nil {
+		t.Fatal("RenderPublic ran the secret function")
+	}
+
+	_, err = engine.Render("kickstart.tmpl", map[string]any{
+		"Profile": map[string]any{"kickstart": map[string]any{"rootPasswordHash": map[string]any{"secretRef": "lab-a/missing"}}},
+	})
+	if !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("missing secret: got %v, want ErrSecretNotFound", err)
+	}
+	if _, err := (MountedSecrets{Dir: mountDir}).Resolve("../etc/passwd"); err == nil {
+		t.Fatal("reference escaping the mount was resolved")
+	}
+}
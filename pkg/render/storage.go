@@ -0,0 +1,846 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Storage is the storage section of a profile. It renders to Kickstart disk
+// directives and to the Unattend DiskConfiguration. Sizes are in MiB unless
+// given with a unit ("20GiB").
+//
+//	storage:
+//	  disks: [sda, sdb]
+//	  partitions:
+//	    - {mount: /boot, fstype: xfs, size: 1024, disk: sda}
+//	    - {pv: pv.01, size: 1, grow: true, disk: sda}
+//	  volumeGroups:
+//	    - name: vg0
+//	      pvs: [pv.01]
+//	      logicalVolumes:
+//	        - {name: root, mount: /, size: 1, grow: true}
+type Storage struct {
+	// Layout expands to a preset: lvm, plain, thinp or btrfs use autopart;
+	// raid1 mirrors /boot and an LVM root across the first two disks.
+	Layout string   `yaml:"layout"`
+	Disks  []string `yaml:"disks"`
+	// Clear is all (the default), linux or none.
+	Clear string `yaml:"clear"`
+	// ReqPart creates the platform's boot partitions (biosboot or
+	// /boot/efi) before the ones listed.
+	ReqPart bool `yaml:"reqpart"`
+	// Firmware picks the default Windows layout: uefi (default) or bios.
+	Firmware     string        `yaml:"firmware"`
+	Bootloader   Bootloader    `yaml:"bootloader"`
+	Autopart     *Autopart     `yaml:"autopart"`
+	Partitions   []Partition   `yaml:"partitions"`
+	RAID         []RAID        `yaml:"raid"`
+	VolumeGroups []VolumeGroup `yaml:"volumeGroups"`
+}
+
+type Bootloader struct {
+	// Location is mbr (default), partition, boot or none.
+	Location string `yaml:"location"`
+	// Drive defaults to the first disk.
+	Drive  string `yaml:"drive"`
+	Append string `yaml:"append"`
+	// PasswordHash is a grub2-mkpasswd-pbkdf2 hash, usually a secretRef.
+	PasswordHash string `yaml:"passwordHash"`
+}
+
+// Encryption is LUKS on a partition, RAID device, logical volume or
+// autopart. The passphrase is normally a secretRef.
+type Encryption struct {
+	Encrypted  bool   `yaml:"encrypted"`
+	Passphrase string `yaml:"passphrase"`
+}
+
+type Autopart struct {
+	Type       string `yaml:"type"`
+	Encryption `yaml:",inline"`
+}
+
+// Filesystem is what is created on a partition, RAID device or logical
+// volume that is mounted.
+type Filesystem struct {
+	Mount      string `yaml:"mount"`
+	FSType     string `yaml:"fstype"`
+	Label      string `yaml:"label"`
+	FSOptions  string `yaml:"fsoptions"`
+	Encryption `yaml:",inline"`
+}
+
+// Partition is mounted, or becomes an LVM physical volume (PV) or an mdraid
+// member (RAID), each named by an id such as pv.01 or raid.01.
+type Partition struct {
+	Filesystem `yaml:",inline"`
+	Size       Size   `yaml:"size"`
+	MaxSize    Size   `yaml:"maxSize"`
+	Grow       bool   `yaml:"grow"`
+	Disk       string `yaml:"disk"`
+	PV         string `yaml:"pv"`
+	RAID       string `yaml:"raid"`
+	// Type and Active only apply to Windows: efi, msr or primary.
+	Type   string `yaml:"type"`
+	Active bool   `yaml:"active"`
+}
+
+type RAID struct {
+	Filesystem `yaml:",inline"`
+	Device     string   `yaml:"device"`
+	Level      string   `yaml:"level"`
+	Members    []string `yaml:"members"`
+	PV         string   `yaml:"pv"`
+}
+
+type VolumeGroup struct {
+	Name           string          `yaml:"name"`
+	PVs            []string        `yaml:"pvs"`
+	LogicalVolumes []LogicalVolume `yaml:"logicalVolumes"`
+}
+
+type LogicalVolume struct {
+	Filesystem `yaml:",inline"`
+	Name       string `yaml:"name"`
+	Size       Size   `yaml:"size"`
+	MaxSize    Size   `yaml:"maxSize"`
+	Grow       bool   `yaml:"grow"`
+}
+
+// Size is a size in MiB. It decodes from a number of MiB or a string with a
+// unit: 512MiB, 20GiB, 1TiB (or M, G, T).
+type Size int64
+
+var sizePattern = regexp.MustCompile(`(?i)^(\d+)\s*([MGT]i?B?)?$`)
+
+func (s *Size) UnmarshalYAML(n *yaml.Node) error {
+	m := sizePattern.FindStringSubmatch(strings.TrimSpace(n.Value))
+	if n.Kind != yaml.ScalarNode || m == nil {
+		return fmt.Errorf("invalid size %q; want MiB or a value such as 20GiB", n.Value)
+	}
+	v, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %w", n.Value, err)
+	}
+	switch strings.ToUpper(m[2][:min(1, len(m[2]))]) {
+	case "G":
+		v <<= 10
+	case "T":
+		v <<= 20
+	}
+	*s = Size(v)
+	return nil
+}
+
+// decodeStorage decodes a profile's storage value, rejecting unknown keys so
+// typos fail the render instead of being ignored.
+func decodeStorage(v any) (*Storage, error) {
+	s := &Storage{}
+	if err := decodeStrict(v, s); err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	return s, nil
+}
+
+// decodeStrict decodes a profile section into out through YAML, rejecting
+// unknown keys. A nil value leaves out unchanged.
+func decodeStrict(v, out any) error {
+	if v == nil {
+		return nil
+	}
+	raw, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(out); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
+		}
+		// Line numbers refer to the re-encoded value, not the profile file.
+		msgs := make([]string, len(typeErr.Errors))
+		for i, msg := range typeErr.Errors {
+			msg = yamlLinePrefix.ReplaceAllString(msg, "")
+			msgs[i] = yamlUnknownField.ReplaceAllString(msg, "unknown field $1")
+		}
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+var (
+	yamlLinePrefix   = regexp.MustCompile(`^line \d+: `)
+	yamlUnknownField = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+)
+
+// ParseStorage decodes, expands and validates a profile's storage section
+// for Kickstart. A missing section means autopart over every disk.
+func ParseStorage(v any) (*Storage, error) {
+	s, err := decodeStorage(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.normalize(); err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Storage) manual() bool {
+	return len(s.Partitions) > 0 || len(s.RAID) > 0 || len(s.VolumeGroups) > 0
+}
+
+func (s *Storage) normalize() error {
+	for i, d := range s.Disks {
+		s.Disks[i] = strings.TrimPrefix(strings.TrimSpace(d), "/dev/")
+	}
+	for i := range s.Partitions {
+		s.Partitions[i].Disk = strings.TrimPrefix(strings.TrimSpace(s.Partitions[i].Disk), "/dev/")
+	}
+	s.Bootloader.Drive = strings.TrimPrefix(strings.TrimSpace(s.Bootloader.Drive), "/dev/")
+	if s.Clear == "" {
+		s.Clear = "all"
+	}
+	if s.Bootloader.Location == "" {
+		s.Bootloader.Location = "mbr"
+	}
+	if s.Bootloader.Drive == "" && len(s.Disks) > 0 && s.Bootloader.Location != "none" {
+		s.Bootloader.Drive = s.Disks[0]
+	}
+
+	switch layout := strings.ToLower(strings.TrimSpace(s.Layout)); layout {
+	case "":
+	case "lvm", "plain", "thinp", "btrfs":
+		if s.manual() || s.Autopart != nil {
+			return fmt.Errorf("layout %s cannot be combined with autopart, partitions, raid or volumeGroups", layout)
+		}
+		s.Autopart = &Autopart{Type: layout}
+	case "raid1":
+		if s.manual() || s.Autopart != nil {
+			return errors.New("layout raid1 cannot be combined with autopart, partitions, raid or volumeGroups")
+		}
+		if len(s.Disks) < 2 {
+			return errors.New("layout raid1 needs two disks")
+		}
+		s.expandRAID1()
+	default:
+		return fmt.Errorf("unknown layout %q; want lvm, plain, thinp, btrfs or raid1", s.Layout)
+	}
+
+	if !s.manual() && s.Autopart == nil {
+		s.Autopart = &Autopart{Type: "lvm"}
+	}
+	if s.Autopart != nil && s.Autopart.Type == "" {
+		s.Autopart.Type = "lvm"
+	}
+
+	for i := range s.Partitions {
+		p := &s.Partitions[i]
+		if p.Grow && p.Size == 0 {
+			p.Size = 1
+		}
+		defaultFSType(&p.Filesystem)
+	}
+	for i := range s.RAID {
+		r := &s.RAID[i]
+		if r.Device == "" {
+			r.Device = fmt.Sprintf("md%d", i)
+		}
+		r.Level = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(r.Level)), "raid")
+		defaultFSType(&r.Filesystem)
+	}
+	for i := range s.VolumeGroups {
+		for j := range s.VolumeGroups[i].LogicalVolumes {
+			lv := &s.VolumeGroups[i].LogicalVolumes[j]
+			if lv.Grow && lv.Size == 0 {
+				lv.Size = 1
+			}
+			defaultFSType(&lv.Filesystem)
+		}
+	}
+	return nil
+}
+
+// expandRAID1 mirrors a 1 GiB /boot and an LVM physical volume filling the
+// rest of the first two disks; reqpart adds the firmware boot partition.
+func (s *Storage) expandRAID1() {
+	a, b := s.Disks[0], s.Disks[1]
+	s.ReqPart = true
+	s.Partitions = []Partition{
+		{RAID: "raid.01", Size: 1024, Disk: a},
+		{RAID: "raid.02", Size: 1024, Disk: b},
+		{RAID: "raid.11", Size: 1, Grow: true, Disk: a},
+		{RAID: "raid.12", Size: 1, Grow: true, Disk: b},
+	}
+	s.RAID = []RAID{
+		{Filesystem: Filesystem{Mount: "/boot", FSType: "xfs"}, Device: "md0", Level: "1", Members: []string{"raid.01", "raid.02"}},
+		{Device: "md1", Level: "1", Members: []string{"raid.11", "raid.12"}, PV: "pv.01"},
+	}
+	s.VolumeGroups = []VolumeGroup{{
+		Name: "vg0",
+		PVs:  []string{"pv.01"},
+		LogicalVolumes: []LogicalVolume{
+			{Filesystem: Filesystem{Mount: "/", FSType: "xfs"}, Name: "root", Size: 1, Grow: true},
+		},
+	}}
+}
+
+func defaultFSType(fs *Filesystem) {
+	if fs.Mount == "" || fs.FSType != "" {
+		return
+	}
+	switch fs.Mount {
+	case "swap":
+		fs.FSType = "swap"
+	case "/boot/efi":
+		fs.FSType = "efi"
+	case "biosboot":
+		fs.FSType = "biosboot"
+	default:
+		fs.FSType = "xfs"
+	}
+}
+
+var (
+	linuxFSTypes = map[string]bool{
+		"xfs": true, "ext4": true, "ext3": true, "ext2": true, "vfat": true,
+		"efi": true, "swap": true, "biosboot": true, "btrfs": true,
+	}
+	raidMinMembers = map[string]int{"0": 2, "1": 2, "4": 3, "5": 3, "6": 4, "10": 4}
+)
+
+func (s *Storage) validate() error {
+	switch s.Clear {
+	case "all", "linux", "none":
+	default:
+		return fmt.Errorf("clear must be all, linux or none, got %q", s.Clear)
+	}
+	switch s.Bootloader.Location {
+	case "mbr", "partition", "boot", "none":
+	default:
+		return fmt.Errorf("bootloader.location must be mbr, partition, boot or none, got %q", s.Bootloader.Location)
+	}
+	disks := map[string]bool{}
+	for i, d := range s.Disks {
+		if d == "" {
+			return fmt.Errorf("disks[%d] is empty", i)
+		}
+		disks[d] = true
+	}
+	onDisk := func(field, d string) error {
+		if d != "" && len(disks) > 0 && !disks[d] {
+			return fmt.Errorf("%s %s is not listed in disks", field, d)
+		}
+		return nil
+	}
+	if err := onDisk("bootloader.drive", s.Bootloader.Drive); err != nil {
+		return err
+	}
+
+	if s.Autopart != nil {
+		if s.manual() {
+			return errors.New("autopart cannot be combined with partitions, raid or volumeGroups")
+		}
+		switch s.Autopart.Type {
+		case "lvm", "plain", "thinp", "btrfs":
+		default:
+			return fmt.Errorf("autopart.type must be lvm, plain, thinp or btrfs, got %q", s.Autopart.Type)
+		}
+		return checkEncryption("autopart", s.Autopart.Encryption)
+	}
+
+	mounts := map[string]string{}
+	checkFS := func(where string, fs Filesystem) error {
+		if fs.Mount != "/" && fs.Mount != "swap" && fs.Mount != "biosboot" && !strings.HasPrefix(fs.Mount, "/") {
+			return fmt.Errorf("%s: mount must be an absolute path, swap or biosboot, got %q", where, fs.Mount)
+		}
+		if other, ok := mounts[fs.Mount]; ok && fs.Mount != "swap" {
+			return fmt.Errorf("%s: %s is already mounted by %s", where, fs.Mount, other)
+		}
+		mounts[fs.Mount] = where
+		if !linuxFSTypes[fs.FSType] {
+			return fmt.Errorf("%s: unsupported fstype %q", where, fs.FSType)
+		}
+		return checkEncryption(where, fs.Encryption)
+	}
+
+	pvs := map[string]string{}
+	raidMembers := map[string]bool{}
+	for i, p := range s.Partitions {
+		where := fmt.Sprintf("partitions[%d]", i)
+		roles := 0
+		for _, v := range []string{p.Mount, p.PV, p.RAID} {
+			if v != "" {
+				roles++
+			}
+		}
+		if roles != 1 {
+			return fmt.Errorf("%s: set exactly one of mount, pv or raid", where)
+		}
+		if p.Size <= 0 {
+			return fmt.Errorf("%s: size is required unless grow is set", where)
+		}
+		if p.MaxSize > 0 && !p.Grow {
+			return fmt.Errorf("%s: maxSize needs grow", where)
+		}
+		if p.Type != "" || p.Active {
+			return fmt.Errorf("%s: type and active only apply to Windows", where)
+		}
+		if err := onDisk(where+": disk", p.Disk); err != nil {
+			return err
+		}
+		switch {
+		case p.Mount != "":
+			if err := checkFS(where, p.Filesystem); err != nil {
+				return err
+			}
+		case p.PV != "":
+			if err := volumeOnly(where, p.Filesystem); err != nil {
+				return err
+			}
+			if pvs[p.PV] != "" {
+				return fmt.Errorf("%s: pv %s is already defined by %s", where, p.PV, pvs[p.PV])
+			}
+			pvs[p.PV] = where
+		default:
+			if p.Filesystem != (Filesystem{}) {
+				return fmt.Errorf("%s: a raid member has no filesystem or encryption; set them on the raid device", where)
+			}
+			if raidMembers[p.RAID] {
+				return fmt.Errorf("%s: raid member %s is defined twice", where, p.RAID)
+			}
+			raidMembers[p.RAID] = true
+		}
+	}
+
+	devices := map[string]bool{}
+	for i, r := range s.RAID {
+		where := fmt.Sprintf("raid[%d]", i)
+		if (r.Mount == "") == (r.PV == "") {
+			return fmt.Errorf("%s: set exactly one of mount or pv", where)
+		}
+		if devices[r.Device] {
+			return fmt.Errorf("%s: device %s is defined twice", where, r.Device)
+		}
+		devices[r.Device] = true
+		want, ok := raidMinMembers[r.Level]
+		if !ok {
+			return fmt.Errorf("%s: level must be 0, 1, 4, 5, 6 or 10, got %q", where, r.Level)
+		}
+		if len(r.Members) < want {
+			return fmt.Errorf("%s: RAID%s needs at least %d members", where, r.Level, want)
+		}
+		for _, m := range r.Members {
+			if !raidMembers[m] {
+				return fmt.Errorf("%s: member %s is not a raid partition or is used twice", where, m)
+			}
+			delete(raidMembers, m)
+		}
+		if r.Mount != "" {
+			if err := checkFS(where, r.Filesystem); err != nil {
+				return err
+			}
+		} else {
+			if err := volumeOnly(where, r.Filesystem); err != nil {
+				return err
+			}
+			if pvs[r.PV] != "" {
+				return fmt.Errorf("%s: pv %s is already defined by %s", where, r.PV, pvs[r.PV])
+			}
+			pvs[r.PV] = where
+		}
+	}
+	for i, p := range s.Partitions {
+		if raidMembers[p.RAID] {
+			return fmt.Errorf("partitions[%d]: raid member %s is not in any raid", i, p.RAID)
+		}
+	}
+
+	vgs := map[string]bool{}
+	for i, vg := range s.VolumeGroups {
+		where := fmt.Sprintf("volumeGroups[%d]", i)
+		if vg.Name == "" {
+			return fmt.Errorf("%s: name is required", where)
+		}
+		if vgs[vg.Name] {
+			return fmt.Errorf("%s: volume group %s is defined twice", where, vg.Name)
+		}
+		vgs[vg.Name] = true
+		if len(vg.PVs) == 0 {
+			return fmt.Errorf("%s: pvs is required", where)
+		}
+		for _, pv := range vg.PVs {
+			if pvs[pv] == "" {
+				return fmt.Errorf("%s: pv %s is not defined or is used twice", where, pv)
+			}
+			delete(pvs, pv)
+		}
+		lvs := map[string]bool{}
+		for j, lv := range vg.LogicalVolumes {
+			lvWhere := fmt.Sprintf("%s.logicalVolumes[%d]", where, j)
+			if lv.Name == "" || lvs[lv.Name] {
+				return fmt.Errorf("%s: name is required and must be unique", lvWhere)
+			}
+			lvs[lv.Name] = true
+			if lv.Size <= 0 {
+				return fmt.Errorf("%s: size is required unless grow is set", lvWhere)
+			}
+			if lv.MaxSize > 0 && !lv.Grow {
+				return fmt.Errorf("%s: maxSize needs grow", lvWhere)
+			}
+			if err := checkFS(lvWhere, lv.Filesystem); err != nil {
+				return err
+			}
+		}
+	}
+	for i, p := range s.Partitions {
+		if p.PV != "" && pvs[p.PV] != "" {
+			return fmt.Errorf("partitions[%d]: pv %s is not in any volume group", i, p.PV)
+		}
+	}
+	for i, r := range s.RAID {
+		if r.PV != "" && pvs[r.PV] != "" {
+			return fmt.Errorf("raid[%d]: pv %s is not in any volume group", i, r.PV)
+		}
+	}
+
+	if _, ok := mounts["/"]; !ok {
+		return errors.New("no filesystem is mounted at /")
+	}
+	return nil
+}
+
+// volumeOnly rejects filesystem settings on an LVM physical volume, which can
+// only be encrypted.
+func volumeOnly(where string, fs Filesystem) error {
+	if fs.FSType != "" || fs.Label != "" || fs.FSOptions != "" {
+		return fmt.Errorf("%s: a pv has no fstype, label or fsoptions; set them on its logical volumes", where)
+	}
+	return checkEncryption(where, fs.Encryption)
+}
+
+func checkEncryption(where string, e Encryption) error {
+	if e.Encrypted && e.Passphrase == "" {
+		return fmt.Errorf("%s: encrypted needs a passphrase (use a secretRef)", where)
+	}
+	if !e.Encrypted && e.Passphrase != "" {
+		return fmt.Errorf("%s: passphrase is set but encrypted is false", where)
+	}
+	return nil
+}
+
+// Kickstart returns the disk directives in the order Anaconda expects them.
+func (s *Storage) Kickstart() []string {
+	var lines []string
+	if len(s.Disks) > 0 {
+		lines = append(lines, "ignoredisk --only-use="+strings.Join(s.Disks, ","))
+	}
+	switch s.Clear {
+	case "all":
+		line := "clearpart --all --initlabel"
+		if len(s.Disks) > 0 {
+			line += " --drives=" + strings.Join(s.Disks, ",")
+		}
+		lines = append(lines, "zerombr", line)
+	case "linux":
+		lines = append(lines, "clearpart --linux")
+	case "none":
+		lines = append(lines, "clearpart --none")
+	}
+
+	bl := "bootloader --location=" + s.Bootloader.Location
+	if s.Bootloader.Drive != "" {
+		bl += " --boot-drive=" + s.Bootloader.Drive
+	}
+	if s.Bootloader.Append != "" {
+		bl += " --append=" + ksQuote(s.Bootloader.Append)
+	}
+	if s.Bootloader.PasswordHash != "" {
+		bl += " --iscrypted --password=" + ksQuote(s.Bootloader.PasswordHash)
+	}
+	lines = append(lines, bl)
+
+	if s.ReqPart {
+		lines = append(lines, "reqpart")
+	}
+	if s.Autopart != nil {
+		return append(lines, "autopart --type="+s.Autopart.Type+ksEncryption(s.Autopart.Encryption))
+	}
+
+	for _, p := range s.Partitions {
+		name := p.Mount
+		if p.PV != "" {
+			name = p.PV
+		} else if p.RAID != "" {
+			name = p.RAID
+		}
+		line := "part " + name + ksFilesystem(p.Filesystem) + ksSize(p.Size, p.MaxSize, p.Grow)
+		if p.Disk != "" {
+			line += " --ondisk=" + p.Disk
+		}
+		lines = append(lines, line)
+	}
+	for _, r := range s.RAID {
+		name := r.Mount
+		if r.PV != "" {
+			name = r.PV
+		}
+		lines = append(lines, "raid "+name+" --device="+r.Device+" --level=RAID"+r.Level+ksFilesystem(r.Filesystem)+" "+strings.Join(r.Members, " "))
+	}
+	for _, vg := range s.VolumeGroups {
+		lines = append(lines, "volgroup "+vg.Name+" "+strings.Join(vg.PVs, " "))
+		for _, lv := range vg.LogicalVolumes {
+			lines = append(lines, "logvol "+lv.Mount+" --vgname="+vg.Name+" --name="+lv.Name+ksFilesystem(lv.Filesystem)+ksSize(lv.Size, lv.MaxSize, lv.Grow))
+		}
+	}
+	return lines
+}
+
+func ksFilesystem(fs Filesystem) string {
+	var b strings.Builder
+	if fs.FSType != "" {
+		b.WriteString(" --fstype=" + fs.FSType)
+	}
+	if fs.Label != "" {
+		b.WriteString(" --label=" + ksQuote(fs.Label))
+	}
+	if fs.FSOptions != "" {
+		b.WriteString(" --fsoptions=" + ksQuote(fs.FSOptions))
+	}
+	b.WriteString(ksEncryption(fs.Encryption))
+	return b.String()
+}
+
+func ksEncryption(e Encryption) string {
+	if !e.Encrypted {
+		return ""
+	}
+	return " --encrypted --passphrase=" + ksQuote(e.Passphrase)
+}
+
+func ksSize(size, maxSize Size, grow bool) string {
+	out := fmt.Sprintf(" --size=%d", size)
+	if grow {
+		out += " --grow"
+	}
+	if maxSize > 0 {
+		out += fmt.Sprintf(" --maxsize=%d", maxSize)
+	}
+	return out
+}
+
+// ksQuote quotes a value the way Anaconda's shlex-based parser reads it.
+func ksQuote(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\"'\\#$`") {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+	return `"` + r.Replace(v) + `"`
+}
+
+// WindowsStorage is a storage section mapped onto Unattend's
+// DiskConfiguration and the partition Windows is installed to.
+type WindowsStorage struct {
+	Disks            []WindowsDisk
+	InstallDisk      int
+	InstallPartition int
+}
+
+type WindowsDisk struct {
+	ID         int
+	Wipe       bool
+	Partitions []WindowsPartition
+}
+
+// WindowsPartition is one CreatePartition/ModifyPartition pair; ID is both
+// its Order and its PartitionID.
+type WindowsPartition struct {
+	ID     int
+	Type   string
+	Size   int64
+	Extend bool
+	Format string
+	Label  string
+	Letter string
+	Active bool
+}
+
+// ParseWindowsStorage maps a profile's storage section onto Unattend disks.
+// Disks are numeric disk IDs (default 0); without partitions the standard
+// UEFI (EFI, MSR, Windows) or BIOS (System Reserved, Windows) layout is used.
+// Windows is installed to the partition mounted at C:.
+func ParseWindowsStorage(v any) (WindowsStorage, error) {
+	s, err := decodeStorage(v)
+	if err != nil {
+		return WindowsStorage{}, err
+	}
+	ws, err := s.windows()
+	if err != nil {
+		return WindowsStorage{}, fmt.Errorf("storage: %w", err)
+	}
+	return ws, nil
+}
+
+func (s *Storage) windows() (WindowsStorage, error) {
+	if s.Layout != "" || s.Autopart != nil || len(s.RAID) > 0 || len(s.VolumeGroups) > 0 || s.ReqPart {
+		return WindowsStorage{}, errors.New("layout, autopart, reqpart, raid and volumeGroups are not supported for Windows")
+	}
+	clear := s.Clear
+	if clear == "" {
+		clear = "all"
+	}
+	if clear != "all" && clear != "none" {
+		return WindowsStorage{}, fmt.Errorf("clear must be all or none for Windows, got %q", s.Clear)
+	}
+
+	ids := s.Disks
+	if len(ids) == 0 {
+		ids = []string{"0"}
+	}
+	var ws WindowsStorage
+	index := map[string]int{}
+	for i, raw := range ids {
+		id, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || id < 0 {
+			return WindowsStorage{}, fmt.Errorf("disks[%d]: Windows disk IDs are numbers, got %q", i, raw)
+		}
+		index[strconv.Itoa(id)] = len(ws.Disks)
+		ws.Disks = append(ws.Disks, WindowsDisk{ID: id, Wipe: clear == "all"})
+	}
+
+	parts := s.Partitions
+	if len(parts) == 0 {
+		switch strings.ToLower(s.Firmware) {
+		case "", "uefi":
+			parts = []Partition{
+				{Type: "efi", Size: 100, Filesystem: Filesystem{FSType: "fat32", Label: "System"}},
+				{Type: "msr", Size: 16},
+				{Grow: true, Filesystem: Filesystem{Mount: "C:", FSType: "ntfs", Label: "Windows"}},
+			}
+		case "bios":
+			parts = []Partition{
+				{Size: 500, Active: true, Filesystem: Filesystem{FSType: "ntfs", Label: "System"}},
+				{Grow: true, Filesystem: Filesystem{Mount: "C:", FSType: "ntfs", Label: "Windows"}},
+			}
+		default:
+			return WindowsStorage{}, fmt.Errorf("firmware must be uefi or bios, got %q", s.Firmware)
+		}
+	}
+
+	letters := map[string]bool{}
+	install := false
+	for i, p := range parts {
+		where := fmt.Sprintf("partitions[%d]", i)
+		if p.PV != "" || p.RAID != "" || p.Encrypted || p.MaxSize > 0 || p.FSOptions != "" {
+			return WindowsStorage{}, fmt.Errorf("%s: pv, raid, encrypted, maxSize and fsoptions are not supported for Windows", where)
+		}
+		diskKey := ids[0]
+		if p.Disk != "" {
+			diskKey = p.Disk
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(diskKey)); err == nil {
+			diskKey = strconv.Itoa(n)
+		}
+		di, ok := index[diskKey]
+		if !ok {
+			return WindowsStorage{}, fmt.Errorf("%s: disk %s is not listed in disks", where, p.Disk)
+		}
+		disk := &ws.Disks[di]
+		if n := len(disk.Partitions); n > 0 && disk.Partitions[n-1].Extend {
+			return WindowsStorage{}, fmt.Errorf("%s: only the last partition on disk %d can grow", where, disk.ID)
+		}
+
+		if strings.ContainsAny(p.Label, "<>&\"'") {
+			return WindowsStorage{}, fmt.Errorf("%s: label %q contains XML markup characters", where, p.Label)
+		}
+
+		wp := WindowsPartition{ID: len(disk.Partitions) + 1, Label: p.Label, Active: p.Active, Extend: p.Grow, Size: int64(p.Size)}
+		switch strings.ToLower(p.Type) {
+		case "efi":
+			wp.Type = "EFI"
+		case "msr":
+			wp.Type = "MSR"
+		case "", "primary":
+			wp.Type = "Primary"
+		default:
+			return WindowsStorage{}, fmt.Errorf("%s: type must be efi, msr or primary, got %q", where, p.Type)
+		}
+		switch strings.ToLower(p.FSType) {
+		case "ntfs":
+			wp.Format = "NTFS"
+		case "fat32", "vfat", "efi":
+			wp.Format = "FAT32"
+		case "":
+			if wp.Type == "EFI" {
+				wp.Format = "FAT32"
+			}
+		default:
+			return WindowsStorage{}, fmt.Errorf("%s: fstype must be ntfs or fat32, got %q", where, p.FSType)
+		}
+		if wp.Type == "MSR" && (wp.Format != "" || p.Mount != "") {
+			return WindowsStorage{}, fmt.Errorf("%s: an msr partition is not formatted or mounted", where)
+		}
+		if !wp.Extend && wp.Size <= 0 {
+			return WindowsStorage{}, fmt.Errorf("%s: size is required unless grow is set", where)
+		}
+		if wp.Extend {
+			wp.Size = 0
+		}
+		if p.Mount != "" {
+			letter := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(p.Mount), ":"))
+			if len(letter) != 1 || letter[0] < 'C' || letter[0] > 'Z' {
+				return WindowsStorage{}, fmt.Errorf("%s: mount must be a drive letter such as C:, got %q", where, p.Mount)
+			}
+			if letters[letter] {
+				return WindowsStorage{}, fmt.Errorf("%s: drive %s: is assigned twice", where, letter)
+			}
+			letters[letter] = true
+			if wp.Format != "NTFS" {
+				return WindowsStorage{}, fmt.Errorf("%s: drive %s: must be NTFS", where, letter)
+			}
+			wp.Letter = letter
+			if letter == "C" {
+				ws.InstallDisk, ws.InstallPartition, install = disk.ID, wp.ID, true
+			}
+		}
+		disk.Partitions = append(disk.Partitions, wp)
+	}
+	if !install {
+		return WindowsStorage{}, errors.New("no partition is mounted at C:")
+	}
+	return ws, nil
+}
+
+// kickstartStorage renders a profile's storage section as Kickstart
+// directives; it backs the kickstart.storage block.
+func kickstartStorage(profile any) ([]string, error) {
+	v, err := dig("storage", nil, profile)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseStorage(v)
+	if err != nil {
+		return nil, err
+	}
+	return s.Kickstart(), nil
+}
+
+// unattendStorage maps a profile's storage section onto Unattend disks.
+func unattendStorage(profile any) (WindowsStorage, error) {
+	v, err := dig("storage", nil, profile)
+	if err != nil {
+		return WindowsStorage{}, err
+	}
+	return ParseWindowsStorage(v)
+}
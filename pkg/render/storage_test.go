@@ -0,0 +1,197 @@
+package render
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func parseYAML(t *testing.T, src string) any {
+	t.Helper()
+	var v any
+	if err := yaml.Unmarshal([]byte(src), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestKickstartStorage(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"zerombr", "clearpart --all --initlabel", "bootloader --location=mbr", "autopart --type=lvm"},
+		},
+		{
+			name: "raid1 layout",
+			src:  "{layout: raid1, disks: [/dev/sda, /dev/sdb]}",
+			want: []string{
+				"ignoredisk --only-use=sda,sdb",
+				"zerombr",
+				"clearpart --all --initlabel --drives=sda,sdb",
+				"bootloader --location=mbr --boot-drive=sda",
+				"reqpart",
+				"part raid.01 --size=1024 --ondisk=sda",
+				"part raid.02 --size=1024 --ondisk=sdb",
+				"part raid.11 --size=1 --grow --ondisk=sda",
+				"part raid.12 --size=1 --grow --ondisk=sdb",
+				"raid /boot --device=md0 --level=RAID1 --fstype=xfs raid.01 raid.02",
+				"raid pv.01 --device=md1 --level=RAID1 raid.11 raid.12",
+				"volgroup vg0 pv.01",
+				"logvol / --vgname=vg0 --name=root --fstype=xfs --size=1 --grow",
+			},
+		},
+		{
+			name: "luks on lvm",
+			src: `
+disks: [nvme0n1]
+clear: linux
+bootloader: {append: "crashkernel=auto console=ttyS0", passwordHash: grub.pbkdf2.sha512.10000.ABC}
+partitions:
+  - {mount: /boot/efi, size: 600}
+  - {mount: /boot, size: 1GiB, fstype: ext4, label: boot}
+  - {pv: pv.01, grow: true, encrypted: true, passphrase: 'p@ss "word"'}
+volumeGroups:
+  - name: vg0
+    pvs: [pv.01]
+    logicalVolumes:
+      - {name: swap, mount: swap, size: 4096}
+      - {name: root, mount: /, size: 20GiB, grow: true, maxSize: 50GiB, fsoptions: "defaults,noatime"}
+`,
+			want: []string{
+				"ignoredisk --only-use=nvme0n1",
+				"clearpart --linux",
+				`bootloader --location=mbr --boot-drive=nvme0n1 --append="crashkernel=auto console=ttyS0" --iscrypted --password=grub.pbkdf2.sha512.10000.ABC`,
+				"part /boot/efi --fstype=efi --size=600",
+				"part /boot --fstype=ext4 --label=boot --size=1024",
+				`part pv.01 --encrypted --passphrase="p@ss \"word\"" --size=1 --grow`,
+				"volgroup vg0 pv.01",
+				"logvol swap --vgname=vg0 --name=swap --fstype=swap --size=4096",
+				"logvol / --vgname=vg0 --name=root --fstype=xfs --fsoptions=defaults,noatime --size=20480 --grow --maxsize=51200",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var v any
+			if tc.src != "" {
+				v = parseYAML(t, tc.src)
+			}
+			got, err := kickstartStorage(map[string]any{"storage": v})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestStorageValidation(t *testing.T) {
+	cases := map[string]string{
+		"unknown key":       "{disks: [sda], partition: []}",
+		"no root":           "{partitions: [{mount: /boot, size: 1024}]}",
+		"autopart and part": "{autopart: {type: lvm}, partitions: [{mount: /, size: 1}]}",
+		"missing size":      "{partitions: [{mount: /}]}",
+		"bad size":          "{partitions: [{mount: /, size: 20GB!}]}",
+		"disk not listed":   "{disks: [sda], partitions: [{mount: /, size: 1, disk: sdb}]}",
+		"duplicate mount":   "{partitions: [{mount: /, size: 1}, {mount: /, size: 1}]}",
+		"two roles":         "{partitions: [{mount: /, pv: pv.01, size: 1}]}",
+		"unused pv":         "{partitions: [{mount: /, size: 1}, {pv: pv.01, size: 1}]}",
+		"undefined pv":      "{partitions: [{mount: /boot, size: 1}], volumeGroups: [{name: vg0, pvs: [pv.01], logicalVolumes: [{name: root, mount: /, size: 1}]}]}",
+		"raid too small":    "{partitions: [{raid: raid.01, size: 1}], raid: [{mount: /, level: 1, members: [raid.01]}]}",
+		"bad raid level":    "{partitions: [{raid: raid.01, size: 1}, {raid: raid.02, size: 1}], raid: [{mount: /, level: 3, members: [raid.01, raid.02]}]}",
+		"luks no key":       "{partitions: [{mount: /, size: 1, encrypted: true}]}",
+		"fstype on pv":      "{partitions: [{mount: /, size: 1}, {pv: pv.01, size: 1, fstype: xfs}], volumeGroups: [{name: vg0, pvs: [pv.01]}]}",
+		"raid1 one disk":    "{layout: raid1, disks: [sda]}",
+		"bad layout":        "{layout: zfs}",
+		"bad clear":         "{clear: some}",
+	}
+	for name, src := range cases {
+		if _, err := kickstartStorage(map[string]any{"storage": parseYAML(t, src)}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.HasPrefix(err.Error(), "storage: ") {
+			t.Errorf("%s: error %q lacks the storage prefix", name, err)
+		}
+	}
+}
+
+func TestWindowsStorage(t *testing.T) {
+	got, err := unattendStorage(map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := WindowsStorage{
+		Disks: []WindowsDisk{{ID: 0, Wipe: true, Partitions: []WindowsPartition{
+			{ID: 1, Type: "EFI", Size: 100, Format: "FAT32", Label: "System"},
+			{ID: 2, Type: "MSR", Size: 16},
+			{ID: 3, Type: "Primary", Extend: true, Format: "NTFS", Label: "Windows", Letter: "C"},
+		}}},
+		InstallDisk:      0,
+		InstallPartition: 3,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("default layout = %+v", got)
+	}
+
+	got, err = unattendStorage(map[string]any{"storage": parseYAML(t, `
+disks: [0, 1]
+partitions:
+  - {size: 500, fstype: ntfs, label: System, active: true}
+  - {mount: "C:", size: 100GiB, fstype: ntfs}
+  - {mount: "D:", disk: 1, grow: true, fstype: ntfs, label: Data}
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InstallDisk != 0 || got.InstallPartition != 2 || len(got.Disks) != 2 || got.Disks[1].Partitions[0].Letter != "D" || got.Disks[0].Partitions[1].Size != 102400 {
+		t.Fatalf("custom layout = %+v", got)
+	}
+
+	for name, src := range map[string]string{
+		"lvm":         "{volumeGroups: [{name: vg0}]}",
+		"no C:":       "{partitions: [{mount: 'D:', size: 1, fstype: ntfs}]}",
+		"after grow":  "{partitions: [{mount: 'C:', grow: true, fstype: ntfs}, {size: 1, fstype: ntfs}]}",
+		"linux disk":  "{disks: [sda]}",
+		"xml label":   "{partitions: [{mount: 'C:', grow: true, fstype: ntfs, label: '<x>'}]}",
+		"fat32 on C:": "{partitions: [{mount: 'C:', grow: true, fstype: fat32}]}",
+	} {
+		if _, err := unattendStorage(map[string]any{"storage": parseYAML(t, src)}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRenderUnattendDiskConfiguration(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := e.Render("unattend.xml.tmpl", map[string]any{
+		"Machine": map[string]any{"ID": "m-1", "Serial": "S1"},
+		"APIBase": "http://api",
+		"Token":   "tok",
+		"Profile": map[string]any{"storage": map[string]any{"firmware": "bios"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<Active>true</Active>", "<PartitionID>2</PartitionID>\n          </InstallTo>"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("unattend lacks %q:\n%s", want, out)
+		}
+	}
+
+	if _, err := e.Render("kickstart.tmpl", map[string]any{
+		"Machine": map[string]any{"ID": "m-1"},
+		"Profile": map[string]any{"storage": map[string]any{"layout": "zfs"}},
+	}); err == nil || !strings.Contains(err.Error(), "unknown layout") {
+		t.Fatalf("expected the storage error from the render, got %v", err)
+	}
+}
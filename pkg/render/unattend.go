@@ -0,0 +1,348 @@
+package render
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// languageTag matches the language tags Windows Setup takes, such as en-US
+// or sr-Latn-RS.
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// unattendProfile is the profile's unattend section.
+//
+//	unattend:
+//	  locale: de-DE
+//	  timezone: W. Europe Standard Time
+//	  administratorPassword: {secretRef: lab-a/windows-admin}
+//	  image: {name: Windows 11 Pro}
+//	  firstLogonCommands:
+//	    - command: powershell.exe -File C:\Scripts\install-tools.ps1
+type unattendProfile struct {
+	// Locale sets every language and locale setting; the specific keys
+	// override it.
+	Locale                 string `yaml:"locale"`
+	UILanguage             string `yaml:"uiLanguage"`
+	InputLocale            string `yaml:"inputLocale"`
+	SystemLocale           string `yaml:"systemLocale"`
+	UserLocale             string `yaml:"userLocale"`
+	Timezone               string `yaml:"timezone"`
+	ComputerName           string `yaml:"computerName"`
+	ProductKey             string `yaml:"productKey"`
+	RegisteredOwner        string `yaml:"registeredOwner"`
+	RegisteredOrganization string `yaml:"registeredOrganization"`
+	AdministratorPassword  string `yaml:"administratorPassword"`
+	// AutoLogon logs the Administrator on once so the first logon commands
+	// run; it defaults to true when an administrator password is set.
+	AutoLogon *bool `yaml:"autoLogon"`
+	Image     struct {
+		Index int    `yaml:"index"`
+		Name  string `yaml:"name"`
+		// Path is the install.wim to apply; Setup's own by default.
+		Path string `yaml:"path"`
+	} `yaml:"image"`
+	FirstLogonCommands []struct {
+		Command     string `yaml:"command"`
+		Description string `yaml:"description"`
+	} `yaml:"firstLogonCommands"`
+}
+
+// domainJoin is postInstall.joinDomain when it is a map rather than false.
+type domainJoin struct {
+	Domain   string `yaml:"domain"`
+	OU       string `yaml:"ou"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// CredentialDomain is the account's domain when it differs from Domain.
+	CredentialDomain string `yaml:"credentialDomain"`
+}
+
+// Unattend is the profile mapped onto the Unattend settings the template
+// renders. Passwords are already encoded as Windows Setup expects.
+type Unattend struct {
+	UILanguage   string
+	InputLocale  string
+	SystemLocale string
+	UserLocale   string
+	TimeZone     string
+
+	ComputerName           string
+	ProductKey             string
+	RegisteredOwner        string
+	RegisteredOrganization string
+
+	// AdministratorPassword and AutoLogonPassword are empty when no
+	// administrator password is set.
+	AdministratorPassword string
+	AutoLogonPassword     string
+
+	// ImageKey is /IMAGE/INDEX or /IMAGE/NAME, or empty for Setup's default.
+	ImageKey   string
+	ImageValue string
+	ImagePath  string
+
+	// DriverPaths are searched for drivers in WinPE before the image is
+	// applied; each is a local or UNC path.
+	DriverPaths []WindowsValue
+
+	// FirstLogonCommands are numbered from 2: order 1 is the goosed agent
+	// provisioning script.
+	FirstLogonCommands []WindowsCommand
+
+	Join *WindowsJoin
+}
+
+type WindowsCommand struct {
+	Order       int
+	CommandLine string
+	Description string
+}
+
+// WindowsJoin is the Microsoft-Windows-UnattendedJoin domain join.
+type WindowsJoin struct {
+	Domain           string
+	OU               string
+	CredentialDomain string
+	Username         string
+	Password         string
+}
+
+// ParseUnattend maps a profile onto Unattend settings. It reads the unattend
+// section, drivers, postInstall.joinDomain and hostname, and accepts the
+// older top-level computer_name and product_key keys. serial names the
+// computer when nothing else does.
+func ParseUnattend(profile map[string]any, serial string) (*Unattend, error) {
+	var p unattendProfile
+	if err := decodeStrict(profile["unattend"], &p); err != nil {
+		return nil, fmt.Errorf("unattend: %w", err)
+	}
+	u, err := p.settings(profile, serial)
+	if err != nil {
+		return nil, fmt.Errorf("unattend: %w", err)
+	}
+	return u, nil
+}
+
+func (p *unattendProfile) settings(profile map[string]any, serial string) (*Unattend, error) {
+	var err error
+	locale := firstNonEmpty(p.Locale, "en-US")
+	u := &Unattend{
+		UILanguage:             firstNonEmpty(p.UILanguage, locale),
+		InputLocale:            firstNonEmpty(p.InputLocale, locale),
+		SystemLocale:           firstNonEmpty(p.SystemLocale, locale),
+		UserLocale:             firstNonEmpty(p.UserLocale, locale),
+		TimeZone:               firstNonEmpty(p.Timezone, "UTC"),
+		ProductKey:             firstNonEmpty(p.ProductKey, stringAt(profile, "product_key")),
+		RegisteredOwner:        firstNonEmpty(p.RegisteredOwner, "goosed"),
+		RegisteredOrganization: strings.TrimSpace(p.RegisteredOrganization),
+	}
+	for _, l := range []struct{ key, value string }{
+		{"uiLanguage", u.UILanguage}, {"systemLocale", u.SystemLocale}, {"userLocale", u.UserLocale},
+	} {
+		if !languageTag.MatchString(l.value) {
+			return nil, fmt.Errorf("%s %q is not a language tag such as en-US", l.key, l.value)
+		}
+	}
+	// InputLocale may also be a keyboard layout, such as 0409:00000409.
+	if strings.ContainsAny(u.InputLocale, "<>&\"") {
+		return nil, fmt.Errorf("inputLocale %q contains XML markup characters", u.InputLocale)
+	}
+	if strings.Contains(u.TimeZone, "/") {
+		return nil, fmt.Errorf("timezone %q is an IANA name; use a Windows time zone ID such as W. Europe Standard Time", u.TimeZone)
+	}
+
+	if name := firstNonEmpty(p.ComputerName, stringAt(profile, "computer_name"), stringAt(profile, "hostname")); name != "" {
+		if u.ComputerName, err = computerName(name); err != nil {
+			return nil, err
+		}
+	} else if u.ComputerName, err = computerName(serial); err != nil {
+		// Serials are often longer than a computer name; let Setup pick one.
+		u.ComputerName = "*"
+	}
+
+	if pw := p.AdministratorPassword; pw != "" {
+		u.AdministratorPassword = setupPassword(pw, "AdministratorPassword")
+		if p.AutoLogon == nil || *p.AutoLogon {
+			u.AutoLogonPassword = setupPassword(pw, "Password")
+		}
+	} else if p.AutoLogon != nil && *p.AutoLogon {
+		return nil, errors.New("autoLogon needs administratorPassword")
+	}
+
+	switch img := p.Image; {
+	case img.Index != 0 && img.Name != "":
+		return nil, errors.New("image takes an index or a name, not both")
+	case img.Index < 0:
+		return nil, fmt.Errorf("image.index %d must be 1 or more", img.Index)
+	case img.Index > 0:
+		u.ImageKey, u.ImageValue = "/IMAGE/INDEX", fmt.Sprint(img.Index)
+	case img.Name != "":
+		u.ImageKey, u.ImageValue = "/IMAGE/NAME", strings.TrimSpace(img.Name)
+	}
+	u.ImagePath = strings.TrimSpace(p.Image.Path)
+
+	for i, c := range p.FirstLogonCommands {
+		cmd := strings.TrimSpace(c.Command)
+		if cmd == "" {
+			return nil, fmt.Errorf("firstLogonCommands[%d].command is required", i)
+		}
+		u.FirstLogonCommands = append(u.FirstLogonCommands, WindowsCommand{
+			Order:       i + 2,
+			CommandLine: cmd,
+			Description: firstNonEmpty(c.Description, fmt.Sprintf("Profile command %d", i+1)),
+		})
+	}
+
+	drivers, err := driverPaths(profile["drivers"])
+	if err != nil {
+		return nil, err
+	}
+	for i, path := range drivers {
+		u.DriverPaths = append(u.DriverPaths, WindowsValue{Key: i + 1, Value: path})
+	}
+
+	join, err := parseJoin(profile)
+	if err != nil {
+		return nil, err
+	}
+	u.Join = join
+	return u, nil
+}
+
+// computerName derives the NetBIOS computer name from a hostname or serial:
+// the first DNS label, at most 15 characters.
+func computerName(s string) (string, error) {
+	name, _, _ := strings.Cut(strings.TrimSpace(s), ".")
+	if name == "" {
+		return "*", nil
+	}
+	if len(name) > 15 {
+		return "", fmt.Errorf("computer name %q is longer than 15 characters; set unattend.computerName", name)
+	}
+	for _, r := range name {
+		if !(r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return "", fmt.Errorf("computer name %q may only contain letters, digits and hyphens", name)
+		}
+	}
+	return name, nil
+}
+
+// driverPaths flattens drivers, either a list of paths or a map of lists
+// by category (storage, network, ...), into distinct directories. A path to
+// an .inf file is reduced to its directory, which is what WinPE searches.
+func driverPaths(v any) ([]string, error) {
+	var lists [][]string
+	switch d := v.(type) {
+	case nil:
+	case []any:
+		var list []string
+		if err := decodeStrict(d, &list); err != nil {
+			return nil, fmt.Errorf("drivers: %w", err)
+		}
+		lists = append(lists, list)
+	case map[string]any:
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			var list []string
+			if err := decodeStrict(d[k], &list); err != nil {
+				return nil, fmt.Errorf("drivers.%s: %w", k, err)
+			}
+			lists = append(lists, list)
+		}
+	default:
+		return nil, errors.New("drivers must be a list of paths or a map of lists")
+	}
+
+	var out []string
+	for _, list := range lists {
+		for _, p := range list {
+			p = strings.TrimSpace(p)
+			if strings.HasSuffix(strings.ToLower(p), ".inf") {
+				i := strings.LastIndex(p, `\`)
+				if i <= 0 {
+					return nil, fmt.Errorf("drivers: %q is not a path to a driver directory or .inf file", p)
+				}
+				p = p[:i]
+			}
+			if p == "" {
+				continue
+			}
+			if !slices.Contains(out, p) {
+				out = append(out, p)
+			}
+		}
+	}
+	return out, nil
+}
+
+// parseJoin reads postInstall.joinDomain: false (or absent) for none, or
+// the domain, OU and join account.
+func parseJoin(profile map[string]any) (*WindowsJoin, error) {
+	v, _ := dig("postInstall", "joinDomain", nil, profile)
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if v {
+			return nil, errors.New("postInstall.joinDomain: true needs the domain, username and password; set it to a map")
+		}
+		return nil, nil
+	}
+	var j domainJoin
+	if err := decodeStrict(v, &j); err != nil {
+		return nil, fmt.Errorf("postInstall.joinDomain: %w", err)
+	}
+	if j.Domain == "" || j.Username == "" || j.Password == "" {
+		return nil, errors.New("postInstall.joinDomain needs domain, username and password")
+	}
+	return &WindowsJoin{
+		Domain:           j.Domain,
+		OU:               j.OU,
+		CredentialDomain: firstNonEmpty(j.CredentialDomain, j.Domain),
+		Username:         j.Username,
+		Password:         j.Password,
+	}, nil
+}
+
+// setupPassword encodes a password the way Windows Setup stores it with
+// PlainText false: base64 of the UTF-16LE password followed by the name of
+// the element that holds it.
+func setupPassword(password, element string) string {
+	units := utf16.Encode([]rune(password + element))
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(buf[2*i:], u)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func stringAt(profile map[string]any, key string) string {
+	s, _ := profile[key].(string)
+	return s
+}
+
+// unattend backs unattend.xml.tmpl: {{ $u := unattend .Profile .Machine.Serial }}.
+func unattend(profile, serial any) (*Unattend, error) {
+	m, _ := profile.(map[string]any)
+	s, _ := serial.(string)
+	return ParseUnattend(m, s)
+}
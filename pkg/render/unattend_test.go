@@ -0,0 +1,120 @@
+package render
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestParseUnattend(t *testing.T) {
+	u, err := ParseUnattend(map[string]any{
+		"hostname": "win01.lab.local",
+		"unattend": parseYAML(t, `
+locale: de-DE
+inputLocale: 0407:00000407
+timezone: W. Europe Standard Time
+administratorPassword: secret
+image: {index: 6}
+firstLogonCommands:
+  - {command: 'cmd /c echo a > C:\a.txt', description: Write a}
+`),
+		"drivers": parseYAML(t, `
+storage: ['\\srv\drivers\lsi\drv.inf', '\\srv\drivers\lsi\other.inf']
+network: ['\\srv\drivers\intel']
+`),
+		"postInstall": parseYAML(t, "{joinDomain: {domain: corp.example, ou: 'OU=Lab,DC=corp,DC=example', username: join, password: pw}}"),
+	}, "SERIAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.UILanguage != "de-DE" || u.UserLocale != "de-DE" || u.InputLocale != "0407:00000407" || u.TimeZone != "W. Europe Standard Time" {
+		t.Fatalf("locale = %+v", u)
+	}
+	if u.ComputerName != "win01" {
+		t.Fatalf("computer name = %q", u.ComputerName)
+	}
+	// The documented example: "Password" + "AdministratorPassword".
+	if got := setupPassword("Password", "AdministratorPassword"); got != "UABhAHMAcwB3AG8AcgBkAEEAZABtAGkAbgBpAHMAdAByAGEAdABvAHIAUABhAHMAcwB3AG8AcgBkAA==" {
+		t.Fatalf("setupPassword = %s", got)
+	}
+	if u.AdministratorPassword == "" || u.AutoLogonPassword == "" {
+		t.Fatal("administrator password or autologon missing")
+	}
+	if u.ImageKey != "/IMAGE/INDEX" || u.ImageValue != "6" {
+		t.Fatalf("image = %s %s", u.ImageKey, u.ImageValue)
+	}
+	if len(u.DriverPaths) != 2 || u.DriverPaths[0].Value != `\\srv\drivers\intel` || u.DriverPaths[1].Value != `\\srv\drivers\lsi` {
+		t.Fatalf("drivers = %+v", u.DriverPaths)
+	}
+	if len(u.FirstLogonCommands) != 1 || u.FirstLogonCommands[0].Order != 2 {
+		t.Fatalf("commands = %+v", u.FirstLogonCommands)
+	}
+	if u.Join == nil || u.Join.CredentialDomain != "corp.example" || u.Join.OU == "" {
+		t.Fatalf("join = %+v", u.Join)
+	}
+
+	u, err = ParseUnattend(map[string]any{}, "A-VERY-LONG-SERIAL-NUMBER")
+	if err != nil || u.ComputerName != "*" || u.TimeZone != "UTC" || u.RegisteredOwner != "goosed" || u.Join != nil {
+		t.Fatalf("defaults = %+v, %v", u, err)
+	}
+}
+
+func TestUnattendValidation(t *testing.T) {
+	cases := map[string]map[string]any{
+		"unknown key":      {"unattend": map[string]any{"timeZone": "UTC"}},
+		"iana timezone":    {"unattend": map[string]any{"timezone": "Europe/Berlin"}},
+		"bad locale":       {"unattend": map[string]any{"locale": "english"}},
+		"long name":        {"hostname": "a-very-long-windows-hostname.lab"},
+		"index and name":   {"unattend": map[string]any{"image": map[string]any{"index": 1, "name": "Pro"}}},
+		"empty command":    {"unattend": map[string]any{"firstLogonCommands": []any{map[string]any{"description": "x"}}}},
+		"autologon no pw":  {"unattend": map[string]any{"autoLogon": true}},
+		"join true":        {"postInstall": map[string]any{"joinDomain": true}},
+		"join no password": {"postInstall": map[string]any{"joinDomain": map[string]any{"domain": "corp", "username": "join"}}},
+		"bare inf":         {"drivers": []any{"drv.inf"}},
+	}
+	for name, profile := range cases {
+		if _, err := ParseUnattend(profile, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.HasPrefix(err.Error(), "unattend: ") {
+			t.Errorf("%s: error %q lacks the unattend prefix", name, err)
+		}
+	}
+}
+
+func TestRenderUnattendProfile(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := e.Render("unattend.xml.tmpl", map[string]any{
+		"Machine": map[string]any{"ID": "m-1", "Serial": "S1"},
+		"APIBase": "http://api.goose.local",
+		"Token":   "t",
+		"Profile": map[string]any{
+			"unattend": map[string]any{
+				"image":              map[string]any{"name": "Windows 11 Pro"},
+				"firstLogonCommands": []any{map[string]any{"command": `cmd /c "a & b"`}},
+			},
+			"drivers":     []any{`D:\drivers`},
+			"postInstall": map[string]any{"joinDomain": map[string]any{"domain": "corp", "username": "join", "password": "p<w>"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<Key>/IMAGE/NAME</Key>",
+		"<Path>D:\\drivers</Path>",
+		"<JoinDomain>corp</JoinDomain>",
+		"<Password>p&lt;w&gt;</Password>",
+		"<CommandLine>cmd /c &#34;a &amp; b&#34;</CommandLine>",
+		"<ComputerName>S1</ComputerName>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("unattend lacks %q:\n%s", want, out)
+		}
+	}
+	if err := xml.Unmarshal([]byte(out), new(struct{})); err != nil {
+		t.Fatalf("unattend is not well-formed XML: %v", err)
+	}
+}
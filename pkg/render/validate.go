@@ -0,0 +1,317 @@
+package render
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one defect found in a rendered install config.
+type Problem struct {
+	// Line is 1-based, or 0 when the problem concerns the whole document.
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// ValidationError lists the problems found in the output of a template.
+type ValidationError struct {
+	Template string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return fmt.Sprintf("validate %s: %s", e.Template, strings.Join(msgs, "; "))
+}
+
+// Validate checks the output of the named template, as Render does before
+// returning it. Every output is checked for the <no value> text/template
+// prints for a missing key. Kickstart is checked for known commands,
+// balanced sections and the commands an unattended install needs; Unattend
+// for well-formed XML in the known passes and components. The other install
+// configs are checked to parse as XML, JSON or YAML.
+func Validate(name, output string) error {
+	problems := noValueProblems(output)
+	switch base := path.Base(name); {
+	case base == "kickstart.tmpl":
+		problems = append(problems, kickstartProblems(output)...)
+	case base == "unattend.xml.tmpl":
+		problems = append(problems, unattendProblems(output)...)
+	case strings.HasSuffix(base, ".xml.tmpl"):
+		problems = append(problems, xmlProblems(output)...)
+	case strings.HasSuffix(base, ".json.tmpl"):
+		if !json.Valid([]byte(output)) {
+			problems = append(problems, Problem{Message: "not valid JSON"})
+		}
+	case strings.HasPrefix(base, "cloud-init.") || strings.HasPrefix(base, "autoinstall."):
+		var v any
+		if err := yaml.Unmarshal([]byte(output), &v); err != nil {
+			problems = append(problems, Problem{Message: fmt.Sprintf("not valid YAML: %v", err)})
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	// Report in document order, whole-document problems last.
+	slices.SortStableFunc(problems, func(a, b Problem) int {
+		return cmp.Compare(sortLine(a), sortLine(b))
+	})
+	return &ValidationError{Template: name, Problems: problems}
+}
+
+func sortLine(p Problem) int {
+	if p.Line == 0 {
+		return math.MaxInt
+	}
+	return p.Line
+}
+
+// noValueProblems finds the lines where a template printed a missing value.
+func noValueProblems(output string) []Problem {
+	var problems []Problem
+	for i, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, "<no value>") {
+			problems = append(problems, Problem{Line: i + 1, Message: "unresolved value (<no value>)"})
+		}
+	}
+	return problems
+}
+
+// kickstartCommands are the commands current Anaconda accepts. Removed
+// commands such as install and auth are reported as unknown.
+var kickstartCommands = map[string]bool{
+	"authselect": true, "autopart": true, "bootloader": true, "btrfs": true,
+	"cdrom": true, "clearpart": true, "cmdline": true, "driverdisk": true,
+	"eula": true, "fcoe": true, "firewall": true, "firstboot": true,
+	"graphical": true, "group": true, "halt": true, "harddrive": true,
+	"hmc": true, "ignoredisk": true, "iscsi": true, "iscsiname": true,
+	"keyboard": true, "lang": true, "liveimg": true, "logging": true,
+	"logvol": true, "mediacheck": true, "module": true, "mount": true,
+	"network": true, "nfs": true, "nvdimm": true, "ostreecontainer": true,
+	"ostreesetup": true, "part": true, "partition": true, "poweroff": true,
+	"raid": true, "realm": true, "reboot": true, "repo": true,
+	"reqpart": true, "rescue": true, "rhsm": true, "rootpw": true,
+	"selinux": true, "services": true, "shutdown": true, "skipx": true,
+	"snapshot": true, "sshkey": true, "sshpw": true, "syspurpose": true,
+	"text": true, "timesource": true, "timezone": true, "updates": true,
+	"url": true, "user": true, "vnc": true, "volgroup": true,
+	"xconfig": true, "zerombr": true, "zfcp": true, "zipl": true,
+	"%include": true, "%ksappend": true,
+}
+
+// kickstartSections open a section that runs to the next %end.
+var kickstartSections = map[string]bool{
+	"%pre": true, "%pre-install": true, "%post": true, "%packages": true,
+	"%onerror": true, "%addon": true, "%anaconda": true, "%traceback": true,
+}
+
+// kickstartPartitioning are the commands that lay out the disks; an
+// unattended install needs one of them.
+var kickstartPartitioning = []string{"autopart", "part", "partition", "mount", "raid", "logvol", "volgroup", "btrfs"}
+
+func kickstartProblems(output string) []Problem {
+	var (
+		problems []Problem
+		seen     = map[string]bool{}
+		section  string
+		opened   int
+	)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		word, _, _ := strings.Cut(line, " ")
+		word, _, _ = strings.Cut(word, "\t")
+		switch {
+		case word == "%end":
+			if section == "" {
+				problems = append(problems, Problem{Line: n, Message: "%end without an open section"})
+			}
+			section = ""
+		case kickstartSections[word]:
+			if section != "" {
+				problems = append(problems, Problem{Line: n, Message: fmt.Sprintf("%s inside %s; close it with %%end first", word, section)})
+			}
+			section, opened = word, n
+			seen[word] = true
+		case section != "":
+			// Section bodies are shell scripts or package lists.
+		case kickstartCommands[word]:
+			seen[word] = true
+		default:
+			problems = append(problems, Problem{Line: n, Message: fmt.Sprintf("unknown command %q", word)})
+		}
+	}
+	if section != "" {
+		problems = append(problems, Problem{Line: opened, Message: fmt.Sprintf("%s is not closed by %%end", section)})
+	}
+
+	// A %include may supply anything, typically partitioning written by %pre.
+	if seen["%include"] {
+		return problems
+	}
+	for _, cmd := range []string{"lang", "keyboard", "timezone"} {
+		if !seen[cmd] {
+			problems = append(problems, Problem{Message: fmt.Sprintf("missing required command %s", cmd)})
+		}
+	}
+	partitioned := false
+	for _, cmd := range kickstartPartitioning {
+		partitioned = partitioned || seen[cmd]
+	}
+	if !partitioned {
+		problems = append(problems, Problem{Message: "no partitioning; add autopart or part directives"})
+	}
+	return problems
+}
+
+const unattendNamespace = "urn:schemas-microsoft-com:unattend"
+
+// unattendPasses are the configuration passes of Windows Setup.
+var unattendPasses = map[string]bool{
+	"windowsPE": true, "offlineServicing": true, "generalize": true,
+	"specialize": true, "auditSystem": true, "auditUser": true,
+	"oobeSystem": true,
+}
+
+// unattendComponents lists the passes each well-known component may be
+// configured in. Components not listed here are not checked.
+var unattendComponents = map[string][]string{
+	"Microsoft-Windows-International-Core-WinPE":                  {"windowsPE"},
+	"Microsoft-Windows-Setup":                                     {"windowsPE"},
+	"Microsoft-Windows-PnpCustomizationsWinPE":                    {"windowsPE"},
+	"Microsoft-Windows-PnpCustomizationsNonWinPE":                 {"offlineServicing", "auditSystem"},
+	"Microsoft-Windows-International-Core":                        {"specialize", "oobeSystem"},
+	"Microsoft-Windows-Shell-Setup":                               {"offlineServicing", "generalize", "specialize", "auditSystem", "auditUser", "oobeSystem"},
+	"Microsoft-Windows-TCPIP":                                     {"windowsPE", "specialize"},
+	"Microsoft-Windows-DNS-Client":                                {"windowsPE", "specialize"},
+	"Microsoft-Windows-UnattendedJoin":                            {"specialize"},
+	"Microsoft-Windows-Deployment":                                {"generalize", "specialize", "auditSystem", "auditUser", "oobeSystem"},
+	"Microsoft-Windows-Security-SPP":                              {"generalize", "specialize"},
+	"Microsoft-Windows-Security-SPP-UX":                           {"specialize"},
+	"Microsoft-Windows-TerminalServices-LocalSessionManager":      {"offlineServicing", "specialize"},
+	"Microsoft-Windows-TerminalServices-RDP-WinStationExtensions": {"specialize"},
+	"Microsoft-Windows-LUA-Settings":                              {"offlineServicing"},
+}
+
+func unattendProblems(output string) []Problem {
+	var problems []Problem
+	d := xml.NewDecoder(strings.NewReader(output))
+	var (
+		stack      []string
+		pass       string
+		passes     = map[string]bool{}
+		components = map[string]bool{}
+		root       bool
+	)
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		line, _ := d.InputPos()
+		if err != nil {
+			return append(problems, Problem{Line: line, Message: fmt.Sprintf("malformed XML: %v", err)})
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch len(stack) {
+			case 0:
+				root = true
+				if t.Name.Local != "unattend" || t.Name.Space != unattendNamespace {
+					problems = append(problems, Problem{Line: line, Message: fmt.Sprintf("root element is %s, want unattend in %s", t.Name.Local, unattendNamespace)})
+				}
+			case 1:
+				if t.Name.Local != "settings" {
+					break
+				}
+				pass = attr(t, "pass")
+				switch {
+				case !unattendPasses[pass]:
+					problems = append(problems, Problem{Line: line, Message: fmt.Sprintf("unknown pass %q", pass)})
+				case passes[pass]:
+					problems = append(problems, Problem{Line: line, Message: fmt.Sprintf("pass %s is configured twice", pass)})
+				}
+				passes[pass] = true
+			case 2:
+				if stack[1] != "settings" {
+					break
+				}
+				if t.Name.Local != "component" {
+					problems = append(problems, Problem{Line: line, Message: fmt.Sprintf("<%s> in pass %s; settings hold components", t.Name.Local, pass)})
+					break
+				}
+				name, arch := attr(t, "name"), attr(t, "processorArchitecture")
+				if name == "" || arch == "" {
+					problems = append(problems, Problem{Line: line, Message: "component needs name and processorArchitecture"})
+					break
+				}
+				if allowed, ok := unattendComponents[name]; ok && unattendPasses[pass] && !slices.Contains(allowed, pass) {
+					problems = append(problems, Problem{Line: line, Message: fmt.Sprintf("%s cannot be configured in pass %s (only %s)", name, pass, strings.Join(allowed, ", "))})
+				}
+				key := pass + "/" + name + "/" + arch
+				if components[key] {
+					problems = append(problems, Problem{Line: line, Message: fmt.Sprintf("%s appears twice in pass %s", name, pass)})
+				}
+				components[key] = true
+			}
+			stack = append(stack, t.Name.Local)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if !root {
+		return append(problems, Problem{Message: "empty document"})
+	}
+	if len(passes) == 0 {
+		problems = append(problems, Problem{Message: "no settings passes"})
+	}
+	return problems
+}
+
+// xmlProblems reports the first well-formedness error in output.
+func xmlProblems(output string) []Problem {
+	d := xml.NewDecoder(strings.NewReader(output))
+	for {
+		_, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			line, _ := d.InputPos()
+			return []Problem{{Line: line, Message: fmt.Sprintf("malformed XML: %v", err)}}
+		}
+	}
+}
+
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
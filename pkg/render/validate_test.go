@@ -0,0 +1,113 @@
+package render
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateKickstart(t *testing.T) {
+	valid := "lang en_US.UTF-8\nkeyboard us\ntimezone UTC --isUtc\nautopart\n\n%packages --ignoremissing\n@^minimal\n%end\n\n%post\nnetwrok is shell here\n%end\n"
+	if err := Validate("kickstart.tmpl", valid); err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate("kickstart.tmpl", "%include /tmp/part.ks\n%pre\necho\n%end\n"); err != nil {
+		t.Fatalf("%%include should stand in for required commands: %v", err)
+	}
+
+	cases := map[string]struct {
+		src  string
+		want Problem
+	}{
+		"unknown command": {"netwrok --bootproto=dhcp\n" + valid, Problem{Line: 1, Message: `unknown command "netwrok"`}},
+		"unclosed":        {valid + "%pre\necho\n", Problem{Line: 13, Message: "%pre is not closed by %end"}},
+		"nested":          {"%post\n%packages\n%end\n" + valid, Problem{Line: 2, Message: "%packages inside %post; close it with %end first"}},
+		"stray end":       {"%end\n" + valid, Problem{Line: 1, Message: "%end without an open section"}},
+		"no timezone":     {strings.Replace(valid, "timezone UTC --isUtc\n", "", 1), Problem{Message: "missing required command timezone"}},
+		"no partitioning": {strings.Replace(valid, "autopart\n", "", 1), Problem{Message: "no partitioning; add autopart or part directives"}},
+		"no value":        {valid + "# host <no value>\n", Problem{Line: 13, Message: "unresolved value (<no value>)"}},
+	}
+	for name, tc := range cases {
+		err := Validate("kickstart.tmpl", tc.src)
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			t.Errorf("%s: got %v, want a ValidationError", name, err)
+			continue
+		}
+		if len(verr.Problems) != 1 || verr.Problems[0] != tc.want {
+			t.Errorf("%s: problems = %+v, want %+v", name, verr.Problems, tc.want)
+		}
+	}
+}
+
+func TestValidateUnattend(t *testing.T) {
+	const head = `<?xml version="1.0" encoding="utf-8"?>
+<unattend xmlns="urn:schemas-microsoft-com:unattend">
+`
+	valid := head + `  <settings pass="windowsPE">
+    <component name="Microsoft-Windows-Setup" processorArchitecture="amd64"/>
+  </settings>
+  <settings pass="oobeSystem">
+    <component name="Microsoft-Windows-Shell-Setup" processorArchitecture="amd64"/>
+    <component name="Contoso-Custom" processorArchitecture="amd64"/>
+  </settings>
+</unattend>
+`
+	if err := Validate("unattend.xml.tmpl", valid); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		src  string
+		want string
+	}{
+		"malformed":      {strings.Replace(valid, "</settings>", "", 1), "line 10: malformed XML"},
+		"unknown pass":   {strings.Replace(valid, "oobeSystem", "oobe", 1), `line 6: unknown pass "oobe"`},
+		"duplicate pass": {strings.Replace(valid, "oobeSystem", "windowsPE", 1), "line 6: pass windowsPE is configured twice"},
+		"wrong pass":     {strings.Replace(valid, "Microsoft-Windows-Shell-Setup", "Microsoft-Windows-Setup", 1), "line 7: Microsoft-Windows-Setup cannot be configured in pass oobeSystem"},
+		"no arch":        {strings.Replace(valid, `"Contoso-Custom" processorArchitecture="amd64"`, `"Contoso-Custom"`, 1), "line 8: component needs name and processorArchitecture"},
+		"root":           {strings.Replace(valid, "urn:schemas-microsoft-com:unattend", "urn:other", 1), "line 2: root element is unattend"},
+		"no passes":      {head + "</unattend>\n", "no settings passes"},
+	}
+	for name, tc := range cases {
+		err := Validate("unattend.xml.tmpl", tc.src)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestValidateOtherFormats(t *testing.T) {
+	cases := []struct {
+		name, output string
+		ok           bool
+	}{
+		{"ignition.json.tmpl", `{"ignition": {"version": "3.4.0"}}`, true},
+		{"ignition.json.tmpl", `{"ignition": `, false},
+		{"autoyast.xml.tmpl", `<profile><general></profile>`, false},
+		{"cloud-init.user-data.tmpl", "#cloud-config\nhostname: [n1\n", false},
+		{"autoinstall.user-data.tmpl", "#cloud-config\nautoinstall:\n  version: 1\n", true},
+		{"ipxe.tmpl", "#!ipxe\nkernel http://api/v1/boot/kernel?token=<no value>\n", false},
+	}
+	for _, tc := range cases {
+		if err := Validate(tc.name, tc.output); (err == nil) != tc.ok {
+			t.Errorf("%s %q: got %v", tc.name, tc.output, err)
+		}
+	}
+}
+
+func TestRenderValidates(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Render("kickstart.tmpl", map[string]any{
+		"Machine": map[string]any{"ID": "m-1"},
+		"Profile": map[string]any{},
+		"APIBase": "http://api",
+	})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || !strings.Contains(err.Error(), "<no value>") {
+		t.Fatalf("expected the missing token to fail validation, got %v", err)
+	}
+}
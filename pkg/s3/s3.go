@@ -115,6 +115,47 @@ func (c *Client) PutObject(ctx context.Context, bucket, key string, r io.Reader,
 	return err
 }
 
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size int64
+	ETag string
+}
+
+// GetObject opens the object at bucket/key for reading. The caller must close the returned reader.
+func (c *Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, ObjectInfo, error) {
+	if c == nil {
+		return nil, ObjectInfo{}, errors.New("nil client")
+	}
+
+	out, err := c.api.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, mapNotFound(err)
+	}
+	return out.Body, ObjectInfo{Size: aws.ToInt64(out.ContentLength), ETag: aws.ToString(out.ETag)}, nil
+}
+
+// HeadObject returns the size and ETag of the object at bucket/key without fetching it.
+func (c *Client) HeadObject(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	if c == nil {
+		return ObjectInfo{}, errors.New("nil client")
+	}
+
+	out, err := c.api.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return ObjectInfo{}, mapNotFound(err)
+	}
+	return ObjectInfo{Size: aws.ToInt64(out.ContentLength), ETag: aws.ToString(out.ETag)}, nil
+}
+
 // PresignGet generates a presigned GET URL for the provided key and TTL.
 func (c *Client) PresignGet(ctx context.Context, bucket, key string, ttl time.Duration) (string, error) {
 	if c == nil {
@@ -163,3 +204,12 @@ func encodeSHA256(hexDigest string) (string, error) {
 	}
 	return base64.StdEncoding.EncodeToString(raw), nil
 }
+
+func mapNotFound(err error) error {
+	var noSuchKey *s3types.NoSuchKey
+	var notFound *s3types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,325 @@
+package schema
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"goosed/pkg/render"
+)
+
+// Blueprint is infra/blueprints/<ref>/blueprint.yaml: the OS a machine is
+// installed with and the profile values shared by every machine using it.
+type Blueprint struct {
+	Header `yaml:",inline"`
+	Spec   BlueprintSpec `yaml:"spec"`
+}
+
+// BlueprintSpec is the spec of a Blueprint. Besides the fields below it
+// holds profile values, such as kickstart or unattend, that templates read.
+type BlueprintSpec struct {
+	Description string            `yaml:"description,omitempty"`
+	OS          OS                `yaml:"os"`
+	Artifacts   map[string]string `yaml:"artifacts,omitempty"`
+	Packages    Packages          `yaml:"packages,omitempty"`
+	Repos       map[string]string `yaml:"repos,omitempty"`
+	// Profile holds the remaining keys.
+	Profile map[string]any `yaml:",inline"`
+}
+
+// OS selects the installer and its install format.
+type OS struct {
+	Family  string `yaml:"family"`
+	Version string `yaml:"version,omitempty"`
+	// Architecture defaults to x86_64.
+	Architecture string `yaml:"architecture,omitempty"`
+	// Format overrides the install format chosen by Family.
+	Format string `yaml:"format,omitempty"`
+}
+
+// Packages lists package groups (written with a leading @) and packages.
+type Packages struct {
+	Groups []string `yaml:"groups,omitempty"`
+	Extra  []string `yaml:"extra,omitempty"`
+}
+
+// Architectures are the values OS.Architecture accepts.
+var Architectures = []string{"x86_64", "aarch64", "ppc64le", "s390x"}
+
+func (b *Blueprint) Default() {
+	if b.Spec.OS.Architecture == "" {
+		b.Spec.OS.Architecture = "x86_64"
+	}
+}
+
+func (b *Blueprint) Validate() []Problem {
+	v := b.Header.validate()
+	spec := b.Spec
+	if spec.OS.Family == "" {
+		v = append(v, required("spec.os.family"))
+	} else if _, err := render.FormatFor(map[string]any{"os": map[string]any{"family": spec.OS.Family, "format": spec.OS.Format}}); err != nil {
+		path := "spec.os.family"
+		if spec.OS.Format != "" {
+			path = "spec.os.format"
+		}
+		v = append(v, Problem{Path: path, Message: strings.TrimPrefix(err.Error(), strings.TrimPrefix(path, "spec.")+" ")})
+	}
+	if !slices.Contains(Architectures, spec.OS.Architecture) {
+		v = append(v, Problem{Path: "spec.os.architecture", Message: fmt.Sprintf("%q is not one of %s", spec.OS.Architecture, strings.Join(Architectures, ", "))})
+	}
+	for _, name := range sortedKeys(spec.Artifacts) {
+		if p := spec.Artifacts[name]; !fs.ValidPath(p) || p == "." {
+			v = append(v, Problem{Path: "spec.artifacts." + name, Message: fmt.Sprintf("%q is not a relative artifact path", p)})
+		}
+	}
+	for i, g := range spec.Packages.Groups {
+		if !strings.HasPrefix(g, "@") {
+			v = append(v, Problem{Path: fmt.Sprintf("spec.packages.groups[%d]", i), Message: fmt.Sprintf("group %q must start with @", g)})
+		}
+	}
+	for i, p := range spec.Packages.Extra {
+		if p == "" || strings.HasPrefix(p, "@") {
+			v = append(v, Problem{Path: fmt.Sprintf("spec.packages.extra[%d]", i), Message: fmt.Sprintf("%q is not a package name; list groups under groups", p)})
+		}
+	}
+	for _, name := range sortedKeys(spec.Repos) {
+		if u, err := url.Parse(spec.Repos[name]); err != nil || u.Scheme == "" || u.Host == "" && u.Scheme != "file" {
+			v = append(v, Problem{Path: "spec.repos." + name, Message: fmt.Sprintf("%q is not a repository URL", spec.Repos[name])})
+		}
+	}
+	return v
+}
+
+// Workflow is infra/workflows/<name>.yaml: the steps the orchestrator runs
+// to provision a machine.
+type Workflow struct {
+	Header `yaml:",inline"`
+	Spec   WorkflowSpec `yaml:"spec"`
+}
+
+// WorkflowSpec is the spec of a Workflow.
+type WorkflowSpec struct {
+	Description string `yaml:"description,omitempty"`
+	Steps       []Step `yaml:"steps"`
+}
+
+// Step is one action of a workflow and its arguments.
+type Step struct {
+	// Name defaults to the action and must be unique within the workflow.
+	Name   string         `yaml:"name,omitempty"`
+	Action string         `yaml:"action"`
+	With   map[string]any `yaml:"with,omitempty"`
+}
+
+// Workflow step actions.
+const (
+	ActionDownloadArtifacts = "download-artifacts"
+	ActionRenderTemplate    = "render-template"
+	ActionAwaitAgent        = "await-agent"
+)
+
+// DefaultAgentTimeout is how long an await-agent step waits by default.
+const DefaultAgentTimeout = "30m"
+
+var actions = []string{ActionAwaitAgent, ActionDownloadArtifacts, ActionRenderTemplate}
+
+func (w *Workflow) Default() {
+	for i := range w.Spec.Steps {
+		s := &w.Spec.Steps[i]
+		if s.Name == "" {
+			s.Name = s.Action
+		}
+		if s.Action == ActionAwaitAgent {
+			if s.With == nil {
+				s.With = map[string]any{}
+			}
+			if _, ok := s.With["timeout"]; !ok {
+				s.With["timeout"] = DefaultAgentTimeout
+			}
+		}
+	}
+}
+
+func (w *Workflow) Validate() []Problem {
+	v := w.Header.validate()
+	if len(w.Spec.Steps) == 0 {
+		v = append(v, Problem{Path: "spec.steps", Message: "a workflow needs at least one step"})
+	}
+	seen := map[string]int{}
+	for i, s := range w.Spec.Steps {
+		path := fmt.Sprintf("spec.steps[%d]", i)
+		if j, ok := seen[s.Name]; ok && s.Name != "" {
+			v = append(v, Problem{Path: path + ".name", Message: fmt.Sprintf("%q is already the name of step %d", s.Name, j)})
+		}
+		seen[s.Name] = i
+
+		switch s.Action {
+		case "":
+			v = append(v, required(path+".action"))
+		case ActionDownloadArtifacts:
+			if len(s.With) == 0 {
+				v = append(v, Problem{Path: path + ".with", Message: "list the artifacts to download"})
+			}
+			for _, name := range sortedKeys(s.With) {
+				if p, ok := s.With[name].(string); !ok || !fs.ValidPath(p) || p == "." {
+					v = append(v, Problem{Path: path + ".with." + name, Message: "must be a relative artifact path"})
+				}
+			}
+		case ActionRenderTemplate:
+			if t, _ := s.With["template"].(string); !strings.HasSuffix(t, ".tmpl") {
+				v = append(v, Problem{Path: path + ".with.template", Message: "must name a template, such as kickstart.tmpl"})
+			}
+		case ActionAwaitAgent:
+			if d, err := time.ParseDuration(fmt.Sprint(s.With["timeout"])); err != nil || d <= 0 {
+				v = append(v, Problem{Path: path + ".with.timeout", Message: fmt.Sprintf("%v is not a duration such as 15m", s.With["timeout"])})
+			}
+		default:
+			v = append(v, Problem{Path: path + ".action", Message: fmt.Sprintf("unknown action %q; want %s", s.Action, strings.Join(actions, ", "))})
+		}
+	}
+	return v
+}
+
+// MachineProfile is a file under infra/machine-profiles: one machine, the
+// blueprint and workflow it is provisioned with, and its own profile values.
+type MachineProfile struct {
+	Header `yaml:",inline"`
+	Spec   MachineProfileSpec `yaml:"spec"`
+}
+
+// MachineProfileSpec is the spec of a MachineProfile.
+type MachineProfileSpec struct {
+	Machine Machine `yaml:"machine"`
+	// Blueprint is a reference under infra/blueprints, such as rocky/9/base.
+	Blueprint string `yaml:"blueprint,omitempty"`
+	// Workflow is the metadata.name of a Workflow.
+	Workflow string         `yaml:"workflow,omitempty"`
+	Profile  map[string]any `yaml:"profile,omitempty"`
+}
+
+// Machine identifies the hardware a MachineProfile is for.
+type Machine struct {
+	// MAC is normalised to lower case with colons.
+	MAC      string `yaml:"mac"`
+	Serial   string `yaml:"serial,omitempty"`
+	AssetTag string `yaml:"assetTag,omitempty"`
+}
+
+func (m *MachineProfile) Default() {
+	if hw, err := net.ParseMAC(strings.TrimSpace(m.Spec.Machine.MAC)); err == nil {
+		m.Spec.Machine.MAC = hw.String()
+	}
+}
+
+func (m *MachineProfile) Validate() []Problem {
+	v := m.Header.validate()
+	if m.Spec.Machine.MAC == "" {
+		v = append(v, required("spec.machine.mac"))
+	} else if hw, err := net.ParseMAC(m.Spec.Machine.MAC); err != nil || len(hw) != 6 {
+		v = append(v, Problem{Path: "spec.machine.mac", Message: fmt.Sprintf("%q is not a MAC address", m.Spec.Machine.MAC)})
+	}
+	if ref := m.Spec.Blueprint; ref != "" && !ValidBlueprintRef(ref) {
+		v = append(v, Problem{Path: "spec.blueprint", Message: fmt.Sprintf("%q is not a blueprint reference such as rocky/9/base", ref)})
+	}
+	if name := m.Spec.Workflow; name != "" && !validName(name) {
+		v = append(v, Problem{Path: "spec.workflow", Message: fmt.Sprintf("%q is not a workflow name", name)})
+	}
+	return v
+}
+
+// ProfileOverlay is a file under infra/overlays: profile values applied to
+// every machine profile whose labels match its selector.
+type ProfileOverlay struct {
+	Header `yaml:",inline"`
+	Spec   ProfileOverlaySpec `yaml:"spec"`
+}
+
+// ProfileOverlaySpec is the spec of a ProfileOverlay. An empty selector
+// matches every machine profile.
+type ProfileOverlaySpec struct {
+	Selector map[string]string `yaml:"selector,omitempty"`
+	Profile  map[string]any    `yaml:"profile"`
+}
+
+func (o *ProfileOverlay) Default() {}
+
+func (o *ProfileOverlay) Validate() []Problem {
+	v := o.Header.validate()
+	if len(o.Spec.Profile) == 0 {
+		v = append(v, required("spec.profile"))
+	}
+	for _, k := range sortedKeys(o.Spec.Selector) {
+		if !validLabelKey(k) {
+			v = append(v, Problem{Path: "spec.selector", Message: fmt.Sprintf("%q is not a label key", k)})
+		}
+	}
+	return v
+}
+
+// ValidBlueprintRef reports whether ref is a relative path under
+// infra/blueprints, such as rocky/9/base.
+func ValidBlueprintRef(ref string) bool {
+	return fs.ValidPath(ref) && ref != "."
+}
+
+var (
+	nameRE     = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+	labelKeyRE = regexp.MustCompile(`^([a-z0-9]([a-z0-9.-]*[a-z0-9])?/)?[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+)
+
+// validName accepts lower-case DNS-style names such as ubuntu-24.04-base.
+func validName(name string) bool {
+	return len(name) <= 253 && nameRE.MatchString(name)
+}
+
+// validLabelKey accepts keys such as site or goosed.io/os-family.
+func validLabelKey(key string) bool {
+	return len(key) <= 317 && labelKeyRE.MatchString(key)
+}
+
+func (h *Header) validate() []Problem {
+	var v []Problem
+	switch h.APIVersion {
+	case APIVersion:
+	case "":
+		v = append(v, required("apiVersion"))
+	default:
+		v = append(v, Problem{Path: "apiVersion", Message: fmt.Sprintf("%q is not supported; want %s", h.APIVersion, APIVersion)})
+	}
+	switch h.Kind {
+	case KindBlueprint, KindWorkflow, KindMachineProfile, KindProfileOverlay:
+	case "":
+		v = append(v, required("kind"))
+	default:
+		v = append(v, Problem{Path: "kind", Message: fmt.Sprintf("unknown kind %q", h.Kind)})
+	}
+	if h.Metadata.Name == "" {
+		v = append(v, required("metadata.name"))
+	} else if !validName(h.Metadata.Name) {
+		v = append(v, Problem{Path: "metadata.name", Message: fmt.Sprintf("%q must be lower-case letters, digits, '-' and '.'", h.Metadata.Name)})
+	}
+	for _, k := range sortedKeys(h.Metadata.Labels) {
+		if !validLabelKey(k) {
+			v = append(v, Problem{Path: "metadata.labels", Message: fmt.Sprintf("%q is not a label key", k)})
+		}
+	}
+	return v
+}
+
+func required(path string) Problem {
+	return Problem{Path: path, Message: "is required"}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,239 @@
+// Package schema defines the goosed.io/v1alpha1 documents kept under infra/:
+// Blueprint, Workflow, MachineProfile and ProfileOverlay. Parse decodes a
+// file into its typed object, fills in defaults and validates it, reporting
+// every problem with the line it was found on.
+package schema
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIVersion is the only apiVersion documents may declare.
+const APIVersion = "goosed.io/v1alpha1"
+
+// Kinds of infra/ documents.
+const (
+	KindBlueprint      = "Blueprint"
+	KindWorkflow       = "Workflow"
+	KindMachineProfile = "MachineProfile"
+	KindProfileOverlay = "ProfileOverlay"
+)
+
+// Header is the apiVersion, kind and metadata every document starts with.
+type Header struct {
+	APIVersion string     `yaml:"apiVersion"`
+	Kind       string     `yaml:"kind"`
+	Metadata   ObjectMeta `yaml:"metadata"`
+}
+
+// ObjectMeta names a document and labels it.
+type ObjectMeta struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// ObjectHeader returns the document's header.
+func (h *Header) ObjectHeader() *Header { return h }
+
+// Object is one of the typed documents.
+type Object interface {
+	ObjectHeader() *Header
+	// Default fills in the values a document may leave out.
+	Default()
+	// Validate returns the problems with the document, with paths but no
+	// lines. Call it after Default.
+	Validate() []Problem
+}
+
+// Problem is one defect in a document.
+type Problem struct {
+	// Line is 1-based, or 0 when the problem concerns the whole file.
+	Line int
+	// Path is the dotted path of the offending field, such as
+	// spec.steps[1].action, or empty for syntax errors.
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	msg := p.Message
+	if p.Path != "" {
+		msg = p.Path + ": " + msg
+	}
+	if p.Line == 0 {
+		return msg
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, msg)
+}
+
+// Error lists the problems found in one file.
+type Error struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = e.File
+		if p.Line > 0 {
+			msgs[i] += ":" + strconv.Itoa(p.Line)
+		}
+		msgs[i] += ": " + Problem{Path: p.Path, Message: p.Message}.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Document is a parsed file and the object it holds.
+type Document struct {
+	File   string
+	Object Object
+	root   *yaml.Node
+}
+
+// Kind returns the kind of the document's object.
+func (d *Document) Kind() string { return d.Object.ObjectHeader().Kind }
+
+// Name returns the metadata.name of the document's object.
+func (d *Document) Name() string { return d.Object.ObjectHeader().Metadata.Name }
+
+// Line returns the line of the field at path, or of its closest parent that
+// is present, so a problem with a missing field points at its parent.
+func (d *Document) Line(path string) int {
+	return lineOf(d.root, path)
+}
+
+// Problem returns an *Error for a problem found outside the document, such
+// as a reference to a blueprint that does not exist.
+func (d *Document) Problem(path, format string, args ...any) *Error {
+	return &Error{File: d.File, Problems: []Problem{{Line: d.Line(path), Path: path, Message: fmt.Sprintf(format, args...)}}}
+}
+
+// Parse decodes data, the content of file, into the typed object its kind
+// names, applies defaults and validates it. Unknown fields are rejected,
+// except in the free-form profile values of blueprints, machine profiles and
+// overlays. Problems are returned as an *Error.
+func Parse(file string, data []byte) (*Document, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, &Error{File: file, Problems: yamlProblems(err)}
+	}
+	if len(root.Content) == 0 {
+		return nil, &Error{File: file, Problems: []Problem{{Message: "empty document"}}}
+	}
+	doc := &Document{File: file, root: root.Content[0]}
+	if doc.root.Kind != yaml.MappingNode {
+		return nil, &Error{File: file, Problems: []Problem{{Line: doc.root.Line, Message: "document is not a mapping"}}}
+	}
+
+	var header Header
+	if err := doc.root.Decode(&header); err != nil {
+		return nil, &Error{File: file, Problems: yamlProblems(err)}
+	}
+	if problems := header.validate(); len(problems) > 0 {
+		return nil, doc.errorFor(problems)
+	}
+	switch header.Kind {
+	case KindBlueprint:
+		doc.Object = &Blueprint{}
+	case KindWorkflow:
+		doc.Object = &Workflow{}
+	case KindMachineProfile:
+		doc.Object = &MachineProfile{}
+	case KindProfileOverlay:
+		doc.Object = &ProfileOverlay{}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(doc.Object); err != nil {
+		return nil, &Error{File: file, Problems: yamlProblems(err)}
+	}
+	var extra yaml.Node
+	if err := dec.Decode(&extra); !errors.Is(err, io.EOF) {
+		return nil, &Error{File: file, Problems: []Problem{{Line: extra.Line, Message: "only one document per file is read"}}}
+	}
+
+	doc.Object.Default()
+	if problems := doc.Object.Validate(); len(problems) > 0 {
+		return nil, doc.errorFor(problems)
+	}
+	return doc, nil
+}
+
+func (d *Document) errorFor(problems []Problem) *Error {
+	for i := range problems {
+		problems[i].Line = d.Line(problems[i].Path)
+	}
+	return &Error{File: d.File, Problems: problems}
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlProblems turns the errors of yaml.v3, which carry the line in their
+// text, into problems.
+func yamlProblems(err error) []Problem {
+	msgs := []string{err.Error()}
+	var terr *yaml.TypeError
+	if errors.As(err, &terr) {
+		msgs = terr.Errors
+	}
+	problems := make([]Problem, 0, len(msgs))
+	for _, msg := range msgs {
+		m := yamlLine.FindStringSubmatch(msg)
+		if m == nil {
+			problems = append(problems, Problem{Message: strings.TrimPrefix(msg, "yaml: ")})
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+		problems = append(problems, Problem{Line: line, Message: m[2]})
+	}
+	return problems
+}
+
+// lineOf walks path, such as spec.steps[1].with, from node and returns the
+// line of the deepest node it reaches.
+func lineOf(node *yaml.Node, path string) int {
+	if node == nil {
+		return 0
+	}
+	line := node.Line
+	if path == "" {
+		return line
+	}
+	for _, seg := range strings.Split(strings.ReplaceAll(path, "[", ".["), ".") {
+		if seg == "" {
+			continue
+		}
+		var next *yaml.Node
+		if strings.HasPrefix(seg, "[") {
+			i, err := strconv.Atoi(strings.Trim(seg, "[]"))
+			if err == nil && node.Kind == yaml.SequenceNode && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		} else if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == seg {
+					// Point at the key, which is where the field starts.
+					next = node.Content[i+1]
+					line = node.Content[i].Line
+					break
+				}
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
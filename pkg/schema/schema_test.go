@@ -0,0 +1,186 @@
+package schema
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInfra(t *testing.T) {
+	files, err := filepath.Glob("../../infra/*/*/*/*/blueprint.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pattern := range []string{"workflows/*.yaml", "machine-profiles/*/*/*.yaml", "overlays/*.yaml"} {
+		more, err := filepath.Glob("../../infra/" + pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, more...)
+	}
+	if len(files) < 10 {
+		t.Fatalf("found only %d infra/ documents", len(files))
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(f, data); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	doc, err := Parse("bp.yaml", []byte(`
+apiVersion: goosed.io/v1alpha1
+kind: Blueprint
+metadata: {name: rocky-9}
+spec:
+  os: {family: rocky, version: 9}
+  kickstart: {lang: en_US.UTF-8}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp := doc.Object.(*Blueprint)
+	if bp.Spec.OS.Architecture != "x86_64" || bp.Spec.OS.Version != "9" {
+		t.Fatalf("os = %+v", bp.Spec.OS)
+	}
+	if !reflect.DeepEqual(bp.Spec.Profile, map[string]any{"kickstart": map[string]any{"lang": "en_US.UTF-8"}}) {
+		t.Fatalf("profile = %v", bp.Spec.Profile)
+	}
+
+	doc, err = Parse("wf.yaml", []byte(`
+apiVersion: goosed.io/v1alpha1
+kind: Workflow
+metadata: {name: wf}
+spec:
+  steps:
+    - action: await-agent
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := doc.Object.(*Workflow).Spec.Steps[0]
+	if step.Name != ActionAwaitAgent || step.With["timeout"] != DefaultAgentTimeout {
+		t.Fatalf("step = %+v", step)
+	}
+
+	doc, err = Parse("mp.yaml", []byte(`
+apiVersion: goosed.io/v1alpha1
+kind: MachineProfile
+metadata: {name: n1}
+spec:
+  machine: {mac: "00-11-22-AA-BB-CC"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac := doc.Object.(*MachineProfile).Spec.Machine.MAC; mac != "00:11:22:aa:bb:cc" {
+		t.Fatalf("mac = %q", mac)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]struct {
+		src  string
+		want []Problem
+	}{
+		"syntax": {
+			"apiVersion: goosed.io/v1alpha1\nkind: Workflow\nmetadata: name: wf\n",
+			[]Problem{{Line: 3, Message: "mapping values are not allowed in this context"}},
+		},
+		"empty": {"# nothing yet\n", []Problem{{Message: "empty document"}}},
+		"header": {
+			"apiVersion: goosed.io/v1\nkind: Machine\nmetadata:\n  name: Node_1\n",
+			[]Problem{
+				{Line: 1, Path: "apiVersion", Message: `"goosed.io/v1" is not supported; want goosed.io/v1alpha1`},
+				{Line: 2, Path: "kind", Message: `unknown kind "Machine"`},
+				{Line: 4, Path: "metadata.name", Message: `"Node_1" must be lower-case letters, digits, '-' and '.'`},
+			},
+		},
+		"unknown field": {
+			"apiVersion: goosed.io/v1alpha1\nkind: Workflow\nmetadata: {name: wf}\nspec:\n  steps:\n    - action: await-agent\n      timeout: 5m\n",
+			[]Problem{{Line: 7, Message: "field timeout not found in type schema.Step"}},
+		},
+		"wrong type": {
+			"apiVersion: goosed.io/v1alpha1\nkind: Blueprint\nmetadata: {name: bp}\nspec:\n  os: rocky\n",
+			[]Problem{{Line: 5, Message: "cannot unmarshal !!str `rocky` into schema.OS"}},
+		},
+		"workflow": {
+			`apiVersion: goosed.io/v1alpha1
+kind: Workflow
+metadata: {name: wf}
+spec:
+  steps:
+    - name: render
+      action: render-template
+      with: {template: kickstart}
+    - name: render
+      action: reboot
+    - action: await-agent
+      with: {timeout: soon}
+`,
+			[]Problem{
+				{Line: 8, Path: "spec.steps[0].with.template", Message: "must name a template, such as kickstart.tmpl"},
+				{Line: 9, Path: "spec.steps[1].name", Message: `"render" is already the name of step 0`},
+				{Line: 10, Path: "spec.steps[1].action", Message: `unknown action "reboot"; want await-agent, download-artifacts, render-template`},
+				{Line: 12, Path: "spec.steps[2].with.timeout", Message: "soon is not a duration such as 15m"},
+			},
+		},
+		"blueprint": {
+			`apiVersion: goosed.io/v1alpha1
+kind: Blueprint
+metadata: {name: bp}
+spec:
+  os: {family: plan9, architecture: i386}
+  packages:
+    groups: [minimal]
+  repos: {os: mirror/os}
+`,
+			[]Problem{
+				{Line: 5, Path: "spec.os.family", Message: `"plan9" has no install format; set os.format`},
+				{Line: 5, Path: "spec.os.architecture", Message: `"i386" is not one of x86_64, aarch64, ppc64le, s390x`},
+				{Line: 7, Path: "spec.packages.groups[0]", Message: `group "minimal" must start with @`},
+				{Line: 8, Path: "spec.repos.os", Message: `"mirror/os" is not a repository URL`},
+			},
+		},
+		"machine profile": {
+			"apiVersion: goosed.io/v1alpha1\nkind: MachineProfile\nmetadata: {name: n1}\nspec:\n  blueprint: ../rocky\n",
+			[]Problem{
+				{Line: 4, Path: "spec.machine.mac", Message: "is required"},
+				{Line: 5, Path: "spec.blueprint", Message: `"../rocky" is not a blueprint reference such as rocky/9/base`},
+			},
+		},
+	}
+	for name, tc := range cases {
+		_, err := Parse("f.yaml", []byte(tc.src))
+		var serr *Error
+		if !errors.As(err, &serr) {
+			t.Errorf("%s: got %v, want an *Error", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(serr.Problems, tc.want) {
+			t.Errorf("%s: problems =\n%+v\nwant\n%+v", name, serr.Problems, tc.want)
+		}
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	err := &Error{File: "workflows/wf.yaml", Problems: []Problem{
+		{Line: 10, Path: "spec.steps[1].action", Message: "is required"},
+		{Message: "empty document"},
+	}}
+	want := "workflows/wf.yaml:10: spec.steps[1].action: is required; workflows/wf.yaml: empty document"
+	if got := err.Error(); got != want {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+	if !strings.Contains(Problem{Line: 3, Path: "kind", Message: "is required"}.String(), "line 3: kind: is required") {
+		t.Fatal("Problem.String lacks the line")
+	}
+}
@@ -1,6 +1,9 @@
 package api
 
 import (
+	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,3 +18,28 @@ type Artifact struct {
 	Meta      map[string]any `json:"meta" db:"meta"`
 	CreatedAt time.Time      `json:"created_at" db:"created_at"`
 }
+
+// Boot loader artifact kinds. They are stored under
+// tftp/<distro>/<version>/<file> rather than by ID so pxe-stack's S3 TFTP
+// backend can serve the Secure Boot chain as uploaded: shim loads grubx64.efi
+// from its own directory, and each release's signed GRUB only boots that
+// release's kernels.
+const (
+	ArtifactKindShim = "shim"
+	ArtifactKindGRUB = "grub"
+)
+
+// isBootLoaderKind reports whether kind is stored under tftp/.
+func isBootLoaderKind(kind string) bool {
+	return kind == ArtifactKindShim || kind == ArtifactKindGRUB
+}
+
+// bootLoaderKey derives the S3 key of a boot loader from its bundle path,
+// which must end in <distro>/<version>/<file>.efi.
+func bootLoaderKey(p string) (string, error) {
+	parts := strings.Split(strings.Trim(path.Clean("/"+strings.TrimSpace(p)), "/"), "/")
+	if len(parts) < 3 || !strings.HasSuffix(strings.ToLower(parts[len(parts)-1]), ".efi") {
+		return "", fmt.Errorf("meta.path %q must end in <distro>/<version>/<file>.efi", p)
+	}
+	return "tftp/" + strings.Join(parts[len(parts)-3:], "/"), nil
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"goosed/infra/branding"
+	"goosed/pkg/render"
+)
+
+// Boot intents a machine may be offered in the bootd menu.
+const (
+	IntentInstall = "install"
+	IntentLocal   = "local"
+	IntentRescue  = "rescue"
+	IntentMemtest = "memtest"
+)
+
+var knownIntents = map[string]bool{
+	IntentInstall: true,
+	IntentLocal:   true,
+	IntentRescue:  true,
+	IntentMemtest: true,
+}
+
+// bootIntent is the template data shared by the iPXE, pxelinux and GRUB boot
+// configs.
+type bootIntent struct {
+	MAC     string
+	Token   string
+	APIBase string
+	// Label names the machine in menus: its profile hostname, else its MAC.
+	Label      string
+	KernelURL  string
+	InitrdURL  string
+	KernelArgs string
+	// Format is the install format the profile renders, such as kickstart
+	// or autoinstall.
+	Format string
+	// UnattendURL is where WinPE fetches a Windows machine's Unattend with
+	// its single-use unattend token. Empty for other formats.
+	UnattendURL string
+	// GRUBKernel and GRUBInitrd are the URLs in GRUB's (http,host)/path form.
+	GRUBKernel string
+	GRUBInitrd string
+	// GRUBKernelArgs is KernelArgs with the semicolons GRUB would read as
+	// command separators escaped.
+	GRUBKernelArgs string
+	Branding       branding.Branding
+	// TimeoutTenths is the menu timeout in the tenths of a second pxelinux
+	// expects.
+	TimeoutTenths int
+	Machine       Machine
+	Profile       map[string]any
+}
+
+// errRescueFormat rejects a rescue boot for a format whose installer has no
+// rescue mode goosed knows how to start.
+var errRescueFormat = errors.New("rescue boots need boot.rescueArgs for this install format")
+
+// newBootIntent builds the template data for kind, which is IntentInstall or
+// IntentRescue; rescue boots the same kernel with profile.boot.rescueArgs.
+// configToken is the single-use token the installer redeems for the install
+// config of format. The installer's network comes from profile.network as
+// kernel arguments in the syntax of the format's initramfs, so it can reach
+// the API before the install config configures the installed system.
+func newBootIntent(machine Machine, kind, format, token, configToken, apiBase string, brand branding.Branding) (bootIntent, error) {
+	base := strings.TrimRight(apiBase, "/")
+	intent := bootIntent{
+		MAC:           machine.MAC,
+		Token:         token,
+		APIBase:       base,
+		Label:         machine.MAC,
+		KernelURL:     base + "/v1/boot/kernel?token=" + url.QueryEscape(token),
+		InitrdURL:     base + "/v1/boot/initrd?token=" + url.QueryEscape(token),
+		Format:        format,
+		Branding:      brand,
+		TimeoutTenths: brand.TimeoutSeconds * 10,
+		Machine:       machine,
+		Profile:       machine.Profile,
+	}
+	if hostname, ok := machine.Profile["hostname"].(string); ok && hostname != "" {
+		intent.Label = hostname
+	}
+
+	network, err := render.InstallerNetworkArgs(machine.Profile, format)
+	if err != nil {
+		return bootIntent{}, err
+	}
+	argsKey := "kernelArgs"
+	if kind == IntentRescue {
+		argsKey = "rescueArgs"
+	}
+	if args, ok := bootProfile(machine.Profile)[argsKey].(string); ok && strings.TrimSpace(args) != "" {
+		intent.KernelArgs = strings.TrimSpace(args)
+	} else if kind == IntentRescue {
+		if format != render.FormatKickstart {
+			return bootIntent{}, errRescueFormat
+		}
+		intent.KernelArgs = joinArgs(network, "inst.rescue")
+	} else {
+		intent.KernelArgs = joinArgs(network, installerArgs(machine.Profile, format, base, configToken))
+	}
+
+	if format == render.FormatUnattend && configToken != "" {
+		intent.UnattendURL = base + "/v1/render/unattend?token=" + url.QueryEscape(configToken)
+	}
+	intent.GRUBKernel = grubURL(intent.KernelURL)
+	intent.GRUBInitrd = grubURL(intent.InitrdURL)
+	intent.GRUBKernelArgs = strings.ReplaceAll(intent.KernelArgs, ";", `\;`)
+	return intent, nil
+}
+
+// installerArgs points the installer of format at its install config.
+// profile.install.url, when set, is where the installer loads its own image
+// or repository from. Windows installs from WinPE, which fetches its
+// Unattend from UnattendURL instead, so it takes none.
+func installerArgs(profile map[string]any, format, base, configToken string) string {
+	install, _ := profile["install"].(map[string]any)
+	source, _ := install["url"].(string)
+	token := url.QueryEscape(configToken)
+	switch format {
+	case render.FormatKickstart:
+		return fmt.Sprintf("inst.ks=%s/v1/render/kickstart?token=%s", base, token)
+	case render.FormatCloudInit:
+		return fmt.Sprintf("ds=nocloud-net;s=%s/v1/render/cloud-init/%s/", base, token)
+	case render.FormatAutoinstall:
+		args := fmt.Sprintf("autoinstall ds=nocloud-net;s=%s/v1/render/autoinstall/%s/", base, token)
+		if source != "" {
+			args += " url=" + source
+		}
+		return args
+	case render.FormatAutoYaST:
+		args := fmt.Sprintf("autoyast=%s/v1/render/autoyast?token=%s", base, token)
+		if source != "" {
+			args += " install=" + source
+		}
+		return args
+	case render.FormatIgnition:
+		device, _ := install["device"].(string)
+		if device == "" {
+			device = "/dev/sda"
+		}
+		args := fmt.Sprintf("coreos.inst.install_dev=%s coreos.inst.ignition_url=%s/v1/render/ignition?token=%s", device, base, token)
+		if source != "" {
+			args += " coreos.live.rootfs_url=" + source
+		}
+		return args
+	}
+	return ""
+}
+
+func joinArgs(args ...string) string {
+	var out []string
+	for _, a := range args {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, a)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// grubURL rewrites http://host/path?query as (http,host)/path?query. GRUB has
+// no TLS support, so https URLs are left as they are and will fail to load.
+func grubURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "http" {
+		return raw
+	}
+	return fmt.Sprintf("(http,%s)%s", u.Host, u.RequestURI())
+}
+
+// bootProfile returns profile.boot, or nil when it is unset.
+func bootProfile(profile map[string]any) map[string]any {
+	boot, _ := profile["boot"].(map[string]any)
+	return boot
+}
+
+// allowedIntents returns the intents profile.boot.intents permits, in menu
+// order, and the default from profile.boot.defaultIntent. Machines without a
+// list may install or boot from local disk. An unknown or disallowed default
+// falls back to the first allowed intent.
+func allowedIntents(profile map[string]any) ([]string, string) {
+	boot := bootProfile(profile)
+
+	var intents []string
+	seen := make(map[string]bool)
+	if list, ok := boot["intents"].([]any); ok {
+		for _, v := range list {
+			name, _ := v.(string)
+			name = strings.ToLower(strings.TrimSpace(name))
+			if knownIntents[name] && !seen[name] {
+				seen[name] = true
+				intents = append(intents, name)
+			}
+		}
+	}
+	if len(intents) == 0 {
+		intents = []string{IntentInstall, IntentLocal}
+		seen[IntentInstall], seen[IntentLocal] = true, true
+	}
+
+	def := intents[0]
+	if name, ok := boot["defaultIntent"].(string); ok && seen[strings.ToLower(name)] {
+		def = strings.ToLower(name)
+	}
+	return intents, def
+}
@@ -53,6 +53,14 @@ func (a *API) handleArtifacts(w http.ResponseWriter, r *http.Request) {
 
 	artifactID := uuid.New()
 	key := fmt.Sprintf("artifacts/%s/%s", req.Kind, artifactID)
+	if isBootLoaderKind(req.Kind) {
+		name, _ := req.Meta["path"].(string)
+		var err error
+		if key, err = bootLoaderKey(name); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Errorf("%s artifact: %w", req.Kind, err))
+			return
+		}
+	}
 	location := fmt.Sprintf("s3://%s/%s", a.config.ArtifactBucket, key)
 	now := time.Now().UTC()
 
@@ -1,16 +1,40 @@
 package api
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 
-	"github.com/google/uuid"
+	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
+
+	"goosed/pkg/render"
 )
 
 func (a *API) handleIPXE(w http.ResponseWriter, r *http.Request) {
+	a.renderBootConfig(w, r, "ipxe.tmpl")
+}
+
+// handlePXELinux renders a pxelinux menu for legacy BIOS clients. Fetching
+// the kernel over HTTP needs lpxelinux.0; the menu also offers a chain into
+// iPXE via ipxe.lkrn.
+func (a *API) handlePXELinux(w http.ResponseWriter, r *http.Request) {
+	a.renderBootConfig(w, r, "pxelinux.tmpl")
+}
+
+// handleGRUB renders grub.cfg-01-<mac> for UEFI clients that boot GRUB2, such
+// as the Secure Boot shim path.
+func (a *API) handleGRUB(w http.ResponseWriter, r *http.Request) {
+	a.renderBootConfig(w, r, "grub.cfg.tmpl")
+}
+
+// renderBootConfig renders one of the boot loader templates from the shared
+// boot intent, so iPXE, pxelinux and GRUB clients boot the same kernel,
+// initrd and arguments.
+func (a *API) renderBootConfig(w http.ResponseWriter, r *http.Request, tmpl string) {
 	mac := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("mac")))
 	if mac == "" {
 		respondError(w, http.StatusBadRequest, errors.New("mac query parameter is required"))
@@ -27,139 +51,365 @@ func (a *API) handleIPXE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, ok, err := a.tokens.Active(r.Context(), machine.MAC)
+	machine, err = a.withEffectiveProfile(machine)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if !ok {
-		token, err = a.tokens.Issue(r.Context(), machine.MAC)
+
+	kind := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("intent")))
+	if kind == "" {
+		kind = IntentInstall
+	}
+	if kind != IntentInstall && kind != IntentRescue {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("intent %q cannot be rendered; want install or rescue", kind))
+		return
+	}
+	if allowed, _ := allowedIntents(machine.Profile); !slices.Contains(allowed, kind) {
+		respondError(w, http.StatusForbidden, fmt.Errorf("intent %s is not allowed for machine %s", kind, machine.MAC))
+		return
+	}
+
+	boundIP := ""
+	if a.config.BindTokensToIP {
+		boundIP = clientIP(r)
+	}
+	format, err := render.FormatFor(machine.Profile)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	token, err := a.activeToken(r, machine.MAC, TokenPurposeBoot, boundIP)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var configToken Token
+	if kind == IntentInstall && format != "" {
+		configToken, err = a.activeToken(r, machine.MAC, format, boundIP)
 		if err != nil {
 			respondError(w, http.StatusInternalServerError, err)
 			return
 		}
 	}
 
-	if err := a.tokens.MarkUsed(r.Context(), token.Value); err != nil {
+	intent, err := newBootIntent(machine, kind, format, token.Value, configToken.Value, a.apiBase(r), a.config.Branding)
+	if errors.Is(err, errRescueFormat) {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("%w (%s)", err, format))
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Boot configs are served to anyone who knows the MAC, so secretRefs in
+	// the profile stay unresolved.
+	rendered, err := a.renderer.RenderPublic(tmpl, intent)
+	if err != nil {
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	apiBase := a.config.APIBase
-	if apiBase == "" {
-		scheme := "http"
-		if r.TLS != nil {
-			scheme = "https"
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(rendered))
+}
+
+// handleBootKernel sends the boot loader to the kernel of the machine its
+// boot token was issued to. The token is only checked here: every boot
+// config loads the initrd after the kernel, and that request redeems it.
+func (a *API) handleBootKernel(w http.ResponseWriter, r *http.Request) {
+	a.bootArtifact(w, r, "kernel", a.tokens.Peek)
+}
+
+// handleBootInitrd sends the boot loader to the initrd and redeems the boot
+// token, so a leaked boot config cannot be replayed.
+func (a *API) handleBootInitrd(w http.ResponseWriter, r *http.Request) {
+	a.bootArtifact(w, r, "initrd", a.tokens.Redeem)
+}
+
+// bootArtifact checks the request's boot token with check and redirects to
+// profile.artifacts.<name>: an http(s) URL as is, or an artifact bucket key
+// through a presigned URL.
+func (a *API) bootArtifact(w http.ResponseWriter, r *http.Request, name string, check func(ctx context.Context, tokenValue, purpose, clientIP string) (Token, error)) {
+	token, err := check(r.Context(), r.URL.Query().Get("token"), TokenPurposeBoot, clientIP(r))
+	if err != nil {
+		respondTokenError(w, err)
+		return
+	}
+	machine, err := a.fetchMachineByMAC(r.Context(), token.MAC)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			respondError(w, http.StatusNotFound, fmt.Errorf("machine with mac %s not found", token.MAC))
+			return
+		}
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+	machine, err = a.withEffectiveProfile(machine)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	artifacts, _ := machine.Profile["artifacts"].(map[string]any)
+	location, _ := artifacts[name].(string)
+	location = strings.TrimSpace(location)
+	switch {
+	case location == "":
+		respondError(w, http.StatusNotFound, fmt.Errorf("machine %s has no artifacts.%s", machine.MAC, name))
+		return
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+	case a.store.S3 == nil:
+		respondError(w, http.StatusFailedDependency, errors.New("s3 client not configured"))
+		return
+	default:
+		ctx, cancel := withTimeout(r.Context())
+		defer cancel()
+		if location, err = a.store.S3.PresignGet(ctx, a.config.ArtifactBucket, strings.TrimPrefix(location, "/"), presignURLExpiry); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("presign get: %w", err))
+			return
 		}
-		apiBase = fmt.Sprintf("%s://%s", scheme, r.Host)
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// apiBase is the configured API base URL, or the one the request reached.
+func (a *API) apiBase(r *http.Request) string {
+	if a.config.APIBase != "" {
+		return a.config.APIBase
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// activeToken reuses the machine's unredeemed token for purpose and boundIP,
+// or issues one, so re-rendering a boot config does not pile up tokens.
+func (a *API) activeToken(r *http.Request, mac, purpose, boundIP string) (Token, error) {
+	token, ok, err := a.tokens.Active(r.Context(), mac, purpose, boundIP)
+	if err != nil || ok {
+		return token, err
+	}
+	return a.tokens.Issue(r.Context(), mac, purpose, boundIP)
+}
+
+// bootIntentsResponse lists the boot intents bootd offers a machine.
+type bootIntentsResponse struct {
+	MAC     string   `json:"mac"`
+	Label   string   `json:"label"`
+	Intents []string `json:"intents"`
+	Default string   `json:"default"`
+}
+
+// handleBootIntents tells bootd which menu entries to offer a machine and
+// which one boots when the countdown expires.
+func (a *API) handleBootIntents(w http.ResponseWriter, r *http.Request) {
+	mac := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("mac")))
+	if mac == "" {
+		respondError(w, http.StatusBadRequest, errors.New("mac query parameter is required"))
+		return
 	}
 
-	payload := map[string]any{
-		"Token":   token.Value,
-		"MAC":     machine.MAC,
-		"APIBase": apiBase,
+	machine, err := a.fetchMachineByMAC(r.Context(), mac)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			respondError(w, http.StatusNotFound, fmt.Errorf("machine with mac %s not found", mac))
+			return
+		}
+		respondError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	rendered, err := a.renderer.Render("ipxe.tmpl", payload)
+	machine, err = a.withEffectiveProfile(machine)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	_, _ = w.Write([]byte(rendered))
+	intents, def := allowedIntents(machine.Profile)
+	resp := bootIntentsResponse{MAC: machine.MAC, Label: machine.MAC, Intents: intents, Default: def}
+	if hostname, ok := machine.Profile["hostname"].(string); ok && hostname != "" {
+		resp.Label = hostname
+	}
+	respondJSON(w, http.StatusOK, resp)
 }
 
+// handleKickstart renders the kickstart for the machine a kickstart token was
+// issued to. The token is single-use, so a leaked inst.ks URL cannot be
+// replayed.
 func (a *API) handleKickstart(w http.ResponseWriter, r *http.Request) {
-	machineID, err := uuid.Parse(strings.TrimSpace(r.URL.Query().Get("machine_id")))
+	a.renderInstallConfig(w, r, render.FormatKickstart, "kickstart.tmpl", "text/plain")
+}
+
+// handleAutoYaST renders the AutoYaST control file named by the autoyast=
+// boot argument.
+func (a *API) handleAutoYaST(w http.ResponseWriter, r *http.Request) {
+	a.renderInstallConfig(w, r, render.FormatAutoYaST, "autoyast.xml.tmpl", "application/xml")
+}
+
+// handleIgnition renders the Ignition config coreos-installer writes to the
+// installed disk.
+func (a *API) handleIgnition(w http.ResponseWriter, r *http.Request) {
+	a.renderInstallConfig(w, r, render.FormatIgnition, "ignition.json.tmpl", "application/json")
+}
+
+// renderInstallConfig redeems the request's token for format and renders
+// tmpl for the machine it was issued to, with a fresh agent token.
+func (a *API) renderInstallConfig(w http.ResponseWriter, r *http.Request, format, tmpl, contentType string) {
+	redeemed, err := a.tokens.Redeem(r.Context(), r.URL.Query().Get("token"), format, clientIP(r))
 	if err != nil {
-		respondError(w, http.StatusBadRequest, errors.New("valid machine_id is required"))
+		respondTokenError(w, err)
 		return
 	}
+	a.renderForToken(w, r, redeemed, tmpl, contentType)
+}
 
-	machine, err := a.fetchMachineByID(r.Context(), machineID)
+// renderForToken renders tmpl for the machine token was issued to.
+func (a *API) renderForToken(w http.ResponseWriter, r *http.Request, token Token, tmpl, contentType string) {
+	machine, err := a.fetchMachineByMAC(r.Context(), token.MAC)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			respondError(w, http.StatusNotFound, fmt.Errorf("machine %s not found", machineID))
+			respondError(w, http.StatusNotFound, fmt.Errorf("machine with mac %s not found", token.MAC))
 			return
 		}
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if raw := strings.TrimSpace(r.URL.Query().Get("machine_id")); raw != "" && raw != machine.ID.String() {
+		respondError(w, http.StatusBadRequest, errors.New("machine_id does not match the token"))
+		return
+	}
 
-	issuedToken, err := a.tokens.Issue(r.Context(), machine.MAC)
+	machine, err = a.withEffectiveProfile(machine)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	apiBase := a.config.APIBase
-	if apiBase == "" {
-		scheme := "http"
-		if r.TLS != nil {
-			scheme = "https"
-		}
-		apiBase = fmt.Sprintf("%s://%s", scheme, r.Host)
+	issuedToken, err := a.tokens.Issue(r.Context(), machine.MAC, TokenPurposeAgent, "")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	rendered, err := a.renderer.Render("kickstart.tmpl", map[string]any{
+	rendered, err := a.renderer.Render(tmpl, map[string]any{
 		"Machine": machine,
 		"Profile": machine.Profile,
 		"Token":   issuedToken.Value,
-		"APIBase": apiBase,
+		"APIBase": a.apiBase(r),
 	})
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Type", contentType)
 	_, _ = w.Write([]byte(rendered))
 }
 
-func (a *API) handleUnattend(w http.ResponseWriter, r *http.Request) {
-	machineID, err := uuid.Parse(strings.TrimSpace(r.URL.Query().Get("machine_id")))
+// noCloudTemplates maps each NoCloud file cloud-init fetches from the s=
+// seed URL onto its template. vendor-data is served empty; a file missing
+// from the map is answered with 404.
+var noCloudTemplates = map[string]map[string]string{
+	render.FormatCloudInit: {
+		"user-data":      "cloud-init.user-data.tmpl",
+		"meta-data":      "cloud-init.meta-data.tmpl",
+		"vendor-data":    "",
+		"network-config": "cloud-init.network-config.tmpl",
+	},
+	// Subiquity's network comes from the boot arguments, so autoinstall has
+	// no network-config.
+	render.FormatAutoinstall: {
+		"user-data":   "autoinstall.user-data.tmpl",
+		"meta-data":   "cloud-init.meta-data.tmpl",
+		"vendor-data": "",
+	},
+}
+
+// handleCloudInit serves the NoCloud seed for the cloud-init format.
+func (a *API) handleCloudInit(w http.ResponseWriter, r *http.Request) {
+	a.renderNoCloud(w, r, render.FormatCloudInit)
+}
+
+// handleAutoinstall serves the NoCloud seed Subiquity reads its autoinstall
+// section from.
+func (a *API) handleAutoinstall(w http.ResponseWriter, r *http.Request) {
+	a.renderNoCloud(w, r, render.FormatAutoinstall)
+}
+
+// renderNoCloud serves one file of a NoCloud seed whose URL carries the
+// config token in its path. cloud-init fetches meta-data and the optional
+// files around user-data, so only user-data redeems the token; the others
+// check it without consuming it.
+func (a *API) renderNoCloud(w http.ResponseWriter, r *http.Request, format string) {
+	file := chi.URLParam(r, "file")
+	tmpl, ok := noCloudTemplates[format][file]
+	if !ok {
+		respondError(w, http.StatusNotFound, fmt.Errorf("%s has no NoCloud file %q", format, file))
+		return
+	}
+
+	if file == "user-data" {
+		token, err := a.tokens.Redeem(r.Context(), chi.URLParam(r, "token"), format, clientIP(r))
+		if err != nil {
+			respondTokenError(w, err)
+			return
+		}
+		a.renderForToken(w, r, token, tmpl, "text/plain")
+		return
+	}
+
+	token, err := a.tokens.Peek(r.Context(), chi.URLParam(r, "token"), format, clientIP(r))
 	if err != nil {
-		respondError(w, http.StatusBadRequest, errors.New("valid machine_id is required"))
+		respondTokenError(w, err)
+		return
+	}
+	if tmpl == "" {
+		w.Header().Set("Content-Type", "text/plain")
 		return
 	}
+	a.renderSeedFile(w, r, token, tmpl)
+}
 
-	machine, err := a.fetchMachineByID(r.Context(), machineID)
+// renderSeedFile renders a NoCloud file other than user-data. An empty
+// network-config is answered with 404 so cloud-init keeps its DHCP default.
+func (a *API) renderSeedFile(w http.ResponseWriter, r *http.Request, token Token, tmpl string) {
+	machine, err := a.fetchMachineByMAC(r.Context(), token.MAC)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			respondError(w, http.StatusNotFound, fmt.Errorf("machine %s not found", machineID))
+			respondError(w, http.StatusNotFound, fmt.Errorf("machine with mac %s not found", token.MAC))
 			return
 		}
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	issuedToken, err := a.tokens.Issue(r.Context(), machine.MAC)
+	machine, err = a.withEffectiveProfile(machine)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	apiBase := a.config.APIBase
-	if apiBase == "" {
-		scheme := "http"
-		if r.TLS != nil {
-			scheme = "https"
-		}
-		apiBase = fmt.Sprintf("%s://%s", scheme, r.Host)
-	}
-
-	rendered, err := a.renderer.Render("unattend.xml.tmpl", map[string]any{
+	rendered, err := a.renderer.Render(tmpl, map[string]any{
 		"Machine": machine,
 		"Profile": machine.Profile,
-		"Token":   issuedToken.Value,
-		"APIBase": apiBase,
 	})
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/xml")
+	if strings.TrimSpace(rendered) == "" {
+		respondError(w, http.StatusNotFound, errors.New("no network-config; the profile uses DHCP"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
 	_, _ = w.Write([]byte(rendered))
 }
+
+// handleUnattend renders the Unattend for the machine an unattend token was
+// issued to. It carries the domain join and local account passwords, so the
+// token is single-use like the kickstart token.
+func (a *API) handleUnattend(w http.ResponseWriter, r *http.Request) {
+	a.renderInstallConfig(w, r, render.FormatUnattend, "unattend.xml.tmpl", "application/xml")
+}
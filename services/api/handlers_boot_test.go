@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+
+	"goosed/pkg/profile"
+	"goosed/pkg/render"
+)
+
+// newTestAPI serves the API from an in-memory database holding one machine
+// with the stored profile.
+func newTestAPI(t *testing.T, stored map[string]any) (*API, http.Handler) {
+	t.Helper()
+	ts, db, _ := newTestTokenStore(t)
+	if err := db.AutoMigrate(&machineModel{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&machineModel{ID: uuid.New(), MAC: testMAC, Profile: datatypes.JSONMap(stored)}).Error; err != nil {
+		t.Fatal(err)
+	}
+	renderer, err := render.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &API{store: &Store{ORM: db}, tokens: ts, renderer: renderer, profiles: &profile.Source{}}
+	h, err := a.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, h
+}
+
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = "10.0.0.5:40000"
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBootArtifactsRedeemBootToken(t *testing.T) {
+	a, h := newTestAPI(t, map[string]any{
+		"artifacts": map[string]any{"kernel": "http://mirror/vmlinuz", "initrd": "http://mirror/initrd.img"},
+	})
+	ctx := context.Background()
+	boot, err := a.tokens.Issue(ctx, testMAC, TokenPurposeBoot, "10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel request checks the token; the initrd request consumes it.
+	for _, tc := range []struct{ path, want string }{
+		{"/v1/boot/kernel", "http://mirror/vmlinuz"},
+		{"/v1/boot/kernel", "http://mirror/vmlinuz"},
+		{"/v1/boot/initrd", "http://mirror/initrd.img"},
+	} {
+		rec := get(h, tc.path+"?token="+boot.Value)
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != tc.want {
+			t.Fatalf("%s: status %d location %q: %s", tc.path, rec.Code, rec.Header().Get("Location"), rec.Body)
+		}
+	}
+	if rec := get(h, "/v1/boot/initrd?token="+boot.Value); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed initrd: status %d, want 401", rec.Code)
+	}
+
+	kickstart, err := a.tokens.Issue(ctx, testMAC, TokenPurposeKickstart, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(h, "/v1/boot/kernel?token="+kickstart.Value); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("kickstart token: status %d, want 401", rec.Code)
+	}
+	other, err := a.tokens.Issue(ctx, testMAC, TokenPurposeBoot, "10.0.0.6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(h, "/v1/boot/initrd?token="+other.Value); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token bound to another client: status %d, want 401", rec.Code)
+	}
+}
+
+func TestUnattendRedeemsUnattendToken(t *testing.T) {
+	a, h := newTestAPI(t, map[string]any{"os": map[string]any{"family": "windows"}})
+	unattend, err := a.tokens.Issue(context.Background(), testMAC, render.FormatUnattend, "10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(h, "/v1/render/unattend?token="+unattend.Value); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := get(h, "/v1/render/unattend?token="+unattend.Value); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed token: status %d, want 401", rec.Code)
+	}
+	var machine machineModel
+	if err := a.store.ORM.First(&machine).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(h, "/v1/render/unattend?machine_id="+machine.ID.String()); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("machine_id without a token: status %d, want 401", rec.Code)
+	}
+}
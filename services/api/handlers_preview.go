@@ -0,0 +1,90 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"goosed/pkg/render"
+)
+
+// previewToken stands in for the agent token in previews, which issue none.
+const previewToken = "PREVIEW-TOKEN"
+
+type previewRequest struct {
+	// Blueprint is a reference under infra/blueprints, such as rocky/9/base.
+	Blueprint string `json:"blueprint"`
+	// Labels select overlays as a machine profile's labels would.
+	Labels  map[string]string `json:"labels"`
+	Profile map[string]any    `json:"profile"`
+	// Format overrides the format chosen by os.format or os.family.
+	Format string `json:"format"`
+	MAC    string `json:"mac"`
+	Serial string `json:"serial"`
+}
+
+type previewResponse struct {
+	Blueprint string   `json:"blueprint,omitempty"`
+	Layers    []string `json:"layers"`
+	Format    string   `json:"format"`
+	Template  string   `json:"template"`
+	Content   string   `json:"content"`
+	Warnings  []string `json:"warnings"`
+}
+
+// handleRenderPreview renders the install config for a blueprint and a
+// profile that need not belong to any machine, so profile changes can be
+// reviewed before they are merged to infra/. No tokens are issued and
+// secrets are not resolved; validation problems are returned as warnings.
+func (a *API) handleRenderPreview(w http.ResponseWriter, r *http.Request) {
+	var req previewRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	req.Blueprint = strings.TrimSpace(req.Blueprint)
+	if req.Blueprint == "" && len(req.Profile) == 0 {
+		respondError(w, http.StatusBadRequest, errors.New("blueprint or profile is required"))
+		return
+	}
+
+	eff, err := a.profiles.Compose(req.Blueprint, req.Labels, req.Profile)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	format, tmpl, err := render.TemplateFor(eff.Profile, req.Format)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	mac := strings.ToLower(strings.TrimSpace(req.MAC))
+	if mac == "" {
+		mac = "00:00:00:00:00:00"
+	}
+	machine := Machine{MAC: mac, Serial: req.Serial, Profile: eff.Profile}
+	content, warnings, err := a.renderer.Preview(tmpl, map[string]any{
+		"Machine": machine,
+		"Profile": eff.Profile,
+		"Token":   previewToken,
+		"APIBase": a.apiBase(r),
+	})
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if warnings == nil {
+		warnings = []string{}
+	}
+
+	respondJSON(w, http.StatusOK, previewResponse{
+		Blueprint: eff.Blueprint,
+		Layers:    eff.Layers,
+		Format:    format,
+		Template:  tmpl,
+		Content:   content,
+		Warnings:  warnings,
+	})
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"goosed/pkg/profile"
+)
+
+// effectiveProfile merges the machine's stored profile over the built-in
+// defaults, its blueprint and the overlays matching its labels.
+func (a *API) effectiveProfile(machine Machine) (profile.Effective, error) {
+	eff, err := a.profiles.Resolve(machine.MAC, machine.Profile)
+	if err != nil {
+		return profile.Effective{}, fmt.Errorf("effective profile for %s: %w", machine.MAC, err)
+	}
+	return eff, nil
+}
+
+// withEffectiveProfile returns machine with Profile replaced by its effective
+// profile, which is what templates and boot decisions see.
+func (a *API) withEffectiveProfile(machine Machine) (Machine, error) {
+	eff, err := a.effectiveProfile(machine)
+	if err != nil {
+		return Machine{}, err
+	}
+	machine.Profile = eff.Profile
+	return machine, nil
+}
+
+// handleEffectiveProfile shows the merged profile a machine is rendered with
+// and the layers it came from.
+func (a *API) handleEffectiveProfile(w http.ResponseWriter, r *http.Request) {
+	machineID, err := uuid.Parse(strings.TrimSpace(chi.URLParam(r, "id")))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errors.New("valid machine id is required"))
+		return
+	}
+
+	machine, err := a.fetchMachineByID(r.Context(), machineID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			respondError(w, http.StatusNotFound, fmt.Errorf("machine %s not found", machineID))
+			return
+		}
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	eff, err := a.effectiveProfile(machine)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{
+		"machine_id": machine.ID,
+		"mac":        machine.MAC,
+		"blueprint":  eff.Blueprint,
+		"layers":     eff.Layers,
+		"profile":    eff.Profile,
+	})
+}
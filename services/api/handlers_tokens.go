@@ -44,19 +44,10 @@ func (a *API) handleAgentTokenRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rotated, err := a.tokens.Rotate(r.Context(), machine.MAC, oldToken)
+	rotated, err := a.tokens.Rotate(r.Context(), machine.MAC, oldToken, clientIP(r))
 	if err != nil {
-		switch {
-		case errors.Is(err, ErrTokenNotFound):
-			respondError(w, http.StatusUnauthorized, errors.New("invalid token"))
-			return
-		case errors.Is(err, ErrTokenExpired):
-			respondError(w, http.StatusUnauthorized, errors.New("token expired"))
-			return
-		default:
-			respondError(w, http.StatusInternalServerError, err)
-			return
-		}
+		respondTokenError(w, err)
+		return
 	}
 
 	respondJSON(w, http.StatusOK, map[string]any{
@@ -64,3 +55,17 @@ func (a *API) handleAgentTokenRefresh(w http.ResponseWriter, r *http.Request) {
 		"expires_at": rotated.ExpiresAt.Format(time.RFC3339),
 	})
 }
+
+// respondTokenError answers a failed redemption. Reused, misdirected and
+// wrong-purpose tokens all read as invalid; the audit log has the reason.
+func respondTokenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		respondError(w, http.StatusUnauthorized, errors.New("token expired"))
+	case errors.Is(err, ErrTokenNotFound), errors.Is(err, ErrTokenUsed),
+		errors.Is(err, ErrTokenPurpose), errors.Is(err, ErrTokenClientIP):
+		respondError(w, http.StatusUnauthorized, errors.New("invalid token"))
+	default:
+		respondError(w, http.StatusInternalServerError, err)
+	}
+}
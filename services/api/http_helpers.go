@@ -4,7 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 	"time"
 )
 
@@ -38,3 +42,93 @@ func respondError(w http.ResponseWriter, status int, err error) {
 func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
 	return context.WithTimeout(ctx, 5*time.Second)
 }
+
+// clientIP returns the address of the client that made r. The realIP
+// middleware has already applied X-Real-IP or X-Forwarded-For when they came
+// from a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// realIP replaces r.RemoteAddr with the client address from True-Client-IP,
+// X-Real-IP or X-Forwarded-For, which bootd and pxe-stack set when they fetch
+// a config on a machine's behalf. The headers are only honoured from peers in
+// trusted: from anyone else they would let the client choose the address its
+// tokens are bound to and checked against.
+func realIP(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if peer, err := netip.ParseAddrPort(r.RemoteAddr); err == nil && containsAddr(trusted, peer.Addr()) {
+				if ip, ok := forwardedClient(r.Header, trusted); ok {
+					r.RemoteAddr = ip.String()
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedClient picks the client address from the proxy headers. In
+// X-Forwarded-For it is the last hop not added by a trusted proxy.
+func forwardedClient(h http.Header, trusted []netip.Prefix) (netip.Addr, bool) {
+	for _, name := range []string{"True-Client-IP", "X-Real-IP"} {
+		if ip, err := netip.ParseAddr(strings.TrimSpace(h.Get(name))); err == nil {
+			return ip.Unmap(), true
+		}
+	}
+	hops := strings.Split(strings.Join(h.Values("X-Forwarded-For"), ","), ",")
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = ip.Unmap()
+		if !containsAddr(trusted, client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs or single addresses.
+func parsePrefixes(raw string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", field)
+			}
+			out = append(out, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", field)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
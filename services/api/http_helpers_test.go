@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIPOnlyTrustsConfiguredProxies(t *testing.T) {
+	trusted, err := parsePrefixes("10.42.0.0/16, 192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen string
+	h := realIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = clientIP(r)
+	}))
+
+	for _, tc := range []struct {
+		name   string
+		remote string
+		header string
+		value  string
+		want   string
+	}{
+		{"trusted proxy", "10.42.3.7:5000", "X-Real-IP", "192.168.122.50", "192.168.122.50"},
+		{"trusted single address", "192.168.1.10:5000", "True-Client-IP", "192.168.122.50", "192.168.122.50"},
+		{"spoofed from a machine", "192.168.122.60:5000", "X-Real-IP", "192.168.122.50", "192.168.122.60"},
+		{"spoofed forwarded-for", "192.168.122.60:5000", "X-Forwarded-For", "192.168.122.50", "192.168.122.60"},
+		// Only the hop the trusted proxy appended counts, not what the
+		// client sent it.
+		{"forwarded through proxies", "10.42.3.7:5000", "X-Forwarded-For", "1.2.3.4, 192.168.122.50, 10.42.0.9", "192.168.122.50"},
+		{"garbage header", "10.42.3.7:5000", "X-Real-IP", "nope", "10.42.3.7"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/boot/ipxe", nil)
+		req.RemoteAddr = tc.remote
+		req.Header.Set(tc.header, tc.value)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if seen != tc.want {
+			t.Errorf("%s: client IP = %s, want %s", tc.name, seen, tc.want)
+		}
+	}
+
+	if _, err := parsePrefixes("10.0.0.0/33"); err == nil {
+		t.Fatal("expected an invalid CIDR to fail")
+	}
+}
@@ -2,13 +2,20 @@ package api
 
 import (
 	"errors"
+	"fmt"
+	"io/fs"
+	"log"
 	"net/http"
+	"net/netip"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"goosed/infra/branding"
+	"goosed/pkg/profile"
 	"goosed/pkg/render"
 )
 
@@ -26,6 +33,23 @@ type Config struct {
 	APIBase        string
 	TokenTTL       time.Duration
 	ArtifactBucket string
+	// Branding themes the boot menus. When unset it is loaded from
+	// BRANDING_PATH, falling back to the embedded infra/branding.
+	Branding branding.Branding
+	// BindTokensToIP binds boot and kickstart tokens to the address of the
+	// client they were rendered for, so a leaked URL cannot be redeemed from
+	// another host. Also enabled by TOKEN_BIND_CLIENT_IP=true.
+	BindTokensToIP bool
+	// TrustedProxies are the peers whose True-Client-IP, X-Real-IP and
+	// X-Forwarded-For headers are believed, typically the pod network of
+	// bootd and pxe-stack. Defaults to TRUSTED_PROXY_CIDRS; when both are
+	// empty the socket address is always used.
+	TrustedProxies []netip.Prefix
+	// InfraPath is the infra/ checkout blueprints, overlays and machine
+	// profiles are merged from. Defaults to INFRA_PATH; when both are empty
+	// machines render from the built-in defaults and their stored profile.
+	InfraPath string
+	Logger    *log.Logger
 }
 
 // API wires dependencies, template renderer, and configuration for HTTP handlers.
@@ -34,6 +58,7 @@ type API struct {
 	renderer *render.Engine
 	config   Config
 	tokens   *tokenStore
+	profiles *profile.Source
 }
 
 // New initialises the API layer with sane defaults applied to the provided configuration.
@@ -57,8 +82,38 @@ func New(store *Store, renderer *render.Engine, cfg Config) (*API, error) {
 	if cfg.ArtifactBucket == "" {
 		return nil, errors.New("artifact bucket is required")
 	}
+	if !cfg.BindTokensToIP {
+		cfg.BindTokensToIP, _ = strconv.ParseBool(os.Getenv("TOKEN_BIND_CLIENT_IP"))
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if len(cfg.TrustedProxies) == 0 {
+		proxies, err := parsePrefixes(os.Getenv("TRUSTED_PROXY_CIDRS"))
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXY_CIDRS: %w", err)
+		}
+		cfg.TrustedProxies = proxies
+	}
+	if cfg.BindTokensToIP && len(cfg.TrustedProxies) == 0 {
+		cfg.Logger.Printf("WARN api binds tokens to client IPs but trusts no proxies; configs fetched through pxe-stack or bootd are bound to their address")
+	}
+	if cfg.InfraPath == "" {
+		cfg.InfraPath = os.Getenv("INFRA_PATH")
+	}
+	if cfg.Branding == (branding.Branding{}) {
+		var fsys fs.FS = branding.Files
+		if dir := os.Getenv("BRANDING_PATH"); dir != "" {
+			fsys = os.DirFS(dir)
+		}
+		b, err := branding.Load(fsys)
+		if err != nil {
+			return nil, fmt.Errorf("load branding: %w", err)
+		}
+		cfg.Branding = b
+	}
 
-	tokenStore, err := newTokenStore(store.ORM, cfg.TokenTTL)
+	tokenStore, err := newTokenStore(store.ORM, cfg.TokenTTL, cfg.Logger)
 	if err != nil {
 		return nil, err
 	}
@@ -68,6 +123,7 @@ func New(store *Store, renderer *render.Engine, cfg Config) (*API, error) {
 		renderer: renderer,
 		config:   cfg,
 		tokens:   tokenStore,
+		profiles: &profile.Source{Root: cfg.InfraPath, Logger: cfg.Logger},
 	}, nil
 }
 
@@ -79,16 +135,27 @@ func (a *API) Routes() (http.Handler, error) {
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(realIP(a.config.TrustedProxies))
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
 	r.Route("/v1", func(r chi.Router) {
 		r.Get("/machines", a.handleListMachines)
 		r.Post("/machines", a.handleUpsertMachine)
+		r.Get("/machines/{id}/effective-profile", a.handleEffectiveProfile)
 		r.Get("/boot/ipxe", a.handleIPXE)
+		r.Get("/boot/pxelinux", a.handlePXELinux)
+		r.Get("/boot/grub", a.handleGRUB)
+		r.Get("/boot/kernel", a.handleBootKernel)
+		r.Get("/boot/initrd", a.handleBootInitrd)
+		r.Get("/boot/intents", a.handleBootIntents)
 		r.Get("/render/kickstart", a.handleKickstart)
 		r.Get("/render/unattend", a.handleUnattend)
+		r.Post("/render/preview", a.handleRenderPreview)
+		r.Get("/render/autoyast", a.handleAutoYaST)
+		r.Get("/render/ignition", a.handleIgnition)
+		r.Get("/render/cloud-init/{token}/{file}", a.handleCloudInit)
+		r.Get("/render/autoinstall/{token}/{file}", a.handleAutoinstall)
 		r.Post("/artifacts", a.handleArtifacts)
 		r.Post("/agents/facts", a.handleFacts)
 		r.Post("/agents/token/refresh", a.handleAgentTokenRefresh)
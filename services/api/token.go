@@ -6,11 +6,25 @@ import (
 	"github.com/google/uuid"
 )
 
+// Token purposes. A token can only be redeemed for the purpose it was issued
+// for, so a boot token cannot fetch a kickstart or authenticate an agent.
+// Tokens for the other install configs use the format name as their purpose,
+// such as autoyast, ignition or unattend.
+const (
+	TokenPurposeBoot      = "boot"
+	TokenPurposeKickstart = "kickstart"
+	TokenPurposeAgent     = "agent"
+)
+
 // Token represents a boot or agent authentication token tracked by the store.
 type Token struct {
-	ID        uuid.UUID
-	MAC       string
-	Value     string
+	ID      uuid.UUID
+	MAC     string
+	Value   string
+	Purpose string
+	// BoundIP, when set, is the only client address that may redeem the
+	// token.
+	BoundIP   string
 	ExpiresAt time.Time
 	Used      bool
 }
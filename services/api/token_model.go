@@ -7,13 +7,17 @@ import (
 )
 
 type tokenModel struct {
-	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
-	MAC       string    `gorm:"type:text;index;not null"`
-	Token     string    `gorm:"type:text;uniqueIndex;not null"`
-	ExpiresAt time.Time `gorm:"type:timestamptz;not null"`
-	Used      bool      `gorm:"type:boolean;not null;default:false"`
-	CreatedAt time.Time `gorm:"type:timestamptz;not null;default:now();autoCreateTime"`
-	UpdatedAt time.Time `gorm:"type:timestamptz;not null;default:now();autoUpdateTime"`
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	MAC       string     `gorm:"type:text;index;not null"`
+	Token     string     `gorm:"type:text;uniqueIndex;not null"`
+	Purpose   string     `gorm:"type:text;not null;default:''"`
+	BoundIP   string     `gorm:"type:text;not null;default:''"`
+	ExpiresAt time.Time  `gorm:"type:timestamptz;not null"`
+	Used      bool       `gorm:"type:boolean;not null;default:false"`
+	UsedAt    *time.Time `gorm:"type:timestamptz"`
+	UsedIP    string     `gorm:"type:text;not null;default:''"`
+	CreatedAt time.Time  `gorm:"type:timestamptz;not null;default:now();autoCreateTime"`
+	UpdatedAt time.Time  `gorm:"type:timestamptz;not null;default:now();autoUpdateTime"`
 }
 
 func (tokenModel) TableName() string { return "tokens" }
@@ -23,6 +27,8 @@ func (m tokenModel) toToken() Token {
 		ID:        m.ID,
 		MAC:       m.MAC,
 		Value:     m.Token,
+		Purpose:   m.Purpose,
+		BoundIP:   m.BoundIP,
 		ExpiresAt: m.ExpiresAt,
 		Used:      m.Used,
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -21,15 +22,30 @@ var (
 	// ErrTokenExpired signals that the supplied token has elapsed its TTL
 	// and can no longer be used.
 	ErrTokenExpired = errors.New("token expired")
+	// ErrTokenUsed signals that a single-use token was already redeemed.
+	ErrTokenUsed = errors.New("token already used")
+	// ErrTokenPurpose signals that the token was issued for another purpose.
+	ErrTokenPurpose = errors.New("token issued for another purpose")
+	// ErrTokenClientIP signals that the token is bound to another client
+	// address.
+	ErrTokenClientIP = errors.New("token bound to another client")
+)
+
+// Audit actions recorded for every redemption attempt. The token value is
+// never written to the audit log; entries carry the token ID instead.
+const (
+	auditTokenRedeemed = "token_redeemed"
+	auditTokenRejected = "token_rejected"
 )
 
 type tokenStore struct {
-	db  *gorm.DB
-	ttl time.Duration
-	now func() time.Time
+	db     *gorm.DB
+	ttl    time.Duration
+	now    func() time.Time
+	logger *log.Logger
 }
 
-func newTokenStore(db *gorm.DB, ttl time.Duration) (*tokenStore, error) {
+func newTokenStore(db *gorm.DB, ttl time.Duration, logger *log.Logger) (*tokenStore, error) {
 	if db == nil {
 		return nil, errTokenStoreDBRequired
 	}
@@ -39,9 +55,10 @@ func newTokenStore(db *gorm.DB, ttl time.Duration) (*tokenStore, error) {
 	}
 
 	store := &tokenStore{
-		db:  db,
-		ttl: ttl,
-		now: func() time.Time { return time.Now().UTC() },
+		db:     db,
+		ttl:    ttl,
+		now:    func() time.Time { return time.Now().UTC() },
+		logger: logger,
 	}
 
 	if err := db.AutoMigrate(&tokenModel{}); err != nil {
@@ -59,11 +76,16 @@ func (ts *tokenStore) purgeExpired(ctx context.Context, tx *gorm.DB) error {
 	return nil
 }
 
-func (ts *tokenStore) Issue(ctx context.Context, mac string) (Token, error) {
+// Issue creates a token for mac that can be redeemed once for purpose. A
+// non-empty boundIP restricts redemption to that client address.
+func (ts *tokenStore) Issue(ctx context.Context, mac, purpose, boundIP string) (Token, error) {
 	mac = strings.TrimSpace(strings.ToLower(mac))
 	if mac == "" {
 		return Token{}, errors.New("mac is required")
 	}
+	if purpose == "" {
+		return Token{}, errors.New("purpose is required")
+	}
 
 	if err := ts.purgeExpired(ctx, ts.db); err != nil {
 		return Token{}, err
@@ -74,6 +96,8 @@ func (ts *tokenStore) Issue(ctx context.Context, mac string) (Token, error) {
 		ID:        uuid.New(),
 		MAC:       mac,
 		Token:     uuid.NewString(),
+		Purpose:   purpose,
+		BoundIP:   boundIP,
 		ExpiresAt: now.Add(ts.ttl),
 		Used:      false,
 	}
@@ -85,7 +109,9 @@ func (ts *tokenStore) Issue(ctx context.Context, mac string) (Token, error) {
 	return model.toToken(), nil
 }
 
-func (ts *tokenStore) Active(ctx context.Context, mac string) (Token, bool, error) {
+// Active returns an unexpired, unused token for mac issued for purpose and
+// bound to boundIP, so re-rendering a boot config reuses it.
+func (ts *tokenStore) Active(ctx context.Context, mac, purpose, boundIP string) (Token, bool, error) {
 	mac = strings.TrimSpace(strings.ToLower(mac))
 	if mac == "" {
 		return Token{}, false, errors.New("mac is required")
@@ -98,7 +124,7 @@ func (ts *tokenStore) Active(ctx context.Context, mac string) (Token, bool, erro
 	now := ts.now()
 	var model tokenModel
 	err := ts.db.WithContext(ctx).
-		Where("mac = ? AND used = FALSE AND expires_at > ?", mac, now).
+		Where("mac = ? AND purpose = ? AND bound_ip = ? AND used = FALSE AND expires_at > ?", mac, purpose, boundIP, now).
 		Order("expires_at DESC").
 		First(&model).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -111,27 +137,121 @@ func (ts *tokenStore) Active(ctx context.Context, mac string) (Token, bool, erro
 	return model.toToken(), true, nil
 }
 
-func (ts *tokenStore) MarkUsed(ctx context.Context, tokenValue string) error {
+// Redeem consumes tokenValue for purpose on behalf of clientIP. The token
+// must exist, match purpose, be unused and unexpired, and if it is bound to
+// an address, clientIP must be that address. Every attempt is audited.
+func (ts *tokenStore) Redeem(ctx context.Context, tokenValue, purpose, clientIP string) (Token, error) {
 	tokenValue = strings.TrimSpace(tokenValue)
 	if tokenValue == "" {
-		return errors.New("token is required")
+		return Token{}, ErrTokenNotFound
 	}
 
-	res := ts.db.WithContext(ctx).
-		Model(&tokenModel{}).
-		Where("token = ?", tokenValue).
-		Update("used", true)
-	if res.Error != nil {
-		return fmt.Errorf("mark token used: %w", res.Error)
+	var redeemed tokenModel
+	err := ts.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token = ?", tokenValue).
+			First(&redeemed).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrTokenNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("lookup token: %w", err)
+		}
+		if err := ts.check(redeemed, purpose, clientIP); err != nil {
+			return err
+		}
+
+		now := ts.now()
+		if err := tx.Model(&redeemed).Updates(map[string]any{
+			"used":    true,
+			"used_at": now,
+			"used_ip": clientIP,
+		}).Error; err != nil {
+			return fmt.Errorf("mark token used: %w", err)
+		}
+		return nil
+	})
+	ts.audit(ctx, redeemed, purpose, clientIP, err)
+	if err != nil {
+		return Token{}, err
 	}
-	if res.RowsAffected == 0 {
-		return ErrTokenNotFound
+	return redeemed.toToken(), nil
+}
+
+// Peek validates tokenValue for purpose and clientIP like Redeem, without
+// consuming it or writing an audit entry. NoCloud seeds use it for the files
+// cloud-init fetches alongside user-data, some of them after user-data has
+// redeemed the token, so a used token is accepted until it expires.
+func (ts *tokenStore) Peek(ctx context.Context, tokenValue, purpose, clientIP string) (Token, error) {
+	tokenValue = strings.TrimSpace(tokenValue)
+	if tokenValue == "" {
+		return Token{}, ErrTokenNotFound
 	}
 
+	var model tokenModel
+	err := ts.db.WithContext(ctx).Where("token = ?", tokenValue).First(&model).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Token{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return Token{}, fmt.Errorf("lookup token: %w", err)
+	}
+	unused := model
+	unused.Used = false
+	if err := ts.check(unused, purpose, clientIP); err != nil {
+		return Token{}, err
+	}
+	return model.toToken(), nil
+}
+
+// check reports why token cannot be redeemed for purpose by clientIP.
+func (ts *tokenStore) check(token tokenModel, purpose, clientIP string) error {
+	switch {
+	case token.Purpose != purpose:
+		return ErrTokenPurpose
+	case token.Used:
+		return ErrTokenUsed
+	case !token.ExpiresAt.After(ts.now()):
+		return ErrTokenExpired
+	case token.BoundIP != "" && token.BoundIP != clientIP:
+		return ErrTokenClientIP
+	}
 	return nil
 }
 
-func (ts *tokenStore) Rotate(ctx context.Context, mac, oldToken string) (Token, error) {
+// audit records a redemption attempt. Failing to write the audit entry does
+// not fail the redemption, but is logged.
+func (ts *tokenStore) audit(ctx context.Context, token tokenModel, purpose, clientIP string, err error) {
+	details := map[string]any{
+		"purpose":   purpose,
+		"client_ip": clientIP,
+	}
+	if token.ID != uuid.Nil {
+		details["token_id"] = token.ID.String()
+		details["issued_for"] = token.Purpose
+		if token.BoundIP != "" {
+			details["bound_ip"] = token.BoundIP
+		}
+	}
+	action := auditTokenRedeemed
+	if err != nil {
+		action = auditTokenRejected
+		details["reason"] = err.Error()
+	}
+	entry := auditModel{
+		Actor:   "token",
+		Action:  action,
+		Obj:     token.MAC,
+		Details: toJSONMap(details),
+	}
+	if werr := ts.db.WithContext(ctx).Create(&entry).Error; werr != nil {
+		ts.logger.Printf("ERROR api write %s audit entry for %s from %s: %v", action, token.MAC, clientIP, werr)
+	}
+}
+
+// Rotate redeems the agent token oldToken on behalf of clientIP and issues
+// its replacement. The attempt is audited like any other redemption.
+func (ts *tokenStore) Rotate(ctx context.Context, mac, oldToken, clientIP string) (Token, error) {
 	mac = strings.TrimSpace(strings.ToLower(mac))
 	if mac == "" {
 		return Token{}, errors.New("mac is required")
@@ -142,9 +262,18 @@ func (ts *tokenStore) Rotate(ctx context.Context, mac, oldToken string) (Token,
 		return Token{}, errors.New("old token is required")
 	}
 
+	current, replacement, err := ts.rotate(ctx, mac, oldToken, clientIP)
+	ts.audit(ctx, current, TokenPurposeAgent, clientIP, err)
+	if err != nil {
+		return Token{}, err
+	}
+	return replacement.toToken(), nil
+}
+
+func (ts *tokenStore) rotate(ctx context.Context, mac, oldToken, clientIP string) (current, replacement tokenModel, err error) {
 	tx := ts.db.WithContext(ctx).Begin()
 	if tx.Error != nil {
-		return Token{}, tx.Error
+		return current, replacement, tx.Error
 	}
 	defer func() {
 		if tx.Error != nil {
@@ -154,52 +283,54 @@ func (ts *tokenStore) Rotate(ctx context.Context, mac, oldToken string) (Token,
 
 	if err := ts.purgeExpired(ctx, tx); err != nil {
 		tx.Rollback()
-		return Token{}, err
+		return current, replacement, err
 	}
 
 	now := ts.now()
-	var current tokenModel
-	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
 		Where("mac = ? AND token = ?", mac, oldToken).
 		First(&current).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		tx.Rollback()
-		return Token{}, ErrTokenNotFound
+		return current, replacement, ErrTokenNotFound
 	}
 	if err != nil {
 		tx.Rollback()
-		return Token{}, fmt.Errorf("lookup token: %w", err)
+		return current, replacement, fmt.Errorf("lookup token: %w", err)
 	}
 
-	if !current.ExpiresAt.After(now) {
+	if err := ts.check(current, TokenPurposeAgent, clientIP); err != nil {
 		tx.Rollback()
-		return Token{}, ErrTokenExpired
+		return current, replacement, err
 	}
 
 	if err := tx.Model(&current).Updates(map[string]any{
 		"used":       true,
+		"used_at":    now,
+		"used_ip":    clientIP,
 		"expires_at": now,
 	}).Error; err != nil {
 		tx.Rollback()
-		return Token{}, fmt.Errorf("invalidate token: %w", err)
+		return current, replacement, fmt.Errorf("invalidate token: %w", err)
 	}
 
-	replacement := tokenModel{
+	replacement = tokenModel{
 		ID:        uuid.New(),
 		MAC:       mac,
 		Token:     uuid.NewString(),
+		Purpose:   TokenPurposeAgent,
 		ExpiresAt: now.Add(ts.ttl),
 		Used:      false,
 	}
 
 	if err := tx.Create(&replacement).Error; err != nil {
 		tx.Rollback()
-		return Token{}, fmt.Errorf("create replacement token: %w", err)
+		return current, replacement, fmt.Errorf("create replacement token: %w", err)
 	}
 
 	if err := tx.Commit().Error; err != nil {
-		return Token{}, err
+		return current, replacement, err
 	}
 
-	return replacement.toToken(), nil
+	return current, replacement, nil
 }
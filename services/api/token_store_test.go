@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const testMAC = "aa:bb:cc:dd:ee:ff"
+
+// newTestTokenStore opens the token store on an in-memory SQLite database.
+// The tables are created with SQLite stand-ins for the Postgres-only column
+// types and defaults.
+func newTestTokenStore(t *testing.T) (*tokenStore, *gorm.DB, *bytes.Buffer) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection would get its own in-memory database.
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	ddl := strings.NewReplacer("DEFAULT now()", "DEFAULT CURRENT_TIMESTAMP", "bigserial", "integer", "timestamptz", "datetime")
+	err = db.Callback().Raw().Before("gorm:raw").Register("test:sqlite_ddl", func(tx *gorm.DB) {
+		if sql := tx.Statement.SQL.String(); strings.HasPrefix(sql, "CREATE TABLE") {
+			tx.Statement.SQL.Reset()
+			tx.Statement.SQL.WriteString(ddl.Replace(sql))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	ts, err := newTokenStore(db, time.Minute, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&auditModel{}); err != nil {
+		t.Fatal(err)
+	}
+	return ts, db, &logs
+}
+
+func auditActions(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var entries []auditModel
+	if err := db.Order("id").Find(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+	actions := make([]string, len(entries))
+	for i, e := range entries {
+		actions[i] = e.Action + ":" + e.Details["client_ip"].(string)
+	}
+	return actions
+}
+
+func TestTokenIssueAndRedeem(t *testing.T) {
+	ts, db, _ := newTestTokenStore(t)
+	ctx := context.Background()
+
+	issued, err := ts.Issue(ctx, "AA:BB:CC:DD:EE:FF", TokenPurposeKickstart, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.MAC != testMAC || issued.Used || issued.Value == "" {
+		t.Fatalf("issued = %+v", issued)
+	}
+	active, ok, err := ts.Active(ctx, testMAC, TokenPurposeKickstart, "")
+	if err != nil || !ok || active.Value != issued.Value {
+		t.Fatalf("active = %+v, %t, %v", active, ok, err)
+	}
+
+	if _, err := ts.Peek(ctx, issued.Value, TokenPurposeKickstart, "10.0.0.5"); err != nil {
+		t.Fatalf("peek: %v", err)
+	}
+	redeemed, err := ts.Redeem(ctx, issued.Value, TokenPurposeKickstart, "10.0.0.5")
+	if err != nil || redeemed.MAC != testMAC {
+		t.Fatalf("redeem = %+v, %v", redeemed, err)
+	}
+
+	// Single use, but NoCloud's follow-up fetches may still peek.
+	if _, err := ts.Redeem(ctx, issued.Value, TokenPurposeKickstart, "10.0.0.5"); !errors.Is(err, ErrTokenUsed) {
+		t.Fatalf("second redeem: err = %v, want ErrTokenUsed", err)
+	}
+	if _, err := ts.Peek(ctx, issued.Value, TokenPurposeKickstart, "10.0.0.5"); err != nil {
+		t.Fatalf("peek after redeem: %v", err)
+	}
+	if _, ok, _ := ts.Active(ctx, testMAC, TokenPurposeKickstart, ""); ok {
+		t.Fatal("redeemed token is still active")
+	}
+	if _, err := ts.Redeem(ctx, "nope", TokenPurposeKickstart, "10.0.0.5"); !errors.Is(err, ErrTokenNotFound) {
+		t.Fatalf("unknown token: err = %v", err)
+	}
+
+	got := strings.Join(auditActions(t, db), " ")
+	want := "token_redeemed:10.0.0.5 token_rejected:10.0.0.5 token_rejected:10.0.0.5"
+	if got != want {
+		t.Fatalf("audit = %s, want %s", got, want)
+	}
+}
+
+func TestTokenRedeemChecks(t *testing.T) {
+	ts, _, _ := newTestTokenStore(t)
+	ctx := context.Background()
+
+	boot, err := ts.Issue(ctx, testMAC, TokenPurposeBoot, "10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		purpose  string
+		clientIP string
+		want     error
+	}{
+		{"purpose mismatch", TokenPurposeKickstart, "10.0.0.5", ErrTokenPurpose},
+		{"ip mismatch", TokenPurposeBoot, "10.0.0.6", ErrTokenClientIP},
+	} {
+		if _, err := ts.Peek(ctx, boot.Value, tc.purpose, tc.clientIP); !errors.Is(err, tc.want) {
+			t.Errorf("%s: peek err = %v, want %v", tc.name, err, tc.want)
+		}
+		if _, err := ts.Redeem(ctx, boot.Value, tc.purpose, tc.clientIP); !errors.Is(err, tc.want) {
+			t.Errorf("%s: redeem err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	// Rejected attempts do not consume the token.
+	if _, err := ts.Redeem(ctx, boot.Value, TokenPurposeBoot, "10.0.0.5"); err != nil {
+		t.Fatalf("redeem from the bound address: %v", err)
+	}
+
+	expired, err := ts.Issue(ctx, testMAC, TokenPurposeBoot, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.now = func() time.Time { return time.Now().UTC().Add(2 * time.Minute) }
+	if _, err := ts.Redeem(ctx, expired.Value, TokenPurposeBoot, "10.0.0.5"); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expired: err = %v", err)
+	}
+}
+
+func TestTokenAuditFailureIsLogged(t *testing.T) {
+	ts, db, logs := newTestTokenStore(t)
+	ctx := context.Background()
+	if err := db.Migrator().DropTable(&auditModel{}); err != nil {
+		t.Fatal(err)
+	}
+
+	issued, err := ts.Issue(ctx, testMAC, TokenPurposeBoot, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Redeem(ctx, issued.Value, TokenPurposeBoot, "10.0.0.5"); err != nil {
+		t.Fatalf("redeem failed with the audit table gone: %v", err)
+	}
+	if !strings.Contains(logs.String(), "ERROR api write token_redeemed audit entry for "+testMAC) {
+		t.Fatalf("log = %q", logs.String())
+	}
+}
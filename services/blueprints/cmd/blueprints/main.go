@@ -2,18 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"goosed/pkg/bus"
 	"goosed/pkg/telemetry"
+	"goosed/services/blueprints"
 )
 
 func main() {
@@ -41,10 +48,37 @@ func run(serviceName string) error {
 		}
 	}()
 
+	watcher, closeBus, err := newWatcher(logger)
+	if err != nil {
+		return err
+	}
+	defer closeBus()
+
+	go func() {
+		if err := watcher.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Printf("ERROR watcher stopped: %v", err)
+			stop()
+		}
+	}()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", healthHandler)
-	mux.HandleFunc("/readyz", readyHandler)
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		// Ready once the first snapshot is loaded.
+		if watcher.Snapshot().Version == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("GET /v1/snapshot", snapshotHandler(watcher))
+	rollbackToken := os.Getenv("ROLLBACK_TOKEN")
+	if rollbackToken == "" {
+		logger.Printf("INFO rollback endpoints disabled; set ROLLBACK_TOKEN to enable them")
+	}
+	mux.HandleFunc("POST /v1/rollback", requireToken(rollbackToken, rollbackHandler(watcher)))
+	mux.HandleFunc("DELETE /v1/rollback", requireToken(rollbackToken, resumeHandler(watcher)))
 
 	server := &http.Server{
 		Addr:    ":8080",
@@ -74,6 +108,176 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func readyHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// newWatcher configures the infra watcher from the environment: INFRA_PATH
+// for a local directory, or INFRA_GIT_URL and friends for a Git remote, with
+// INFRA_GIT_ALLOWED_SIGNERS or INFRA_GIT_GPG_KEYRING to require signed
+// commits. Events go to NATS_URL when it is set.
+func newWatcher(logger *log.Logger) (*blueprints.Watcher, func(), error) {
+	var (
+		pub     blueprints.Publisher = logPublisher{logger}
+		closeFn                      = func() {}
+	)
+	if url := os.Getenv("NATS_URL"); url != "" {
+		b, err := bus.New(url, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("connect nats: %w", err)
+		}
+		pub, closeFn = b, b.Close
+	}
+
+	var interval time.Duration
+	if v := os.Getenv("INFRA_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			closeFn()
+			return nil, nil, fmt.Errorf("INFRA_SYNC_INTERVAL: %w", err)
+		}
+		interval = d
+	}
+
+	opts := []blueprints.Option{blueprints.WithLogger(logger)}
+	if url := os.Getenv("INFRA_GIT_URL"); url != "" {
+		dir := os.Getenv("INFRA_GIT_DIR")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "goosed-infra")
+		}
+		src := &blueprints.GitSource{
+			URL:            url,
+			Ref:            os.Getenv("INFRA_GIT_REF"),
+			Dir:            dir,
+			Path:           os.Getenv("INFRA_GIT_PATH"),
+			SSHKeyFile:     os.Getenv("INFRA_GIT_SSH_KEY"),
+			KnownHostsFile: os.Getenv("INFRA_GIT_KNOWN_HOSTS"),
+		}
+		opts = append(opts, blueprints.WithGit(src))
+		logger.Printf("INFO watching %s at %s", src.DisplayURL(), refOrHead(src.Ref))
+	}
+	trust := &blueprints.TrustStore{
+		AllowedSignersFile: os.Getenv("INFRA_GIT_ALLOWED_SIGNERS"),
+		GPGKeyringFile:     os.Getenv("INFRA_GIT_GPG_KEYRING"),
+	}
+	if trust.AllowedSignersFile != "" || trust.GPGKeyringFile != "" {
+		if os.Getenv("INFRA_GIT_URL") == "" {
+			closeFn()
+			return nil, nil, errors.New("INFRA_GIT_ALLOWED_SIGNERS and INFRA_GIT_GPG_KEYRING need INFRA_GIT_URL")
+		}
+		opts = append(opts, blueprints.WithTrustStore(trust))
+		logger.Printf("INFO requiring commits signed by a trusted key")
+	}
+	return blueprints.NewWatcher(pub, "", interval, opts...), closeFn, nil
+}
+
+func refOrHead(ref string) string {
+	if ref == "" {
+		return "HEAD"
+	}
+	return ref
+}
+
+// logPublisher stands in for NATS when NATS_URL is unset.
+type logPublisher struct{ logger *log.Logger }
+
+func (p logPublisher) Publish(ctx context.Context, subj string, v any) error {
+	switch ev := v.(type) {
+	case blueprints.UpdatedEvent:
+		p.logger.Printf("INFO %s version=%s valid=%d invalid=%d changed=%d", subj, ev.Version, len(ev.Valid), len(ev.Invalid), len(ev.Changed))
+	case blueprints.RejectedEvent:
+		p.logger.Printf("WARN %s commit=%s signature=%s serving=%s", subj, ev.Commit.SHA, ev.Commit.Signature.Status, ev.Version)
+	}
+	return nil
+}
+
+// snapshotStatus is the body of GET /v1/snapshot and the rollback endpoints.
+type snapshotStatus struct {
+	Version         string                     `json:"version"`
+	UpdatedAt       time.Time                  `json:"updated_at"`
+	Commit          *blueprints.Commit         `json:"commit,omitempty"`
+	RolledBack      bool                       `json:"rolled_back"`
+	Blueprints      int                        `json:"blueprints_count"`
+	Workflows       int                        `json:"workflows_count"`
+	MachineProfiles int                        `json:"machine_profiles_count"`
+	Overlays        int                        `json:"overlays_count"`
+	Invalid         []blueprints.InvalidObject `json:"invalid"`
+}
+
+func statusOf(s blueprints.Snapshot) snapshotStatus {
+	invalid := s.Invalid
+	if invalid == nil {
+		invalid = []blueprints.InvalidObject{}
+	}
+	return snapshotStatus{
+		Version:         s.Version,
+		UpdatedAt:       s.UpdatedAt,
+		Commit:          s.Commit,
+		RolledBack:      s.RolledBack,
+		Blueprints:      len(s.Blueprints),
+		Workflows:       len(s.Workflows),
+		MachineProfiles: len(s.MachineProfiles),
+		Overlays:        len(s.Overlays),
+		Invalid:         invalid,
+	}
+}
+
+func snapshotHandler(watcher *blueprints.Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, statusOf(watcher.Snapshot()))
+	}
+}
+
+// rollbackHandler holds the snapshot at {"ref": "<commit, tag or branch>"}
+// until DELETE /v1/rollback.
+func rollbackHandler(watcher *blueprints.Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Ref string `json:"ref"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil || req.Ref == "" {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error": "body must be {\"ref\": \"<commit>\"}"})
+			return
+		}
+		snap, err := watcher.Rollback(r.Context(), req.Ref)
+		if err != nil {
+			respondJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		respondJSON(w, http.StatusOK, statusOf(snap))
+	}
+}
+
+// requireToken admits requests that carry token as a bearer token. Without a
+// token nothing is admitted, since a rollback changes what every machine is
+// rendered from.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			respondJSON(w, http.StatusForbidden, map[string]string{"error": "rollback is disabled; set ROLLBACK_TOKEN"})
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondJSON(w, http.StatusUnauthorized, map[string]string{"error": "a valid bearer token is required"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func resumeHandler(watcher *blueprints.Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snap, err := watcher.Resume(r.Context())
+		if err != nil {
+			respondJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		respondJSON(w, http.StatusOK, statusOf(snap))
+	}
+}
+
+func respondJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
 }
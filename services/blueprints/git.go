@@ -0,0 +1,354 @@
+package blueprints
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// GitSource keeps a clone of a Git remote and a checkout of a branch, tag or
+// commit. It shells out to git, which must be on PATH. The whole history is
+// fetched so any earlier commit can be checked out again.
+//
+// Each commit is checked out into its own directory, Dir/trees/<sha>, and
+// Dir/current is a symlink to the one in use. Switching commits replaces the
+// symlink atomically, so a reader such as goosed-api sees one commit or the
+// next, never a tree that is half way between them.
+type GitSource struct {
+	// URL is an HTTPS or SSH remote (https://..., ssh://..., git@host:path),
+	// or the path or file:// URL of a local bare repository.
+	URL string
+	// Ref is a branch, tag or commit SHA. Empty follows the remote's HEAD.
+	Ref string
+	// Dir holds the clone and the checkouts; it is created on the first
+	// Fetch.
+	Dir string
+	// Path is the directory within the repository that holds blueprints/,
+	// workflows/ and the other infra/ directories. Empty is the root.
+	Path string
+	// SSHKeyFile and KnownHostsFile are used for SSH remotes. Without
+	// KnownHostsFile, host keys are accepted on first use.
+	SSHKeyFile     string
+	KnownHostsFile string
+}
+
+// Commit is the commit a snapshot was read from, recorded for audit.
+type Commit struct {
+	SHA     string    `json:"sha"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+	// Signature is set when the watcher verifies commit signatures.
+	Signature *Signature `json:"signature,omitempty"`
+}
+
+// Checkouts under Dir.
+const (
+	treesDir    = "trees"
+	currentLink = "current"
+)
+
+var shaRE = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+// Root returns the directory the watcher reads documents from, through the
+// current symlink.
+func (g *GitSource) Root() string {
+	return filepath.Join(g.Dir, currentLink, filepath.FromSlash(g.Path))
+}
+
+// Fetch clones the remote into Dir the first time and fetches every branch
+// and tag after that.
+func (g *GitSource) Fetch(ctx context.Context) error {
+	if g.URL == "" || g.Dir == "" {
+		return errors.New("git source needs a URL and a directory")
+	}
+	if _, err := os.Stat(filepath.Join(g.Dir, ".git")); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(g.Dir, 0o755); err != nil {
+			return fmt.Errorf("create %s: %w", g.Dir, err)
+		}
+		if _, err := g.git(ctx, "init", "--quiet"); err != nil {
+			return err
+		}
+		if _, err := g.git(ctx, "remote", "add", "origin", g.URL); err != nil {
+			return err
+		}
+	} else if _, err := g.git(ctx, "remote", "set-url", "origin", g.URL); err != nil {
+		return err
+	}
+
+	if _, err := g.git(ctx, "fetch", "--quiet", "--prune", "--force", "origin",
+		"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"); err != nil {
+		return err
+	}
+	if g.Ref == "" {
+		if _, err := g.git(ctx, "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve returns the commit SHA ref names among the fetched branches, tags
+// and commits. Empty resolves the remote's HEAD.
+func (g *GitSource) Resolve(ctx context.Context, ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid ref %q", ref)
+	}
+	var candidates []string
+	switch {
+	case ref == "":
+		candidates = []string{"refs/remotes/origin/HEAD"}
+	case strings.HasPrefix(ref, "refs/heads/"):
+		candidates = []string{"refs/remotes/origin/" + strings.TrimPrefix(ref, "refs/heads/")}
+	case strings.HasPrefix(ref, "refs/"):
+		candidates = []string{ref}
+	default:
+		candidates = []string{"refs/remotes/origin/" + ref, "refs/tags/" + ref}
+		if shaRE.MatchString(ref) {
+			candidates = append(candidates, ref)
+		}
+	}
+	for _, c := range candidates {
+		out, err := g.git(ctx, "rev-parse", "--verify", "--quiet", c+"^{commit}")
+		if err == nil {
+			return strings.TrimSpace(out), nil
+		}
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return "", fmt.Errorf("ref %s is not a fetched branch, tag or commit", ref)
+}
+
+// Checkout writes sha to Dir/trees/<sha>, unless it is there already, points
+// Dir/current at it and returns the commit. Trees other than the new one and
+// the one it replaced, which readers may still be in, are removed.
+func (g *GitSource) Checkout(ctx context.Context, sha string) (Commit, error) {
+	if !shaRE.MatchString(sha) {
+		return Commit{}, fmt.Errorf("checkout %q: not a commit SHA", sha)
+	}
+	trees := filepath.Join(g.Dir, treesDir)
+	tree := filepath.Join(trees, sha)
+	if _, err := os.Stat(tree); errors.Is(err, fs.ErrNotExist) {
+		if err := g.export(ctx, sha, trees); err != nil {
+			return Commit{}, err
+		}
+	} else if err != nil {
+		return Commit{}, err
+	}
+
+	link := filepath.Join(g.Dir, currentLink)
+	prev, _ := os.Readlink(link)
+	tmp := link + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Commit{}, fmt.Errorf("switch to %s: %w", sha, err)
+	}
+	// Relative, so the link resolves wherever the volume is mounted.
+	if err := os.Symlink(filepath.Join(treesDir, sha), tmp); err != nil {
+		return Commit{}, fmt.Errorf("switch to %s: %w", sha, err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		return Commit{}, fmt.Errorf("switch to %s: %w", sha, err)
+	}
+
+	entries, err := os.ReadDir(trees)
+	if err != nil {
+		return Commit{}, err
+	}
+	for _, e := range entries {
+		if e.Name() == sha || e.Name() == filepath.Base(prev) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(trees, e.Name())); err != nil {
+			return Commit{}, fmt.Errorf("remove old checkout %s: %w", e.Name(), err)
+		}
+	}
+	return g.Commit(ctx, sha)
+}
+
+// export writes the files of sha to trees/<sha>. They are unpacked from git
+// archive into a temporary directory that is renamed into place, so a tree
+// is either complete or absent. Symlinks and submodules are left out.
+func (g *GitSource) export(ctx context.Context, sha, trees string) error {
+	if err := os.MkdirAll(trees, 0o755); err != nil {
+		return fmt.Errorf("create %s: %w", trees, err)
+	}
+	tmp, err := os.MkdirTemp(trees, ".tmp-"+sha+"-")
+	if err != nil {
+		return fmt.Errorf("check out %s: %w", sha, err)
+	}
+	out, err := g.git(ctx, "archive", "--format=tar", sha)
+	if err == nil {
+		err = untar(strings.NewReader(out), tmp)
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0o755)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(trees, sha))
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return fmt.Errorf("check out %s: %w", sha, err)
+	}
+	return nil
+}
+
+// untar writes the directories and regular files of a tar stream under dir.
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("archive entry %q escapes the checkout", hdr.Name)
+		}
+		p := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fs.FileMode(hdr.Mode)&0o755|0o644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Commit describes sha.
+func (g *GitSource) Commit(ctx context.Context, sha string) (Commit, error) {
+	out, err := g.git(ctx, "log", "-1", "--format=%H%n%an <%ae>%n%aI%n%B", sha)
+	if err != nil {
+		return Commit{}, err
+	}
+	fields := strings.SplitN(out, "\n", 4)
+	if len(fields) < 4 {
+		return Commit{}, fmt.Errorf("unexpected git log output for %s", sha)
+	}
+	date, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return Commit{}, fmt.Errorf("parse commit date %q: %w", fields[2], err)
+	}
+	return Commit{
+		SHA:     fields[0],
+		Author:  fields[1],
+		Date:    date.UTC(),
+		Message: strings.TrimSpace(fields[3]),
+	}, nil
+}
+
+// git runs git in Dir and returns its standard output.
+func (g *GitSource) git(ctx context.Context, args ...string) (string, error) {
+	return g.gitEnv(ctx, nil, args...)
+}
+
+// gitEnv is git with extra environment variables.
+func (g *GitSource) gitEnv(ctx context.Context, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = g.Dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, env...)
+	if ssh := g.sshCommand(); ssh != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+ssh)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("git %s: %s", subcommand(args), redact(msg, g.URL))
+	}
+	return stdout.String(), nil
+}
+
+// subcommand returns the git command in args, skipping -c options.
+func subcommand(args []string) string {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-c" {
+			i++
+			continue
+		}
+		return args[i]
+	}
+	return ""
+}
+
+func (g *GitSource) sshCommand() string {
+	if g.SSHKeyFile == "" && g.KnownHostsFile == "" {
+		return ""
+	}
+	args := []string{"ssh", "-o", "BatchMode=yes"}
+	if g.SSHKeyFile != "" {
+		args = append(args, "-i", shellQuote(g.SSHKeyFile), "-o", "IdentitiesOnly=yes")
+	}
+	if g.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+shellQuote(g.KnownHostsFile), "-o", "StrictHostKeyChecking=yes")
+	} else {
+		args = append(args, "-o", "StrictHostKeyChecking=accept-new")
+	}
+	return strings.Join(args, " ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// redact removes the password or token of an HTTPS remote from git's output.
+func redact(msg, remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return msg
+	}
+	secret, ok := u.User.Password()
+	if !ok {
+		// A token given as the user name, as in https://TOKEN@host/repo.
+		secret = u.User.Username()
+	}
+	if secret == "" {
+		return msg
+	}
+	return strings.ReplaceAll(msg, secret, "xxxxx")
+}
+
+// DisplayURL returns URL without credentials, for logs and events.
+func (g *GitSource) DisplayURL() string {
+	u, err := url.Parse(g.URL)
+	if err != nil || u.User == nil || u.Scheme == "" {
+		return g.URL
+	}
+	u.User = nil
+	return u.String()
+}
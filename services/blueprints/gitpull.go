@@ -3,48 +3,186 @@ package blueprints
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io/fs"
+	"log"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
-	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
 
-	"goosed/pkg/bus"
+	"goosed/pkg/schema"
 )
 
 const (
 	defaultInfraPath    = "./infra"
 	blueprintsDir       = "blueprints"
 	workflowsDir        = "workflows"
+	profilesDir         = "machine-profiles"
+	overlaysDir         = "overlays"
+	blueprintFile       = "blueprint.yaml"
 	blueprintsTopicName = "goosed.blueprints.updated"
+	rejectedTopicName   = "goosed.blueprints.rejected"
+	// pinFile, under the clone's .git directory, records the commit
+	// Rollback holds the watcher at so a restart keeps it there.
+	pinFile = "goosed-rollback"
 )
 
-// Snapshot represents the in-memory view of blueprints and workflows loaded from disk.
+// dirKinds maps each directory the watcher reads to the kind its documents
+// must have.
+var dirKinds = []struct{ dir, kind string }{
+	{blueprintsDir, schema.KindBlueprint},
+	{workflowsDir, schema.KindWorkflow},
+	{profilesDir, schema.KindMachineProfile},
+	{overlaysDir, schema.KindProfileOverlay},
+}
+
+// Snapshot represents the in-memory view of the valid documents loaded from
+// disk. Invalid files are left out and listed in Invalid.
 type Snapshot struct {
-	Version    string
-	UpdatedAt  time.Time
-	Blueprints map[string]string
-	Workflows  map[string]string
+	// Version is the commit SHA when reading from Git, otherwise a nonce
+	// that changes with the files.
+	Version   string
+	UpdatedAt time.Time
+	// Commit is the commit the documents were read from, if any.
+	Commit *Commit
+	// RolledBack is set while the watcher is held at an earlier commit by
+	// Rollback.
+	RolledBack bool
+	// Blueprints are keyed by reference, such as rocky/9/base.
+	Blueprints map[string]*schema.Blueprint
+	// Workflows are keyed by metadata.name.
+	Workflows map[string]*schema.Workflow
+	// MachineProfiles are keyed by MAC address.
+	MachineProfiles map[string]*schema.MachineProfile
+	// Overlays are keyed by metadata.name.
+	Overlays map[string]*schema.ProfileOverlay
+	Invalid  []InvalidObject
+
+	// files holds the content of every file read, by path relative to the
+	// infra root, to tell which objects changed.
+	files map[string]string
+}
+
+// ObjectRef names a document under the infra root.
+type ObjectRef struct {
+	// File is relative to the infra root, such as workflows/rocky-default.yaml.
+	File string `json:"file"`
+	Kind string `json:"kind,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// InvalidObject is a file that was rejected and why.
+type InvalidObject struct {
+	ObjectRef
+	Errors []string `json:"errors"`
+}
+
+// ChangedObject is a file added, modified or removed since the last snapshot.
+type ChangedObject struct {
+	ObjectRef
+	Change string `json:"change"`
+}
+
+// Changes recorded in ChangedObject.
+const (
+	ChangeAdded    = "added"
+	ChangeModified = "modified"
+	ChangeRemoved  = "removed"
+)
+
+// UpdatedEvent is the payload published on goosed.blueprints.updated.
+type UpdatedEvent struct {
+	Version              string          `json:"version"`
+	UpdatedAt            time.Time       `json:"updated_at"`
+	Commit               *Commit         `json:"commit,omitempty"`
+	RolledBack           bool            `json:"rolled_back,omitempty"`
+	BlueprintsCount      int             `json:"blueprints_count"`
+	WorkflowsCount       int             `json:"workflows_count"`
+	MachineProfilesCount int             `json:"machine_profiles_count"`
+	OverlaysCount        int             `json:"overlays_count"`
+	Valid                []ObjectRef     `json:"valid"`
+	Invalid              []InvalidObject `json:"invalid"`
+	Changed              []ChangedObject `json:"changed"`
+}
+
+// RejectedEvent is the payload published on goosed.blueprints.rejected when
+// a commit is refused for its signature. It is published once per commit.
+type RejectedEvent struct {
+	// Commit is the refused commit; Commit.Signature says why.
+	Commit     Commit    `json:"commit"`
+	RejectedAt time.Time `json:"rejected_at"`
+	// Version is the snapshot that keeps being served.
+	Version string `json:"version"`
+}
+
+// Publisher is satisfied by *bus.Bus.
+type Publisher interface {
+	Publish(ctx context.Context, subj string, v any) error
 }
 
-// Watcher monitors the local infrastructure repository and publishes updates when
-// changes are detected.
+// Watcher monitors the infrastructure repository and publishes updates when
+// changes are detected. It reads a local directory, or with WithGit, fetches
+// a Git remote and reads the checked out commit.
 type Watcher struct {
-	bus       *bus.Bus
+	pub       Publisher
 	infraPath string
 	interval  time.Duration
+	git       *GitSource
+	trust     *TrustStore
+	logger    *log.Logger
+
+	// syncMu serialises syncs, which switch the current checkout.
+	syncMu sync.Mutex
+	// pin is the commit Rollback holds the watcher at, persisted in
+	// pinFile.
+	pin string
+	// rejected is the last commit a RejectedEvent was published for.
+	rejected string
 
 	mu       sync.RWMutex
 	snapshot Snapshot
 }
 
+// Option configures a Watcher.
+type Option func(*Watcher)
+
+// WithGit makes the watcher fetch src on every poll and read the documents
+// at src.Ref from src.Root().
+func WithGit(src *GitSource) Option {
+	return func(w *Watcher) {
+		w.git = src
+		w.infraPath = src.Root()
+	}
+}
+
+// WithTrustStore makes a Git watcher refuse commits that are not signed by
+// a key in trust: the previous snapshot is kept and a RejectedEvent is
+// published instead of an update.
+func WithTrustStore(trust *TrustStore) Option {
+	return func(w *Watcher) {
+		w.trust = trust
+	}
+}
+
+// WithLogger sets the logger fetch failures are reported to.
+func WithLogger(logger *log.Logger) Option {
+	return func(w *Watcher) {
+		w.logger = logger
+	}
+}
+
 // NewWatcher builds a new Watcher instance. If infraPath is empty the INFRA_PATH
 // environment variable is considered before falling back to ./infra. Interval
 // defaults to 30 seconds when not provided.
-func NewWatcher(b *bus.Bus, infraPath string, interval time.Duration) *Watcher {
+func NewWatcher(pub Publisher, infraPath string, interval time.Duration, opts ...Option) *Watcher {
 	if infraPath == "" {
 		infraPath = os.Getenv("INFRA_PATH")
 	}
@@ -55,15 +193,26 @@ func NewWatcher(b *bus.Bus, infraPath string, interval time.Duration) *Watcher {
 		interval = 30 * time.Second
 	}
 
-	return &Watcher{
-		bus:       b,
+	w := &Watcher{
+		pub:       pub,
 		infraPath: infraPath,
 		interval:  interval,
-		snapshot: Snapshot{
-			Blueprints: map[string]string{},
-			Workflows:  map[string]string{},
-		},
+		logger:    log.Default(),
+		snapshot:  newSnapshot(),
+	}
+	for _, opt := range opts {
+		opt(w)
 	}
+	if w.git != nil {
+		pin, err := os.ReadFile(w.pinPath())
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			w.logger.Printf("WARN blueprints: read rollback pin: %v", err)
+		}
+		if w.pin = strings.TrimSpace(string(pin)); w.pin != "" {
+			w.logger.Printf("INFO blueprints: held at %s by an earlier rollback", w.pin)
+		}
+	}
+	return w
 }
 
 // Start begins polling the infra repository and publishing updates. It blocks
@@ -72,7 +221,7 @@ func (w *Watcher) Start(ctx context.Context) error {
 	if w == nil {
 		return errors.New("nil watcher")
 	}
-	if w.bus == nil {
+	if w.pub == nil {
 		return errors.New("bus is required")
 	}
 	if ctx == nil {
@@ -81,7 +230,11 @@ func (w *Watcher) Start(ctx context.Context) error {
 
 	// Perform an initial sync so consumers receive the latest view right away.
 	if err := w.sync(ctx, true); err != nil {
-		return err
+		if w.git == nil {
+			return err
+		}
+		// Not ready until a later tick loads a snapshot.
+		w.logger.Printf("WARN blueprints: sync %s: %v", w.git.DisplayURL(), err)
 	}
 
 	ticker := time.NewTicker(w.interval)
@@ -93,13 +246,19 @@ func (w *Watcher) Start(ctx context.Context) error {
 			return ctx.Err()
 		case <-ticker.C:
 			if err := w.sync(ctx, false); err != nil {
-				return err
+				if w.git == nil {
+					return err
+				}
+				// The remote may be briefly unreachable; keep serving the
+				// last snapshot and try again on the next tick.
+				w.logger.Printf("WARN blueprints: sync %s: %v", w.git.DisplayURL(), err)
 			}
 		}
 	}
 }
 
-// Snapshot returns a copy of the latest cached state.
+// Snapshot returns a copy of the latest cached state. The objects are shared
+// and must not be modified.
 func (w *Watcher) Snapshot() Snapshot {
 	if w == nil {
 		return Snapshot{}
@@ -109,26 +268,126 @@ func (w *Watcher) Snapshot() Snapshot {
 	defer w.mu.RUnlock()
 
 	return Snapshot{
-		Version:    w.snapshot.Version,
-		UpdatedAt:  w.snapshot.UpdatedAt,
-		Blueprints: cloneMap(w.snapshot.Blueprints),
-		Workflows:  cloneMap(w.snapshot.Workflows),
+		Version:         w.snapshot.Version,
+		UpdatedAt:       w.snapshot.UpdatedAt,
+		Commit:          w.snapshot.Commit,
+		RolledBack:      w.snapshot.RolledBack,
+		Blueprints:      maps.Clone(w.snapshot.Blueprints),
+		Workflows:       maps.Clone(w.snapshot.Workflows),
+		MachineProfiles: maps.Clone(w.snapshot.MachineProfiles),
+		Overlays:        maps.Clone(w.snapshot.Overlays),
+		Invalid:         slices.Clone(w.snapshot.Invalid),
 	}
 }
 
+// Rollback checks out ref, usually an earlier commit, and holds the watcher
+// there until Resume, publishing the resulting snapshot. Fetches continue in
+// the meantime, and the pin survives a restart.
+func (w *Watcher) Rollback(ctx context.Context, ref string) (Snapshot, error) {
+	if w.git == nil {
+		return Snapshot{}, errors.New("rollback needs a Git source")
+	}
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	sha, err := w.git.Resolve(ctx, ref)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := w.setPin(ctx, sha); err != nil {
+		return Snapshot{}, err
+	}
+	return w.Snapshot(), nil
+}
+
+// Resume releases a Rollback and returns to the configured ref.
+func (w *Watcher) Resume(ctx context.Context) (Snapshot, error) {
+	if w.git == nil {
+		return Snapshot{}, errors.New("resume needs a Git source")
+	}
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	if err := w.setPin(ctx, ""); err != nil {
+		return Snapshot{}, err
+	}
+	return w.Snapshot(), nil
+}
+
+// setPin records sha, or no pin when empty, in pinFile and syncs to it. The
+// previous pin is restored if the sync fails.
+func (w *Watcher) setPin(ctx context.Context, sha string) error {
+	prev := w.pin
+	if err := w.savePin(sha); err != nil {
+		return err
+	}
+	w.pin = sha
+	if err := w.syncLocked(ctx, false); err != nil {
+		w.pin = prev
+		if perr := w.savePin(prev); perr != nil {
+			w.logger.Printf("ERROR blueprints: restore rollback pin %q: %v", prev, perr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (w *Watcher) pinPath() string {
+	return filepath.Join(w.git.Dir, ".git", pinFile)
+}
+
+// savePin writes sha to pinFile, or removes it when sha is empty.
+func (w *Watcher) savePin(sha string) error {
+	if sha == "" {
+		if err := os.Remove(w.pinPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove rollback pin: %w", err)
+		}
+		return nil
+	}
+	tmp := w.pinPath() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sha+"\n"), 0o644); err != nil {
+		return fmt.Errorf("save rollback pin: %w", err)
+	}
+	if err := os.Rename(tmp, w.pinPath()); err != nil {
+		return fmt.Errorf("save rollback pin: %w", err)
+	}
+	return nil
+}
+
 func (w *Watcher) sync(ctx context.Context, force bool) error {
-	current, err := w.readSnapshot()
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	return w.syncLocked(ctx, force)
+}
+
+func (w *Watcher) syncLocked(ctx context.Context, force bool) error {
+	var commit *Commit
+	if w.git != nil {
+		c, err := w.checkout(ctx)
+		if err != nil {
+			return err
+		}
+		commit = &c
+	}
+
+	current, valid, err := w.readSnapshot()
 	if err != nil {
 		return err
 	}
+	current.Commit = commit
+	current.RolledBack = w.pin != ""
 
 	w.mu.Lock()
-	changed := !reflect.DeepEqual(w.snapshot.Blueprints, current.Blueprints) || !reflect.DeepEqual(w.snapshot.Workflows, current.Workflows)
-	if w.snapshot.Version == "" {
-		changed = true
+	changed := changedObjects(w.snapshot.files, current.files, valid, w.snapshot.Invalid, current.Invalid)
+	update := len(changed) > 0 || w.snapshot.Version == ""
+	if commit != nil {
+		update = update || commit.SHA != w.snapshot.Version || current.RolledBack != w.snapshot.RolledBack
 	}
-	if changed {
+	if update {
 		current.Version = uuid.NewString()
+		if commit != nil {
+			current.Version = commit.SHA
+		}
 		current.UpdatedAt = time.Now().UTC()
 		w.snapshot = current
 	} else {
@@ -136,40 +395,269 @@ func (w *Watcher) sync(ctx context.Context, force bool) error {
 	}
 	w.mu.Unlock()
 
-	if !changed && !force {
+	if !update && !force {
 		return nil
 	}
 
-	payload := map[string]any{
-		"version":          current.Version,
-		"updated_at":       current.UpdatedAt,
-		"blueprints_count": len(current.Blueprints),
-		"workflows_count":  len(current.Workflows),
-	}
+	return w.pub.Publish(ctx, blueprintsTopicName, UpdatedEvent{
+		Version:              current.Version,
+		UpdatedAt:            current.UpdatedAt,
+		Commit:               current.Commit,
+		RolledBack:           current.RolledBack,
+		BlueprintsCount:      len(current.Blueprints),
+		WorkflowsCount:       len(current.Workflows),
+		MachineProfilesCount: len(current.MachineProfiles),
+		OverlaysCount:        len(current.Overlays),
+		Valid:                valid,
+		Invalid:              nonNil(current.Invalid),
+		Changed:              nonNil(changed),
+	})
+}
 
-	return w.bus.Publish(ctx, blueprintsTopicName, payload)
+// checkout fetches the remote and checks out the pinned commit, or else the
+// configured ref.
+func (w *Watcher) checkout(ctx context.Context) (Commit, error) {
+	if err := w.git.Fetch(ctx); err != nil {
+		if w.pin == "" {
+			return Commit{}, err
+		}
+		// A rollback must work while the remote is down.
+		w.logger.Printf("WARN blueprints: fetch %s: %v", w.git.DisplayURL(), err)
+	}
+	sha := w.pin
+	if sha == "" {
+		var err error
+		if sha, err = w.git.Resolve(ctx, w.git.Ref); err != nil {
+			return Commit{}, err
+		}
+	}
+	sig, err := w.verify(ctx, sha)
+	if err != nil {
+		return Commit{}, err
+	}
+	commit, err := w.git.Checkout(ctx, sha)
+	if err != nil {
+		return Commit{}, err
+	}
+	commit.Signature = sig
+	return commit, nil
 }
 
-func (w *Watcher) readSnapshot() (Snapshot, error) {
-	base := w.infraPath
-	blueprintsPath := filepath.Join(base, blueprintsDir)
-	workflowsPath := filepath.Join(base, workflowsDir)
+// verify checks the signature on sha when a trust store is configured and
+// fails unless it is trusted. The commit is not checked out until it passes.
+func (w *Watcher) verify(ctx context.Context, sha string) (*Signature, error) {
+	if w.trust == nil {
+		return nil, nil
+	}
+	sig, err := w.git.Verify(ctx, sha, w.trust)
+	if err != nil {
+		signatureVerifications.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("verify %s: %w", sha, err)
+	}
+	signatureVerifications.WithLabelValues(sig.Status).Inc()
+	if !sig.Trusted() {
+		commitRejected.Set(1)
+		w.reject(ctx, sha, sig)
+		if sig.Key != "" {
+			return nil, fmt.Errorf("refusing commit %s: signature by %s is %s", sha, sig.Key, sig.Status)
+		}
+		return nil, fmt.Errorf("refusing commit %s: %s", sha, sig.Status)
+	}
+	commitRejected.Set(0)
+	w.rejected = ""
+	return &sig, nil
+}
 
-	blueprints, err := readFiles(blueprintsPath)
+// reject publishes a RejectedEvent for sha unless the last one was for the
+// same commit, which is refused again on every poll until the ref moves.
+func (w *Watcher) reject(ctx context.Context, sha string, sig Signature) {
+	if sha == w.rejected {
+		return
+	}
+	commit, err := w.git.Commit(ctx, sha)
 	if err != nil {
-		return Snapshot{}, err
+		commit = Commit{SHA: sha}
 	}
-	workflows, err := readFiles(workflowsPath)
+	commit.Signature = &sig
+	err = w.pub.Publish(ctx, rejectedTopicName, RejectedEvent{
+		Commit:     commit,
+		RejectedAt: time.Now().UTC(),
+		Version:    w.Snapshot().Version,
+	})
 	if err != nil {
-		return Snapshot{}, err
+		w.logger.Printf("WARN blueprints: publish rejection of %s: %v", sha, err)
+		return
+	}
+	w.rejected = sha
+}
+
+// readSnapshot parses every YAML file under the infra root and returns the
+// valid objects in a snapshot along with references to them.
+func (w *Watcher) readSnapshot() (Snapshot, []ObjectRef, error) {
+	snap := newSnapshot()
+	var docs []*schema.Document
+	for _, d := range dirKinds {
+		files, err := readFiles(filepath.Join(w.infraPath, d.dir))
+		if err != nil {
+			return Snapshot{}, nil, err
+		}
+		for _, rel := range sortedKeys(files) {
+			file := path.Join(d.dir, rel)
+			snap.files[file] = files[rel]
+			doc, err := schema.Parse(file, []byte(files[rel]))
+			if err == nil && doc.Kind() != d.kind {
+				err = doc.Problem("kind", "%s documents do not belong under %s/; want %s", doc.Kind(), d.dir, d.kind)
+			}
+			if err == nil && d.kind == schema.KindBlueprint && path.Base(rel) != blueprintFile {
+				err = doc.Problem("", "blueprints are read from %s/<ref>/%s", blueprintsDir, blueprintFile)
+			}
+			if err != nil {
+				snap.Invalid = append(snap.Invalid, invalidObject(file, files[rel], err))
+				continue
+			}
+			docs = append(docs, doc)
+		}
 	}
 
+	// Blueprints, workflows and overlays first, so machine profiles can be
+	// checked against them.
+	var valid []ObjectRef
+	accept := func(doc *schema.Document) {
+		valid = append(valid, ObjectRef{File: doc.File, Kind: doc.Kind(), Name: doc.Name()})
+	}
+	reject := func(doc *schema.Document, err error) {
+		snap.Invalid = append(snap.Invalid, invalidObject(doc.File, snap.files[doc.File], err))
+	}
+	var (
+		profiles []*schema.Document
+		// defined maps workflow and overlay names and MACs to the file
+		// that claimed them first.
+		defined = map[string]string{}
+	)
+	claim := func(doc *schema.Document, key string) (string, bool) {
+		if prev, ok := defined[key]; ok {
+			return prev, false
+		}
+		defined[key] = doc.File
+		return "", true
+	}
+	for _, doc := range docs {
+		switch obj := doc.Object.(type) {
+		case *schema.Blueprint:
+			ref := path.Dir(strings.TrimPrefix(doc.File, blueprintsDir+"/"))
+			snap.Blueprints[ref] = obj
+			accept(doc)
+		case *schema.Workflow:
+			if prev, ok := claim(doc, "workflow/"+obj.Metadata.Name); !ok {
+				reject(doc, doc.Problem("metadata.name", "workflow %s is also defined by %s", obj.Metadata.Name, prev))
+				continue
+			}
+			snap.Workflows[obj.Metadata.Name] = obj
+			accept(doc)
+		case *schema.ProfileOverlay:
+			if prev, ok := claim(doc, "overlay/"+obj.Metadata.Name); !ok {
+				reject(doc, doc.Problem("metadata.name", "overlay %s is also defined by %s", obj.Metadata.Name, prev))
+				continue
+			}
+			snap.Overlays[obj.Metadata.Name] = obj
+			accept(doc)
+		case *schema.MachineProfile:
+			profiles = append(profiles, doc)
+		}
+	}
+	for _, doc := range profiles {
+		obj := doc.Object.(*schema.MachineProfile)
+		spec := obj.Spec
+		if spec.Blueprint != "" && snap.Blueprints[strings.Trim(spec.Blueprint, "/")] == nil {
+			reject(doc, doc.Problem("spec.blueprint", "blueprint %s not found", spec.Blueprint))
+			continue
+		}
+		if spec.Workflow != "" && snap.Workflows[spec.Workflow] == nil {
+			reject(doc, doc.Problem("spec.workflow", "workflow %s not found", spec.Workflow))
+			continue
+		}
+		if prev, ok := claim(doc, "mac/"+spec.Machine.MAC); !ok {
+			reject(doc, doc.Problem("spec.machine.mac", "mac %s is also declared by %s", spec.Machine.MAC, prev))
+			continue
+		}
+		snap.MachineProfiles[spec.Machine.MAC] = obj
+		accept(doc)
+	}
+
+	slices.SortFunc(valid, func(a, b ObjectRef) int { return strings.Compare(a.File, b.File) })
+	slices.SortFunc(snap.Invalid, func(a, b InvalidObject) int { return strings.Compare(a.File, b.File) })
+	return snap, nonNil(valid), nil
+}
+
+func newSnapshot() Snapshot {
 	return Snapshot{
-		Blueprints: blueprints,
-		Workflows:  workflows,
-	}, nil
+		Blueprints:      map[string]*schema.Blueprint{},
+		Workflows:       map[string]*schema.Workflow{},
+		MachineProfiles: map[string]*schema.MachineProfile{},
+		Overlays:        map[string]*schema.ProfileOverlay{},
+		files:           map[string]string{},
+	}
+}
+
+// invalidObject names a rejected file by whatever kind and name it declares.
+func invalidObject(file, content string, err error) InvalidObject {
+	obj := InvalidObject{ObjectRef: ObjectRef{File: file}}
+	var header schema.Header
+	if yaml.Unmarshal([]byte(content), &header) == nil {
+		obj.Kind, obj.Name = header.Kind, header.Metadata.Name
+	}
+	var serr *schema.Error
+	if !errors.As(err, &serr) {
+		obj.Errors = []string{err.Error()}
+		return obj
+	}
+	for _, p := range serr.Problems {
+		obj.Errors = append(obj.Errors, (&schema.Error{File: file, Problems: []schema.Problem{p}}).Error())
+	}
+	return obj
 }
 
+// changedObjects compares the files of two snapshots. Objects are named as in
+// the newer snapshot, or the older one for removed files.
+func changedObjects(before, after map[string]string, valid []ObjectRef, invalidBefore, invalidAfter []InvalidObject) []ChangedObject {
+	refs := map[string]ObjectRef{}
+	for _, inv := range invalidBefore {
+		refs[inv.File] = inv.ObjectRef
+	}
+	for _, inv := range invalidAfter {
+		refs[inv.File] = inv.ObjectRef
+	}
+	for _, ref := range valid {
+		refs[ref.File] = ref
+	}
+
+	var changed []ChangedObject
+	for _, file := range sortedKeys(after) {
+		prev, ok := before[file]
+		switch {
+		case !ok:
+			changed = append(changed, ChangedObject{ObjectRef: refOf(refs, file), Change: ChangeAdded})
+		case prev != after[file]:
+			changed = append(changed, ChangedObject{ObjectRef: refOf(refs, file), Change: ChangeModified})
+		}
+	}
+	for _, file := range sortedKeys(before) {
+		if _, ok := after[file]; !ok {
+			changed = append(changed, ChangedObject{ObjectRef: refOf(refs, file), Change: ChangeRemoved})
+		}
+	}
+	return changed
+}
+
+func refOf(refs map[string]ObjectRef, file string) ObjectRef {
+	if ref, ok := refs[file]; ok {
+		return ref
+	}
+	return ObjectRef{File: file}
+}
+
+// readFiles returns the content of every YAML file under root by
+// slash-separated path relative to root. A missing root is empty.
 func readFiles(root string) (map[string]string, error) {
 	result := map[string]string{}
 
@@ -191,6 +679,9 @@ func readFiles(root string) (map[string]string, error) {
 		if d.IsDir() {
 			return nil
 		}
+		if ext := strings.ToLower(filepath.Ext(path)); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
 		data, err := os.ReadFile(path)
 		if err != nil {
 			return err
@@ -209,13 +700,19 @@ func readFiles(root string) (map[string]string, error) {
 	return result, nil
 }
 
-func cloneMap(src map[string]string) map[string]string {
-	if src == nil {
-		return map[string]string{}
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	out := make(map[string]string, len(src))
-	for k, v := range src {
-		out[k] = v
+	slices.Sort(keys)
+	return keys
+}
+
+// nonNil makes empty lists encode as [] rather than null.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
 	}
-	return out
+	return s
 }
@@ -0,0 +1,159 @@
+package blueprints
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type recordingPublisher struct {
+	events   []UpdatedEvent
+	rejected []RejectedEvent
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, subj string, v any) error {
+	switch subj {
+	case blueprintsTopicName:
+		p.events = append(p.events, v.(UpdatedEvent))
+	case rejectedTopicName:
+		p.rejected = append(p.rejected, v.(RejectedEvent))
+	}
+	return nil
+}
+
+const (
+	testBlueprint = `apiVersion: goosed.io/v1alpha1
+kind: Blueprint
+metadata: {name: rocky-9-base}
+spec:
+  os: {family: rocky}
+`
+	testWorkflow = `apiVersion: goosed.io/v1alpha1
+kind: Workflow
+metadata: {name: rocky-default}
+spec:
+  steps:
+    - action: await-agent
+`
+	testProfile = `apiVersion: goosed.io/v1alpha1
+kind: MachineProfile
+metadata: {name: node-1}
+spec:
+  machine: {mac: "00:11:22:AA:BB:CC"}
+  blueprint: rocky/9/base
+  workflow: rocky-default
+`
+)
+
+func TestWatcherSync(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "blueprints/rocky/9/base/blueprint.yaml", testBlueprint)
+	writeFile(t, root, "blueprints/rocky/9/base/README.md", "not a document")
+	writeFile(t, root, "workflows/rocky-default.yaml", testWorkflow)
+	writeFile(t, root, "machine-profiles/node-1.yaml", testProfile)
+	writeFile(t, root, "machine-profiles/node-2.yaml", strings.Replace(testProfile, "rocky-default", "windows-default", 1))
+	writeFile(t, root, "workflows/broken.yaml", "apiVersion: goosed.io/v1alpha1\nkind: Workflow\nmetadata: {name: broken}\nspec:\n  steps: []\n")
+
+	pub := &recordingPublisher{}
+	w := NewWatcher(pub, root, 0)
+	ctx := context.Background()
+	if err := w.sync(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.events) != 1 {
+		t.Fatalf("published %d events", len(pub.events))
+	}
+	ev := pub.events[0]
+	wantValid := []ObjectRef{
+		{File: "blueprints/rocky/9/base/blueprint.yaml", Kind: "Blueprint", Name: "rocky-9-base"},
+		{File: "machine-profiles/node-1.yaml", Kind: "MachineProfile", Name: "node-1"},
+		{File: "workflows/rocky-default.yaml", Kind: "Workflow", Name: "rocky-default"},
+	}
+	if !reflect.DeepEqual(ev.Valid, wantValid) {
+		t.Fatalf("valid = %+v", ev.Valid)
+	}
+	wantInvalid := []InvalidObject{
+		{ObjectRef{File: "machine-profiles/node-2.yaml", Kind: "MachineProfile", Name: "node-1"}, []string{"machine-profiles/node-2.yaml:7: spec.workflow: workflow windows-default not found"}},
+		{ObjectRef{File: "workflows/broken.yaml", Kind: "Workflow", Name: "broken"}, []string{"workflows/broken.yaml:5: spec.steps: a workflow needs at least one step"}},
+	}
+	if !reflect.DeepEqual(ev.Invalid, wantInvalid) {
+		t.Fatalf("invalid = %+v", ev.Invalid)
+	}
+	if len(ev.Changed) != 5 || ev.Changed[0].Change != ChangeAdded {
+		t.Fatalf("changed = %+v", ev.Changed)
+	}
+	snap := w.Snapshot()
+	if snap.Blueprints["rocky/9/base"] == nil || snap.MachineProfiles["00:11:22:aa:bb:cc"] == nil || len(snap.Workflows) != 1 {
+		t.Fatalf("snapshot = %+v", snap)
+	}
+
+	// Nothing changed: no event.
+	if err := w.sync(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.events) != 1 {
+		t.Fatalf("published %d events for an unchanged tree", len(pub.events))
+	}
+
+	if err := os.Remove(filepath.Join(root, "workflows/broken.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, root, "workflows/rocky-default.yaml", strings.Replace(testWorkflow, "await-agent", "reboot", 1))
+	if err := w.sync(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	ev = pub.events[len(pub.events)-1]
+	wantChanged := []ChangedObject{
+		{ObjectRef{File: "workflows/rocky-default.yaml", Kind: "Workflow", Name: "rocky-default"}, ChangeModified},
+		{ObjectRef{File: "workflows/broken.yaml", Kind: "Workflow", Name: "broken"}, ChangeRemoved},
+	}
+	if !reflect.DeepEqual(ev.Changed, wantChanged) {
+		t.Fatalf("changed = %+v", ev.Changed)
+	}
+	// The machine profile now names a workflow that is invalid.
+	if len(ev.Valid) != 1 || len(ev.Invalid) != 3 || ev.Version == snap.Version {
+		t.Fatalf("event = %+v", ev)
+	}
+}
+
+func TestWatcherRejectsMisplacedDocuments(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "blueprints/rocky/9/base/blueprint.yaml", testWorkflow)
+	writeFile(t, root, "blueprints/rocky/9/extra.yaml", testBlueprint)
+	writeFile(t, root, "machine-profiles/a.yaml", strings.Replace(testProfile, "  blueprint: rocky/9/base\n  workflow: rocky-default\n", "", 1))
+	writeFile(t, root, "machine-profiles/b.yaml", strings.Replace(testProfile, "  blueprint: rocky/9/base\n  workflow: rocky-default\n", "", 1))
+
+	snap, valid, err := NewWatcher(&recordingPublisher{}, root, 0).readSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(valid) != 1 || valid[0].File != "machine-profiles/a.yaml" {
+		t.Fatalf("valid = %+v", valid)
+	}
+	var got []string
+	for _, inv := range snap.Invalid {
+		got = append(got, inv.Errors...)
+	}
+	want := []string{
+		"blueprints/rocky/9/base/blueprint.yaml:2: kind: Workflow documents do not belong under blueprints/; want Blueprint",
+		"blueprints/rocky/9/extra.yaml:1: blueprints are read from blueprints/<ref>/blueprint.yaml",
+		"machine-profiles/b.yaml:5: spec.machine.mac: mac 00:11:22:aa:bb:cc is also declared by machine-profiles/a.yaml",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("errors =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func writeFile(t *testing.T, root, rel, content string) {
+	t.Helper()
+	p := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
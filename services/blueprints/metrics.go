@@ -0,0 +1,17 @@
+package blueprints
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	signatureVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blueprints_signature_verifications_total",
+		Help: "Commit signature checks by result: trusted, untrusted, unsigned, bad, expired, revoked or error.",
+	}, []string{"result"})
+	commitRejected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blueprints_commit_rejected",
+		Help: "1 when the last commit the watcher tried to load was refused for its signature; the previous snapshot is kept.",
+	})
+)
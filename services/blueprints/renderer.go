@@ -1,8 +1,10 @@
 package blueprints
 
 import (
+	"fmt"
 	"sync"
 
+	"goosed/pkg/profile"
 	"goosed/pkg/render"
 )
 
@@ -14,29 +16,34 @@ var (
 
 func getRenderer() (*render.Engine, error) {
 	rendererOnce.Do(func() {
-		renderer, rendererErr = render.New()
+		opts, err := render.OptionsFromEnv()
+		if err != nil {
+			rendererErr = err
+			return
+		}
+		renderer, rendererErr = render.New(opts...)
 	})
 	return renderer, rendererErr
 }
 
-// RenderKickstart renders the Kickstart template using the provided profile data.
-func RenderKickstart(profile map[string]any) string {
+// RenderKickstart renders the Kickstart template using the provided profile
+// data, merged over the built-in defaults.
+func RenderKickstart(profile map[string]any) (string, error) {
 	return renderProfileTemplate("kickstart.tmpl", profile)
 }
 
-// RenderUnattend renders the Windows unattend XML template using the provided profile data.
-func RenderUnattend(profile map[string]any) string {
+// RenderUnattend renders the Windows unattend XML template using the provided
+// profile data, merged over the built-in defaults.
+func RenderUnattend(profile map[string]any) (string, error) {
 	return renderProfileTemplate("unattend.xml.tmpl", profile)
 }
 
-func renderProfileTemplate(name string, profile map[string]any) string {
-	if profile == nil {
-		profile = map[string]any{}
-	}
-
+// renderProfileTemplate renders name for a placeholder machine. No agent
+// token is issued, so the install config enrolls nothing when used as is.
+func renderProfileTemplate(name string, data map[string]any) (string, error) {
 	engine, err := getRenderer()
 	if err != nil {
-		return ""
+		return "", fmt.Errorf("renderer: %w", err)
 	}
 
 	payload := map[string]any{
@@ -45,13 +52,14 @@ func renderProfileTemplate(name string, profile map[string]any) string {
 			"MAC":    "",
 			"Serial": "",
 		},
-		"Profile": profile,
+		"Profile": profile.Merge(profile.Defaults(), data),
+		"Token":   "",
+		"APIBase": "",
 	}
 
 	rendered, err := engine.Render(name, payload)
 	if err != nil {
-		return ""
+		return "", fmt.Errorf("render %s: %w", name, err)
 	}
-
-	return rendered
+	return rendered, nil
 }
@@ -0,0 +1,160 @@
+package blueprints
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TrustStore holds the public keys infra commits must be signed with. SSH
+// signatures are checked against AllowedSignersFile and GPG signatures
+// against the keys in GPGKeyringFile; every key given is trusted.
+type TrustStore struct {
+	// AllowedSignersFile is in ssh-keygen's allowed_signers format:
+	// "<principal> <key type> <key>" per line.
+	AllowedSignersFile string
+	// GPGKeyringFile holds OpenPGP public keys, armored or binary, as written
+	// by gpg --export.
+	GPGKeyringFile string
+
+	mu sync.Mutex
+	// gpgHome is a private GNUPGHOME with GPGKeyringFile imported, and
+	// gpgSum the digest of the keyring it was imported from.
+	gpgHome string
+	gpgSum  [sha256.Size]byte
+}
+
+// Signature states recorded in Signature.Status.
+const (
+	SignatureTrusted   = "trusted"
+	SignatureUntrusted = "untrusted"
+	SignatureUnsigned  = "unsigned"
+	SignatureBad       = "bad"
+	SignatureExpired   = "expired"
+	SignatureRevoked   = "revoked"
+)
+
+// Signature is the result of verifying a commit against a TrustStore.
+type Signature struct {
+	Status string `json:"status"`
+	// Signer is the allowed_signers principal or the GPG user ID.
+	Signer string `json:"signer,omitempty"`
+	// Key is the fingerprint of the signing key, or its GPG key ID when the
+	// key is unknown.
+	Key string `json:"key,omitempty"`
+}
+
+// Trusted reports whether the commit was signed by a key in the trust store.
+func (s Signature) Trusted() bool {
+	return s.Status == SignatureTrusted
+}
+
+// signatureStatus maps git's %G? codes to Signature states. For SSH, U means
+// the key is not in the allowed signers file; for GPG, E means it is not in
+// the keyring.
+var signatureStatus = map[string]string{
+	"G": SignatureTrusted,
+	"U": SignatureUntrusted,
+	"E": SignatureUntrusted,
+	"N": SignatureUnsigned,
+	"B": SignatureBad,
+	"X": SignatureExpired,
+	"Y": SignatureExpired,
+	"R": SignatureRevoked,
+}
+
+// Verify checks the signature on sha against trust.
+func (g *GitSource) Verify(ctx context.Context, sha string, trust *TrustStore) (Signature, error) {
+	env, args, err := trust.gitConfig(ctx)
+	if err != nil {
+		return Signature{}, err
+	}
+	args = append(args, "log", "-1", "--format=%G?%n%GS%n%GF%n%GK", sha)
+	out, err := g.gitEnv(ctx, env, args...)
+	if err != nil {
+		return Signature{}, err
+	}
+	fields := strings.SplitN(out, "\n", 4)
+	if len(fields) < 4 {
+		return Signature{}, fmt.Errorf("unexpected git log output for %s", sha)
+	}
+	status, ok := signatureStatus[fields[0]]
+	if !ok {
+		return Signature{}, fmt.Errorf("unknown signature status %q on %s", fields[0], sha)
+	}
+	key := fields[2]
+	if key == "" {
+		// GPG has only the key ID of a key missing from the keyring.
+		key = strings.TrimSpace(fields[3])
+	}
+	return Signature{Status: status, Signer: fields[1], Key: key}, nil
+}
+
+// gitConfig returns the environment and git options that point signature
+// verification at the trust store and nowhere else.
+func (t *TrustStore) gitConfig(ctx context.Context) ([]string, []string, error) {
+	// Without a file, SSH-signed commits show as untrusted instead of
+	// failing to verify.
+	signers := os.DevNull
+	if t.AllowedSignersFile != "" {
+		if _, err := os.Stat(t.AllowedSignersFile); err != nil {
+			return nil, nil, fmt.Errorf("allowed signers: %w", err)
+		}
+		signers = t.AllowedSignersFile
+	}
+	home, err := t.gnupgHome(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{"GNUPGHOME=" + home},
+		[]string{"-c", "gpg.ssh.allowedSignersFile=" + signers},
+		nil
+}
+
+// gnupgHome imports GPGKeyringFile into a private GNUPGHOME that trusts
+// every key in it, again whenever the file changes. Without a keyring the
+// home is empty, so GPG-signed commits show as untrusted.
+func (t *TrustStore) gnupgHome(ctx context.Context) (string, error) {
+	var keyring []byte
+	if t.GPGKeyringFile != "" {
+		var err error
+		if keyring, err = os.ReadFile(t.GPGKeyringFile); err != nil {
+			return "", fmt.Errorf("gpg keyring: %w", err)
+		}
+	}
+	sum := sha256.Sum256(keyring)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.gpgHome != "" && sum == t.gpgSum {
+		return t.gpgHome, nil
+	}
+
+	home, err := os.MkdirTemp("", "goosed-gnupg-")
+	if err != nil {
+		return "", fmt.Errorf("create gnupg home: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(home, "gpg.conf"), []byte("trust-model always\n"), 0o600); err != nil {
+		os.RemoveAll(home)
+		return "", fmt.Errorf("create gnupg home: %w", err)
+	}
+	if len(keyring) > 0 {
+		cmd := exec.CommandContext(ctx, "gpg", "--homedir", home, "--batch", "--quiet", "--import")
+		cmd.Stdin = bytes.NewReader(keyring)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			os.RemoveAll(home)
+			return "", fmt.Errorf("import gpg keyring %s: %s", t.GPGKeyringFile, strings.TrimSpace(string(out)))
+		}
+	}
+	if t.gpgHome != "" {
+		os.RemoveAll(t.gpgHome)
+	}
+	t.gpgHome, t.gpgSum = home, sum
+	return home, nil
+}
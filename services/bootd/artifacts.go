@@ -0,0 +1,463 @@
+package bootd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNotFound = errors.New("artifact not found")
+	errChecksum = errors.New("artifact checksum mismatch")
+	errBypass   = errors.New("artifact too large to cache")
+)
+
+// upstream is where cache misses are fetched from.
+type upstream interface {
+	// Open downloads key, forwarding Range, If-Range and If-None-Match from
+	// hdr when set. A 304 Not Modified is returned as a response.
+	Open(ctx context.Context, key string, hdr http.Header) (*http.Response, error)
+}
+
+// presignUpstream downloads through artifacts-gw: it asks the gateway for a
+// presigned URL and fetches the object from it, so bootd holds no S3
+// credentials.
+type presignUpstream struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newPresignUpstream(endpoint string) *presignUpstream {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	// No overall timeout: ISOs take as long as they take.
+	return &presignUpstream{endpoint: strings.TrimRight(endpoint, "/"), client: &http.Client{Transport: transport}}
+}
+
+func (u *presignUpstream) Open(ctx context.Context, key string, hdr http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.endpoint+"/v1/presign/get?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("presign %s: %w", key, err)
+	}
+	var presigned struct {
+		URL string `json:"url"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&presigned)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("presign %s: %s", key, resp.Status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode presign response for %s: %w", key, err)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, presigned.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range []string{"Range", "If-Range", "If-None-Match"} {
+		if v := hdr.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	resp, err = u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", key, errNotFound)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("get %s: %s", key, resp.Status)
+	}
+}
+
+// artifactHandler serves /artifacts/<key> from the local cache, fetching
+// misses once however many machines ask for them at the same time.
+type artifactHandler struct {
+	cache    *blobCache
+	upstream upstream
+	logger   *log.Logger
+
+	mu       sync.Mutex
+	inflight map[string]*fetch
+}
+
+func newArtifactHandler(cache *blobCache, up upstream, logger *log.Logger) *artifactHandler {
+	return &artifactHandler{cache: cache, upstream: up, logger: logger, inflight: make(map[string]*fetch)}
+}
+
+func (h *artifactHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/artifacts/")
+	if !fs.ValidPath(key) || key == "." {
+		http.Error(w, "invalid artifact key", http.StatusBadRequest)
+		return
+	}
+	want := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("sha256")))
+	if want != "" && !validSum(want) {
+		http.Error(w, "invalid sha256 query parameter", http.StatusBadRequest)
+		return
+	}
+
+	if p, sum, ok := h.cache.lookup(key, want); ok {
+		f, err := os.Open(p)
+		if err == nil {
+			defer f.Close()
+			artifactRequests.WithLabelValues("hit").Inc()
+			h.serve(w, r, f, sum, "hit")
+			return
+		}
+	}
+
+	f, leader := h.start(key, want)
+	body, err := f.open()
+	switch {
+	case errors.Is(err, errBypass):
+		artifactRequests.WithLabelValues("bypass").Inc()
+		h.proxy(w, r, key)
+		return
+	case err != nil:
+		artifactRequests.WithLabelValues("error").Inc()
+		h.fail(w, key, err)
+		return
+	}
+	defer body.Close()
+
+	result := "miss"
+	if !leader {
+		result = "coalesced"
+	}
+	artifactRequests.WithLabelValues(result).Inc()
+	h.serve(w, r, body, f.checksum(), result)
+}
+
+// serve answers r from content, which may still be downloading. Range
+// requests block until the requested bytes have arrived.
+func (h *artifactHandler) serve(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, sum, result string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Bootd-Cache", result)
+	if sum != "" {
+		w.Header().Set("ETag", `"`+sum+`"`)
+	}
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// proxy streams an artifact that is too large to cache straight from
+// upstream, passing Range through.
+func (h *artifactHandler) proxy(w http.ResponseWriter, r *http.Request, key string) {
+	resp, err := h.upstream.Open(r.Context(), key, r.Header)
+	if err != nil {
+		h.fail(w, key, err)
+		return
+	}
+	defer resp.Body.Close()
+	for _, name := range []string{"Content-Length", "Content-Range", "Content-Type", "Accept-Ranges", "ETag", "Last-Modified"} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.Header().Set("X-Bootd-Cache", "bypass")
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	n, _ := io.Copy(w, resp.Body)
+	upstreamBytes.Add(float64(n))
+}
+
+func (h *artifactHandler) fail(w http.ResponseWriter, key string, err error) {
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+	h.logger.Printf("WARN bootd artifact %s: %v", key, err)
+	http.Error(w, "artifact unavailable", http.StatusBadGateway)
+}
+
+// start joins the in-flight fetch of key for the same expected checksum or
+// begins a new one, so a client asking for the wrong checksum cannot fail
+// the others. The fetch is detached from the request so one client
+// disconnecting does not fail the others either.
+func (h *artifactHandler) start(key, want string) (*fetch, bool) {
+	id := key + "?sha256=" + want
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if f, ok := h.inflight[id]; ok {
+		return f, false
+	}
+	f := newFetch(want)
+	h.inflight[id] = f
+	go h.run(f, id, key, want)
+	return f, true
+}
+
+func (h *artifactHandler) run(f *fetch, id, key, want string) {
+	defer func() {
+		h.mu.Lock()
+		delete(h.inflight, id)
+		h.mu.Unlock()
+	}()
+
+	// A key whose ttl ran out is revalidated with the ETag it had.
+	hdr := http.Header{}
+	var stale string
+	if want == "" {
+		if sum, etag, _, ok := h.cache.resolve(key); ok && etag != "" {
+			hdr.Set("If-None-Match", etag)
+			stale = sum
+		}
+	}
+	resp, err := h.upstream.Open(context.Background(), key, hdr)
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		if p, ok := h.cache.refresh(key, stale); ok {
+			f.finish(p, stale, nil)
+			return
+		}
+		// The blob was evicted in the meantime.
+		resp, err = h.upstream.Open(context.Background(), key, nil)
+	}
+	if err != nil {
+		f.finish("", "", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		f.finish("", "", fmt.Errorf("get %s: %s", key, resp.Status))
+		return
+	}
+	if !h.cache.fits(resp.ContentLength) {
+		f.finish("", "", errBypass)
+		return
+	}
+
+	tmp, err := h.cache.tempFile()
+	if err != nil {
+		f.finish("", "", fmt.Errorf("create cache file: %w", err))
+		return
+	}
+	// Without a length, responses cannot be sized up front, so they wait
+	// for the download to complete.
+	stream := resp.ContentLength >= 0
+	if stream {
+		f.begin(tmp.Name(), resp.ContentLength)
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, 256<<10)
+	var written int64
+	for err == nil {
+		var n int
+		n, err = resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := tmp.Write(buf[:n]); werr != nil {
+				err = werr
+				break
+			}
+			hash.Write(buf[:n])
+			written += int64(n)
+			upstreamBytes.Add(float64(n))
+			if !stream && written > h.cache.maxBytes {
+				err = errBypass
+				break
+			}
+			f.advance(int64(n))
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && stream && written != resp.ContentLength {
+		err = fmt.Errorf("short read: got %d of %d bytes", written, resp.ContentLength)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err == nil && want != "" && sum != want {
+		err = fmt.Errorf("%w: got %s, want %s", errChecksum, sum, want)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		f.finish("", "", err)
+		return
+	}
+	etag := resp.Header.Get("ETag")
+	f.commit(func() (string, error) { return h.cache.commit(key, tmp.Name(), sum, etag, written) }, sum)
+}
+
+// fetch is one upstream download written to a temporary file that any
+// number of responses follow as it grows.
+type fetch struct {
+	// want is the checksum the download must match, if any.
+	want    string
+	mu      sync.Mutex
+	cond    *sync.Cond
+	started bool
+	done    bool
+	err     error
+	tmp     string
+	path    string
+	sum     string
+	size    int64
+	written int64
+}
+
+func newFetch(want string) *fetch {
+	f := &fetch{want: want}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *fetch) begin(tmp string, size int64) {
+	f.mu.Lock()
+	f.started, f.tmp, f.size = true, tmp, size
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+func (f *fetch) advance(n int64) {
+	f.mu.Lock()
+	f.written += n
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+func (f *fetch) finish(path, sum string, err error) {
+	f.mu.Lock()
+	f.started, f.done = true, true
+	f.path, f.sum, f.err = path, sum, err
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// commit runs move under the lock, so followers never open the temporary
+// file after it has been renamed.
+func (f *fetch) commit(move func() (string, error), sum string) {
+	f.mu.Lock()
+	path, err := move()
+	if err != nil {
+		f.err = fmt.Errorf("commit to cache: %w", err)
+	} else {
+		f.path, f.sum = path, sum
+	}
+	f.started, f.done = true, true
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// readable is how much of the download responses may send. When a checksum
+// was asked for, the last byte is held back until it has been verified, so a
+// corrupt download never reaches the client complete.
+func (f *fetch) readable() int64 {
+	if f.want != "" && f.written > 0 && (!f.done || f.err != nil) {
+		return f.written - 1
+	}
+	return f.written
+}
+
+// checksum is the content's SHA256 once the download has completed.
+func (f *fetch) checksum() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sum
+}
+
+// open waits for the download to start and returns a reader over the
+// content, which blocks until the bytes it is asked for have arrived.
+func (f *fetch) open() (io.ReadSeekCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.started {
+		f.cond.Wait()
+	}
+	if f.done {
+		if f.err != nil {
+			return nil, f.err
+		}
+		return os.Open(f.path)
+	}
+	file, err := os.Open(f.tmp)
+	if err != nil {
+		return nil, err
+	}
+	return &follower{f: f, file: file}, nil
+}
+
+type follower struct {
+	f    *fetch
+	file *os.File
+	off  int64
+}
+
+func (r *follower) Read(p []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	for r.off >= f.readable() && !f.done {
+		f.cond.Wait()
+	}
+	avail, err := f.readable()-r.off, f.err
+	f.mu.Unlock()
+
+	if avail <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, rerr := r.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	if n > 0 && errors.Is(rerr, io.EOF) {
+		rerr = nil
+	}
+	return n, rerr
+}
+
+func (r *follower) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *follower) Close() error {
+	return r.file.Close()
+}
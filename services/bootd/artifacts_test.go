@@ -0,0 +1,248 @@
+package bootd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeUpstream struct {
+	objects map[string][]byte
+	release chan struct{}
+	// unsized hides the Content-Length.
+	unsized     bool
+	calls       atomic.Int32
+	notModified atomic.Int32
+}
+
+func (u *fakeUpstream) Open(ctx context.Context, key string, hdr http.Header) (*http.Response, error) {
+	u.calls.Add(1)
+	data, ok := u.objects[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:6]) + `"`
+	if hdr.Get("If-None-Match") == etag {
+		u.notModified.Add(1)
+		return &http.Response{StatusCode: http.StatusNotModified, Body: http.NoBody, Header: http.Header{}}, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		half := len(data) / 2
+		_, _ = pw.Write(data[:half])
+		<-u.release
+		_, _ = pw.Write(data[half:])
+		_ = pw.Close()
+	}()
+	size := int64(len(data))
+	if u.unsized {
+		size = -1
+	}
+	return &http.Response{StatusCode: http.StatusOK, ContentLength: size, Body: pr, Header: http.Header{"Etag": {etag}}}, nil
+}
+
+func newArtifactTest(t *testing.T, up *fakeUpstream, maxBytes int64, ttl time.Duration) *httptest.Server {
+	t.Helper()
+	cache, err := newBlobCache(t.TempDir(), maxBytes, ttl)
+	if err != nil {
+		t.Fatalf("newBlobCache: %v", err)
+	}
+	srv := httptest.NewServer(newArtifactHandler(cache, up, log.New(io.Discard, "", 0)))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func getArtifact(t *testing.T, url string) ([]byte, string, error) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.Header.Get("X-Bootd-Cache"), err
+}
+
+func TestArtifactFetchesAreCoalescedAndCached(t *testing.T) {
+	data := bytes.Repeat([]byte("initrd"), 100000)
+	sum := sha256.Sum256(data)
+	up := &fakeUpstream{objects: map[string][]byte{"images/initrd.img": data}, release: make(chan struct{})}
+
+	cache, err := newBlobCache(t.TempDir(), 10<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("newBlobCache: %v", err)
+	}
+	h := newArtifactHandler(cache, up, log.New(io.Discard, "", 0))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	url := srv.URL + "/artifacts/images/initrd.img?sha256=" + hex.EncodeToString(sum[:])
+	var wg sync.WaitGroup
+	bodies := make([][]byte, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Errorf("get: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			bodies[i], _ = io.ReadAll(resp.Body)
+		}(i)
+	}
+	close(up.release)
+	wg.Wait()
+
+	for i, b := range bodies {
+		if !bytes.Equal(b, data) {
+			t.Fatalf("response %d: got %d bytes, want %d", i, len(b), len(data))
+		}
+	}
+	if n := up.calls.Load(); n != 1 {
+		t.Fatalf("upstream fetched %d times, want 1", n)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/artifacts/images/initrd.img", nil)
+	req.Header.Set("Range", "bytes=6-11")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("range get: %v", err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(got) != "initrd" {
+		t.Fatalf("range: status %d body %q", resp.StatusCode, got)
+	}
+	if resp.Header.Get("X-Bootd-Cache") != "hit" {
+		t.Fatalf("range request was not served from cache")
+	}
+	if up.calls.Load() != 1 {
+		t.Fatalf("cache hit went upstream")
+	}
+}
+
+func TestArtifactCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := newBlobCache(t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatalf("newBlobCache: %v", err)
+	}
+	for i, key := range []string{"a", "b", "c"} {
+		tmp, err := cache.tempFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = tmp.WriteString("1234")
+		_ = tmp.Close()
+		sum := sha256.Sum256([]byte(key + strconv.Itoa(i)))
+		if _, err := cache.commit(key, tmp.Name(), hex.EncodeToString(sum[:]), "", 4); err != nil {
+			t.Fatalf("commit %s: %v", key, err)
+		}
+		if key == "b" {
+			// Touch a so b becomes the least recently used.
+			if _, _, ok := cache.lookup("a", ""); !ok {
+				t.Fatal("a missing")
+			}
+		}
+	}
+	if _, _, ok := cache.lookup("b", ""); ok {
+		t.Fatal("b should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, ok := cache.lookup(key, ""); !ok {
+			t.Fatalf("%s should still be cached", key)
+		}
+	}
+}
+
+func TestArtifactChecksumIsVerifiedBeforeTheLastByte(t *testing.T) {
+	data := bytes.Repeat([]byte("kernel"), 100000)
+	other := sha256.Sum256([]byte("something else"))
+	up := &fakeUpstream{objects: map[string][]byte{"images/vmlinuz": data}, release: make(chan struct{})}
+	srv := newArtifactTest(t, up, 10<<20, time.Hour)
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	bad, plain := make(chan result, 1), make(chan result, 1)
+	go func() {
+		body, _, err := getArtifact(t, srv.URL+"/artifacts/images/vmlinuz?sha256="+hex.EncodeToString(other[:]))
+		bad <- result{body, err}
+	}()
+	go func() {
+		body, _, err := getArtifact(t, srv.URL+"/artifacts/images/vmlinuz")
+		plain <- result{body, err}
+	}()
+	for up.calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(up.release)
+
+	// The wrong checksum fails its own download only.
+	if r := <-bad; r.err == nil || len(r.body) >= len(data) {
+		t.Fatalf("mismatched download: %d of %d bytes, err %v", len(r.body), len(data), r.err)
+	}
+	if r := <-plain; r.err != nil || !bytes.Equal(r.body, data) {
+		t.Fatalf("download without checksum: %d bytes, err %v", len(r.body), r.err)
+	}
+}
+
+func TestArtifactWithoutContentLength(t *testing.T) {
+	data := bytes.Repeat([]byte("rootfs"), 1000)
+	release := make(chan struct{})
+	close(release)
+	up := &fakeUpstream{objects: map[string][]byte{"images/rootfs.img": data}, release: release, unsized: true}
+
+	srv := newArtifactTest(t, up, 10<<20, time.Hour)
+	for _, want := range []string{"miss", "hit"} {
+		body, result, err := getArtifact(t, srv.URL+"/artifacts/images/rootfs.img")
+		if err != nil || !bytes.Equal(body, data) || result != want {
+			t.Fatalf("%s: %d bytes, cache %q, err %v", want, len(body), result, err)
+		}
+	}
+	if n := up.calls.Load(); n != 1 {
+		t.Fatalf("upstream fetched %d times, want 1", n)
+	}
+
+	// Once it outgrows the cache it is streamed through instead.
+	srv = newArtifactTest(t, up, 100, time.Hour)
+	body, result, err := getArtifact(t, srv.URL+"/artifacts/images/rootfs.img")
+	if err != nil || !bytes.Equal(body, data) || result != "bypass" {
+		t.Fatalf("oversized: %d bytes, cache %q, err %v", len(body), result, err)
+	}
+}
+
+func TestArtifactKeysAreRevalidated(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	up := &fakeUpstream{objects: map[string][]byte{"images/initrd.img": []byte("v1 initrd")}, release: release}
+	srv := newArtifactTest(t, up, 10<<20, 0)
+	url := srv.URL + "/artifacts/images/initrd.img"
+
+	for i := 0; i < 2; i++ {
+		if body, _, err := getArtifact(t, url); err != nil || string(body) != "v1 initrd" {
+			t.Fatalf("get %d: %q, %v", i, body, err)
+		}
+	}
+	if up.notModified.Load() != 1 {
+		t.Fatalf("expired key was not revalidated with its ETag")
+	}
+
+	up.objects["images/initrd.img"] = []byte("v2 initrd")
+	if body, _, err := getArtifact(t, url); err != nil || string(body) != "v2 initrd" {
+		t.Fatalf("after overwrite: %q, %v", body, err)
+	}
+}
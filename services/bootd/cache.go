@@ -0,0 +1,238 @@
+package bootd
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blobCache is a size-bounded LRU of artifacts on local disk. Content lives
+// in blobs/<sha256>, so identical objects under different keys are stored
+// once, and keys/<sha256 of key> records which blob a key resolved to and the
+// upstream ETag it had. Both survive restarts. A key is trusted for ttl after
+// it was last fetched or revalidated.
+type blobCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	blobs map[string]*list.Element
+}
+
+type blobEntry struct {
+	sum  string
+	size int64
+}
+
+func newBlobCache(dir string, maxBytes int64, ttl time.Duration) (*blobCache, error) {
+	for _, sub := range []string{"blobs", "keys", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("create cache dir: %w", err)
+		}
+	}
+	// Partial downloads cannot be resumed.
+	stale, _ := filepath.Glob(filepath.Join(dir, "tmp", "*"))
+	for _, p := range stale {
+		_ = os.Remove(p)
+	}
+
+	c := &blobCache{dir: dir, maxBytes: maxBytes, ttl: ttl, ll: list.New(), blobs: make(map[string]*list.Element)}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs"))
+	if err != nil {
+		return nil, fmt.Errorf("read cache dir: %w", err)
+	}
+	type found struct {
+		blobEntry
+		used time.Time
+	}
+	var existing []found
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !validSum(e.Name()) {
+			continue
+		}
+		existing = append(existing, found{blobEntry{sum: e.Name(), size: info.Size()}, info.ModTime()})
+	}
+	// Blob mtimes are bumped on every hit, so they restore the LRU order.
+	sort.Slice(existing, func(i, j int) bool { return existing[i].used.Before(existing[j].used) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range existing {
+		entry := f.blobEntry
+		c.blobs[entry.sum] = c.ll.PushFront(&entry)
+		c.size += entry.size
+	}
+	for c.size > c.maxBytes && c.ll.Len() > 0 {
+		c.evictLocked(c.ll.Back())
+	}
+	cacheBytes.Set(float64(c.size))
+	return c, nil
+}
+
+// fits reports whether an object of size bytes may be cached at all. An
+// unknown size (-1) is tried, and the download given up if it outgrows the
+// cache.
+func (c *blobCache) fits(size int64) bool {
+	return size <= c.maxBytes
+}
+
+// lookup returns the cached blob for sum, or for whatever key last resolved
+// to when sum is empty and that was checked within ttl, and marks it most
+// recently used.
+func (c *blobCache) lookup(key, sum string) (string, string, bool) {
+	if sum == "" {
+		var checked time.Time
+		var ok bool
+		sum, _, checked, ok = c.resolve(key)
+		if !ok || time.Since(checked) >= c.ttl {
+			return "", "", false
+		}
+	}
+	return c.use(sum)
+}
+
+// resolve reads what key last resolved to: the blob's checksum, the upstream
+// ETag and when it was last checked against upstream.
+func (c *blobCache) resolve(key string) (sum, etag string, checked time.Time, ok bool) {
+	p := c.keyPath(key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	lines := strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)
+	if len(lines) == 2 {
+		etag = strings.TrimSpace(lines[1])
+	}
+	return strings.TrimSpace(lines[0]), etag, info.ModTime(), true
+}
+
+// refresh records that key still resolves to sum upstream and returns the
+// blob, unless it has been evicted since.
+func (c *blobCache) refresh(key, sum string) (string, bool) {
+	p, _, ok := c.use(sum)
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	_ = os.Chtimes(c.keyPath(key), now, now)
+	return p, true
+}
+
+// use marks the blob sum most recently used and returns its path.
+func (c *blobCache) use(sum string) (string, string, bool) {
+	c.mu.Lock()
+	el, ok := c.blobs[sum]
+	if ok {
+		c.ll.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return "", "", false
+	}
+
+	p := c.blobPath(sum)
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return p, sum, true
+}
+
+// tempFile creates a file for an in-progress download.
+func (c *blobCache) tempFile() (*os.File, error) {
+	return os.CreateTemp(filepath.Join(c.dir, "tmp"), "fetch-*")
+}
+
+// commit moves a completed download into blobs/ under its checksum, records
+// key as resolving to it with the upstream etag and evicts least recently
+// used blobs to stay within maxBytes. It returns the blob path.
+func (c *blobCache) commit(key, tmp, sum, etag string, size int64) (string, error) {
+	p := c.blobPath(sum)
+	if err := os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	if err := writeFileAtomic(c.keyPath(key), []byte(sum+"\n"+etag+"\n")); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.blobs[sum]; ok {
+		c.ll.MoveToFront(el)
+		return p, nil
+	}
+	for c.size+size > c.maxBytes && c.ll.Len() > 0 {
+		c.evictLocked(c.ll.Back())
+	}
+	entry := blobEntry{sum: sum, size: size}
+	c.blobs[sum] = c.ll.PushFront(&entry)
+	c.size += size
+	cacheBytes.Set(float64(c.size))
+	return p, nil
+}
+
+func (c *blobCache) evictLocked(el *list.Element) {
+	e := el.Value.(*blobEntry)
+	c.ll.Remove(el)
+	delete(c.blobs, e.sum)
+	c.size -= e.size
+	// Responses that already opened the blob keep reading it. Key files
+	// pointing at it are left behind and read as misses.
+	_ = os.Remove(c.blobPath(e.sum))
+	cacheEvictions.Inc()
+	cacheBytes.Set(float64(c.size))
+}
+
+func (c *blobCache) blobPath(sum string) string {
+	return filepath.Join(c.dir, "blobs", sum)
+}
+
+func (c *blobCache) keyPath(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, "keys", hex.EncodeToString(h[:]))
+}
+
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// validSum reports whether s is a lower-case hex SHA256.
+func validSum(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -47,7 +47,12 @@ func run(serviceName string) error {
 	mux.HandleFunc("/readyz", readyHandler)
 	mux.Handle("/metrics", promhttp.Handler())
 
-	if err := bootd.RegisterHandlers(mux); err != nil {
+	cfg, err := bootd.ConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	cfg.Logger = logger
+	if err := bootd.RegisterHandlers(mux, cfg); err != nil {
 		return fmt.Errorf("register bootd handlers: %w", err)
 	}
 
@@ -4,42 +4,119 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	brandingfs "goosed/infra/branding"
 )
 
-const apiEndpoint = "http://api.goose.local"
+const (
+	defaultAPIEndpoint = "http://api.goose.local"
+	defaultCacheDir    = "/var/cache/bootd"
+	defaultCacheMB     = 10240
+	defaultCacheTTL    = 5 * time.Minute
+)
+
+// Config controls the menus and artifacts bootd serves.
+type Config struct {
+	// APIEndpoint is the base URL of the goosed API the menu chains to.
+	APIEndpoint string
+	// BrandingPath is a branding directory read on every request, so edits
+	// show up without a restart. Empty uses the embedded infra/branding.
+	BrandingPath string
+	// MemtestURL is the memtest86+ image booted by the memtest intent. The
+	// entry is hidden while it is empty.
+	MemtestURL string
+	// ArtifactsEndpoint is the artifacts-gw base URL that /artifacts/ proxies
+	// and caches. The artifact path is disabled while it is empty.
+	ArtifactsEndpoint string
+	CacheDir          string
+	CacheBytes        int64
+	// CacheTTL is how long a key is served from the cache before its ETag is
+	// checked against upstream again.
+	CacheTTL time.Duration
+	Logger   *log.Logger
+}
+
+// ConfigFromEnv reads BOOTD_API_ENDPOINT, BRANDING_PATH, BOOTD_MEMTEST_URL,
+// BOOTD_ARTIFACTS_ENDPOINT, BOOTD_CACHE_DIR, BOOTD_CACHE_MB and
+// BOOTD_CACHE_TTL_SECONDS.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		APIEndpoint:       strings.TrimSpace(os.Getenv("BOOTD_API_ENDPOINT")),
+		BrandingPath:      strings.TrimSpace(os.Getenv("BRANDING_PATH")),
+		MemtestURL:        strings.TrimSpace(os.Getenv("BOOTD_MEMTEST_URL")),
+		ArtifactsEndpoint: strings.TrimSpace(os.Getenv("BOOTD_ARTIFACTS_ENDPOINT")),
+		CacheDir:          strings.TrimSpace(os.Getenv("BOOTD_CACHE_DIR")),
+		CacheBytes:        defaultCacheMB << 20,
+		CacheTTL:          defaultCacheTTL,
+	}
+	if cfg.APIEndpoint == "" {
+		cfg.APIEndpoint = defaultAPIEndpoint
+	}
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = defaultCacheDir
+	}
+	if raw := strings.TrimSpace(os.Getenv("BOOTD_CACHE_MB")); raw != "" {
+		mb, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || mb <= 0 {
+			return Config{}, fmt.Errorf("BOOTD_CACHE_MB must be a positive integer, got %q", raw)
+		}
+		cfg.CacheBytes = mb << 20
+	}
+	if raw := strings.TrimSpace(os.Getenv("BOOTD_CACHE_TTL_SECONDS")); raw != "" {
+		secs, err := strconv.Atoi(raw)
+		if err != nil || secs < 0 {
+			return Config{}, fmt.Errorf("BOOTD_CACHE_TTL_SECONDS must be a non-negative integer, got %q", raw)
+		}
+		cfg.CacheTTL = time.Duration(secs) * time.Second
+	}
+	return cfg, nil
+}
 
 // RegisterHandlers wires HTTP handlers for PXE boot helpers and static assets.
-func RegisterHandlers(mux *http.ServeMux) error {
+func RegisterHandlers(mux *http.ServeMux, cfg Config) error {
 	if mux == nil {
 		return errors.New("nil mux")
 	}
-
-	mux.HandleFunc("/menu.ipxe", menuHandler)
-
-	sub, err := fs.Sub(brandingfs.Files, ".")
-	if err != nil {
-		return fmt.Errorf("prepare branding fs: %w", err)
+	if cfg.APIEndpoint == "" {
+		cfg.APIEndpoint = defaultAPIEndpoint
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
-	fileServer := http.FileServer(http.FS(sub))
-	mux.Handle("/branding/", http.StripPrefix("/branding/", fileServer))
+	var brandingFS fs.FS = brandingfs.Files
+	if cfg.BrandingPath != "" {
+		brandingFS = os.DirFS(cfg.BrandingPath)
+	}
 
-	return nil
-}
+	menu := &menuHandler{
+		api:        strings.TrimRight(cfg.APIEndpoint, "/"),
+		branding:   brandingFS,
+		memtestURL: cfg.MemtestURL,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		logger:     cfg.Logger,
+	}
+	mux.Handle("/menu.ipxe", menu)
 
-func menuHandler(w http.ResponseWriter, r *http.Request) {
-	mac := strings.TrimSpace(r.URL.Query().Get("mac"))
-	if mac == "" {
-		http.Error(w, "missing mac query parameter", http.StatusBadRequest)
-		return
+	if cfg.ArtifactsEndpoint != "" {
+		if cfg.CacheBytes <= 0 {
+			cfg.CacheBytes = defaultCacheMB << 20
+		}
+		cache, err := newBlobCache(cfg.CacheDir, cfg.CacheBytes, cfg.CacheTTL)
+		if err != nil {
+			return fmt.Errorf("open artifact cache: %w", err)
+		}
+		mux.Handle("/artifacts/", newArtifactHandler(cache, newPresignUpstream(cfg.ArtifactsEndpoint), cfg.Logger))
 	}
 
-	script := fmt.Sprintf("#!ipxe\nset api %s\nchain ${api}/v1/boot/ipxe?mac=${mac}\n", apiEndpoint)
+	fileServer := http.FileServer(http.FS(brandingFS))
+	mux.Handle("/branding/", http.StripPrefix("/branding/", fileServer))
 
-	w.Header().Set("Content-Type", "text/plain")
-	_, _ = w.Write([]byte(script))
+	return nil
 }
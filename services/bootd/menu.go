@@ -0,0 +1,194 @@
+package bootd
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"goosed/infra/branding"
+)
+
+//go:embed templates/menu.ipxe.tmpl
+var templateFS embed.FS
+
+var menuTemplate = template.Must(template.ParseFS(templateFS, "templates/menu.ipxe.tmpl"))
+
+// Boot intents the menu knows how to offer.
+const (
+	intentInstall = "install"
+	intentLocal   = "local"
+	intentRescue  = "rescue"
+	intentMemtest = "memtest"
+)
+
+var intentText = map[string]string{
+	intentInstall: "Install operating system",
+	intentLocal:   "Boot from local disk",
+	intentRescue:  "Rescue environment",
+	intentMemtest: "Memory test (memtest86+)",
+}
+
+var errUnknownMachine = errors.New("machine not registered")
+
+// intents is the API's answer to GET /v1/boot/intents.
+type intents struct {
+	Label   string   `json:"label"`
+	Intents []string `json:"intents"`
+	Default string   `json:"default"`
+}
+
+type menuItem struct {
+	Name string
+	Text string
+}
+
+type menuData struct {
+	MAC           string
+	Label         string
+	API           string
+	Branding      branding.Branding
+	Items         []menuItem
+	Default       string
+	TimeoutMillis int
+	MemtestURL    string
+}
+
+// menuHandler renders a branded iPXE menu listing the boot intents the API
+// allows for the requesting machine.
+type menuHandler struct {
+	api        string
+	branding   fs.FS
+	memtestURL string
+	client     *http.Client
+	logger     *log.Logger
+}
+
+func (h *menuHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("mac"))
+	if raw == "" {
+		http.Error(w, "missing mac query parameter", http.StatusBadRequest)
+		return
+	}
+	hw, err := net.ParseMAC(raw)
+	if err != nil {
+		http.Error(w, "invalid mac query parameter", http.StatusBadRequest)
+		return
+	}
+	mac := hw.String()
+
+	brand, err := branding.Load(h.branding)
+	if err != nil {
+		h.logger.Printf("WARN bootd branding: %v; using defaults", err)
+		brand = branding.Default()
+	}
+
+	allowed, err := h.fetchIntents(r.Context(), mac)
+	switch {
+	case errors.Is(err, errUnknownMachine):
+		// Nothing to install onto an unregistered machine; hand it back to
+		// the firmware.
+		allowed = intents{Intents: []string{intentLocal}, Default: intentLocal}
+	case err != nil:
+		h.logger.Printf("WARN bootd intents for %s: %v; offering install and local", mac, err)
+		allowed = intents{Intents: []string{intentInstall, intentLocal}, Default: intentLocal}
+	}
+
+	data := h.menu(mac, brand, allowed)
+
+	var buf bytes.Buffer
+	if err := menuTemplate.Execute(&buf, data); err != nil {
+		h.logger.Printf("ERROR bootd render menu for %s: %v", mac, err)
+		http.Error(w, "render menu", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// menu picks the items to offer: the allowed intents this bootd can serve, in
+// the order the API listed them, defaulting to the API's default when it is
+// among them and to the first item otherwise.
+func (h *menuHandler) menu(mac string, brand branding.Branding, allowed intents) menuData {
+	// choose --timeout 0 waits for a keypress forever, stranding unattended
+	// machines at the menu.
+	timeout := brand.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = branding.Default().TimeoutSeconds
+	}
+	data := menuData{
+		MAC:           mac,
+		Label:         menuText(allowed.Label),
+		API:           h.api,
+		Branding:      brand,
+		TimeoutMillis: timeout * 1000,
+		MemtestURL:    h.memtestURL,
+	}
+	if data.Label == "" {
+		data.Label = mac
+	}
+	data.Branding.Title = menuText(brand.Title)
+	for _, name := range allowed.Intents {
+		text, ok := intentText[name]
+		if !ok || (name == intentMemtest && h.memtestURL == "") {
+			continue
+		}
+		data.Items = append(data.Items, menuItem{Name: name, Text: text})
+		if name == allowed.Default || data.Default == "" {
+			data.Default = name
+		}
+	}
+	if len(data.Items) == 0 {
+		data.Items = []menuItem{{Name: intentLocal, Text: intentText[intentLocal]}}
+		data.Default = intentLocal
+	}
+	return data
+}
+
+func (h *menuHandler) fetchIntents(ctx context.Context, mac string) (intents, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.api+"/v1/boot/intents?mac="+url.QueryEscape(mac), nil)
+	if err != nil {
+		return intents{}, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return intents{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return intents{}, errUnknownMachine
+	default:
+		return intents{}, fmt.Errorf("GET /v1/boot/intents: %s", resp.Status)
+	}
+
+	var out intents
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return intents{}, fmt.Errorf("decode intents: %w", err)
+	}
+	return out, nil
+}
+
+// menuText keeps API- and operator-supplied strings on one line and stops
+// iPXE from expanding settings inside them.
+func menuText(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.ReplaceAll(s, "${", "$ {")
+}
@@ -0,0 +1,116 @@
+package bootd
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"goosed/infra/branding"
+)
+
+func newMenuTest(t *testing.T, memtestURL string) *menuHandler {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("mac") {
+		case "00:11:22:33:44:55":
+			_ = json.NewEncoder(w).Encode(intents{
+				Label:   "rack-01 ${evil}\nitem shell",
+				Intents: []string{intentInstall, "bogus", intentRescue, intentMemtest},
+				Default: intentRescue,
+			})
+		case "00:11:22:33:44:66":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(api.Close)
+	h := &menuHandler{
+		api:        api.URL,
+		branding:   fstest.MapFS{branding.FileName: {Data: []byte("title: Lab A\ntimeoutSeconds: 3\n")}},
+		memtestURL: memtestURL,
+		client:     api.Client(),
+		logger:     log.New(io.Discard, "", 0),
+	}
+	return h
+}
+
+func getMenu(t *testing.T, h http.Handler, mac string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/menu.ipxe?mac="+mac, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestMenuOffersAllowedIntents(t *testing.T) {
+	h := newMenuTest(t, "")
+	code, body := getMenu(t, h, "00-11-22-33-44-55")
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	for _, want := range []string{
+		"menu Lab A\n",
+		"item --gap -- rack-01 $ {evil} item shell (00:11:22:33:44:55)\n",
+		"item install Install operating system\n",
+		"item rescue Rescue environment\n",
+		"choose --timeout 3000 --default rescue selected",
+		"chain ${api}/v1/boot/ipxe?mac=00:11:22:33:44:55&intent=rescue",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("menu missing %q:\n%s", want, body)
+		}
+	}
+	// memtest needs MemtestURL, and unknown intents are dropped.
+	if strings.Contains(body, "item memtest") || strings.Contains(body, "bogus") {
+		t.Fatalf("menu offers items it cannot boot:\n%s", body)
+	}
+
+	h = newMenuTest(t, "http://mirror/memtest.efi")
+	if _, body := getMenu(t, h, "00:11:22:33:44:55"); !strings.Contains(body, "kernel http://mirror/memtest.efi") {
+		t.Fatalf("memtest not offered with a URL:\n%s", body)
+	}
+}
+
+func TestMenuWithoutIntents(t *testing.T) {
+	h := newMenuTest(t, "")
+
+	// Unregistered machines only get to boot their local disk.
+	_, body := getMenu(t, h, "00:11:22:33:44:77")
+	if strings.Contains(body, "item install") || !strings.Contains(body, "--default local") {
+		t.Fatalf("unknown machine menu:\n%s", body)
+	}
+
+	// When the API fails, install stays available but is not the default.
+	_, body = getMenu(t, h, "00:11:22:33:44:66")
+	if !strings.Contains(body, "item install") || !strings.Contains(body, "--default local") {
+		t.Fatalf("API error menu:\n%s", body)
+	}
+
+	for _, mac := range []string{"", "nope"} {
+		if code, _ := getMenu(t, h, mac); code != http.StatusBadRequest {
+			t.Fatalf("mac %q: status %d, want 400", mac, code)
+		}
+	}
+}
+
+func TestMenuDefaults(t *testing.T) {
+	h := &menuHandler{api: "http://api"}
+
+	data := h.menu("00:11:22:33:44:55", branding.Branding{}, intents{Intents: []string{intentRescue, intentInstall}, Default: intentMemtest})
+	if data.TimeoutMillis != branding.Default().TimeoutSeconds*1000 {
+		t.Fatalf("timeout = %dms, want the default instead of waiting forever", data.TimeoutMillis)
+	}
+	if data.Default != intentRescue || data.Label != "00:11:22:33:44:55" {
+		t.Fatalf("default %q label %q, want the first item and the MAC", data.Default, data.Label)
+	}
+
+	data = h.menu("00:11:22:33:44:55", branding.Default(), intents{Intents: []string{intentMemtest, "bogus"}})
+	if len(data.Items) != 1 || data.Items[0].Name != intentLocal || data.Default != intentLocal {
+		t.Fatalf("items = %+v default %q, want local only", data.Items, data.Default)
+	}
+}
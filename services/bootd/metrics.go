@@ -0,0 +1,25 @@
+package bootd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	artifactRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bootd_artifact_requests_total",
+		Help: "Artifact requests by result: hit, miss, coalesced (joined an in-flight fetch), bypass (too large to cache) or error.",
+	}, []string{"result"})
+	upstreamBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bootd_artifact_upstream_bytes_total",
+		Help: "Bytes fetched from the artifacts gateway.",
+	})
+	cacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bootd_artifact_cache_bytes",
+		Help: "Bytes currently held in the artifact cache.",
+	})
+	cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bootd_artifact_cache_evictions_total",
+		Help: "Artifacts evicted from the cache to make room.",
+	})
+)
@@ -243,9 +243,25 @@ func writeBundle(output string, manifest []byte, artifactsDir string, entries []
 	return nil
 }
 
+// shimCompanions are the MokManager and fallback loaders the shim package
+// ships next to shim itself.
+var shimCompanions = map[string]bool{
+	"mmx64.efi":  true,
+	"mmaa64.efi": true,
+	"fbx64.efi":  true,
+	"fbaa64.efi": true,
+}
+
 func inferKind(path string) string {
 	lower := strings.ToLower(path)
+	base := filepath.Base(lower)
 	switch {
+	case strings.HasSuffix(base, ".efi") && (strings.HasPrefix(base, "shim") || shimCompanions[base]):
+		return "shim"
+	case strings.HasSuffix(base, ".efi") && strings.HasPrefix(base, "grub"):
+		return "grub"
+	case strings.HasSuffix(lower, ".efi"):
+		return "efi"
 	case strings.HasSuffix(lower, ".iso"):
 		return "iso"
 	case strings.HasSuffix(lower, ".wim"):
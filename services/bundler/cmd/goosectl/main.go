@@ -27,6 +27,7 @@ func newRootCommand() *cobra.Command {
 	}
 
 	cmd.AddCommand(newBundlesCommand())
+	cmd.AddCommand(newRenderCommand())
 	return cmd
 }
 
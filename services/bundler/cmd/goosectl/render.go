@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"goosed/pkg/profile"
+	"goosed/pkg/render"
+	"goosed/pkg/schema"
+)
+
+// previewOptions are the flags of goosectl render.
+type previewOptions struct {
+	blueprint   string
+	profileFile string
+	labels      map[string]string
+	format      string
+	mac         string
+	serial      string
+	apiBaseURL  string
+	infraDir    string
+	templates   string
+	output      string
+	strict      bool
+}
+
+// preview is the rendered install config and what it was rendered from, as
+// returned by POST /v1/render/preview.
+type preview struct {
+	Blueprint string   `json:"blueprint,omitempty"`
+	Layers    []string `json:"layers"`
+	Format    string   `json:"format"`
+	Template  string   `json:"template"`
+	Content   string   `json:"content"`
+	Warnings  []string `json:"warnings"`
+}
+
+func newRenderCommand() *cobra.Command {
+	opts := previewOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "render",
+		Short: "Render and validate install configs",
+		Long: `Renders the install config for a blueprint and a profile file without issuing
+tokens or resolving secrets, so profile changes can be reviewed before they
+are merged to infra/. By default the blueprint and overlays are read from a
+local infra/ checkout; with --api the API renders from its own infra/.
+
+The profile file holds profile keys, or is a MachineProfile document whose
+spec.blueprint, spec.profile and metadata.labels are used.`,
+		Example: "  goosectl render --blueprint rocky/9/base --profile node.yaml\n" +
+			"  goosectl render --profile infra/machine-profiles/lab-a/rack-01/03-mac-001122ccddee.yaml --api https://api.goose.local",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.blueprint == "" && opts.profileFile == "" {
+				return cmd.Help()
+			}
+			ctx := cmd.Context()
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			return runPreview(ctx, cmd.OutOrStdout(), cmd.ErrOrStderr(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.blueprint, "blueprint", "", "Blueprint reference under infra/blueprints, such as rocky/9/base")
+	cmd.Flags().StringVar(&opts.profileFile, "profile", "", "YAML or JSON profile, or a MachineProfile document")
+	cmd.Flags().StringToStringVar(&opts.labels, "labels", nil, "Labels that select overlays (site=lab-a,rack=rack-01)")
+	cmd.Flags().StringVar(&opts.format, "format", "", "Install format; defaults to the profile's os.format or os.family")
+	cmd.Flags().StringVar(&opts.mac, "mac", "", "MAC address of the machine to render for")
+	cmd.Flags().StringVar(&opts.serial, "serial", "", "Serial number of the machine to render for")
+	cmd.Flags().StringVar(&opts.apiBaseURL, "api", "", "Render with the goosed API at this base URL instead of locally")
+	cmd.Flags().StringVar(&opts.infraDir, "infra", "infra", "Local infra/ checkout to read blueprints and overlays from")
+	cmd.Flags().StringVar(&opts.templates, "templates", "", "Template overrides directory, as TEMPLATES_DIR on the API")
+	cmd.Flags().StringVar(&opts.output, "output", "", "Write the rendered config to this file instead of stdout")
+	cmd.Flags().BoolVar(&opts.strict, "strict", false, "Exit non-zero when the rendered config fails validation")
+
+	cmd.AddCommand(newRenderValidateCommand())
+	return cmd
+}
+
+func runPreview(ctx context.Context, stdout, stderr io.Writer, opts previewOptions) error {
+	req, err := previewRequestFor(opts)
+	if err != nil {
+		return err
+	}
+
+	var p preview
+	if opts.apiBaseURL != "" {
+		p, err = remotePreview(ctx, opts.apiBaseURL, req)
+	} else {
+		p, err = localPreview(opts, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "rendered %s (%s) from %s\n", p.Template, p.Format, strings.Join(p.Layers, " <- "))
+	for _, w := range p.Warnings {
+		fmt.Fprintf(stderr, "warning: %s\n", w)
+	}
+	if opts.output != "" {
+		if err := os.WriteFile(opts.output, []byte(p.Content), 0o644); err != nil {
+			return fmt.Errorf("write %s: %w", opts.output, err)
+		}
+	} else {
+		fmt.Fprint(stdout, p.Content)
+	}
+	if opts.strict {
+		// Unresolved secretRefs are expected in every preview.
+		problems := 0
+		for _, w := range p.Warnings {
+			if !strings.HasPrefix(w, "secretRef ") {
+				problems++
+			}
+		}
+		if problems > 0 {
+			return fmt.Errorf("%d validation problems", problems)
+		}
+	}
+	return nil
+}
+
+// previewRequest is the body of POST /v1/render/preview.
+type previewRequest struct {
+	Blueprint string            `json:"blueprint,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Profile   map[string]any    `json:"profile,omitempty"`
+	Format    string            `json:"format,omitempty"`
+	MAC       string            `json:"mac,omitempty"`
+	Serial    string            `json:"serial,omitempty"`
+}
+
+// previewRequestFor reads the profile file and applies the flags over what a
+// MachineProfile document supplies.
+func previewRequestFor(opts previewOptions) (previewRequest, error) {
+	req := previewRequest{Format: opts.format, MAC: opts.mac, Serial: opts.serial}
+	if opts.profileFile != "" {
+		data, err := os.ReadFile(opts.profileFile)
+		if err != nil {
+			return req, err
+		}
+		var doc map[string]any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return req, fmt.Errorf("parse %s: %w", opts.profileFile, err)
+		}
+		if kind, _ := doc["kind"].(string); kind == schema.KindMachineProfile {
+			// Parsed as the blueprints service will once it is merged.
+			parsed, err := schema.Parse(opts.profileFile, data)
+			if err != nil {
+				return req, err
+			}
+			mp := parsed.Object.(*schema.MachineProfile)
+			req.Profile = mp.Spec.Profile
+			req.Blueprint = mp.Spec.Blueprint
+			req.Labels = mp.Metadata.Labels
+			if req.MAC == "" {
+				req.MAC = mp.Spec.Machine.MAC
+			}
+			if req.Serial == "" {
+				req.Serial = mp.Spec.Machine.Serial
+			}
+		} else {
+			req.Profile = doc
+		}
+	}
+	if opts.blueprint != "" {
+		req.Blueprint = opts.blueprint
+	}
+	if opts.labels != nil {
+		req.Labels = opts.labels
+	}
+	return req, nil
+}
+
+// localPreview renders like the API does, from a local infra/ checkout.
+func localPreview(opts previewOptions, req previewRequest) (preview, error) {
+	root := opts.infraDir
+	if _, err := os.Stat(filepath.Join(root, "blueprints")); err != nil {
+		return preview{}, fmt.Errorf("%s is not an infra/ checkout; set --infra or --api", root)
+	}
+	eff, err := (&profile.Source{Root: root}).Compose(req.Blueprint, req.Labels, req.Profile)
+	if err != nil {
+		return preview{}, err
+	}
+	format, tmpl, err := render.TemplateFor(eff.Profile, req.Format)
+	if err != nil {
+		return preview{}, err
+	}
+
+	var engineOpts []render.Option
+	if opts.templates != "" {
+		engineOpts = append(engineOpts, render.WithOverrides(opts.templates))
+	}
+	engine, err := render.New(engineOpts...)
+	if err != nil {
+		return preview{}, err
+	}
+	mac := strings.ToLower(req.MAC)
+	if mac == "" {
+		mac = "00:00:00:00:00:00"
+	}
+	content, warnings, err := engine.Preview(tmpl, map[string]any{
+		"Machine": map[string]any{"ID": "00000000-0000-0000-0000-000000000000", "MAC": mac, "Serial": req.Serial},
+		"Profile": eff.Profile,
+		"Token":   "PREVIEW-TOKEN",
+		"APIBase": "http://goosed.invalid",
+	})
+	if err != nil {
+		return preview{}, err
+	}
+	return preview{Blueprint: eff.Blueprint, Layers: eff.Layers, Format: format, Template: tmpl, Content: content, Warnings: warnings}, nil
+}
+
+// remotePreview asks the API to render the preview.
+func remotePreview(ctx context.Context, baseURL string, body previewRequest) (preview, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return preview{}, fmt.Errorf("marshal preview request: %w", err)
+	}
+	url := strings.TrimRight(baseURL, "/") + "/v1/render/preview"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return preview{}, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return preview{}, fmt.Errorf("post preview: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return preview{}, errors.New(apiErr.Error)
+		}
+		return preview{}, fmt.Errorf("preview failed: %s", strings.TrimSpace(string(data)))
+	}
+	var p preview
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return preview{}, fmt.Errorf("decode preview response: %w", err)
+	}
+	return p, nil
+}
+
+func newRenderValidateCommand() *cobra.Command {
+	var kind string
+
+	cmd := &cobra.Command{
+		Use:   "validate FILE...",
+		Short: "Check rendered Kickstart, Unattend and other install configs",
+		Long: `Runs the checks the API applies to every render on files saved from it:
+Kickstart commands and sections, Unattend passes and components, well-formed
+XML, JSON and YAML, and unresolved <no value> output. The kind of each file is
+taken from its name and content unless --kind is set.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			failed := 0
+			for _, file := range args {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				k := kind
+				if k == "" {
+					k = detectKind(file, data)
+				}
+				tmpl, ok := render.FormatTemplates[k]
+				if !ok {
+					return fmt.Errorf("%s: cannot tell the kind of file; set --kind", file)
+				}
+				if err := render.Validate(tmpl, string(data)); err != nil {
+					var verr *render.ValidationError
+					if !errors.As(err, &verr) {
+						return err
+					}
+					for _, p := range verr.Problems {
+						if p.Line > 0 {
+							fmt.Fprintf(cmd.OutOrStdout(), "%s:%d: %s\n", file, p.Line, p.Message)
+						} else {
+							fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", file, p.Message)
+						}
+					}
+					failed++
+					continue
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: valid %s\n", file, k)
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d files failed validation", failed, len(args))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&kind, "kind", "", "File kind: kickstart, unattend, cloud-init, autoinstall, autoyast or ignition")
+	return cmd
+}
+
+// detectKind guesses a file's kind from its extension and first lines.
+func detectKind(file string, data []byte) string {
+	head := string(data[:min(len(data), 512)])
+	switch {
+	case strings.HasSuffix(file, ".ks") || strings.Contains(filepath.Base(file), "kickstart"):
+		return render.FormatKickstart
+	case strings.Contains(head, "<unattend"):
+		return render.FormatUnattend
+	case strings.Contains(head, "yast2ns"):
+		return render.FormatAutoYaST
+	case strings.HasSuffix(file, ".json") || strings.HasPrefix(strings.TrimSpace(head), "{"):
+		return render.FormatIgnition
+	case strings.HasPrefix(head, "#cloud-config") && strings.Contains(string(data), "\nautoinstall:"):
+		return render.FormatAutoinstall
+	case strings.HasPrefix(head, "#cloud-config"):
+		return render.FormatCloudInit
+	}
+	return ""
+}
@@ -9,15 +9,20 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"goosed/pkg/bus"
 	"goosed/pkg/telemetry"
 	"goosed/services/pxe-stack/internal/config"
 	"goosed/services/pxe-stack/internal/dhcp"
+	"goosed/services/pxe-stack/internal/dhcp6"
+	"goosed/services/pxe-stack/internal/events"
 	"goosed/services/pxe-stack/internal/pxehttp"
 	"goosed/services/pxe-stack/internal/tftp"
 )
@@ -51,15 +56,30 @@ func run(serviceName string) error {
 		return fmt.Errorf("load config: %w", err)
 	}
 
-	var dhcpReady, tftpReady, httpReady atomic.Bool
+	var emitter *events.Emitter
+	if cfg.Events.NATSURL != "" {
+		// Keep netboot running while NATS is unavailable; events are dropped
+		// with a warning until the connection comes up.
+		b, err := bus.New(cfg.Events.NATSURL, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+		if err != nil {
+			return fmt.Errorf("connect nats: %w", err)
+		}
+		defer b.Close()
+		emitter = events.NewEmitter(b, logger)
+		logger.Printf("INFO publishing boot events to %s", cfg.Events.NATSURL)
+	}
+
+	var dhcpReady, dhcpv6Ready, tftpReady, httpReady atomic.Bool
 
-	errCh := make(chan error, 3)
+	errCh := make(chan error, 4)
 
+	var dhcpServer *dhcp.Server
 	if cfg.DHCP.Enabled {
-		server, err := dhcp.NewServer(cfg.DHCP, logger)
+		server, err := dhcp.NewServer(cfg.DHCP, logger, emitter)
 		if err != nil {
 			return fmt.Errorf("create dhcp server: %w", err)
 		}
+		dhcpServer = server
 		go func() {
 			if err := server.Run(ctx, &dhcpReady); err != nil {
 				errCh <- fmt.Errorf("dhcp: %w", err)
@@ -69,8 +89,25 @@ func run(serviceName string) error {
 		dhcpReady.Store(true)
 	}
 
+	if cfg.DHCPv6.Enabled {
+		server, err := dhcp6.NewServer(cfg.DHCPv6, logger, emitter)
+		if err != nil {
+			return fmt.Errorf("create dhcpv6 server: %w", err)
+		}
+		go func() {
+			if err := server.Run(ctx, &dhcpv6Ready); err != nil {
+				errCh <- fmt.Errorf("dhcpv6: %w", err)
+			}
+		}()
+	} else {
+		dhcpv6Ready.Store(true)
+	}
+
 	if cfg.TFTP.Enabled {
-		server := tftp.NewServer(cfg.TFTP, logger)
+		server, err := tftp.NewServer(cfg.TFTP, logger, emitter)
+		if err != nil {
+			return fmt.Errorf("create tftp server: %w", err)
+		}
 		go func() {
 			if err := server.Run(ctx, &tftpReady); err != nil {
 				errCh <- fmt.Errorf("tftp: %w", err)
@@ -85,7 +122,7 @@ func run(serviceName string) error {
 		w.WriteHeader(http.StatusOK)
 	})
 	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		if dhcpReady.Load() && tftpReady.Load() && httpReady.Load() {
+		if dhcpReady.Load() && dhcpv6Ready.Load() && tftpReady.Load() && httpReady.Load() {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -94,9 +131,14 @@ func run(serviceName string) error {
 	mux.Handle("/metrics", promhttp.Handler())
 
 	if cfg.HTTP.Enabled {
-		if err := pxehttp.RegisterHandlers(mux, cfg.HTTP, &httpReady, logger); err != nil {
+		if err := pxehttp.RegisterHandlers(mux, cfg.HTTP, &httpReady, logger, emitter); err != nil {
 			return fmt.Errorf("register http handlers: %w", err)
 		}
+		if dhcpServer != nil {
+			if err := pxehttp.RegisterLeaseHandler(mux, dhcpServer); err != nil {
+				return fmt.Errorf("register lease handler: %w", err)
+			}
+		}
 	} else {
 		httpReady.Store(true)
 	}
@@ -127,7 +169,7 @@ func run(serviceName string) error {
 	)
 	preferredPort := portsToTry[0]
 	for idx, port := range portsToTry {
-		listenAddr = fmt.Sprintf(":%d", port)
+		listenAddr = net.JoinHostPort(cfg.HTTP.BindAddress, strconv.Itoa(port))
 		ln, err := listenWithRetry(ctx, listenAddr, 30*time.Second, 500*time.Millisecond, logger)
 		if err != nil {
 			if errors.Is(err, syscall.EADDRINUSE) && idx < len(portsToTry)-1 {
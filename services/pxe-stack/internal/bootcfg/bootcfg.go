@@ -0,0 +1,107 @@
+// Package bootcfg fetches per-machine boot loader configs that the API renders
+// on request, so pxe-stack can serve them as virtual TFTP and HTTP files.
+package bootcfg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Kind is a boot loader config type, named after its API endpoint.
+type Kind string
+
+const (
+	// PXELinux configs are requested as pxelinux.cfg/01-<mac>.
+	PXELinux Kind = "pxelinux"
+	// GRUB configs are requested as <prefix>/grub.cfg-01-<mac>.
+	GRUB Kind = "grub"
+)
+
+// maxConfigSize bounds the configs read from the API.
+const maxConfigSize = 1 << 20
+
+// Match reports which config a boot loader is asking for with name, and for
+// which MAC. The 01 in both file names is the ARP hardware type for Ethernet.
+func Match(name string) (Kind, string, bool) {
+	name = strings.ToLower(strings.TrimLeft(name, "/"))
+	if rest, ok := strings.CutPrefix(name, "pxelinux.cfg/01-"); ok {
+		if mac, ok := parseMAC(rest); ok {
+			return PXELinux, mac, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(path.Base(name), "grub.cfg-01-"); ok {
+		if mac, ok := parseMAC(rest); ok {
+			return GRUB, mac, true
+		}
+	}
+	return "", "", false
+}
+
+func parseMAC(s string) (string, bool) {
+	hw, err := net.ParseMAC(s)
+	if err != nil || len(hw) != 6 {
+		return "", false
+	}
+	return hw.String(), true
+}
+
+type clientIPKey struct{}
+
+// WithClientIP records the address of the machine a config is fetched for.
+// Fetch forwards it as X-Real-IP so the API binds the tokens it embeds to the
+// machine rather than to pxe-stack.
+func WithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// Client fetches rendered configs from the API.
+type Client struct {
+	endpoint string
+	http     *http.Client
+}
+
+func NewClient(endpoint string) *Client {
+	return &Client{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		http:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Fetch renders the kind config for mac. Machines the API does not know
+// return an error wrapping fs.ErrNotExist.
+func (c *Client) Fetch(ctx context.Context, kind Kind, mac string) ([]byte, error) {
+	u := fmt.Sprintf("%s/v1/boot/%s?mac=%s", c.endpoint, kind, url.QueryEscape(mac))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ip, ok := ctx.Value(clientIPKey{}).(net.IP); ok && ip != nil {
+		req.Header.Set("X-Real-IP", ip.String())
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("render %s config for %s: %w", kind, mac, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("render %s config for %s: %w", kind, mac, fs.ErrNotExist)
+	default:
+		return nil, fmt.Errorf("render %s config for %s: API returned %s", kind, mac, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize))
+	if err != nil {
+		return nil, fmt.Errorf("render %s config for %s: %w", kind, mac, err)
+	}
+	return body, nil
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -13,6 +15,20 @@ func Load() (Config, error) {
 	cfg := Config{}
 
 	cfg.DHCP.Enabled = getEnvBool("PXE_ENABLE_DHCP", true)
+	cfg.DHCP.Mode = strings.ToLower(strings.TrimSpace(getEnv("PXE_DHCP_MODE", DHCPModeServer)))
+	switch cfg.DHCP.Mode {
+	case DHCPModeServer, DHCPModeProxy:
+	default:
+		return Config{}, fmt.Errorf("invalid PXE_DHCP_MODE: %q (expected %q or %q)", cfg.DHCP.Mode, DHCPModeServer, DHCPModeProxy)
+	}
+	cfg.DHCP.ProxyPort = 4011
+	if port := os.Getenv("PXE_DHCP_PROXY_PORT"); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid PXE_DHCP_PROXY_PORT: %q", port)
+		}
+		cfg.DHCP.ProxyPort = p
+	}
 	ifaceCandidates := getEnv("PXE_DHCP_INTERFACE", "eth0,en0")
 	if start := os.Getenv("PXE_DHCP_RANGE_START"); start != "" {
 		cfg.DHCP.RangeStart = net.ParseIP(start)
@@ -59,6 +75,22 @@ func Load() (Config, error) {
 	} else {
 		cfg.DHCP.LeaseTime = 24 * time.Hour
 	}
+	if hold := os.Getenv("PXE_DHCP_DECLINE_SECONDS"); hold != "" {
+		secs, err := strconv.Atoi(hold)
+		if err != nil || secs <= 0 {
+			return Config{}, fmt.Errorf("invalid PXE_DHCP_DECLINE_SECONDS: %q", hold)
+		}
+		cfg.DHCP.DeclineHold = time.Duration(secs) * time.Second
+	} else {
+		cfg.DHCP.DeclineHold = time.Hour
+	}
+	cfg.DHCP.ConflictProbe = getEnvBool("PXE_DHCP_CONFLICT_PROBE", false)
+	cfg.DHCP.ProbeTimeout = time.Duration(getEnvInt("PXE_DHCP_PROBE_TIMEOUT_MS", 500)) * time.Millisecond
+	if cfg.DHCP.ProbeTimeout <= 0 {
+		return Config{}, fmt.Errorf("invalid PXE_DHCP_PROBE_TIMEOUT_MS: %s", os.Getenv("PXE_DHCP_PROBE_TIMEOUT_MS"))
+	}
+	cfg.DHCP.LeaseFile = getEnv("PXE_DHCP_LEASE_FILE", "/var/lib/pxe-stack/leases.json")
+	cfg.DHCP.ReservationsDir = os.Getenv("PXE_DHCP_RESERVATIONS_DIR")
 	if sip := os.Getenv("PXE_DHCP_SERVER_IP"); sip != "" {
 		cfg.DHCP.ServerIP = net.ParseIP(sip)
 		if cfg.DHCP.ServerIP == nil {
@@ -78,40 +110,136 @@ func Load() (Config, error) {
 	cfg.DHCP.Interface = resolvedInterface
 
 	cfg.DHCP.BootFilename = getEnv("PXE_DHCP_BOOT_FILE", "undionly.kpxe")
+	cfg.DHCP.SecureBootFile = getEnv("PXE_DHCP_SECURE_BOOT_FILE", "shimx64.efi")
+	cfg.DHCP.SecureBootFileARM64 = getEnv("PXE_DHCP_SECURE_BOOT_FILE_ARM64", "shimaa64.efi")
 
-	if cfg.DHCP.Enabled {
-		if cfg.DHCP.RangeStart == nil || cfg.DHCP.RangeEnd == nil {
-			return Config{}, fmt.Errorf("PXE_DHCP_RANGE_START and PXE_DHCP_RANGE_END are required when DHCP is enabled")
+	if cfg.DHCP.Enabled && cfg.DHCP.Mode == DHCPModeProxy {
+		if cfg.DHCP.ServerIP == nil {
+			return Config{}, fmt.Errorf("PXE_DHCP_SERVER_IP is required when DHCP is enabled")
 		}
-		if cfg.DHCP.RangeStart.To4() == nil || cfg.DHCP.RangeEnd.To4() == nil {
-			return Config{}, fmt.Errorf("PXE_DHCP range must be IPv4 addresses")
+		if cfg.DHCP.ServerIP.To4() == nil {
+			return Config{}, fmt.Errorf("PXE_DHCP_SERVER_IP must be an IPv4 address")
 		}
-		if bytesCompare(cfg.DHCP.RangeStart.To4(), cfg.DHCP.RangeEnd.To4()) > 0 {
-			return Config{}, fmt.Errorf("PXE_DHCP_RANGE_START must be <= PXE_DHCP_RANGE_END")
+		if cfg.DHCP.ProxyPort <= 0 || cfg.DHCP.ProxyPort > 65535 {
+			return Config{}, fmt.Errorf("invalid PXE_DHCP_PROXY_PORT: %d", cfg.DHCP.ProxyPort)
 		}
+	}
+
+	if cfg.DHCP.Enabled && cfg.DHCP.Mode == DHCPModeServer {
 		if cfg.DHCP.ServerIP == nil {
 			return Config{}, fmt.Errorf("PXE_DHCP_SERVER_IP is required when DHCP is enabled")
 		}
 		if cfg.DHCP.ServerIP.To4() == nil {
 			return Config{}, fmt.Errorf("PXE_DHCP_SERVER_IP must be an IPv4 address")
 		}
-		if cfg.DHCP.SubnetMask == nil {
-			cfg.DHCP.SubnetMask = cfg.DHCP.RangeStart.DefaultMask()
+
+		scopesFile := os.Getenv("PXE_DHCP_SCOPES_FILE")
+		if scopesFile == "" && (cfg.DHCP.RangeStart == nil || cfg.DHCP.RangeEnd == nil) {
+			return Config{}, fmt.Errorf("PXE_DHCP_RANGE_START and PXE_DHCP_RANGE_END (or PXE_DHCP_SCOPES_FILE) are required when DHCP is enabled")
 		}
-		if cfg.DHCP.Router == nil {
-			cfg.DHCP.Router = cfg.DHCP.ServerIP
+		if cfg.DHCP.RangeStart != nil || cfg.DHCP.RangeEnd != nil {
+			if cfg.DHCP.RangeStart == nil || cfg.DHCP.RangeEnd == nil {
+				return Config{}, fmt.Errorf("PXE_DHCP_RANGE_START and PXE_DHCP_RANGE_END must be set together")
+			}
+			if cfg.DHCP.RangeStart.To4() == nil || cfg.DHCP.RangeEnd.To4() == nil {
+				return Config{}, fmt.Errorf("PXE_DHCP range must be IPv4 addresses (use PXE_DHCPV6_RANGE_START/PXE_DHCPV6_RANGE_END for IPv6)")
+			}
+			if bytesCompare(cfg.DHCP.RangeStart.To4(), cfg.DHCP.RangeEnd.To4()) > 0 {
+				return Config{}, fmt.Errorf("PXE_DHCP_RANGE_START must be <= PXE_DHCP_RANGE_END")
+			}
+			// The classful mask is only a fallback for this single scope;
+			// scopes from the file must not inherit it.
+			mask := cfg.DHCP.SubnetMask
+			if mask == nil {
+				mask = cfg.DHCP.RangeStart.DefaultMask()
+			}
+			if cfg.DHCP.Router == nil {
+				cfg.DHCP.Router = cfg.DHCP.ServerIP
+			}
+			scope := ScopeConfig{
+				Name:         "default",
+				Interface:    cfg.DHCP.Interface,
+				RangeStart:   cfg.DHCP.RangeStart.To4(),
+				RangeEnd:     cfg.DHCP.RangeEnd.To4(),
+				SubnetMask:   mask,
+				Router:       cfg.DHCP.Router,
+				DNSServers:   cfg.DHCP.DNSServers,
+				LeaseTime:    cfg.DHCP.LeaseTime,
+				NextServer:   cfg.DHCP.NextServer,
+				BootFilename: cfg.DHCP.BootFilename,
+			}
+			if err := scope.normalize(); err != nil {
+				return Config{}, fmt.Errorf("default scope: %w", err)
+			}
+			cfg.DHCP.Scopes = append(cfg.DHCP.Scopes, scope)
+		}
+		if scopesFile != "" {
+			scopes, err := loadScopes(scopesFile, cfg.DHCP)
+			if err != nil {
+				return Config{}, err
+			}
+			cfg.DHCP.Scopes = append(cfg.DHCP.Scopes, scopes...)
 		}
+		if err := validateScopes(cfg.DHCP.Scopes); err != nil {
+			return Config{}, err
+		}
+	}
+
+	dhcpv6, err := loadDHCPv6(cfg.DHCP.Interface)
+	if err != nil {
+		return Config{}, err
 	}
+	cfg.DHCPv6 = dhcpv6
 
 	cfg.TFTP.Enabled = getEnvBool("PXE_ENABLE_TFTP", true)
-	cfg.TFTP.Address = getEnv("PXE_TFTP_ADDRESS", ":69")
+	for _, addr := range strings.Split(getEnv("PXE_TFTP_ADDRESS", ":69"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cfg.TFTP.Addresses = append(cfg.TFTP.Addresses, addr)
+		}
+	}
 	cfg.TFTP.RootDir = getEnv("PXE_TFTP_ROOT", "/var/lib/tftpboot")
 	cfg.TFTP.ReadOnly = getEnvBool("PXE_TFTP_READ_ONLY", true)
 	cfg.TFTP.TimeoutSec = getEnvInt("PXE_TFTP_TIMEOUT", 5)
+	cfg.TFTP.Retries = getEnvInt("PXE_TFTP_RETRIES", 5)
+	cfg.TFTP.MaxBlockSize = getEnvInt("PXE_TFTP_MAX_BLKSIZE", 1468)
+	if cfg.TFTP.MaxBlockSize < 8 || cfg.TFTP.MaxBlockSize > 65464 {
+		return Config{}, fmt.Errorf("PXE_TFTP_MAX_BLKSIZE %d is outside the valid range 8-65464", cfg.TFTP.MaxBlockSize)
+	}
+	cfg.TFTP.MaxWindowSize = getEnvInt("PXE_TFTP_MAX_WINDOWSIZE", 16)
+	if cfg.TFTP.MaxWindowSize < 1 || cfg.TFTP.MaxWindowSize > 65535 {
+		return Config{}, fmt.Errorf("PXE_TFTP_MAX_WINDOWSIZE %d is outside the valid range 1-65535", cfg.TFTP.MaxWindowSize)
+	}
+	cfg.TFTP.TSize = getEnvBool("PXE_TFTP_TSIZE", true)
+	cfg.TFTP.Backend = strings.ToLower(strings.TrimSpace(getEnv("PXE_TFTP_BACKEND", TFTPBackendDir)))
+	switch cfg.TFTP.Backend {
+	case TFTPBackendDir:
+	case TFTPBackendS3:
+		cfg.TFTP.S3Bucket = getEnv("PXE_TFTP_S3_BUCKET", os.Getenv("S3_BUCKET"))
+		if cfg.TFTP.S3Bucket == "" {
+			return Config{}, errors.New("PXE_TFTP_S3_BUCKET or S3_BUCKET is required when PXE_TFTP_BACKEND=s3")
+		}
+		cfg.TFTP.S3Prefix = getEnv("PXE_TFTP_S3_PREFIX", "tftp/")
+		if cfg.TFTP.S3Prefix != "" && !strings.HasSuffix(cfg.TFTP.S3Prefix, "/") {
+			cfg.TFTP.S3Prefix += "/"
+		}
+		cfg.TFTP.CacheDir = os.Getenv("PXE_TFTP_CACHE_DIR")
+		cfg.TFTP.CacheBytes = int64(getEnvInt("PXE_TFTP_CACHE_MB", 256)) << 20
+		cfg.TFTP.CacheTTL = time.Duration(getEnvInt("PXE_TFTP_CACHE_TTL_SECONDS", 300)) * time.Second
+	default:
+		return Config{}, fmt.Errorf("invalid PXE_TFTP_BACKEND: %q (expected %q or %q)", cfg.TFTP.Backend, TFTPBackendDir, TFTPBackendS3)
+	}
+	cfg.TFTP.VirtualConfigs = getEnvBool("PXE_TFTP_VIRTUAL_CONFIGS", true)
 
 	cfg.HTTP.Enabled = getEnvBool("PXE_ENABLE_HTTP", true)
 	cfg.HTTP.Port = getEnvInt("PXE_HTTP_PORT", 8080)
+	if bind := strings.TrimSpace(os.Getenv("PXE_HTTP_BIND_ADDRESS")); bind != "" {
+		if ip := net.ParseIP(strings.Trim(bind, "[]")); ip == nil {
+			return Config{}, fmt.Errorf("invalid PXE_HTTP_BIND_ADDRESS: %q", bind)
+		}
+		cfg.HTTP.BindAddress = strings.Trim(bind, "[]")
+	}
 	cfg.HTTP.APIEndpoint = getEnv("PXE_HTTP_API_ENDPOINT", "http://api.goose.local")
+	cfg.TFTP.APIEndpoint = getEnv("PXE_TFTP_API_ENDPOINT", cfg.HTTP.APIEndpoint)
 	cfg.HTTP.BrandingFS = os.Getenv("PXE_HTTP_BRANDING_FS")
 	if fallbacks := os.Getenv("PXE_HTTP_FALLBACK_PORTS"); fallbacks != "" {
 		ports, err := parsePortList(fallbacks)
@@ -121,9 +249,87 @@ func Load() (Config, error) {
 		cfg.HTTP.FallbackPorts = ports
 	}
 
+	cfg.Events.NATSURL = os.Getenv("PXE_NATS_URL")
+
 	return cfg, nil
 }
 
+func loadDHCPv6(defaultInterface string) (DHCPv6Config, error) {
+	cfg := DHCPv6Config{
+		Enabled:     getEnvBool("PXE_ENABLE_DHCPV6", false),
+		Interface:   getEnv("PXE_DHCPV6_INTERFACE", defaultInterface),
+		BootFileURL: os.Getenv("PXE_DHCPV6_BOOT_URL"),
+		HTTPBootURL: os.Getenv("PXE_DHCPV6_HTTP_BOOT_URL"),
+		LeaseTime:   24 * time.Hour,
+	}
+	if !cfg.Enabled {
+		return cfg, nil
+	}
+
+	for _, bound := range []struct {
+		key string
+		dst *net.IP
+	}{
+		{"PXE_DHCPV6_RANGE_START", &cfg.RangeStart},
+		{"PXE_DHCPV6_RANGE_END", &cfg.RangeEnd},
+	} {
+		key := bound.key
+		value := os.Getenv(key)
+		if value == "" {
+			return DHCPv6Config{}, fmt.Errorf("%s is required when DHCPv6 is enabled", key)
+		}
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() != nil {
+			return DHCPv6Config{}, fmt.Errorf("invalid %s: %q (expected an IPv6 address)", key, value)
+		}
+		*bound.dst = ip
+	}
+	if bytesCompare(cfg.RangeStart, cfg.RangeEnd) > 0 {
+		return DHCPv6Config{}, fmt.Errorf("PXE_DHCPV6_RANGE_START must be <= PXE_DHCPV6_RANGE_END")
+	}
+	if dns := os.Getenv("PXE_DHCPV6_DNS"); dns != "" {
+		for _, s := range strings.Split(dns, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil || ip.To4() != nil {
+				return DHCPv6Config{}, fmt.Errorf("invalid DHCPv6 DNS server %q", s)
+			}
+			cfg.DNSServers = append(cfg.DNSServers, ip)
+		}
+	}
+	if lease := os.Getenv("PXE_DHCPV6_LEASE_SECONDS"); lease != "" {
+		secs, err := strconv.Atoi(lease)
+		if err != nil || secs <= 0 {
+			return DHCPv6Config{}, fmt.Errorf("invalid PXE_DHCPV6_LEASE_SECONDS: %q", lease)
+		}
+		cfg.LeaseTime = time.Duration(secs) * time.Second
+	}
+	if cfg.BootFileURL == "" {
+		return DHCPv6Config{}, fmt.Errorf("PXE_DHCPV6_BOOT_URL is required when DHCPv6 is enabled")
+	}
+	return cfg, nil
+}
+
+func validateScopes(scopes []ScopeConfig) error {
+	names := make(map[string]struct{}, len(scopes))
+	for i, scope := range scopes {
+		if _, dup := names[scope.Name]; dup {
+			return fmt.Errorf("duplicate DHCP scope name %q", scope.Name)
+		}
+		names[scope.Name] = struct{}{}
+		for _, other := range scopes[:i] {
+			// Direct requests pick the scope by interface, so it must be
+			// unambiguous.
+			if scope.Interface != "" && scope.Interface == other.Interface {
+				return fmt.Errorf("DHCP scopes %q and %q both serve interface %s", other.Name, scope.Name, scope.Interface)
+			}
+			if scope.Subnet.Contains(other.Subnet.IP) || other.Subnet.Contains(scope.Subnet.IP) {
+				return fmt.Errorf("DHCP scopes %q and %q have overlapping subnets", other.Name, scope.Name)
+			}
+		}
+	}
+	return nil
+}
+
 func bytesCompare(a, b net.IP) int {
 	if a == nil && b == nil {
 		return 0
@@ -137,7 +343,7 @@ func bytesCompare(a, b net.IP) int {
 	aa := a.To4()
 	bb := b.To4()
 	if aa == nil || bb == nil {
-		return strings.Compare(a.String(), b.String())
+		return bytes.Compare(a.To16(), b.To16())
 	}
 	for i := 0; i < len(aa); i++ {
 		if aa[i] < bb[i] {
@@ -2,6 +2,7 @@ package config
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -49,3 +50,41 @@ func TestParsePortList(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadDHCPMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		port     string
+		wantPort int
+		wantErr  string
+	}{
+		{name: "proxy with default port", mode: "Proxy", wantPort: 4011},
+		{name: "proxy port override", mode: "proxy", port: "14011", wantPort: 14011},
+		{name: "unknown mode", mode: "relay", wantErr: `invalid PXE_DHCP_MODE: "relay"`},
+		{name: "port not a number", mode: "proxy", port: "tftp", wantErr: `invalid PXE_DHCP_PROXY_PORT: "tftp"`},
+		{name: "port out of range", mode: "proxy", port: "70000", wantErr: "invalid PXE_DHCP_PROXY_PORT: 70000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PXE_ENABLE_DHCP", "true")
+			t.Setenv("PXE_DHCP_INTERFACE", "lo")
+			t.Setenv("PXE_DHCP_SERVER_IP", "127.0.0.1")
+			t.Setenv("PXE_DHCP_MODE", tt.mode)
+			t.Setenv("PXE_DHCP_PROXY_PORT", tt.port)
+			cfg, err := Load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if cfg.DHCP.Mode != DHCPModeProxy || cfg.DHCP.ProxyPort != tt.wantPort {
+				t.Fatalf("mode %q port %d, want proxy %d", cfg.DHCP.Mode, cfg.DHCP.ProxyPort, tt.wantPort)
+			}
+		})
+	}
+}
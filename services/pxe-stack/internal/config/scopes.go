@@ -0,0 +1,149 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scopeFile mirrors the YAML document referenced by PXE_DHCP_SCOPES_FILE.
+type scopeFile struct {
+	Scopes []scopeSpec `yaml:"scopes"`
+}
+
+type scopeSpec struct {
+	Name         string   `yaml:"name"`
+	Interface    string   `yaml:"interface"`
+	Subnet       string   `yaml:"subnet"`
+	RangeStart   string   `yaml:"rangeStart"`
+	RangeEnd     string   `yaml:"rangeEnd"`
+	Router       string   `yaml:"router"`
+	DNS          []string `yaml:"dns"`
+	LeaseSeconds int      `yaml:"leaseSeconds"`
+	NextServer   string   `yaml:"nextServer"`
+	BootFile     string   `yaml:"bootFile"`
+}
+
+// loadScopes parses the scope file at path. Fields left empty in a scope are
+// filled from defaults, which carries the global PXE_DHCP_* settings; a scope
+// without a subnet takes PXE_DHCP_SUBNET_MASK and fails without one.
+func loadScopes(path string, defaults DHCPConfig) ([]ScopeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read PXE_DHCP_SCOPES_FILE: %w", err)
+	}
+	var file scopeFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse PXE_DHCP_SCOPES_FILE %s: %w", path, err)
+	}
+	if len(file.Scopes) == 0 {
+		return nil, fmt.Errorf("PXE_DHCP_SCOPES_FILE %s defines no scopes", path)
+	}
+
+	scopes := make([]ScopeConfig, 0, len(file.Scopes))
+	for i, spec := range file.Scopes {
+		scope, err := spec.toConfig(defaults)
+		if err != nil {
+			name := spec.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("scope %s: %w", name, err)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+func (s scopeSpec) toConfig(defaults DHCPConfig) (ScopeConfig, error) {
+	scope := ScopeConfig{
+		Name:         strings.TrimSpace(s.Name),
+		Interface:    strings.TrimSpace(s.Interface),
+		SubnetMask:   defaults.SubnetMask,
+		DNSServers:   defaults.DNSServers,
+		LeaseTime:    defaults.LeaseTime,
+		NextServer:   defaults.NextServer,
+		BootFilename: defaults.BootFilename,
+	}
+	if scope.Name == "" {
+		return ScopeConfig{}, fmt.Errorf("name is required")
+	}
+
+	scope.RangeStart = net.ParseIP(strings.TrimSpace(s.RangeStart)).To4()
+	scope.RangeEnd = net.ParseIP(strings.TrimSpace(s.RangeEnd)).To4()
+	if scope.RangeStart == nil || scope.RangeEnd == nil {
+		return ScopeConfig{}, fmt.Errorf("rangeStart and rangeEnd must be IPv4 addresses")
+	}
+	if s.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(s.Subnet))
+		if err != nil || subnet.IP.To4() == nil {
+			return ScopeConfig{}, fmt.Errorf("invalid subnet %q", s.Subnet)
+		}
+		scope.Subnet = subnet
+		scope.SubnetMask = subnet.Mask
+	} else if scope.SubnetMask == nil {
+		return ScopeConfig{}, fmt.Errorf("subnet is required when PXE_DHCP_SUBNET_MASK is not set")
+	}
+	if s.Router != "" {
+		scope.Router = net.ParseIP(strings.TrimSpace(s.Router)).To4()
+		if scope.Router == nil {
+			return ScopeConfig{}, fmt.Errorf("invalid router %q", s.Router)
+		}
+	}
+	if len(s.DNS) > 0 {
+		scope.DNSServers = make([]net.IP, 0, len(s.DNS))
+		for _, raw := range s.DNS {
+			ip := net.ParseIP(strings.TrimSpace(raw))
+			if ip == nil {
+				return ScopeConfig{}, fmt.Errorf("invalid DNS server %q", raw)
+			}
+			scope.DNSServers = append(scope.DNSServers, ip)
+		}
+	}
+	if s.LeaseSeconds < 0 {
+		return ScopeConfig{}, fmt.Errorf("invalid leaseSeconds %d", s.LeaseSeconds)
+	}
+	if s.LeaseSeconds > 0 {
+		scope.LeaseTime = time.Duration(s.LeaseSeconds) * time.Second
+	}
+	if s.NextServer != "" {
+		scope.NextServer = net.ParseIP(strings.TrimSpace(s.NextServer))
+		if scope.NextServer == nil {
+			return ScopeConfig{}, fmt.Errorf("invalid nextServer %q", s.NextServer)
+		}
+	}
+	if s.BootFile != "" {
+		scope.BootFilename = strings.TrimSpace(s.BootFile)
+	}
+
+	return scope, scope.normalize()
+}
+
+// normalize derives the subnet from the range when it was not given explicitly
+// and checks the range is coherent.
+func (s *ScopeConfig) normalize() error {
+	if bytesCompare(s.RangeStart, s.RangeEnd) > 0 {
+		return fmt.Errorf("range start %s must be <= range end %s", s.RangeStart, s.RangeEnd)
+	}
+	if s.Subnet == nil {
+		mask := s.SubnetMask
+		if mask == nil {
+			mask = s.RangeStart.DefaultMask()
+		}
+		s.Subnet = &net.IPNet{IP: s.RangeStart.Mask(mask), Mask: mask}
+	}
+	if s.SubnetMask == nil {
+		s.SubnetMask = s.Subnet.Mask
+	}
+	if !s.Subnet.Contains(s.RangeStart) || !s.Subnet.Contains(s.RangeEnd) {
+		return fmt.Errorf("range %s-%s is outside subnet %s", s.RangeStart, s.RangeEnd, s.Subnet)
+	}
+	if s.LeaseTime <= 0 {
+		s.LeaseTime = 24 * time.Hour
+	}
+	return nil
+}
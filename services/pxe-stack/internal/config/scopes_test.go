@@ -0,0 +1,131 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScopes(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "scopes.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScopes(t *testing.T) {
+	defaults := DHCPConfig{
+		DNSServers:   []net.IP{net.IPv4(10, 0, 0, 53)},
+		LeaseTime:    time.Hour,
+		BootFilename: "undionly.kpxe",
+	}
+	path := writeScopes(t, `scopes:
+  - name: lab
+    interface: eth1
+    subnet: 10.20.0.0/24
+    rangeStart: 10.20.0.100
+    rangeEnd: 10.20.0.200
+    router: 10.20.0.1
+  - name: rack-2
+    subnet: 10.21.0.0/25
+    rangeStart: 10.21.0.10
+    rangeEnd: 10.21.0.50
+    dns: [10.21.0.53]
+    leaseSeconds: 600
+    bootFile: ipxe.efi
+`)
+	scopes, err := loadScopes(path, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 2 {
+		t.Fatalf("scopes = %+v", scopes)
+	}
+	lab, rack := scopes[0], scopes[1]
+	if lab.Interface != "eth1" || lab.Subnet.String() != "10.20.0.0/24" || lab.SubnetMask.String() != "ffffff00" || !lab.Router.Equal(net.IPv4(10, 20, 0, 1)) {
+		t.Fatalf("lab = %+v", lab)
+	}
+	if lab.LeaseTime != time.Hour || lab.BootFilename != "undionly.kpxe" || len(lab.DNSServers) != 1 {
+		t.Fatalf("lab did not inherit defaults: %+v", lab)
+	}
+	if rack.SubnetMask.String() != "ffffff80" || rack.LeaseTime != 10*time.Minute || rack.BootFilename != "ipxe.efi" || !rack.DNSServers[0].Equal(net.IPv4(10, 21, 0, 53)) {
+		t.Fatalf("rack-2 = %+v", rack)
+	}
+	if err := validateScopes(scopes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadScopesSubnetFromGlobalMask(t *testing.T) {
+	// 10.x ranges without a subnet must not fall back to the classful /8,
+	// which would make these two scopes overlap.
+	path := writeScopes(t, `scopes:
+  - {name: a, rangeStart: 10.1.0.10, rangeEnd: 10.1.0.20}
+  - {name: b, rangeStart: 10.2.0.10, rangeEnd: 10.2.0.20}
+`)
+	if _, err := loadScopes(path, DHCPConfig{}); err == nil || !strings.Contains(err.Error(), "subnet is required") {
+		t.Fatalf("missing subnet and mask: err = %v", err)
+	}
+
+	scopes, err := loadScopes(path, DHCPConfig{SubnetMask: net.CIDRMask(16, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scopes[0].Subnet.String() != "10.1.0.0/16" || scopes[1].Subnet.String() != "10.2.0.0/16" {
+		t.Fatalf("subnets = %s, %s", scopes[0].Subnet, scopes[1].Subnet)
+	}
+	if err := validateScopes(scopes); err != nil {
+		t.Fatalf("validateScopes: %v", err)
+	}
+}
+
+func TestLoadScopesErrors(t *testing.T) {
+	tests := map[string]string{
+		"no scopes":      "scopes: []\n",
+		"missing name":   "scopes:\n  - {subnet: 10.0.0.0/24, rangeStart: 10.0.0.10, rangeEnd: 10.0.0.20}\n",
+		"ipv6 range":     "scopes:\n  - {name: a, subnet: 10.0.0.0/24, rangeStart: 'fd00::10', rangeEnd: 'fd00::20'}\n",
+		"reversed range": "scopes:\n  - {name: a, subnet: 10.0.0.0/24, rangeStart: 10.0.0.20, rangeEnd: 10.0.0.10}\n",
+		"outside subnet": "scopes:\n  - {name: a, subnet: 10.0.0.0/24, rangeStart: 10.0.1.10, rangeEnd: 10.0.1.20}\n",
+		"bad router":     "scopes:\n  - {name: a, subnet: 10.0.0.0/24, rangeStart: 10.0.0.10, rangeEnd: 10.0.0.20, router: gw}\n",
+		"bad lease":      "scopes:\n  - {name: a, subnet: 10.0.0.0/24, rangeStart: 10.0.0.10, rangeEnd: 10.0.0.20, leaseSeconds: -1}\n",
+	}
+	for name, content := range tests {
+		if _, err := loadScopes(writeScopes(t, content), DHCPConfig{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	scope := func(name, iface, cidr string) ScopeConfig {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		return ScopeConfig{Name: name, Interface: iface, Subnet: subnet}
+	}
+	tests := []struct {
+		name    string
+		scopes  []ScopeConfig
+		wantErr string
+	}{
+		{"distinct", []ScopeConfig{scope("a", "eth0", "10.0.0.0/24"), scope("b", "eth1", "10.0.1.0/24"), scope("c", "", "10.0.2.0/24"), scope("d", "", "10.0.3.0/24")}, ""},
+		{"duplicate name", []ScopeConfig{scope("a", "", "10.0.0.0/24"), scope("a", "", "10.0.1.0/24")}, `duplicate DHCP scope name "a"`},
+		{"overlap", []ScopeConfig{scope("a", "", "10.0.0.0/16"), scope("b", "", "10.0.1.0/24")}, "overlapping subnets"},
+		{"same interface", []ScopeConfig{scope("a", "eth0", "10.0.0.0/24"), scope("b", "eth0", "10.0.1.0/24")}, "both serve interface eth0"},
+	}
+	for _, tt := range tests {
+		err := validateScopes(tt.scopes)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
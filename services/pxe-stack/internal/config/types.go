@@ -5,38 +5,124 @@ import (
 	"time"
 )
 
+// DHCP operating modes. In server mode pxe-stack owns addressing for the
+// configured range; in proxy mode it only supplies PXE boot options and leaves
+// address assignment to the existing DHCP server on the segment.
+const (
+	DHCPModeServer = "server"
+	DHCPModeProxy  = "proxy"
+)
+
+// TFTP backends. The dir backend serves RootDir from local disk; the s3
+// backend serves objects from the artifacts bucket through a local cache.
+const (
+	TFTPBackendDir = "dir"
+	TFTPBackendS3  = "s3"
+)
+
 type Config struct {
-	DHCP DHCPConfig
-	TFTP TFTPConfig
-	HTTP HTTPConfig
+	DHCP   DHCPConfig
+	DHCPv6 DHCPv6Config
+	TFTP   TFTPConfig
+	HTTP   HTTPConfig
+	Events EventsConfig
 }
 
 type DHCPConfig struct {
-	Enabled      bool
+	Enabled         bool
+	Mode            string
+	Interface       string
+	ProxyPort       int
+	RangeStart      net.IP
+	RangeEnd        net.IP
+	SubnetMask      net.IPMask
+	Router          net.IP
+	DNSServers      []net.IP
+	LeaseTime       time.Duration
+	DeclineHold     time.Duration
+	ConflictProbe   bool
+	ProbeTimeout    time.Duration
+	LeaseFile       string
+	ReservationsDir string
+	ServerIP        net.IP
+	NextServer      net.IP
+	BootFilename    string
+	// SecureBootFile and SecureBootFileARM64 are offered to UEFI clients
+	// whose machine profile sets secureBoot.
+	SecureBootFile      string
+	SecureBootFileARM64 string
+	Scopes              []ScopeConfig
+}
+
+// ScopeConfig describes one addressable subnet. Relayed requests are matched
+// to a scope by giaddr against Subnet; direct requests by the receiving
+// Interface.
+type ScopeConfig struct {
+	Name         string
 	Interface    string
+	Subnet       *net.IPNet
 	RangeStart   net.IP
 	RangeEnd     net.IP
 	SubnetMask   net.IPMask
 	Router       net.IP
 	DNSServers   []net.IP
 	LeaseTime    time.Duration
-	ServerIP     net.IP
 	NextServer   net.IP
 	BootFilename string
 }
 
+// DHCPv6Config configures the stateful DHCPv6 server used for UEFI IPv6
+// netboot. Clients receive an IA_NA address from the range and, when they ask
+// for it, a boot file URL (option 59).
+type DHCPv6Config struct {
+	Enabled     bool
+	Interface   string
+	RangeStart  net.IP
+	RangeEnd    net.IP
+	DNSServers  []net.IP
+	LeaseTime   time.Duration
+	BootFileURL string
+	// HTTPBootURL is handed to UEFI HTTP boot clients instead of BootFileURL.
+	HTTPBootURL string
+}
+
 type TFTPConfig struct {
 	Enabled    bool
-	Address    string
+	Addresses  []string
 	RootDir    string
 	ReadOnly   bool
 	TimeoutSec int
+	Retries    int
+	// MaxBlockSize and MaxWindowSize cap what clients may negotiate with the
+	// RFC 2348 blksize and RFC 7440 windowsize options.
+	MaxBlockSize  int
+	MaxWindowSize int
+	// TSize answers RFC 2349 tsize requests with the file size.
+	TSize bool
+
+	Backend    string
+	S3Bucket   string
+	S3Prefix   string
+	CacheDir   string // empty keeps the cache in memory
+	CacheBytes int64
+	CacheTTL   time.Duration
+	// VirtualConfigs renders pxelinux.cfg/01-<mac> and grub.cfg-01-<mac>
+	// from APIEndpoint.
+	VirtualConfigs bool
+	APIEndpoint    string
 }
 
 type HTTPConfig struct {
 	Enabled       bool
+	BindAddress   string
 	Port          int
 	FallbackPorts []int
 	APIEndpoint   string
 	BrandingFS    string
 }
+
+// EventsConfig controls publishing of boot progress events. Publishing is
+// disabled when NATSURL is empty.
+type EventsConfig struct {
+	NATSURL string
+}
@@ -0,0 +1,166 @@
+package dhcp
+
+import (
+	"net"
+	"time"
+)
+
+// offer picks an address for mac in sc and holds it for offerHoldTime. When a
+// conflict prober is configured, freshly chosen dynamic addresses are probed
+// outside the lock and quarantined if something already answers.
+func (h *handler) offer(sc *scope, mac string) net.IP {
+	for attempt := 0; attempt < maxProbeAttempts; attempt++ {
+		ip, fresh := h.holdOffer(sc, mac)
+		if ip == nil || !fresh || h.prober == nil {
+			return ip
+		}
+		if !h.prober.InUse(ip) {
+			return ip
+		}
+
+		h.mu.Lock()
+		if l, ok := h.leases[mac]; ok && l.offered && l.ip.Equal(ip) {
+			delete(h.leases, mac)
+		}
+		h.quarantineLocked(ip, time.Now())
+		h.mu.Unlock()
+		h.logger.Printf("WARN %s answered conflict probe; quarantined for %s", ip, h.cfg.DeclineHold)
+	}
+	return nil
+}
+
+// holdOffer records a tentative lease for mac. fresh reports whether the
+// address was newly chosen from the dynamic pool and so should be probed.
+func (h *handler) holdOffer(sc *scope, mac string) (net.IP, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if r, ok := h.reservations[mac]; ok {
+		if sc.contains(r.IP) && !h.quarantinedLocked(r.IP, now) {
+			if l, ok := h.leases[mac]; !ok || l.offered || !l.ip.Equal(r.IP) || !l.expiresAt.After(now) {
+				h.leases[mac] = lease{ip: cloneIP(r.IP), scope: sc.cfg.Name, expiresAt: now.Add(offerHoldTime), offered: true}
+			}
+			return cloneIP(r.IP), false
+		}
+		h.logger.Printf("WARN reservation %s for %s is unusable in scope %s; allocating dynamically", r.IP, mac, sc.cfg.Name)
+	}
+
+	if l, ok := h.leases[mac]; ok && l.scope == sc.cfg.Name {
+		if l.expiresAt.After(now) {
+			if l.offered {
+				l.expiresAt = now.Add(offerHoldTime)
+				h.leases[mac] = l
+			}
+			return cloneIP(l.ip), false
+		}
+		// Prefer the client's previous address if nobody has taken it since.
+		if sc.inRange(l.ip) && !h.isAllocated(l.ip, mac, now) {
+			h.leases[mac] = lease{ip: cloneIP(l.ip), scope: sc.cfg.Name, expiresAt: now.Add(offerHoldTime), offered: true}
+			return cloneIP(l.ip), true
+		}
+	}
+
+	ip := h.nextFreeLocked(sc, mac, now)
+	if ip == nil {
+		return nil, false
+	}
+	h.leases[mac] = lease{ip: ip, scope: sc.cfg.Name, expiresAt: now.Add(offerHoldTime), offered: true}
+	return cloneIP(ip), true
+}
+
+// bind commits ip to mac for the scope's full lease time. known reports
+// whether this server has any record of the client; ok reports whether the
+// address matches that record and is still free to use.
+func (h *handler) bind(sc *scope, mac string, ip net.IP) (known, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if r, reserved := h.reservations[mac]; reserved && sc.contains(r.IP) {
+		if !r.IP.Equal(ip) {
+			return true, false
+		}
+	} else if l, has := h.leases[mac]; has {
+		if l.scope != sc.cfg.Name || !l.ip.Equal(ip) {
+			return true, false
+		}
+		if !l.expiresAt.After(now) && h.isAllocated(ip, mac, now) {
+			return true, false
+		}
+	} else {
+		return false, false
+	}
+
+	h.leases[mac] = lease{ip: cloneIP(ip), scope: sc.cfg.Name, expiresAt: now.Add(sc.cfg.LeaseTime)}
+	h.persistLocked()
+	return true, true
+}
+
+// dropOffer forgets a tentative lease after the client selected another server.
+func (h *handler) dropOffer(mac string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if l, ok := h.leases[mac]; ok && l.offered {
+		delete(h.leases, mac)
+	}
+}
+
+func (h *handler) nextFreeLocked(sc *scope, mac string, now time.Time) net.IP {
+	if ip := h.scanLocked(sc.nextIP, sc.endIP, mac, now); ip != nil {
+		sc.nextIP = incrementIP(ip)
+		return ip
+	}
+	if ip := h.scanLocked(sc.startIP, sc.endIP, mac, now); ip != nil {
+		sc.nextIP = incrementIP(ip)
+		return ip
+	}
+	return nil
+}
+
+func (h *handler) scanLocked(from, to net.IP, mac string, now time.Time) net.IP {
+	for ip := cloneIP(from); compareIP(ip, to) <= 0; ip = incrementIP(ip) {
+		if !h.isAllocated(ip, mac, now) {
+			return ip
+		}
+		if compareIP(ip, to) == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+// isAllocated reports whether ip is unavailable to mac: reserved for or leased
+// to another client, or quarantined after a decline or failed probe.
+func (h *handler) isAllocated(ip net.IP, mac string, now time.Time) bool {
+	if h.quarantinedLocked(ip, now) {
+		return true
+	}
+	for owner, r := range h.reservations {
+		if owner != mac && ip.Equal(r.IP) {
+			return true
+		}
+	}
+	for owner, l := range h.leases {
+		if owner != mac && l.expiresAt.After(now) && ip.Equal(l.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) quarantineLocked(ip net.IP, now time.Time) {
+	h.declined[ip.String()] = now.Add(h.cfg.DeclineHold)
+}
+
+func (h *handler) quarantinedLocked(ip net.IP, now time.Time) bool {
+	until, ok := h.declined[ip.String()]
+	if !ok {
+		return false
+	}
+	if !until.After(now) {
+		delete(h.declined, ip.String())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,295 @@
+package dhcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+
+	"goosed/services/pxe-stack/internal/events"
+)
+
+// offerHoldTime is how long an offered address is reserved for the client
+// while it decides between competing offers.
+const offerHoldTime = time.Minute
+
+// maxProbeAttempts bounds how many candidate addresses are probed for a single
+// DISCOVER before giving up.
+const maxProbeAttempts = 3
+
+// handle serves requests received on the primary DHCP interface.
+func (h *handler) handle(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	h.handleOn(h.cfg.Interface, conn, peer, req)
+}
+
+// on returns a server4 handler bound to iface so requests that were not
+// relayed are served from that interface's scope.
+func (h *handler) on(iface string) server4.Handler {
+	return func(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+		h.handleOn(iface, conn, peer, req)
+	}
+}
+
+func (h *handler) handleOn(iface string, conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		h.discover(iface, conn, peer, req)
+	case dhcpv4.MessageTypeRequest:
+		h.request(iface, conn, peer, req)
+	case dhcpv4.MessageTypeDecline:
+		h.decline(req)
+	case dhcpv4.MessageTypeRelease:
+		h.release(req.ClientHWAddr.String())
+	case dhcpv4.MessageTypeInform:
+		h.inform(iface, conn, peer, req)
+	default:
+		// ignore other messages
+	}
+}
+
+func (h *handler) discover(iface string, conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	mac := req.ClientHWAddr.String()
+	sc := h.selectScope(iface, req)
+	if sc == nil {
+		h.logger.Printf("WARN no DHCP scope for %s (interface %s, giaddr %s)", mac, iface, req.GatewayIPAddr)
+		return
+	}
+	ip := h.offer(sc, mac)
+	if ip == nil {
+		h.logger.Printf("WARN no available lease for %s in scope %s", mac, sc.cfg.Name)
+		return
+	}
+	h.reply(conn, peer, req, sc, dhcpv4.MessageTypeOffer, ip)
+}
+
+// request implements the REQUEST states from RFC 2131 section 4.3.2. Requests
+// aimed at another server drop our offer; requests for an address we did not
+// hand out are NAKed, and requests we have no record of are left for the
+// server that does.
+func (h *handler) request(iface string, conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	mac := req.ClientHWAddr.String()
+	serverID := req.ServerIdentifier()
+	requested := req.RequestedIPAddress().To4()
+	ciaddr := nonZeroIPv4(req.ClientIPAddr)
+
+	sc := h.selectScope(iface, req)
+	if ciaddr != nil && nonZeroIPv4(req.GatewayIPAddr) == nil {
+		// RENEWING clients unicast from their bound address.
+		if s := h.scopeForIP(ciaddr); s != nil {
+			sc = s
+		}
+	}
+
+	switch {
+	case serverID != nil:
+		// SELECTING
+		if !serverID.Equal(h.cfg.ServerIP) {
+			h.dropOffer(mac)
+			return
+		}
+		if sc == nil || requested == nil || !sc.contains(requested) {
+			h.nak(conn, req, "requested address not offered")
+			return
+		}
+		if known, ok := h.bind(sc, mac, requested); !known || !ok {
+			h.nak(conn, req, "requested address not offered")
+			return
+		}
+		h.reply(conn, peer, req, sc, dhcpv4.MessageTypeAck, requested)
+	case requested != nil && ciaddr == nil:
+		// INIT-REBOOT
+		if sc == nil || !sc.contains(requested) {
+			h.nak(conn, req, "wrong network")
+			return
+		}
+		known, ok := h.bind(sc, mac, requested)
+		if !known {
+			return
+		}
+		if !ok {
+			h.nak(conn, req, "requested address not leased to client")
+			return
+		}
+		h.reply(conn, peer, req, sc, dhcpv4.MessageTypeAck, requested)
+	case ciaddr != nil:
+		// RENEWING or REBINDING
+		if sc == nil {
+			return
+		}
+		known, ok := h.bind(sc, mac, ciaddr)
+		if !known {
+			return
+		}
+		if !ok {
+			h.nak(conn, req, "address not leased to client")
+			return
+		}
+		h.reply(conn, peer, req, sc, dhcpv4.MessageTypeAck, ciaddr)
+	}
+}
+
+// decline quarantines an address the client found already in use.
+func (h *handler) decline(req *dhcpv4.DHCPv4) {
+	if serverID := req.ServerIdentifier(); serverID != nil && !serverID.Equal(h.cfg.ServerIP) {
+		return
+	}
+	mac := req.ClientHWAddr.String()
+	ip := req.RequestedIPAddress().To4()
+	if ip == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if l, ok := h.leases[mac]; ok && l.ip.Equal(ip) {
+		delete(h.leases, mac)
+		h.persistLocked()
+	}
+	h.quarantineLocked(ip, time.Now())
+	h.logger.Printf("WARN %s declined %s; quarantined for %s", mac, ip, h.cfg.DeclineHold)
+}
+
+func (h *handler) release(mac string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.leases[mac]; !ok {
+		return
+	}
+	delete(h.leases, mac)
+	h.persistLocked()
+}
+
+// inform answers a client that already has an address and only wants local
+// configuration parameters.
+func (h *handler) inform(iface string, conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	ciaddr := nonZeroIPv4(req.ClientIPAddr)
+	var sc *scope
+	if nonZeroIPv4(req.GatewayIPAddr) != nil {
+		sc = h.selectScope(iface, req)
+	} else if ciaddr != nil {
+		sc = h.scopeForIP(ciaddr)
+	}
+	if sc == nil {
+		sc = h.selectScope(iface, req)
+	}
+	if sc == nil {
+		return
+	}
+
+	reply, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		h.logger.Printf("ERROR create reply: %v", err)
+		return
+	}
+	reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	reply.ClientIPAddr = req.ClientIPAddr
+	h.setScopeOptions(reply, sc)
+
+	dest := h.replyDest(peer, req, reply)
+	if nonZeroIPv4(req.GatewayIPAddr) == nil && ciaddr != nil {
+		dest = &net.UDPAddr{IP: ciaddr, Port: dhcpv4.ClientPort}
+	}
+	h.send(conn, dest, reply, req.ClientHWAddr.String())
+}
+
+func (h *handler) reply(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4, sc *scope, msgType dhcpv4.MessageType, ip net.IP) {
+	mac := req.ClientHWAddr.String()
+	reply, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		h.logger.Printf("ERROR create reply: %v", err)
+		return
+	}
+	reply.UpdateOption(dhcpv4.OptMessageType(msgType))
+	reply.ClientIPAddr = req.ClientIPAddr
+	reply.YourIPAddr = ip
+	reply.ServerIPAddr = h.cfg.ServerIP
+	reply.BootFileName = h.bootFile(req, sc.cfg.BootFilename)
+	h.setScopeOptions(reply, sc)
+	reply.Options.Update(dhcpv4.OptIPAddressLeaseTime(sc.cfg.LeaseTime))
+	if r, ok := h.reservations[mac]; ok && r.Hostname != "" {
+		reply.Options.Update(dhcpv4.OptHostName(r.Hostname))
+	}
+	if sc.cfg.NextServer != nil {
+		reply.ServerIPAddr = sc.cfg.NextServer
+		reply.Options.Update(dhcpv4.OptTFTPServerName(sc.cfg.NextServer.String()))
+	}
+	h.send(conn, h.replyDest(peer, req, reply), reply, mac)
+
+	if msgType == dhcpv4.MessageTypeAck {
+		h.events.Emit(events.SubjectDHCPLeased, events.Boot{
+			MAC:      mac,
+			IP:       ip.String(),
+			Arch:     clientArch(req),
+			BootFile: reply.BootFileName,
+			Scope:    sc.cfg.Name,
+		})
+	}
+}
+
+// clientArch names the client system architecture from option 93, if sent.
+func clientArch(req *dhcpv4.DHCPv4) string {
+	if archs := req.ClientArch(); len(archs) > 0 {
+		return archs[0].String()
+	}
+	return ""
+}
+
+func (h *handler) setScopeOptions(reply *dhcpv4.DHCPv4, sc *scope) {
+	reply.Options.Update(dhcpv4.OptServerIdentifier(h.cfg.ServerIP))
+	reply.Options.Update(dhcpv4.OptSubnetMask(sc.cfg.SubnetMask))
+	if sc.cfg.Router != nil {
+		reply.Options.Update(dhcpv4.OptRouter(sc.cfg.Router))
+	}
+	if len(sc.cfg.DNSServers) > 0 {
+		reply.Options.Update(dhcpv4.OptDNS(sc.cfg.DNSServers...))
+	}
+}
+
+// nak rejects a request. NAKs are broadcast to the client's segment, or sent
+// to the relay with the broadcast bit set so it does the same.
+func (h *handler) nak(conn net.PacketConn, req *dhcpv4.DHCPv4, reason string) {
+	mac := req.ClientHWAddr.String()
+	reply, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		h.logger.Printf("ERROR create reply: %v", err)
+		return
+	}
+	reply.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+	reply.Options.Update(dhcpv4.OptServerIdentifier(h.cfg.ServerIP))
+	reply.Options.Update(dhcpv4.OptMessage(reason))
+
+	dest := net.Addr(&net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort})
+	if giaddr := nonZeroIPv4(req.GatewayIPAddr); giaddr != nil {
+		reply.SetBroadcast()
+		dest = &net.UDPAddr{IP: giaddr, Port: dhcpv4.ServerPort}
+	}
+	h.logger.Printf("INFO NAK %s for %s: %s", mac, req.RequestedIPAddress(), reason)
+	h.send(conn, dest, reply, mac)
+}
+
+func (h *handler) replyDest(peer net.Addr, req *dhcpv4.DHCPv4, reply *dhcpv4.DHCPv4) net.Addr {
+	giaddr := nonZeroIPv4(req.GatewayIPAddr)
+	if giaddr == nil {
+		return peer
+	}
+	// RFC 3046: echo the relay agent information back to the relay.
+	if info := req.GetOneOption(dhcpv4.OptionRelayAgentInformation); len(info) > 0 {
+		reply.Options.Update(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, info))
+	}
+	return &net.UDPAddr{IP: giaddr, Port: dhcpv4.ServerPort}
+}
+
+func (h *handler) send(conn net.PacketConn, dest net.Addr, reply *dhcpv4.DHCPv4, mac string) {
+	if _, err := conn.WriteTo(reply.ToBytes(), dest); err != nil {
+		h.logger.Printf("ERROR send %s to %s: %v", reply.MessageType(), mac, err)
+	}
+}
+
+func nonZeroIPv4(ip net.IP) net.IP {
+	ip = ip.To4()
+	if ip == nil || ip.Equal(net.IPv4zero) {
+		return nil
+	}
+	return ip
+}
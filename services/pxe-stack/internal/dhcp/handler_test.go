@@ -0,0 +1,328 @@
+package dhcp
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"goosed/services/pxe-stack/internal/config"
+)
+
+var (
+	testServerIP = net.IPv4(10, 0, 0, 1).To4()
+	testMAC      = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	otherMAC     = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66}
+)
+
+type sentPacket struct {
+	msg  *dhcpv4.DHCPv4
+	dest net.Addr
+}
+
+// captureConn records every packet the handler writes.
+type captureConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	sent []sentPacket
+}
+
+func (c *captureConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	msg, err := dhcpv4.FromBytes(b)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.sent = append(c.sent, sentPacket{msg: msg, dest: addr})
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *captureConn) take(t *testing.T) *sentPacket {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sent) == 0 {
+		return nil
+	}
+	p := c.sent[0]
+	c.sent = c.sent[1:]
+	return &p
+}
+
+type fakeProber struct {
+	inUse map[string]bool
+	calls int
+}
+
+func (p *fakeProber) InUse(ip net.IP) bool {
+	p.calls++
+	return p.inUse[ip.String()]
+}
+
+func newTestHandler(t *testing.T) *handler {
+	t.Helper()
+	scope := config.ScopeConfig{
+		Name:       "default",
+		Interface:  "eth0",
+		Subnet:     &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)},
+		RangeStart: net.IPv4(10, 0, 0, 100).To4(),
+		RangeEnd:   net.IPv4(10, 0, 0, 102).To4(),
+		SubnetMask: net.CIDRMask(24, 32),
+		Router:     testServerIP,
+		DNSServers: []net.IP{net.IPv4(10, 0, 0, 53).To4()},
+		LeaseTime:  time.Hour,
+	}
+	cfg := config.DHCPConfig{
+		Interface:   "eth0",
+		ServerIP:    testServerIP,
+		DeclineHold: time.Hour,
+		Scopes:      []config.ScopeConfig{scope},
+	}
+	return newHandler(cfg, log.New(io.Discard, "", 0), nil, nil, nil)
+}
+
+func newPacket(t *testing.T, mac net.HardwareAddr, mt dhcpv4.MessageType, mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	mods = append([]dhcpv4.Modifier{dhcpv4.WithHwAddr(mac), dhcpv4.WithMessageType(mt)}, mods...)
+	pkt, err := dhcpv4.New(mods...)
+	if err != nil {
+		t.Fatalf("build packet: %v", err)
+	}
+	return pkt
+}
+
+var clientPeer = &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}
+
+// discover runs a DISCOVER for mac and returns the offered address.
+func discover(t *testing.T, h *handler, conn *captureConn, mac net.HardwareAddr) net.IP {
+	t.Helper()
+	h.handle(conn, clientPeer, newPacket(t, mac, dhcpv4.MessageTypeDiscover))
+	p := conn.take(t)
+	if p == nil || p.msg.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Fatalf("expected OFFER, got %+v", p)
+	}
+	return p.msg.YourIPAddr
+}
+
+func TestSelectingRequestAcksOfferedAddress(t *testing.T) {
+	h := newTestHandler(t)
+	conn := &captureConn{}
+	ip := discover(t, h, conn, testMAC)
+
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerIP)),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+	))
+	p := conn.take(t)
+	if p == nil || p.msg.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK, got %+v", p)
+	}
+	if !p.msg.YourIPAddr.Equal(ip) {
+		t.Fatalf("ACK yiaddr = %s, want %s", p.msg.YourIPAddr, ip)
+	}
+	leases := h.activeLeases(time.Now())
+	if len(leases) != 1 || leases[0].State != LeaseStateBound {
+		t.Fatalf("expected one bound lease, got %+v", leases)
+	}
+}
+
+func TestSelectingRequestForWrongAddressIsNaked(t *testing.T) {
+	h := newTestHandler(t)
+	conn := &captureConn{}
+	discover(t, h, conn, testMAC)
+
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerIP)),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 150))),
+	))
+	p := conn.take(t)
+	if p == nil || p.msg.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("expected NAK, got %+v", p)
+	}
+	dest, ok := p.dest.(*net.UDPAddr)
+	if !ok || !dest.IP.Equal(net.IPv4bcast) || dest.Port != dhcpv4.ClientPort {
+		t.Fatalf("NAK sent to %v, want broadcast", p.dest)
+	}
+}
+
+func TestRequestForOtherServerDropsOffer(t *testing.T) {
+	h := newTestHandler(t)
+	conn := &captureConn{}
+	ip := discover(t, h, conn, testMAC)
+
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 2))),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+	))
+	if p := conn.take(t); p != nil {
+		t.Fatalf("expected no reply, got %s", p.msg.MessageType())
+	}
+	if leases := h.activeLeases(time.Now()); len(leases) != 0 {
+		t.Fatalf("expected offer to be dropped, got %+v", leases)
+	}
+}
+
+func TestInitRebootRequest(t *testing.T) {
+	h := newTestHandler(t)
+	conn := &captureConn{}
+
+	// Unknown client: stay silent so another server can answer.
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 100))),
+	))
+	if p := conn.take(t); p != nil {
+		t.Fatalf("expected no reply for unknown client, got %s", p.msg.MessageType())
+	}
+
+	// Wrong network: NAK.
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 168, 1, 10))),
+	))
+	if p := conn.take(t); p == nil || p.msg.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("expected NAK for foreign network, got %+v", p)
+	}
+
+	h.leases[testMAC.String()] = lease{ip: net.IPv4(10, 0, 0, 101).To4(), scope: "default", expiresAt: time.Now().Add(time.Hour)}
+
+	// Known client asking for a different address: NAK.
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 100))),
+	))
+	if p := conn.take(t); p == nil || p.msg.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("expected NAK for mismatched address, got %+v", p)
+	}
+
+	// Known client asking for its address: ACK.
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 101))),
+	))
+	if p := conn.take(t); p == nil || p.msg.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK, got %+v", p)
+	}
+}
+
+func TestRenewingRequest(t *testing.T) {
+	h := newTestHandler(t)
+	conn := &captureConn{}
+	h.leases[testMAC.String()] = lease{ip: net.IPv4(10, 0, 0, 101).To4(), scope: "default", expiresAt: time.Now().Add(time.Minute)}
+
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 101)),
+	))
+	p := conn.take(t)
+	if p == nil || p.msg.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK, got %+v", p)
+	}
+	if got := h.leases[testMAC.String()].expiresAt; got.Before(time.Now().Add(59 * time.Minute)) {
+		t.Fatalf("lease not extended: expires %s", got)
+	}
+
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 102)),
+	))
+	if p := conn.take(t); p == nil || p.msg.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("expected NAK for wrong ciaddr, got %+v", p)
+	}
+}
+
+func TestDeclineQuarantinesAddress(t *testing.T) {
+	h := newTestHandler(t)
+	conn := &captureConn{}
+	ip := discover(t, h, conn, testMAC)
+
+	h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeDecline,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerIP)),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+	))
+	if p := conn.take(t); p != nil {
+		t.Fatalf("DECLINE must not be answered, got %s", p.msg.MessageType())
+	}
+	if _, ok := h.leases[testMAC.String()]; ok {
+		t.Fatal("declined lease still recorded")
+	}
+
+	next := discover(t, h, conn, testMAC)
+	if next.Equal(ip) {
+		t.Fatalf("quarantined address %s offered again", ip)
+	}
+	if other := discover(t, h, conn, otherMAC); other.Equal(ip) {
+		t.Fatalf("quarantined address %s offered to another client", ip)
+	}
+}
+
+func TestInformRepliesWithoutLease(t *testing.T) {
+	h := newTestHandler(t)
+	conn := &captureConn{}
+	ciaddr := net.IPv4(10, 0, 0, 50).To4()
+
+	h.handle(conn, &net.UDPAddr{IP: ciaddr, Port: dhcpv4.ClientPort}, newPacket(t, testMAC, dhcpv4.MessageTypeInform,
+		dhcpv4.WithClientIP(ciaddr),
+	))
+	p := conn.take(t)
+	if p == nil || p.msg.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK, got %+v", p)
+	}
+	if !p.msg.YourIPAddr.Equal(net.IPv4zero) {
+		t.Fatalf("INFORM reply yiaddr = %s, want 0.0.0.0", p.msg.YourIPAddr)
+	}
+	if p.msg.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+		t.Fatal("INFORM reply must not carry a lease time")
+	}
+	if dns := p.msg.DNS(); len(dns) != 1 {
+		t.Fatalf("INFORM reply DNS = %v", dns)
+	}
+	dest, ok := p.dest.(*net.UDPAddr)
+	if !ok || !dest.IP.Equal(ciaddr) || dest.Port != dhcpv4.ClientPort {
+		t.Fatalf("INFORM reply sent to %v, want %s:%d", p.dest, ciaddr, dhcpv4.ClientPort)
+	}
+	if len(h.leases) != 0 {
+		t.Fatalf("INFORM must not create a lease: %+v", h.leases)
+	}
+}
+
+func TestConflictProbeSkipsAddressInUse(t *testing.T) {
+	h := newTestHandler(t)
+	probe := &fakeProber{inUse: map[string]bool{"10.0.0.100": true}}
+	h.prober = probe
+	conn := &captureConn{}
+
+	ip := discover(t, h, conn, testMAC)
+	if !ip.Equal(net.IPv4(10, 0, 0, 101)) {
+		t.Fatalf("offered %s, want 10.0.0.101", ip)
+	}
+	if probe.calls != 2 {
+		t.Fatalf("probe calls = %d, want 2", probe.calls)
+	}
+	if !h.quarantinedLocked(net.IPv4(10, 0, 0, 100), time.Now()) {
+		t.Fatal("conflicting address was not quarantined")
+	}
+}
+
+func TestSecureBootProfileGetsShimOnUEFI(t *testing.T) {
+	h := newTestHandler(t)
+	h.cfg.SecureBootFile = "shimx64.efi"
+	h.secureBoot[testMAC.String()] = "rhel/9"
+
+	for _, tc := range []struct {
+		arch iana.Arch
+		want string
+	}{
+		{iana.EFI_X86_64, "rhel/9/shimx64.efi"},
+		{iana.INTEL_X86PC, ""},
+	} {
+		conn := &captureConn{}
+		h.handle(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeDiscover,
+			dhcpv4.WithOption(dhcpv4.OptClientArch(tc.arch)),
+		))
+		p := conn.take(t)
+		if p == nil || p.msg.BootFileName != tc.want {
+			t.Fatalf("arch %s: boot file = %+v, want %q", tc.arch, p, tc.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package dhcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Lease states. An offered lease is held briefly while the client chooses
+// between servers; it becomes bound once the client's REQUEST is ACKed.
+const (
+	LeaseStateOffered = "offered"
+	LeaseStateBound   = "bound"
+)
+
+// Lease describes an address handed out by the DHCP server.
+type Lease struct {
+	MAC       string    `json:"mac"`
+	IP        net.IP    `json:"ip"`
+	Scope     string    `json:"scope,omitempty"`
+	State     string    `json:"state,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Static    bool      `json:"static"`
+}
+
+// persistDelay batches lease writes so a burst of ACKs and renewals costs
+// one write rather than one per message.
+const persistDelay = time.Second
+
+// leaseStore persists leases to a JSON file so a restart does not forget
+// which addresses are in use.
+type leaseStore struct {
+	path string
+}
+
+type leaseFile struct {
+	Leases []Lease `json:"leases"`
+}
+
+func newLeaseStore(path string) *leaseStore {
+	if path == "" {
+		return nil
+	}
+	return &leaseStore{path: path}
+}
+
+// load returns the unexpired leases recorded on disk. A missing file is not an
+// error; it simply means no leases have been persisted yet. A file that does
+// not decode, such as one truncated by a full disk, is moved aside to
+// <name>.corrupt and the table starts empty rather than keeping DHCP down.
+func (s *leaseStore) load(now time.Time, logger *log.Logger) (map[string]lease, error) {
+	leases := make(map[string]lease)
+	if s == nil {
+		return leases, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return leases, nil
+		}
+		return nil, fmt.Errorf("read lease file %s: %w", s.path, err)
+	}
+
+	var file leaseFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		logger.Printf("ERROR dhcp decode lease file %s: %v; starting with no leases", s.path, err)
+		if err := os.Rename(s.path, s.path+".corrupt"); err != nil {
+			return nil, fmt.Errorf("move aside corrupt lease file %s: %w", s.path, err)
+		}
+		return leases, nil
+	}
+	for _, l := range file.Leases {
+		ip := l.IP.To4()
+		if ip == nil || l.MAC == "" || l.State == LeaseStateOffered || !l.ExpiresAt.After(now) {
+			continue
+		}
+		leases[l.MAC] = lease{ip: ip, scope: l.Scope, expiresAt: l.ExpiresAt}
+	}
+	return leases, nil
+}
+
+// save atomically replaces the lease file with the provided leases.
+func (s *leaseStore) save(leases []Lease) error {
+	if s == nil {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(leaseFile{Leases: leases}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode leases: %w", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create lease dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".leases-*.json")
+	if err != nil {
+		return fmt.Errorf("create temp lease file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write temp lease file: %w", err)
+	}
+	// Flush before the rename so a crash cannot leave an empty lease file
+	// in place of the old one.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("sync temp lease file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("close temp lease file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("replace lease file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename within dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open lease dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync lease dir: %w", err)
+	}
+	return nil
+}
+
+// Leases returns a snapshot of the active leases sorted by IP address.
+func (s *Server) Leases() []Lease {
+	if s == nil || s.handler == nil {
+		return nil
+	}
+	s.handler.mu.Lock()
+	defer s.handler.mu.Unlock()
+	return s.handler.activeLeases(time.Now())
+}
+
+// Reservations returns the static reservations loaded from machine profiles.
+func (s *Server) Reservations() []Reservation {
+	if s == nil || s.handler == nil {
+		return nil
+	}
+	out := make([]Reservation, 0, len(s.handler.reservations))
+	for _, r := range s.handler.reservations {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return compareIP(out[i].IP, out[j].IP) < 0
+	})
+	return out
+}
+
+func (h *handler) activeLeases(now time.Time) []Lease {
+	out := make([]Lease, 0, len(h.leases))
+	for mac, l := range h.leases {
+		if !l.expiresAt.After(now) {
+			continue
+		}
+		_, static := h.reservations[mac]
+		state := LeaseStateBound
+		if l.offered {
+			state = LeaseStateOffered
+		}
+		out = append(out, Lease{
+			MAC:       mac,
+			IP:        cloneIP(l.ip),
+			Scope:     l.scope,
+			State:     state,
+			ExpiresAt: l.expiresAt,
+			Static:    static,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return compareIP(out[i].IP, out[j].IP) < 0
+	})
+	return out
+}
+
+// persistLocked schedules a write of the bound leases within persistDelay.
+// Callers must hold h.mu.
+func (h *handler) persistLocked() {
+	if h.store == nil || h.persistPending {
+		return
+	}
+	h.persistPending = true
+	time.AfterFunc(persistDelay, h.flush)
+}
+
+// flush writes the bound leases to disk if a write is pending. The file is
+// written without holding h.mu so DHCP replies are not held up by the disk.
+func (h *handler) flush() {
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+
+	h.mu.Lock()
+	if !h.persistPending {
+		h.mu.Unlock()
+		return
+	}
+	h.persistPending = false
+	active := h.activeLeases(time.Now())
+	h.mu.Unlock()
+
+	bound := active[:0]
+	for _, l := range active {
+		if l.State == LeaseStateBound {
+			bound = append(bound, l)
+		}
+	}
+	if err := h.store.save(bound); err != nil {
+		h.logger.Printf("WARN persist leases: %v", err)
+	}
+}
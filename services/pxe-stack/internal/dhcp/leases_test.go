@@ -0,0 +1,191 @@
+package dhcp
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestLeaseStoreRoundTrip(t *testing.T) {
+	store := newLeaseStore(filepath.Join(t.TempDir(), "state", "leases.json"))
+	now := time.Now()
+	err := store.save([]Lease{
+		{MAC: testMAC.String(), IP: net.IPv4(10, 0, 0, 100), Scope: "default", State: LeaseStateBound, ExpiresAt: now.Add(time.Hour)},
+		{MAC: otherMAC.String(), IP: net.IPv4(10, 0, 0, 101), State: LeaseStateBound, ExpiresAt: now.Add(-time.Minute)},
+		{MAC: "00:11:22:33:44:77", IP: net.IPv4(10, 0, 0, 102), State: LeaseStateOffered, ExpiresAt: now.Add(time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(store.path), ".leases-*"))
+	if len(matches) != 0 {
+		t.Fatalf("temp files left behind: %v", matches)
+	}
+
+	leases, err := store.load(now, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 {
+		t.Fatalf("loaded %d leases, want only the unexpired bound one: %+v", len(leases), leases)
+	}
+	l := leases[testMAC.String()]
+	if !l.ip.Equal(net.IPv4(10, 0, 0, 100)) || l.scope != "default" || !l.expiresAt.Equal(now.Add(time.Hour).Round(0)) {
+		t.Fatalf("lease = %+v", l)
+	}
+}
+
+func TestLeaseStoreLoad(t *testing.T) {
+	dir := t.TempDir()
+	if leases, err := newLeaseStore(filepath.Join(dir, "missing.json")).load(time.Now(), log.Default()); err != nil || len(leases) != 0 {
+		t.Fatalf("missing file: %v, %v", leases, err)
+	}
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte(`{"leases": [`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	leases, err := newLeaseStore(corrupt).load(time.Now(), log.New(&logs, "", 0))
+	if err != nil || len(leases) != 0 {
+		t.Fatalf("truncated file: %v, %v", leases, err)
+	}
+	if _, err := os.Stat(corrupt + ".corrupt"); err != nil {
+		t.Fatalf("truncated file was not moved aside: %v", err)
+	}
+	if _, err := os.Stat(corrupt); !os.IsNotExist(err) {
+		t.Fatalf("truncated file is still in place: %v", err)
+	}
+	if !strings.Contains(logs.String(), "ERROR dhcp decode lease file") {
+		t.Fatalf("log = %q", logs.String())
+	}
+}
+
+func TestPersistIsDebounced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	h := newTestHandler(t)
+	h.store = newLeaseStore(path)
+	conn := &captureConn{}
+
+	for _, mac := range []net.HardwareAddr{testMAC, otherMAC} {
+		ip := discover(t, h, conn, mac)
+		h.handle(conn, clientPeer, newPacket(t, mac, dhcpv4.MessageTypeRequest,
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerIP)),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+		))
+		conn.take(t)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("leases written before persistDelay: %v", err)
+	}
+
+	h.flush()
+	leases, err := h.store.load(time.Now(), h.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("persisted %d leases, want 2", len(leases))
+	}
+	h.mu.Lock()
+	pending := h.persistPending
+	h.mu.Unlock()
+	if pending {
+		t.Fatal("write still pending after flush")
+	}
+}
+
+func TestLoadReservations(t *testing.T) {
+	root := t.TempDir()
+	writeProfile := func(rel, content string) {
+		t.Helper()
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeProfile("rack-01/a.yaml", `apiVersion: goosed.io/v1alpha1
+kind: MachineProfile
+metadata: {name: node}
+spec:
+  machine: {mac: "00-11-22-AA-BB-CC"}
+  profile:
+    hostname: node-a
+    network: {ipv4: {address: 10.0.0.20/24}}
+`)
+	writeProfile("rack-01/b.yml", `apiVersion: goosed.io/v1alpha1
+kind: MachineProfile
+metadata: {name: node}
+spec:
+  machine: {mac: "00:11:22:aa:bb:dd"}
+  profile:
+    network: {ipv4: {address: 10.0.0.21}}
+`)
+	writeProfile("rack-01/dhcp.yaml", "apiVersion: goosed.io/v1alpha1\nkind: MachineProfile\nmetadata: {name: node}\nspec:\n  machine: {mac: \"00:11:22:aa:bb:ee\"}\n")
+	writeProfile("overlays/site.yaml", "apiVersion: goosed.io/v1alpha1\nkind: ProfileOverlay\nmetadata: {name: site}\nspec:\n  profile:\n    network: {ipv4: {address: 10.0.0.99}}\n")
+	writeProfile("rack-01/README.md", "not a profile")
+
+	got, err := LoadReservations(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("reservations = %+v", got)
+	}
+	a := got["00:11:22:aa:bb:cc"]
+	if !a.IP.Equal(net.IPv4(10, 0, 0, 20)) || a.Hostname != "node-a" || !strings.HasSuffix(a.Source, "rack-01/a.yaml") {
+		t.Fatalf("reservation a = %+v", a)
+	}
+	if b := got["00:11:22:aa:bb:dd"]; !b.IP.Equal(net.IPv4(10, 0, 0, 21)) {
+		t.Fatalf("reservation b = %+v", b)
+	}
+
+	writeProfile("rack-02/dup.yaml", "apiVersion: goosed.io/v1alpha1\nkind: MachineProfile\nmetadata: {name: node}\nspec:\n  machine: {mac: \"00:11:22:aa:bb:ff\"}\n  profile:\n    network: {ipv4: {address: 10.0.0.21}}\n")
+	if _, err := LoadReservations(root); err == nil || !strings.Contains(err.Error(), "already reserved") {
+		t.Fatalf("duplicate address: err = %v", err)
+	}
+	os.Remove(filepath.Join(root, "rack-02/dup.yaml"))
+
+	writeProfile("rack-02/bad.yaml", "apiVersion: goosed.io/v1alpha1\nkind: MachineProfile\nmetadata: {name: node}\nspec:\n  machine: {mac: nope}\n  profile:\n    network: {ipv4: {address: 10.0.0.30}}\n")
+	if _, err := LoadReservations(root); err == nil || !strings.Contains(err.Error(), "spec.machine.mac") {
+		t.Fatalf("bad MAC: err = %v", err)
+	}
+
+	if got, err := LoadReservations(""); err != nil || len(got) != 0 {
+		t.Fatalf("empty root: %v, %v", got, err)
+	}
+}
+
+func TestLoadSecureBoot(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.yaml", "apiVersion: goosed.io/v1alpha1\nkind: MachineProfile\nmetadata: {name: node}\nspec:\n  machine: {mac: \"00:11:22:aa:bb:cc\"}\n  blueprint: rhel/9/base\n  profile: {secureBoot: true}\n")
+	write("b.yaml", "apiVersion: goosed.io/v1alpha1\nkind: MachineProfile\nmetadata: {name: node}\nspec:\n  machine: {mac: \"00:11:22:aa:bb:dd\"}\n  blueprint: ubuntu/24.04/base\n")
+
+	got, err := LoadSecureBoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got["00:11:22:aa:bb:cc"] != "rhel/9" {
+		t.Fatalf("secure boot dirs = %v", got)
+	}
+
+	write("c.yaml", "apiVersion: goosed.io/v1alpha1\nkind: MachineProfile\nmetadata: {name: node}\nspec:\n  machine: {mac: \"00:11:22:aa:bb:ee\"}\n  profile: {secureBoot: true}\n")
+	if _, err := LoadSecureBoot(root); err == nil || !strings.Contains(err.Error(), "spec.blueprint") {
+		t.Fatalf("missing blueprint: err = %v", err)
+	}
+}
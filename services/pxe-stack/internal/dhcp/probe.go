@@ -0,0 +1,78 @@
+package dhcp
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// prober reports whether an address already answers on the network before it
+// is offered to a client.
+type prober interface {
+	InUse(ip net.IP) bool
+}
+
+// icmpProber sends a single ICMP echo request and treats any matching reply
+// within the timeout as evidence the address is taken. It needs CAP_NET_RAW.
+type icmpProber struct {
+	timeout time.Duration
+	seq     atomic.Uint32
+}
+
+func newICMPProber(timeout time.Duration) *icmpProber {
+	if timeout <= 0 {
+		timeout = 500 * time.Millisecond
+	}
+	return &icmpProber{timeout: timeout}
+}
+
+func (p *icmpProber) InUse(ip net.IP) bool {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	seq := int(p.seq.Add(1) & 0xffff)
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("goosed-dhcp-probe")},
+	}
+	payload, err := msg.Marshal(nil)
+	if err != nil {
+		return false
+	}
+	if _, err := conn.WriteTo(payload, &net.IPAddr{IP: ip}); err != nil {
+		return false
+	}
+
+	deadline := time.Now().Add(p.timeout)
+	buf := make([]byte, 1500)
+	for {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return false
+		}
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			// A timeout means nobody answered; any other read error leaves
+			// the address unproven, so it is offered as well.
+			return false
+		}
+		addr, ok := peer.(*net.IPAddr)
+		if !ok || !addr.IP.Equal(ip) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+			return true
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package dhcp
+
+import (
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	"goosed/services/pxe-stack/internal/events"
+)
+
+const pxeClientClass = "PXEClient"
+
+// pxeDiscoveryControl is the PXE vendor option 43 payload telling clients to
+// skip boot server discovery and use the boot file from the offer directly
+// (sub-option 6, PXE_DISCOVERY_CONTROL, value 8).
+var pxeDiscoveryControl = []byte{6, 1, 8, 255}
+
+// handleProxy answers PXE clients on port 67 without assigning addresses so
+// pxe-stack can run alongside the DHCP server that already owns the segment.
+// Non-PXE traffic is ignored entirely.
+func (h *handler) handleProxy(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	h.proxy(conn, peer, req, false)
+}
+
+// handleBootServer answers PXE boot server requests on the proxy port.
+func (h *handler) handleBootServer(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	h.proxy(conn, peer, req, true)
+}
+
+func (h *handler) proxy(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4, bootServer bool) {
+	if !isPXEClient(req) {
+		return
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		h.respondProxy(conn, peer, req, dhcpv4.MessageTypeOffer)
+	case dhcpv4.MessageTypeRequest:
+		// On port 67 only requests naming us are ours: one without an
+		// identifier is an INIT-REBOOT or renewal of a lease the real DHCP
+		// server owns. Boot server requests on the proxy port carry our
+		// identifier or none.
+		sid := req.ServerIdentifier()
+		if sid != nil && !sid.Equal(h.cfg.ServerIP) || sid == nil && !bootServer {
+			// The client is taking or keeping that lease and will boot the
+			// file we offered; record its address so TFTP and HTTP events
+			// can name the MAC.
+			ip := req.RequestedIPAddress().To4()
+			if ip == nil {
+				ip = nonZeroIPv4(req.ClientIPAddr)
+			}
+			if ip != nil {
+				h.emitProxied(req, ip)
+			}
+			return
+		}
+		h.respondProxy(conn, peer, req, dhcpv4.MessageTypeAck)
+		if ip := nonZeroIPv4(req.ClientIPAddr); ip != nil {
+			h.emitProxied(req, ip)
+		}
+	default:
+		// ignore other messages
+	}
+}
+
+func (h *handler) respondProxy(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4, msgType dhcpv4.MessageType) {
+	mac := req.ClientHWAddr.String()
+
+	reply, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		h.logger.Printf("ERROR create proxy reply: %v", err)
+		return
+	}
+	reply.UpdateOption(dhcpv4.OptMessageType(msgType))
+	reply.YourIPAddr = net.IPv4zero
+	reply.ServerIPAddr = h.cfg.ServerIP
+	reply.BootFileName = h.bootFile(req, h.cfg.BootFilename)
+	reply.Options.Update(dhcpv4.OptServerIdentifier(h.cfg.ServerIP))
+	reply.Options.Update(dhcpv4.OptClassIdentifier(pxeClientClass))
+	reply.Options.Update(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, pxeDiscoveryControl))
+	if guid := req.GetOneOption(dhcpv4.OptionClientMachineIdentifier); len(guid) > 0 {
+		reply.Options.Update(dhcpv4.OptGeneric(dhcpv4.OptionClientMachineIdentifier, guid))
+	}
+	if h.cfg.NextServer != nil {
+		reply.ServerIPAddr = h.cfg.NextServer
+		reply.Options.Update(dhcpv4.OptTFTPServerName(h.cfg.NextServer.String()))
+	}
+
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		h.logger.Printf("ERROR send proxy %s to %s: %v", msgType, mac, err)
+	}
+}
+
+func (h *handler) emitProxied(req *dhcpv4.DHCPv4, ip net.IP) {
+	h.events.Emit(events.SubjectDHCPProxied, events.Boot{
+		MAC:      req.ClientHWAddr.String(),
+		IP:       ip.String(),
+		Arch:     clientArch(req),
+		BootFile: h.bootFile(req, h.cfg.BootFilename),
+	})
+}
+
+func isPXEClient(req *dhcpv4.DHCPv4) bool {
+	return strings.HasPrefix(req.ClassIdentifier(), pxeClientClass)
+}
@@ -0,0 +1,177 @@
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	"goosed/services/pxe-stack/internal/config"
+	"goosed/services/pxe-stack/internal/events"
+)
+
+type published struct {
+	subject string
+	ev      events.Boot
+}
+
+// chanPublisher hands events published in the background to the test.
+type chanPublisher chan published
+
+func (p chanPublisher) Publish(ctx context.Context, subj string, v any) error {
+	p <- published{subj, v.(events.Boot)}
+	return nil
+}
+
+func (p chanPublisher) next(t *testing.T) published {
+	t.Helper()
+	select {
+	case got := <-p:
+		return got
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event published")
+		return published{}
+	}
+}
+
+func newProxyHandler(t *testing.T) (*handler, chanPublisher) {
+	t.Helper()
+	cfg := config.DHCPConfig{
+		Mode:         config.DHCPModeProxy,
+		Interface:    "eth0",
+		ServerIP:     testServerIP,
+		ProxyPort:    4011,
+		BootFilename: "ipxe.efi",
+	}
+	logger := log.New(io.Discard, "", 0)
+	h := newHandler(cfg, logger, nil, nil, nil)
+	pub := make(chanPublisher, 4)
+	h.events = events.NewEmitter(pub, logger)
+	return h, pub
+}
+
+func pxeClass() dhcpv4.Modifier {
+	return dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003016"))
+}
+
+func TestProxyOffersBootFileWithoutAddress(t *testing.T) {
+	h, _ := newProxyHandler(t)
+	conn := &captureConn{}
+	guid := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	h.handleProxy(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeDiscover, pxeClass(),
+		dhcpv4.WithGeneric(dhcpv4.OptionClientMachineIdentifier, guid)))
+	p := conn.take(t)
+	if p == nil || p.msg.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Fatalf("expected OFFER, got %+v", p)
+	}
+	if !p.msg.YourIPAddr.Equal(net.IPv4zero) {
+		t.Fatalf("proxy offer yiaddr = %s, want 0.0.0.0", p.msg.YourIPAddr)
+	}
+	if p.msg.BootFileName != "ipxe.efi" || !p.msg.ServerIPAddr.Equal(testServerIP) {
+		t.Fatalf("boot file %q from %s", p.msg.BootFileName, p.msg.ServerIPAddr)
+	}
+	if got := p.msg.ClassIdentifier(); got != pxeClientClass {
+		t.Fatalf("option 60 = %q, want %q", got, pxeClientClass)
+	}
+	if got := p.msg.GetOneOption(dhcpv4.OptionVendorSpecificInformation); !bytes.Equal(got, pxeDiscoveryControl) {
+		t.Fatalf("option 43 = %v, want %v", got, pxeDiscoveryControl)
+	}
+	if got := p.msg.GetOneOption(dhcpv4.OptionClientMachineIdentifier); !bytes.Equal(got, guid) {
+		t.Fatalf("option 97 = %v, want the client's GUID", got)
+	}
+	if p.msg.Options.Has(dhcpv4.OptionIPAddressLeaseTime) || p.msg.Options.Has(dhcpv4.OptionSubnetMask) {
+		t.Fatal("proxy offer must not carry address configuration")
+	}
+	if p.dest != clientPeer {
+		t.Fatalf("offer sent to %v", p.dest)
+	}
+}
+
+func TestProxyIgnoresNonPXEClients(t *testing.T) {
+	h, _ := newProxyHandler(t)
+	conn := &captureConn{}
+	for _, mt := range []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest} {
+		h.handleProxy(conn, clientPeer, newPacket(t, testMAC, mt,
+			dhcpv4.WithOption(dhcpv4.OptClassIdentifier("MSFT 5.0"))))
+		h.handleProxy(conn, clientPeer, newPacket(t, testMAC, mt))
+	}
+	if p := conn.take(t); p != nil {
+		t.Fatalf("answered a non-PXE client with %s", p.msg.MessageType())
+	}
+	if len(h.leases) != 0 {
+		t.Fatalf("proxy mode recorded leases: %+v", h.leases)
+	}
+}
+
+func TestProxyBootServerRequest(t *testing.T) {
+	h, pub := newProxyHandler(t)
+	conn := &captureConn{}
+	clientIP := net.IPv4(10, 0, 0, 120).To4()
+	peer := &net.UDPAddr{IP: clientIP, Port: 4011}
+
+	// The PXE client asks the boot server port from its new address.
+	h.handleBootServer(conn, peer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest, pxeClass(),
+		dhcpv4.WithClientIP(clientIP)))
+	p := conn.take(t)
+	if p == nil || p.msg.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected ACK, got %+v", p)
+	}
+	if p.dest != peer || p.msg.BootFileName != "ipxe.efi" {
+		t.Fatalf("ACK to %v with boot file %q", p.dest, p.msg.BootFileName)
+	}
+	got := pub.next(t)
+	if got.subject != events.SubjectDHCPProxied || got.ev.MAC != testMAC.String() || got.ev.IP != clientIP.String() {
+		t.Fatalf("event = %+v", got)
+	}
+}
+
+func TestProxyRequestForOtherServer(t *testing.T) {
+	h, pub := newProxyHandler(t)
+	conn := &captureConn{}
+	leased := net.IPv4(10, 0, 0, 130).To4()
+
+	h.handleProxy(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest, pxeClass(),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 2))),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(leased))))
+	if p := conn.take(t); p != nil {
+		t.Fatalf("answered another server's REQUEST with %s", p.msg.MessageType())
+	}
+	// The address the client takes is still recorded for TFTP events.
+	got := pub.next(t)
+	if got.subject != events.SubjectDHCPProxied || got.ev.IP != leased.String() || got.ev.BootFile != "ipxe.efi" {
+		t.Fatalf("event = %+v", got)
+	}
+}
+
+func TestProxyRequestOnDHCPPort(t *testing.T) {
+	h, pub := newProxyHandler(t)
+	conn := &captureConn{}
+	leased := net.IPv4(10, 0, 0, 140).To4()
+
+	// INIT-REBOOT and renewals carry no server identifier but belong to the
+	// real DHCP server.
+	h.handleProxy(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest, pxeClass(),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(leased))))
+	h.handleProxy(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest, pxeClass(),
+		dhcpv4.WithClientIP(leased)))
+	if p := conn.take(t); p != nil {
+		t.Fatalf("answered a REQUEST without a server identifier on port 67 with %s", p.msg.MessageType())
+	}
+	for range 2 {
+		if got := pub.next(t); got.ev.IP != leased.String() {
+			t.Fatalf("event = %+v", got)
+		}
+	}
+
+	h.handleProxy(conn, clientPeer, newPacket(t, testMAC, dhcpv4.MessageTypeRequest, pxeClass(),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerIP))))
+	if p := conn.take(t); p == nil || p.msg.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("expected an ACK for a REQUEST naming us, got %+v", p)
+	}
+}
@@ -0,0 +1,131 @@
+package dhcp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"goosed/pkg/schema"
+)
+
+// Reservation pins a MAC address to a fixed IPv4 address.
+type Reservation struct {
+	MAC      string `json:"mac"`
+	IP       net.IP `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+	Source   string `json:"source,omitempty"`
+}
+
+// LoadReservations walks root for MachineProfile documents and returns the
+// reservations declared through spec.profile.network.ipv4.address, keyed by
+// normalised MAC address. Profiles without a static address are skipped.
+func LoadReservations(root string) (map[string]Reservation, error) {
+	reservations := make(map[string]Reservation)
+	if root == "" {
+		return reservations, nil
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("stat reservations dir: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("reservations path %s is not a directory", root)
+	}
+
+	byIP := make(map[string]string)
+	err = walkProfiles(root, func(path string, doc *schema.MachineProfile) error {
+		address := profileString(doc.Spec.Profile, "network", "ipv4", "address")
+		if address == "" {
+			return nil
+		}
+
+		ip := parseReservedIP(address)
+		if ip == nil {
+			return fmt.Errorf("%s: invalid spec.profile.network.ipv4.address %q", path, address)
+		}
+
+		mac := doc.Spec.Machine.MAC
+		if other, ok := byIP[ip.String()]; ok && other != mac {
+			return fmt.Errorf("%s: address %s already reserved for %s", path, ip, other)
+		}
+		byIP[ip.String()] = mac
+		reservations[mac] = Reservation{
+			MAC:      mac,
+			IP:       ip,
+			Hostname: profileString(doc.Spec.Profile, "hostname"),
+			Source:   filepath.ToSlash(path),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// walkProfiles calls fn for every MachineProfile document under root,
+// parsed and validated with schema.Parse as the blueprints service does. A
+// document it rejects fails the walk. A root that disappears mid-walk is
+// treated as empty.
+func walkProfiles(root string, fn func(path string, doc *schema.MachineProfile) error) error {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		doc, err := schema.Parse(path, data)
+		if err != nil {
+			return err
+		}
+		mp, ok := doc.Object.(*schema.MachineProfile)
+		if !ok {
+			return nil
+		}
+		return fn(path, mp)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// profileString returns the string at keys in a free-form spec.profile.
+func profileString(profile map[string]any, keys ...string) string {
+	var v any = profile
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = m[k]
+	}
+	s, _ := v.(string)
+	return strings.TrimSpace(s)
+}
+
+// parseReservedIP accepts either a bare IPv4 address or CIDR notation.
+func parseReservedIP(value string) net.IP {
+	if ip, _, err := net.ParseCIDR(value); err == nil {
+		return ip.To4()
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.To4()
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package dhcp
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	"goosed/services/pxe-stack/internal/config"
+)
+
+// scope tracks the allocation cursor for one configured subnet.
+type scope struct {
+	cfg     config.ScopeConfig
+	startIP net.IP
+	endIP   net.IP
+	nextIP  net.IP
+}
+
+func newScopes(cfgs []config.ScopeConfig) []*scope {
+	scopes := make([]*scope, 0, len(cfgs))
+	for _, c := range cfgs {
+		scopes = append(scopes, &scope{
+			cfg:     c,
+			startIP: c.RangeStart.To4(),
+			endIP:   c.RangeEnd.To4(),
+			nextIP:  c.RangeStart.To4(),
+		})
+	}
+	return scopes
+}
+
+func (s *scope) contains(ip net.IP) bool {
+	return ip != nil && s.cfg.Subnet != nil && s.cfg.Subnet.Contains(ip)
+}
+
+// inRange reports whether ip falls inside the scope's dynamic pool.
+func (s *scope) inRange(ip net.IP) bool {
+	return compareIP(ip, s.startIP) >= 0 && compareIP(ip, s.endIP) <= 0
+}
+
+// selectScope picks the scope serving req. Relayed requests are matched on
+// giaddr; requests received directly are matched on the receiving interface.
+func (h *handler) selectScope(iface string, req *dhcpv4.DHCPv4) *scope {
+	if giaddr := req.GatewayIPAddr.To4(); giaddr != nil && !giaddr.Equal(net.IPv4zero) {
+		return h.scopeForIP(giaddr)
+	}
+	for _, s := range h.scopes {
+		if s.cfg.Interface == iface {
+			return s
+		}
+	}
+	return nil
+}
+
+func (h *handler) scopeForIP(ip net.IP) *scope {
+	for _, s := range h.scopes {
+		if s.contains(ip) {
+			return s
+		}
+	}
+	return nil
+}
+
+// interfaces lists the distinct interfaces DHCP must listen on: the primary
+// interface (which also receives relayed traffic) plus any scope interfaces.
+func (h *handler) interfaces() []string {
+	seen := map[string]struct{}{}
+	var out []string
+	add := func(name string) {
+		if name == "" {
+			return
+		}
+		if _, ok := seen[name]; ok {
+			return
+		}
+		seen[name] = struct{}{}
+		out = append(out, name)
+	}
+	add(h.cfg.Interface)
+	for _, s := range h.scopes {
+		add(s.cfg.Interface)
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package dhcp
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"goosed/pkg/schema"
+)
+
+// LoadSecureBoot walks the machine profiles under root and returns, for each
+// MAC whose spec.profile.secureBoot is set, the TFTP directory holding the
+// shim chain for its blueprint: <distro>/<version> of spec.blueprint.
+func LoadSecureBoot(root string) (map[string]string, error) {
+	macs := make(map[string]string)
+	if root == "" {
+		return macs, nil
+	}
+	err := walkProfiles(root, func(path string, doc *schema.MachineProfile) error {
+		if secureBoot, _ := doc.Spec.Profile["secureBoot"].(bool); !secureBoot {
+			return nil
+		}
+		parts := strings.Split(strings.Trim(strings.TrimSpace(doc.Spec.Blueprint), "/"), "/")
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("%s: secureBoot needs spec.blueprint of the form <distro>/<version>/..., got %q", path, doc.Spec.Blueprint)
+		}
+		macs[doc.Spec.Machine.MAC] = parts[0] + "/" + parts[1]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return macs, nil
+}
+
+// bootFile picks the boot file for req. UEFI clients whose profile requires
+// Secure Boot get the signed shim of their distro release, which loads
+// grubx64.efi (or grubaa64.efi) from the same TFTP directory; everyone else
+// gets def.
+func (h *handler) bootFile(req *dhcpv4.DHCPv4, def string) string {
+	mac := req.ClientHWAddr.String()
+	dir, ok := h.secureBoot[mac]
+	if !ok {
+		return def
+	}
+	for _, arch := range req.ClientArch() {
+		switch arch {
+		case iana.EFI_X86_64, iana.EFI_BC:
+			return path.Join(dir, h.cfg.SecureBootFile)
+		case iana.EFI_ARM64:
+			return path.Join(dir, h.cfg.SecureBootFileARM64)
+		}
+	}
+	h.logger.Printf("WARN dhcp %s requires Secure Boot but did not identify as a UEFI x64 or arm64 client (arch %q); offering %s", mac, clientArch(req), def)
+	return def
+}
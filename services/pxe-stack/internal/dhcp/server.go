@@ -8,143 +8,115 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 
 	"goosed/services/pxe-stack/internal/config"
+	"goosed/services/pxe-stack/internal/events"
 )
 
-func NewServer(cfg config.DHCPConfig, logger *log.Logger) (*Server, error) {
+func NewServer(cfg config.DHCPConfig, logger *log.Logger, emitter *events.Emitter) (*Server, error) {
 	if logger == nil {
 		logger = log.Default()
 	}
-	h := &handler{
-		cfg:       cfg,
-		logger:    logger,
-		leases:    make(map[string]lease),
-		startIP:   cfg.RangeStart.To4(),
-		endIP:     cfg.RangeEnd.To4(),
-		nextIP:    cfg.RangeStart.To4(),
-		leaseTime: cfg.LeaseTime,
+	store := newLeaseStore(cfg.LeaseFile)
+	leases, err := store.load(time.Now(), logger)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := LoadReservations(cfg.ReservationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("load reservations: %w", err)
+	}
+	if len(leases) > 0 || len(reservations) > 0 {
+		logger.Printf("INFO dhcp restored %d leases and %d static reservations", len(leases), len(reservations))
+	}
+	secureBoot, err := LoadSecureBoot(cfg.ReservationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("load secure boot profiles: %w", err)
+	}
+	if len(secureBoot) > 0 {
+		logger.Printf("INFO dhcp %d machines require the Secure Boot shim chain", len(secureBoot))
+	}
+	h := newHandler(cfg, logger, leases, reservations, store)
+	h.secureBoot = secureBoot
+	h.events = emitter
+	if cfg.ConflictProbe {
+		h.prober = newICMPProber(cfg.ProbeTimeout)
+	}
+	for mac, l := range h.leases {
+		if l.scope != "" {
+			continue
+		}
+		if s := h.scopeForIP(l.ip); s != nil {
+			l.scope = s.cfg.Name
+			h.leases[mac] = l
+		}
 	}
 	return &Server{cfg: cfg, logger: logger, handler: h}, nil
 }
 
 func (s *Server) Run(ctx context.Context, ready *atomic.Bool) error {
-	srv, err := server4.NewServer(s.cfg.Interface, nil, s.handler.handle)
+	servers, err := s.listeners()
 	if err != nil {
-		return fmt.Errorf("start listener on %s: %w", s.cfg.Interface, err)
+		return err
 	}
 	ready.Store(true)
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- srv.Serve()
-	}()
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *server4.Server) {
+			errCh <- srv.Serve()
+		}(srv)
+	}
+
+	// Write any lease changes still waiting for persistDelay on the way out.
+	defer s.handler.flush()
 
 	select {
 	case err := <-errCh:
+		for _, srv := range servers {
+			srv.Close()
+		}
 		if err != nil {
 			return fmt.Errorf("dhcp serve: %w", err)
 		}
 	case <-ctx.Done():
-		srv.Close()
+		for _, srv := range servers {
+			srv.Close()
+		}
 		<-errCh
 	}
 	return nil
 }
 
-func (h *handler) handle(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
-	switch req.MessageType() {
-	case dhcpv4.MessageTypeDiscover:
-		h.respond(conn, peer, req, dhcpv4.MessageTypeOffer)
-	case dhcpv4.MessageTypeRequest:
-		h.respond(conn, peer, req, dhcpv4.MessageTypeAck)
-	case dhcpv4.MessageTypeRelease:
-		h.release(req.ClientHWAddr.String())
-	default:
-		// ignore other messages
-	}
-}
-
-func (h *handler) respond(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4, msgType dhcpv4.MessageType) {
-	mac := req.ClientHWAddr.String()
-	ip := h.assign(mac)
-	if ip == nil {
-		h.logger.Printf("WARN no available lease for %s", mac)
-		return
-	}
-
-	reply, err := dhcpv4.NewReplyFromRequest(req)
-	if err != nil {
-		h.logger.Printf("ERROR create reply: %v", err)
-		return
-	}
-	reply.UpdateOption(dhcpv4.OptMessageType(msgType))
-	reply.YourIPAddr = ip
-	reply.ServerIPAddr = h.cfg.ServerIP
-	reply.BootFileName = h.cfg.BootFilename
-	reply.Options.Update(dhcpv4.OptServerIdentifier(h.cfg.ServerIP))
-	reply.Options.Update(dhcpv4.OptSubnetMask(h.cfg.SubnetMask))
-	reply.Options.Update(dhcpv4.OptRouter(h.cfg.Router))
-	if len(h.cfg.DNSServers) > 0 {
-		reply.Options.Update(dhcpv4.OptDNS(h.cfg.DNSServers...))
-	}
-	reply.Options.Update(dhcpv4.OptIPAddressLeaseTime(h.leaseTime))
-	if h.cfg.NextServer != nil {
-		reply.ServerIPAddr = h.cfg.NextServer
-		reply.Options.Update(dhcpv4.OptTFTPServerName(h.cfg.NextServer.String()))
-	}
-
-	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
-		h.logger.Printf("ERROR send %s to %s: %v", msgType, mac, err)
-	}
-}
-
-func (h *handler) assign(mac string) net.IP {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if lease, ok := h.leases[mac]; ok && lease.expiresAt.After(time.Now()) {
-		return lease.ip
-	}
-
-	for ip := cloneIP(h.nextIP); ; ip = incrementIP(ip) {
-		if compareIP(ip, h.endIP) > 0 {
-			return nil
-		}
-		if !h.isAllocated(ip) {
-			expires := time.Now().Add(h.leaseTime)
-			h.leases[mac] = lease{ip: ip, expiresAt: expires}
-			h.nextIP = incrementIP(ip)
-			return ip
-		}
-		if compareIP(ip, h.endIP) == 0 {
-			break
+// listeners opens the DHCP sockets for the configured mode. Server mode only
+// needs port 67; proxy mode additionally answers PXE boot server requests on
+// the proxy port (4011 by default).
+func (s *Server) listeners() ([]*server4.Server, error) {
+	if s.cfg.Mode != config.DHCPModeProxy {
+		var servers []*server4.Server
+		for _, iface := range s.handler.interfaces() {
+			srv, err := server4.NewServer(iface, nil, s.handler.on(iface))
+			if err != nil {
+				for _, started := range servers {
+					started.Close()
+				}
+				return nil, fmt.Errorf("start listener on %s: %w", iface, err)
+			}
+			servers = append(servers, srv)
 		}
+		return servers, nil
 	}
 
-	for ip := cloneIP(h.startIP); compareIP(ip, h.endIP) <= 0; ip = incrementIP(ip) {
-		if !h.isAllocated(ip) {
-			expires := time.Now().Add(h.leaseTime)
-			h.leases[mac] = lease{ip: ip, expiresAt: expires}
-			h.nextIP = incrementIP(ip)
-			return ip
-		}
+	dhcpSrv, err := server4.NewServer(s.cfg.Interface, nil, s.handler.handleProxy)
+	if err != nil {
+		return nil, fmt.Errorf("start proxy listener on %s: %w", s.cfg.Interface, err)
 	}
-	return nil
-}
-
-func (h *handler) release(mac string) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	delete(h.leases, mac)
-}
-
-func (h *handler) isAllocated(ip net.IP) bool {
-	for _, lease := range h.leases {
-		if lease.expiresAt.After(time.Now()) && ip.Equal(lease.ip) {
-			return true
-		}
+	proxyAddr := &net.UDPAddr{IP: net.IPv4zero, Port: s.cfg.ProxyPort}
+	bootSrv, err := server4.NewServer(s.cfg.Interface, proxyAddr, s.handler.handleBootServer)
+	if err != nil {
+		dhcpSrv.Close()
+		return nil, fmt.Errorf("start proxy listener on %s:%d: %w", s.cfg.Interface, s.cfg.ProxyPort, err)
 	}
-	return false
+	s.logger.Printf("INFO proxyDHCP answering PXE clients on %s (ports 67 and %d)", s.cfg.Interface, s.cfg.ProxyPort)
+	return []*server4.Server{dhcpSrv, bootSrv}, nil
 }
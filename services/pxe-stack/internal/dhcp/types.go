@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"goosed/services/pxe-stack/internal/config"
+	"goosed/services/pxe-stack/internal/events"
 )
 
 type Server struct {
@@ -16,17 +17,47 @@ type Server struct {
 }
 
 type handler struct {
-	cfg       config.DHCPConfig
-	logger    *log.Logger
-	mu        sync.Mutex
-	leases    map[string]lease
-	nextIP    net.IP
-	startIP   net.IP
-	endIP     net.IP
-	leaseTime time.Duration
+	cfg          config.DHCPConfig
+	logger       *log.Logger
+	mu           sync.Mutex
+	leases       map[string]lease
+	reservations map[string]Reservation
+	// secureBoot maps the MACs whose profiles require the shim chain to the
+	// TFTP directory it is served from.
+	secureBoot map[string]string
+	store      *leaseStore
+	// persistPending is set while a lease write is scheduled; saveMu
+	// serialises the writes themselves.
+	persistPending bool
+	saveMu         sync.Mutex
+	scopes         []*scope
+	declined       map[string]time.Time
+	prober         prober
+	events         *events.Emitter
 }
 
 type lease struct {
 	ip        net.IP
+	scope     string
 	expiresAt time.Time
+	offered   bool
+}
+
+func newHandler(cfg config.DHCPConfig, logger *log.Logger, leases map[string]lease, reservations map[string]Reservation, store *leaseStore) *handler {
+	if leases == nil {
+		leases = make(map[string]lease)
+	}
+	if reservations == nil {
+		reservations = make(map[string]Reservation)
+	}
+	return &handler{
+		cfg:          cfg,
+		logger:       logger,
+		leases:       leases,
+		reservations: reservations,
+		secureBoot:   make(map[string]string),
+		store:        store,
+		scopes:       newScopes(cfg.Scopes),
+		declined:     make(map[string]time.Time),
+	}
 }
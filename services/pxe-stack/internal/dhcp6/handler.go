@@ -0,0 +1,335 @@
+package dhcp6
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"goosed/services/pxe-stack/internal/events"
+)
+
+// offerHoldTime is how long an advertised address is held for the client
+// before it must REQUEST it.
+const offerHoldTime = time.Minute
+
+// httpBootArchs are the client architectures (RFC 4578/IANA) that fetch the
+// boot file over HTTP rather than TFTP.
+var httpBootArchs = []iana.Arch{
+	iana.EFI_X86_HTTP, iana.EFI_X86_64_HTTP, iana.EFI_BC_HTTP,
+	iana.EFI_ARM32_HTTP, iana.EFI_ARM64_HTTP, iana.INTEL_X86PC_HTTP,
+	iana.UBOOT_ARM32_HTTP, iana.UBOOT_ARM64_HTTP,
+	iana.EFI_RISCV32_HTTP, iana.EFI_RISCV64_HTTP,
+}
+
+func (h *handler) handle(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	msg, err := m.GetInnerMessage()
+	if err != nil {
+		h.logger.Printf("WARN dhcpv6 decode from %s: %v", peer, err)
+		return
+	}
+	reply := h.process(msg)
+	if reply == nil {
+		return
+	}
+
+	var out dhcpv6.DHCPv6 = reply
+	if relay, ok := m.(*dhcpv6.RelayMessage); ok {
+		out, err = dhcpv6.NewRelayReplFromRelayForw(relay, reply)
+		if err != nil {
+			h.logger.Printf("ERROR build dhcpv6 relay reply: %v", err)
+			return
+		}
+	}
+	if _, err := conn.WriteTo(out.ToBytes(), peer); err != nil {
+		h.logger.Printf("ERROR send dhcpv6 %s to %s: %v", reply.Type(), peer, err)
+	}
+}
+
+// process builds the reply to msg, or returns nil when the message should be
+// ignored (unknown type, or addressed to another server).
+func (h *handler) process(msg *dhcpv6.Message) *dhcpv6.Message {
+	duid := msg.Options.ClientID()
+	if duid == nil {
+		return nil
+	}
+	client := hex.EncodeToString(duid.ToBytes())
+
+	var (
+		reply *dhcpv6.Message
+		err   error
+	)
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit:
+		if msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil {
+			reply, err = dhcpv6.NewReplyFromMessage(msg)
+			if err == nil {
+				h.assign(reply, msg, client, true)
+			}
+		} else {
+			reply, err = dhcpv6.NewAdvertiseFromSolicit(msg)
+			if err == nil {
+				h.assign(reply, msg, client, false)
+			}
+		}
+	case dhcpv6.MessageTypeRequest:
+		if !h.isOurs(msg) {
+			return nil
+		}
+		reply, err = dhcpv6.NewReplyFromMessage(msg)
+		if err == nil {
+			h.assign(reply, msg, client, true)
+		}
+	case dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		if msg.Type() == dhcpv6.MessageTypeRenew && !h.isOurs(msg) {
+			return nil
+		}
+		reply, err = dhcpv6.NewReplyFromMessage(msg)
+		if err == nil {
+			h.renew(reply, msg, client)
+		}
+	case dhcpv6.MessageTypeConfirm:
+		reply, err = dhcpv6.NewReplyFromMessage(msg)
+		if err == nil {
+			reply.AddOption(h.confirmStatus(msg))
+		}
+	case dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		if !h.isOurs(msg) {
+			return nil
+		}
+		h.release(msg, client, msg.Type() == dhcpv6.MessageTypeDecline)
+		// NewReplyFromMessage refuses DECLINE, so the REPLY is built here for
+		// both; the server ID is added below.
+		reply = &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply, TransactionID: msg.TransactionID}
+		if cid := msg.Options.ClientID(); cid != nil {
+			reply.AddOption(dhcpv6.OptClientID(cid))
+		}
+		reply.AddOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess})
+	case dhcpv6.MessageTypeInformationRequest:
+		reply, err = dhcpv6.NewReplyFromMessage(msg)
+	default:
+		return nil
+	}
+	if err != nil {
+		h.logger.Printf("ERROR build dhcpv6 reply to %s: %v", msg.Type(), err)
+		return nil
+	}
+
+	reply.AddOption(dhcpv6.OptServerID(h.serverID))
+	if len(h.cfg.DNSServers) > 0 {
+		reply.AddOption(dhcpv6.OptDNS(h.cfg.DNSServers...))
+	}
+	if msg.IsOptionRequested(dhcpv6.OptionBootfileURL) {
+		reply.AddOption(dhcpv6.OptBootFileURL(h.bootURL(msg)))
+	}
+	return reply
+}
+
+func (h *handler) isOurs(msg *dhcpv6.Message) bool {
+	sid := msg.Options.ServerID()
+	return sid != nil && sid.Equal(h.serverID)
+}
+
+// bootURL picks the HTTP boot URL for UEFI HTTP clients when one is
+// configured, and the regular boot file URL otherwise.
+func (h *handler) bootURL(msg *dhcpv6.Message) string {
+	if h.cfg.HTTPBootURL == "" {
+		return h.cfg.BootFileURL
+	}
+	archs := msg.Options.ArchTypes()
+	for _, arch := range httpBootArchs {
+		if archs.Contains(arch) {
+			return h.cfg.HTTPBootURL
+		}
+	}
+	for _, vc := range msg.Options.VendorClasses() {
+		for _, data := range vc.Data {
+			if bytes.HasPrefix(data, []byte("HTTPClient")) {
+				return h.cfg.HTTPBootURL
+			}
+		}
+	}
+	return h.cfg.BootFileURL
+}
+
+// assign answers every IA_NA in msg with an address from the range. Committed
+// assignments get the full lease time; advertised ones are only held briefly.
+func (h *handler) assign(reply, msg *dhcpv6.Message, client string, commit bool) {
+	for _, ia := range msg.Options.IANA() {
+		resp := &dhcpv6.OptIANA{IaId: ia.IaId}
+		addr, ok := h.allocate(bindingKey(client, ia.IaId), commit)
+		if ok {
+			h.addAddress(resp, addr)
+			if commit {
+				h.events.Emit(events.SubjectDHCPLeased, events.Boot{
+					MAC:      clientMAC(msg.Options.ClientID()),
+					IP:       addr.String(),
+					Arch:     clientArch(msg),
+					BootFile: h.bootURL(msg),
+				})
+			}
+		} else {
+			resp.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoAddrsAvail, StatusMessage: "no addresses available"})
+			h.logger.Printf("WARN dhcpv6 range exhausted for client %s", client)
+		}
+		reply.AddOption(resp)
+	}
+}
+
+// renew extends existing bindings. IAs this server has no record of are
+// answered with NoBinding so the client restarts with a SOLICIT.
+func (h *handler) renew(reply, msg *dhcpv6.Message, client string) {
+	for _, ia := range msg.Options.IANA() {
+		resp := &dhcpv6.OptIANA{IaId: ia.IaId}
+		if addr, ok := h.extend(bindingKey(client, ia.IaId)); ok {
+			h.addAddress(resp, addr)
+		} else {
+			resp.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoBinding, StatusMessage: "no binding for IA"})
+		}
+		reply.AddOption(resp)
+	}
+}
+
+func (h *handler) addAddress(resp *dhcpv6.OptIANA, addr netip.Addr) {
+	lease := h.cfg.LeaseTime
+	resp.T1 = lease / 2
+	resp.T2 = lease * 4 / 5
+	resp.Options.Add(&dhcpv6.OptIAAddress{
+		IPv6Addr:          net.IP(addr.AsSlice()),
+		PreferredLifetime: lease,
+		ValidLifetime:     lease,
+	})
+}
+
+// confirmStatus reports whether every address the client holds is on-link
+// for the configured range.
+func (h *handler) confirmStatus(msg *dhcpv6.Message) *dhcpv6.OptStatusCode {
+	for _, ia := range msg.Options.IANA() {
+		for _, a := range ia.Options.Addresses() {
+			addr, ok := netip.AddrFromSlice(a.IPv6Addr.To16())
+			if !ok || !h.inRange(addr) {
+				return &dhcpv6.OptStatusCode{StatusCode: iana.StatusNotOnLink, StatusMessage: "address not on link"}
+			}
+		}
+	}
+	return &dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess}
+}
+
+func (h *handler) allocate(key string, commit bool) (netip.Addr, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	hold := offerHoldTime
+	if commit {
+		hold = h.cfg.LeaseTime
+	}
+	if b, ok := h.bindings[key]; ok && (b.expiresAt.After(now) || !h.inUse(b.addr, key, now)) {
+		if commit || b.offered {
+			b.expiresAt = now.Add(hold)
+			b.offered = !commit
+		}
+		h.bindings[key] = b
+		return b.addr, true
+	}
+
+	addr, ok := h.nextFree(key, now)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	h.bindings[key] = binding{addr: addr, expiresAt: now.Add(hold), offered: !commit}
+	return addr, true
+}
+
+func (h *handler) extend(key string) (netip.Addr, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	b, ok := h.bindings[key]
+	if !ok || b.offered || (!b.expiresAt.After(now) && h.inUse(b.addr, key, now)) {
+		return netip.Addr{}, false
+	}
+	b.expiresAt = now.Add(h.cfg.LeaseTime)
+	h.bindings[key] = b
+	return b.addr, true
+}
+
+func (h *handler) release(msg *dhcpv6.Message, client string, declined bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for _, ia := range msg.Options.IANA() {
+		key := bindingKey(client, ia.IaId)
+		b, ok := h.bindings[key]
+		if !ok {
+			continue
+		}
+		delete(h.bindings, key)
+		if declined {
+			h.declined[b.addr] = now.Add(h.cfg.LeaseTime)
+			h.logger.Printf("WARN dhcpv6 client %s declined %s; quarantined for %s", client, b.addr, h.cfg.LeaseTime)
+		}
+	}
+}
+
+func (h *handler) nextFree(key string, now time.Time) (netip.Addr, bool) {
+	for _, from := range []netip.Addr{h.next, h.start} {
+		for addr := from; addr.IsValid() && addr.Compare(h.end) <= 0; addr = addr.Next() {
+			if !h.inUse(addr, key, now) {
+				h.next = addr.Next()
+				return addr, true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// inUse reports whether addr is bound to an IA other than key or quarantined
+// after a DECLINE. Callers must hold h.mu.
+func (h *handler) inUse(addr netip.Addr, key string, now time.Time) bool {
+	if until, ok := h.declined[addr]; ok {
+		if until.After(now) {
+			return true
+		}
+		delete(h.declined, addr)
+	}
+	for k, b := range h.bindings {
+		if k != key && b.addr == addr && b.expiresAt.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) inRange(addr netip.Addr) bool {
+	return addr.Compare(h.start) >= 0 && addr.Compare(h.end) <= 0
+}
+
+// clientMAC extracts the link-layer address from DUID-LL and DUID-LLT client
+// identifiers; other DUID types carry no MAC.
+func clientMAC(duid dhcpv6.DUID) string {
+	switch d := duid.(type) {
+	case *dhcpv6.DUIDLL:
+		return d.LinkLayerAddr.String()
+	case *dhcpv6.DUIDLLT:
+		return d.LinkLayerAddr.String()
+	}
+	return ""
+}
+
+func clientArch(msg *dhcpv6.Message) string {
+	if archs := msg.Options.ArchTypes(); len(archs) > 0 {
+		return archs[0].String()
+	}
+	return ""
+}
+
+func bindingKey(client string, iaid [4]byte) string {
+	return client + "/" + hex.EncodeToString(iaid[:])
+}
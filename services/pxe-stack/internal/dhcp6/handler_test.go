@@ -0,0 +1,174 @@
+package dhcp6
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"goosed/services/pxe-stack/internal/config"
+)
+
+var (
+	testServerDUID = &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}}
+	testClientMAC  = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+)
+
+func newTestHandler(t *testing.T) *handler {
+	t.Helper()
+	cfg := config.DHCPv6Config{
+		RangeStart:  net.ParseIP("2001:db8::100"),
+		RangeEnd:    net.ParseIP("2001:db8::101"),
+		DNSServers:  []net.IP{net.ParseIP("2001:db8::53")},
+		LeaseTime:   time.Hour,
+		BootFileURL: "tftp://[2001:db8::1]/ipxe.efi",
+		HTTPBootURL: "http://[2001:db8::1]:8080/ipxe.efi",
+	}
+	return newHandler(cfg, log.New(io.Discard, "", 0), testServerDUID)
+}
+
+func solicit(t *testing.T, mods ...dhcpv6.Modifier) *dhcpv6.Message {
+	t.Helper()
+	mods = append([]dhcpv6.Modifier{dhcpv6.WithNetboot}, mods...)
+	msg, err := dhcpv6.NewSolicit(testClientMAC, mods...)
+	if err != nil {
+		t.Fatalf("build solicit: %v", err)
+	}
+	return msg
+}
+
+func TestSolicitRequestAssignsAddressAndBootURL(t *testing.T) {
+	h := newTestHandler(t)
+
+	adv := h.process(solicit(t, dhcpv6.WithArchType(iana.EFI_X86_64)))
+	if adv == nil || adv.Type() != dhcpv6.MessageTypeAdvertise {
+		t.Fatalf("expected ADVERTISE, got %v", adv)
+	}
+	addr := adv.Options.OneIANA().Options.OneAddress()
+	if addr == nil || !addr.IPv6Addr.Equal(net.ParseIP("2001:db8::100")) {
+		t.Fatalf("advertised address = %v, want 2001:db8::100", addr)
+	}
+	if got := adv.Options.BootFileURL(); got != "tftp://[2001:db8::1]/ipxe.efi" {
+		t.Fatalf("boot URL = %q", got)
+	}
+
+	req, err := dhcpv6.NewRequestFromAdvertise(adv, dhcpv6.WithNetboot)
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	reply := h.process(req)
+	if reply == nil || reply.Type() != dhcpv6.MessageTypeReply {
+		t.Fatalf("expected REPLY, got %v", reply)
+	}
+	ia := reply.Options.OneIANA()
+	if ia == nil || ia.Options.OneAddress() == nil || !ia.Options.OneAddress().IPv6Addr.Equal(addr.IPv6Addr) {
+		t.Fatalf("reply IA_NA = %v, want %s", ia, addr.IPv6Addr)
+	}
+	if ia.Options.OneAddress().ValidLifetime != time.Hour {
+		t.Fatalf("valid lifetime = %s, want 1h", ia.Options.OneAddress().ValidLifetime)
+	}
+}
+
+func TestHTTPBootClientGetsHTTPURL(t *testing.T) {
+	h := newTestHandler(t)
+	adv := h.process(solicit(t, dhcpv6.WithArchType(iana.EFI_X86_64_HTTP)))
+	if adv == nil {
+		t.Fatal("expected ADVERTISE")
+	}
+	if got := adv.Options.BootFileURL(); got != "http://[2001:db8::1]:8080/ipxe.efi" {
+		t.Fatalf("boot URL = %q", got)
+	}
+}
+
+func TestRequestForOtherServerIgnored(t *testing.T) {
+	h := newTestHandler(t)
+	adv := h.process(solicit(t))
+	adv.UpdateOption(dhcpv6.OptServerID(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 9}}))
+	req, err := dhcpv6.NewRequestFromAdvertise(adv)
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	if reply := h.process(req); reply != nil {
+		t.Fatalf("expected no reply, got %s", reply.Type())
+	}
+}
+
+func TestRenewWithoutBindingReturnsNoBinding(t *testing.T) {
+	h := newTestHandler(t)
+	msg := solicit(t, dhcpv6.WithServerID(testServerDUID))
+	msg.MessageType = dhcpv6.MessageTypeRenew
+
+	reply := h.process(msg)
+	if reply == nil {
+		t.Fatal("expected REPLY")
+	}
+	status := reply.Options.OneIANA().Options.Status()
+	if status == nil || status.StatusCode != iana.StatusNoBinding {
+		t.Fatalf("IA status = %v, want NoBinding", status)
+	}
+}
+
+func TestDeclineQuarantinesAddress(t *testing.T) {
+	h := newTestHandler(t)
+	adv := h.process(solicit(t))
+	req, err := dhcpv6.NewRequestFromAdvertise(adv)
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	bound := h.process(req)
+	addr := bound.Options.OneIANA().Options.OneAddress().IPv6Addr
+
+	decline, err := dhcpv6.NewMessage(
+		dhcpv6.WithClientID(req.Options.ClientID()),
+		dhcpv6.WithServerID(testServerDUID),
+		dhcpv6.WithIANA(*bound.Options.OneIANA().Options.OneAddress()),
+	)
+	if err != nil {
+		t.Fatalf("build decline: %v", err)
+	}
+	decline.MessageType = dhcpv6.MessageTypeDecline
+	decline.Options.OneIANA().IaId = bound.Options.OneIANA().IaId
+
+	reply := h.process(decline)
+	if reply == nil || reply.Type() != dhcpv6.MessageTypeReply || reply.TransactionID != decline.TransactionID {
+		t.Fatalf("expected REPLY to the DECLINE, got %v", reply)
+	}
+	if status := reply.Options.Status(); status == nil || status.StatusCode != iana.StatusSuccess {
+		t.Fatalf("status = %v, want Success", status)
+	}
+	if !reply.Options.ClientID().Equal(req.Options.ClientID()) || !reply.Options.ServerID().Equal(testServerDUID) {
+		t.Fatalf("reply IDs = %v / %v", reply.Options.ClientID(), reply.Options.ServerID())
+	}
+	if len(h.bindings) != 0 {
+		t.Fatalf("bindings after DECLINE = %+v", h.bindings)
+	}
+
+	next := h.process(solicit(t)).Options.OneIANA().Options.OneAddress()
+	if next == nil || next.IPv6Addr.Equal(addr) {
+		t.Fatalf("re-advertised declined address %s", addr)
+	}
+}
+
+func TestRangeExhaustion(t *testing.T) {
+	h := newTestHandler(t)
+	for i, mac := range []net.HardwareAddr{
+		{0, 0, 0, 0, 0, 1}, {0, 0, 0, 0, 0, 2}, {0, 0, 0, 0, 0, 3},
+	} {
+		msg, err := dhcpv6.NewSolicit(mac, dhcpv6.WithRapidCommit)
+		if err != nil {
+			t.Fatalf("build solicit: %v", err)
+		}
+		reply := h.process(msg)
+		status := reply.Options.OneIANA().Options.Status()
+		if i < 2 && status != nil {
+			t.Fatalf("client %d: unexpected status %v", i, status)
+		}
+		if i == 2 && (status == nil || status.StatusCode != iana.StatusNoAddrsAvail) {
+			t.Fatalf("client %d: status = %v, want NoAddrsAvail", i, status)
+		}
+	}
+}
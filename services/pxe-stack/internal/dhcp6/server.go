@@ -0,0 +1,76 @@
+package dhcp6
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"goosed/services/pxe-stack/internal/config"
+	"goosed/services/pxe-stack/internal/events"
+)
+
+func NewServer(cfg config.DHCPv6Config, logger *log.Logger, emitter *events.Emitter) (*Server, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("lookup interface %s: %w", cfg.Interface, err)
+	}
+	if len(iface.HardwareAddr) == 0 {
+		return nil, fmt.Errorf("interface %s has no hardware address for the server DUID", cfg.Interface)
+	}
+	serverID := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: iface.HardwareAddr}
+	h := newHandler(cfg, logger, serverID)
+	h.events = emitter
+	return &Server{cfg: cfg, logger: logger, handler: h}, nil
+}
+
+func newHandler(cfg config.DHCPv6Config, logger *log.Logger, serverID dhcpv6.DUID) *handler {
+	start, _ := netip.AddrFromSlice(cfg.RangeStart.To16())
+	end, _ := netip.AddrFromSlice(cfg.RangeEnd.To16())
+	return &handler{
+		cfg:      cfg,
+		logger:   logger,
+		serverID: serverID,
+		bindings: make(map[string]binding),
+		declined: make(map[netip.Addr]time.Time),
+		start:    start,
+		end:      end,
+		next:     start,
+	}
+}
+
+func (s *Server) Run(ctx context.Context, ready *atomic.Bool) error {
+	srv, err := server6.NewServer(s.cfg.Interface, nil, s.handler.handle)
+	if err != nil {
+		return fmt.Errorf("start dhcpv6 listener on %s: %w", s.cfg.Interface, err)
+	}
+	ready.Store(true)
+	s.logger.Printf("INFO dhcpv6 serving %s-%s on %s", s.cfg.RangeStart, s.cfg.RangeEnd, s.cfg.Interface)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		srv.Close()
+		if err != nil {
+			return fmt.Errorf("dhcpv6 serve: %w", err)
+		}
+	case <-ctx.Done():
+		srv.Close()
+		<-errCh
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package dhcp6
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"goosed/services/pxe-stack/internal/config"
+	"goosed/services/pxe-stack/internal/events"
+)
+
+type Server struct {
+	cfg     config.DHCPv6Config
+	logger  *log.Logger
+	handler *handler
+}
+
+type handler struct {
+	cfg      config.DHCPv6Config
+	logger   *log.Logger
+	serverID dhcpv6.DUID
+	mu       sync.Mutex
+	bindings map[string]binding
+	declined map[netip.Addr]time.Time
+	start    netip.Addr
+	end      netip.Addr
+	next     netip.Addr
+	events   *events.Emitter
+}
+
+// binding is the address assigned to one identity association (client DUID
+// plus IAID).
+type binding struct {
+	addr      netip.Addr
+	expiresAt time.Time
+	offered   bool
+}
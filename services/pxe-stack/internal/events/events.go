@@ -0,0 +1,113 @@
+package events
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Subjects published by pxe-stack as a host moves through network boot.
+const (
+	SubjectDHCPLeased = "goosed.pxe.dhcp.leased"
+	// SubjectDHCPProxied is published in ProxyDHCP mode, where another
+	// server assigns the address, once the client's IP is known.
+	SubjectDHCPProxied = "goosed.pxe.dhcp.proxied"
+	SubjectTFTPServed  = "goosed.pxe.tftp.served"
+	SubjectHTTPMenu    = "goosed.pxe.http.menu"
+)
+
+const (
+	publishTimeout = 5 * time.Second
+	// clientTTL bounds how long a lease is remembered for filling in TFTP and
+	// HTTP events, which only see the client's IP.
+	clientTTL = 30 * time.Minute
+)
+
+// Boot is the payload of every pxe-stack boot event.
+type Boot struct {
+	MAC       string    `json:"mac,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Arch      string    `json:"arch,omitempty"`
+	BootFile  string    `json:"boot_file,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Publisher is satisfied by *bus.Bus.
+type Publisher interface {
+	Publish(ctx context.Context, subj string, v any) error
+}
+
+type client struct {
+	mac  string
+	arch string
+	seen time.Time
+}
+
+// Emitter publishes boot events without blocking the DHCP/TFTP/HTTP paths. A
+// nil *Emitter is valid and discards events.
+type Emitter struct {
+	pub    Publisher
+	logger *log.Logger
+
+	mu      sync.Mutex
+	clients map[string]client
+}
+
+func NewEmitter(pub Publisher, logger *log.Logger) *Emitter {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &Emitter{pub: pub, logger: logger, clients: make(map[string]client)}
+}
+
+// Emit publishes ev on subject in the background. Missing MAC or arch are
+// filled in from the most recent lease for the same IP.
+func (e *Emitter) Emit(subject string, ev Boot) {
+	if e == nil || e.pub == nil {
+		return
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+	e.enrich(&ev)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		defer cancel()
+		if err := e.pub.Publish(ctx, subject, ev); err != nil {
+			e.logger.Printf("WARN publish %s for %s: %v", subject, ev.MAC, err)
+		}
+	}()
+}
+
+func (e *Emitter) enrich(ev *Boot) {
+	if ev.IP == "" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if c, ok := e.clients[ev.IP]; ok && now.Sub(c.seen) <= clientTTL {
+		if ev.MAC == "" {
+			ev.MAC = c.mac
+		}
+		if ev.Arch == "" && ev.MAC == c.mac {
+			ev.Arch = c.arch
+		}
+	}
+	if ev.MAC != "" {
+		e.clients[ev.IP] = client{mac: ev.MAC, arch: ev.Arch, seen: now}
+		e.pruneLocked(now)
+	}
+}
+
+func (e *Emitter) pruneLocked(now time.Time) {
+	for ip, c := range e.clients {
+		if now.Sub(c.seen) > clientTTL {
+			delete(e.clients, ip)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package pxehttp
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+
+	"goosed/services/pxe-stack/internal/bootcfg"
+)
+
+// bootConfigHandler serves pxelinux.cfg/01-<mac> and grub/grub.cfg-01-<mac>
+// for lpxelinux and GRUB clients that load their config over HTTP.
+func bootConfigHandler(client *bootcfg.Client, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kind, mac, ok := bootcfg.Match(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		ctx := r.Context()
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ctx = bootcfg.WithClientIP(ctx, net.ParseIP(host))
+		}
+		body, err := client.Fetch(ctx, kind, mac)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("WARN %v", err)
+			http.Error(w, "boot config unavailable", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(body)
+	}
+}
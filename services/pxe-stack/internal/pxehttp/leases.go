@@ -0,0 +1,48 @@
+package pxehttp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"goosed/services/pxe-stack/internal/dhcp"
+)
+
+// LeaseSource exposes the DHCP server state rendered by the lease endpoint.
+type LeaseSource interface {
+	Leases() []dhcp.Lease
+	Reservations() []dhcp.Reservation
+}
+
+// RegisterLeaseHandler serves the active DHCP leases and static reservations
+// as JSON on /leases.
+func RegisterLeaseHandler(mux *http.ServeMux, source LeaseSource) error {
+	if mux == nil {
+		return errors.New("nil mux")
+	}
+	if source == nil {
+		return errors.New("lease source is nil")
+	}
+
+	mux.HandleFunc("/leases", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		leases := source.Leases()
+		if leases == nil {
+			leases = []dhcp.Lease{}
+		}
+		reservations := source.Reservations()
+		if reservations == nil {
+			reservations = []dhcp.Reservation{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"leases":       leases,
+			"reservations": reservations,
+		})
+	})
+	return nil
+}
@@ -5,16 +5,19 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync/atomic"
 
 	brandingfs "goosed/infra/branding"
+	"goosed/services/pxe-stack/internal/bootcfg"
 	"goosed/services/pxe-stack/internal/config"
+	"goosed/services/pxe-stack/internal/events"
 )
 
-func RegisterHandlers(mux *http.ServeMux, cfg config.HTTPConfig, ready *atomic.Bool, logger *log.Logger) error {
+func RegisterHandlers(mux *http.ServeMux, cfg config.HTTPConfig, ready *atomic.Bool, logger *log.Logger, emitter *events.Emitter) error {
 	if mux == nil {
 		return errors.New("nil mux")
 	}
@@ -37,8 +40,23 @@ func RegisterHandlers(mux *http.ServeMux, cfg config.HTTPConfig, ready *atomic.B
 		script := fmt.Sprintf("#!ipxe\nset api %s\nchain ${api}/v1/boot/ipxe?mac=${mac}\n", cfg.APIEndpoint)
 		w.Header().Set("Content-Type", "text/plain")
 		_, _ = w.Write([]byte(script))
+
+		ip := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = host
+		}
+		emitter.Emit(events.SubjectHTTPMenu, events.Boot{
+			MAC:      strings.ToLower(mac),
+			IP:       ip,
+			Arch:     strings.TrimSpace(r.URL.Query().Get("arch")),
+			BootFile: "menu.ipxe",
+		})
 	})
 
+	configs := bootConfigHandler(bootcfg.NewClient(cfg.APIEndpoint), logger)
+	mux.Handle("/pxelinux.cfg/", configs)
+	mux.Handle("/grub/", configs)
+
 	fileSystem, err := brandingFileSystem(cfg.BrandingFS)
 	if err != nil {
 		return fmt.Errorf("prepare branding filesystem: %w", err)
@@ -0,0 +1,152 @@
+package tftp
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const cacheFileSuffix = ".tftpcache"
+
+// cache is a size-bounded LRU of object contents, kept in memory or as files
+// under dir when one is configured.
+type cache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	etag    string
+	size    int64
+	checked time.Time
+	data    []byte // memory mode
+	path    string // disk mode
+}
+
+func newCache(dir string, maxBytes int64) (*cache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create cache dir: %w", err)
+		}
+		// Entries are not indexed across restarts and partial downloads
+		// cannot be resumed, so start clean.
+		stale, _ := filepath.Glob(filepath.Join(dir, "*"+cacheFileSuffix))
+		partial, _ := filepath.Glob(filepath.Join(dir, "fetch-*"))
+		for _, p := range append(stale, partial...) {
+			_ = os.Remove(p)
+		}
+	}
+	return &cache{dir: dir, maxBytes: maxBytes, ll: list.New(), items: make(map[string]*list.Element)}, nil
+}
+
+// fits reports whether an object of size bytes may be cached at all.
+func (c *cache) fits(size int64) bool {
+	return size >= 0 && size <= c.maxBytes
+}
+
+// get returns the entry for key and marks it most recently used.
+func (c *cache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	c.ll.MoveToFront(el)
+	return *el.Value.(*cacheEntry), true
+}
+
+// touch records that key was revalidated against the origin at t.
+func (c *cache) touch(key string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*cacheEntry).checked = t
+	}
+}
+
+// tempFile creates a file for an in-progress download in disk mode.
+func (c *cache) tempFile() (*os.File, error) {
+	return os.CreateTemp(c.dir, "fetch-*")
+}
+
+// add stores a completed download under key, evicting least recently used
+// entries to stay within maxBytes. In memory mode the content is data; in
+// disk mode it is the file tmp, which is moved into the cache.
+func (c *cache) add(key, etag string, data []byte, tmp string, size int64) (cacheEntry, error) {
+	if size > c.maxBytes {
+		return cacheEntry{}, fmt.Errorf("%s exceeds cache size", key)
+	}
+	e := cacheEntry{key: key, etag: etag, size: size, checked: time.Now(), data: data}
+	if c.dir != "" {
+		sum := sha256.Sum256([]byte(key))
+		e.path = filepath.Join(c.dir, hex.EncodeToString(sum[:])+cacheFileSuffix)
+		if err := os.Rename(tmp, e.path); err != nil {
+			_ = os.Remove(tmp)
+			return cacheEntry{}, err
+		}
+		e.data = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.size -= el.Value.(*cacheEntry).size
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+	for c.size+e.size > c.maxBytes && c.ll.Len() > 0 {
+		c.evictLocked(c.ll.Back())
+	}
+	stored := e
+	c.items[key] = c.ll.PushFront(&stored)
+	c.size += e.size
+	cacheBytes.Set(float64(c.size))
+	return e, nil
+}
+
+// remove drops key from the cache.
+func (c *cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.evictLocked(el)
+	}
+}
+
+func (c *cache) evictLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.size -= e.size
+	if e.path != "" {
+		// Transfers that already opened the file keep reading it.
+		_ = os.Remove(e.path)
+	}
+	cacheBytes.Set(float64(c.size))
+}
+
+// open returns a reader over a cached entry.
+func (c *cache) open(e cacheEntry) (io.ReadCloser, error) {
+	if e.path == "" {
+		return io.NopCloser(bytes.NewReader(e.data)), nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
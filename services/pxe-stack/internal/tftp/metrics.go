@@ -0,0 +1,50 @@
+package tftp
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	transfersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pxe_tftp_transfers_total",
+		Help: "TFTP read transfers by result.",
+	}, []string{"result"})
+	transferBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pxe_tftp_transfer_bytes",
+		Help:    "Bytes sent per TFTP transfer.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	transferDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pxe_tftp_transfer_duration_seconds",
+		Help:    "Duration of TFTP transfers.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 3, 10),
+	})
+	retransmitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pxe_tftp_retransmits_total",
+		Help: "TFTP packets retransmitted after a timeout or a gap in the client's window.",
+	})
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pxe_tftp_cache_requests_total",
+		Help: "S3-backed TFTP reads served from the local cache (hit), fetched from S3 (miss), joined to a fetch in progress (coalesced) or too large to cache (bypass).",
+	}, []string{"result"})
+	cacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pxe_tftp_cache_bytes",
+		Help: "Bytes currently held in the TFTP object cache.",
+	})
+)
+
+func observeTransfer(t *transfer, ok bool) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	transfersTotal.WithLabelValues(result).Inc()
+	retransmitsTotal.Add(float64(t.retransmits))
+	if ok {
+		transferBytes.Observe(float64(t.bytes))
+		transferDuration.Observe(time.Since(t.started).Seconds())
+	}
+}
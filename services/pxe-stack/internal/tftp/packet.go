@@ -0,0 +1,116 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TFTP opcodes (RFC 1350, RFC 2347).
+const (
+	opRRQ   uint16 = 1
+	opWRQ   uint16 = 2
+	opDATA  uint16 = 3
+	opACK   uint16 = 4
+	opERROR uint16 = 5
+	opOACK  uint16 = 6
+)
+
+// TFTP error codes.
+const (
+	errNotDefined       uint16 = 0
+	errFileNotFound     uint16 = 1
+	errAccessViolation  uint16 = 2
+	errIllegalOperation uint16 = 4
+	errUnknownTID       uint16 = 5
+	errOptionRejected   uint16 = 8
+)
+
+const defaultBlockSize = 512
+
+type request struct {
+	filename string
+	mode     string
+	options  map[string]string
+	// order preserves the client's option order for the OACK.
+	order []string
+}
+
+func parseRequest(b []byte) (request, error) {
+	if len(b) < 4 {
+		return request{}, errors.New("short request")
+	}
+	fields := bytes.Split(b[2:], []byte{0})
+	if len(fields) < 3 {
+		return request{}, errors.New("malformed request")
+	}
+	req := request{
+		filename: string(fields[0]),
+		mode:     strings.ToLower(string(fields[1])),
+		options:  make(map[string]string),
+	}
+	if req.filename == "" {
+		return request{}, errors.New("empty filename")
+	}
+	opts := fields[2:]
+	for i := 0; i+1 < len(opts); i += 2 {
+		name := strings.ToLower(string(opts[i]))
+		if name == "" {
+			break
+		}
+		if _, dup := req.options[name]; !dup {
+			req.order = append(req.order, name)
+		}
+		req.options[name] = string(opts[i+1])
+	}
+	return req, nil
+}
+
+func packData(buf []byte, block uint16, data []byte) []byte {
+	buf = buf[:4+len(data)]
+	binary.BigEndian.PutUint16(buf[0:], opDATA)
+	binary.BigEndian.PutUint16(buf[2:], block)
+	copy(buf[4:], data)
+	return buf
+}
+
+func packOACK(names []string, values map[string]string) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, opOACK)
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		buf.WriteString(values[name])
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func packError(code uint16, msg string) []byte {
+	buf := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(buf[0:], opERROR)
+	binary.BigEndian.PutUint16(buf[2:], code)
+	buf = append(buf, msg...)
+	return append(buf, 0)
+}
+
+// parseAck returns the acknowledged block number. A client ERROR is returned
+// as an error.
+func parseAck(b []byte) (uint16, error) {
+	if len(b) < 4 {
+		return 0, errors.New("short packet")
+	}
+	switch binary.BigEndian.Uint16(b) {
+	case opACK:
+		return binary.BigEndian.Uint16(b[2:]), nil
+	case opERROR:
+		msg := strings.TrimRight(string(b[4:]), "\x00")
+		return 0, fmt.Errorf("client error %d: %s", binary.BigEndian.Uint16(b[2:]), msg)
+	default:
+		return 0, errUnexpectedPacket
+	}
+}
+
+var errUnexpectedPacket = errors.New("unexpected packet")
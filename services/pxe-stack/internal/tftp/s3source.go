@@ -0,0 +1,324 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	gos3 "goosed/pkg/s3"
+)
+
+// objectStore is the subset of the S3 client used to serve TFTP files.
+type objectStore interface {
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, gos3.ObjectInfo, error)
+	HeadObject(ctx context.Context, bucket, key string) (gos3.ObjectInfo, error)
+}
+
+// s3Source serves files from the artifacts bucket under prefix. Objects are
+// cached and revalidated by ETag once they are older than ttl; concurrent
+// misses on the same key share one download.
+type s3Source struct {
+	store  objectStore
+	bucket string
+	prefix string
+	cache  *cache
+	ttl    time.Duration
+	logger *log.Logger
+
+	mu       sync.Mutex
+	inflight map[string]*fill
+}
+
+// errUncacheable sends a read too large for the cache straight to S3.
+var errUncacheable = errors.New("object too large to cache")
+
+func (s *s3Source) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	key := s.prefix + name
+
+	if e, ok := s.cache.get(key); ok {
+		if time.Since(e.checked) >= s.ttl {
+			info, err := s.store.HeadObject(ctx, s.bucket, key)
+			switch {
+			case errors.Is(err, gos3.ErrNotFound):
+				s.cache.remove(key)
+				return nil, 0, fmt.Errorf("s3://%s/%s: %w", s.bucket, key, fs.ErrNotExist)
+			case err != nil:
+				// Keep booting from the cached copy while S3 is unreachable.
+				s.logger.Printf("WARN tftp revalidate s3://%s/%s: %v; serving cached copy", s.bucket, key, err)
+			case info.ETag != e.etag:
+				s.cache.remove(key)
+				return s.fetch(ctx, key)
+			default:
+				s.cache.touch(key, time.Now())
+			}
+		}
+		if rc, err := s.cache.open(e); err == nil {
+			cacheRequests.WithLabelValues("hit").Inc()
+			return rc, e.size, nil
+		}
+	}
+	return s.fetch(ctx, key)
+}
+
+// fetch downloads key into the cache, or joins the download already in
+// progress, and returns a reader that follows it as it grows, so the first
+// DATA block goes out before the object has arrived.
+func (s *s3Source) fetch(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	f, leader := s.start(key)
+	rc, size, err := f.open(s.cache)
+	if errors.Is(err, errUncacheable) {
+		cacheRequests.WithLabelValues("bypass").Inc()
+		body, info, err := s.get(ctx, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		return body, info.Size, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	result := "miss"
+	if !leader {
+		result = "coalesced"
+	}
+	cacheRequests.WithLabelValues(result).Inc()
+	return rc, size, nil
+}
+
+func (s *s3Source) get(ctx context.Context, key string) (io.ReadCloser, gos3.ObjectInfo, error) {
+	body, info, err := s.store.GetObject(ctx, s.bucket, key)
+	if err != nil {
+		if errors.Is(err, gos3.ErrNotFound) {
+			return nil, info, fmt.Errorf("s3://%s/%s: %w", s.bucket, key, fs.ErrNotExist)
+		}
+		return nil, info, fmt.Errorf("get s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return body, info, nil
+}
+
+// start joins the in-flight download of key or begins a new one. The
+// download is detached from the transfer so one client going away does not
+// fail the others.
+func (s *s3Source) start(key string) (*fill, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.inflight[key]; ok {
+		return f, false
+	}
+	if s.inflight == nil {
+		s.inflight = make(map[string]*fill)
+	}
+	f := newFill()
+	s.inflight[key] = f
+	go s.run(f, key)
+	return f, true
+}
+
+func (s *s3Source) run(f *fill, key string) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.inflight, key)
+		s.mu.Unlock()
+	}()
+
+	body, info, err := s.get(context.Background(), key)
+	if err != nil {
+		f.finish(err)
+		return
+	}
+	defer body.Close()
+	if !s.cache.fits(info.Size) {
+		f.finish(errUncacheable)
+		return
+	}
+
+	var tmp *os.File
+	if s.cache.dir != "" {
+		if tmp, err = s.cache.tempFile(); err != nil {
+			f.finish(fmt.Errorf("cache s3://%s/%s: %w", s.bucket, key, err))
+			return
+		}
+		f.begin(tmp.Name(), info.Size)
+	} else {
+		f.begin("", info.Size)
+	}
+
+	buf := make([]byte, 64<<10)
+	var written int64
+	for err == nil {
+		var n int
+		n, err = body.Read(buf)
+		if n > 0 {
+			if tmp != nil {
+				if _, werr := tmp.Write(buf[:n]); werr != nil {
+					err = werr
+					break
+				}
+			}
+			written += int64(n)
+			f.advance(buf[:n])
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if tmp != nil {
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && written != info.Size {
+		err = fmt.Errorf("short read: got %d of %d bytes", written, info.Size)
+	}
+	if err != nil {
+		if tmp != nil {
+			_ = os.Remove(tmp.Name())
+		}
+		f.finish(fmt.Errorf("get s3://%s/%s: %w", s.bucket, key, err))
+		return
+	}
+	f.commit(func(data []byte) (cacheEntry, error) {
+		name := ""
+		if tmp != nil {
+			name = tmp.Name()
+		}
+		return s.cache.add(key, info.ETag, data, name, written)
+	})
+}
+
+// fill is one S3 download being written to the cache that any number of
+// transfers read as it grows: from data in memory mode, or from the
+// temporary file tmp in disk mode.
+type fill struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	started bool
+	done    bool
+	err     error
+	size    int64
+	data    []byte
+	tmp     string
+	written int64
+	entry   cacheEntry
+}
+
+func newFill() *fill {
+	f := &fill{}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *fill) begin(tmp string, size int64) {
+	f.mu.Lock()
+	f.started, f.tmp, f.size = true, tmp, size
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+func (f *fill) advance(p []byte) {
+	f.mu.Lock()
+	if f.tmp == "" {
+		f.data = append(f.data, p...)
+	}
+	f.written += int64(len(p))
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+func (f *fill) finish(err error) {
+	f.mu.Lock()
+	f.started, f.done, f.err = true, true, err
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// commit runs add under the lock, so readers never open the temporary file
+// after it has been moved into the cache.
+func (f *fill) commit(add func(data []byte) (cacheEntry, error)) {
+	f.mu.Lock()
+	e, err := add(f.data)
+	if err != nil {
+		f.err = fmt.Errorf("commit to cache: %w", err)
+	}
+	f.entry, f.done = e, true
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// open waits for the download to start and returns a reader over the
+// content, which blocks until the bytes it is asked for have arrived.
+func (f *fill) open(c *cache) (io.ReadCloser, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.started {
+		f.cond.Wait()
+	}
+	if f.done {
+		if f.err != nil {
+			return nil, 0, f.err
+		}
+		rc, err := c.open(f.entry)
+		return rc, f.entry.size, err
+	}
+	r := &fillReader{f: f}
+	if f.tmp != "" {
+		file, err := os.Open(f.tmp)
+		if err != nil {
+			return nil, 0, err
+		}
+		r.file = file
+	}
+	return r, f.size, nil
+}
+
+type fillReader struct {
+	f    *fill
+	file *os.File // disk mode
+	off  int64
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	for r.off >= f.written && !f.done {
+		f.cond.Wait()
+	}
+	avail, err := f.written-r.off, f.err
+	if r.file == nil && avail > 0 {
+		// data may be reallocated by the next append, so copy under the lock.
+		n := copy(p, f.data[r.off:f.written])
+		f.mu.Unlock()
+		r.off += int64(n)
+		return n, nil
+	}
+	f.mu.Unlock()
+
+	if avail <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, rerr := r.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	if n > 0 && errors.Is(rerr, io.EOF) {
+		rerr = nil
+	}
+	return n, rerr
+}
+
+func (r *fillReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -2,79 +2,238 @@ package tftp
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
-	"os"
-	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/pin/tftp"
-
+	gos3 "goosed/pkg/s3"
+	"goosed/services/pxe-stack/internal/bootcfg"
 	"goosed/services/pxe-stack/internal/config"
+	"goosed/services/pxe-stack/internal/events"
 )
 
-func NewServer(cfg config.TFTPConfig, logger *log.Logger) *Server {
+// options are the server-side limits applied during option negotiation.
+type options struct {
+	maxBlockSize  int
+	maxWindowSize int
+	tsize         bool
+}
+
+func NewServer(cfg config.TFTPConfig, logger *log.Logger, emitter *events.Emitter) (*Server, error) {
 	if logger == nil {
 		logger = log.Default()
 	}
-	return &Server{cfg: cfg, logger: logger}
+	s := &Server{cfg: cfg, logger: logger, events: emitter}
+
+	if cfg.VirtualConfigs && cfg.APIEndpoint != "" {
+		s.sources = append(s.sources, virtualSource{client: bootcfg.NewClient(cfg.APIEndpoint)})
+	}
+	switch cfg.Backend {
+	case config.TFTPBackendS3:
+		client, err := gos3.NewClientFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("init s3 client: %w", err)
+		}
+		c, err := newCache(cfg.CacheDir, cfg.CacheBytes)
+		if err != nil {
+			return nil, err
+		}
+		s.sources = append(s.sources, &s3Source{
+			store:  client,
+			bucket: cfg.S3Bucket,
+			prefix: cfg.S3Prefix,
+			cache:  c,
+			ttl:    cfg.CacheTTL,
+			logger: logger,
+		})
+	default:
+		s.sources = append(s.sources, dirSource{root: cfg.RootDir})
+	}
+	return s, nil
 }
 
 func (s *Server) Run(ctx context.Context, ready *atomic.Bool) error {
-	srv := tftp.NewServer(s.readHandler, nil)
-	srv.SetTimeout(time.Duration(s.cfg.TimeoutSec) * time.Second)
-
-	addr := s.cfg.Address
-	if addr == "" {
-		addr = ":69"
+	addrs := s.cfg.Addresses
+	if len(addrs) == 0 {
+		addrs = []string{":69"}
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return fmt.Errorf("resolve %s: %w", addr, err)
-	}
-
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return fmt.Errorf("listen on %s: %w", addr, err)
+	conns := make([]*net.UDPConn, 0, len(addrs))
+	for _, addr := range addrs {
+		conn, err := listen(addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return err
+		}
+		conns = append(conns, conn)
 	}
 	ready.Store(true)
 
-	done := make(chan struct{})
-	go func() {
-		srv.Serve(conn)
-		close(done)
-	}()
+	var transfers sync.WaitGroup
+	done := make(chan error, len(conns))
+	for _, conn := range conns {
+		s.logger.Printf("INFO tftp listening on %s (blksize<=%d windowsize<=%d tsize=%t)",
+			conn.LocalAddr(), s.cfg.MaxBlockSize, s.cfg.MaxWindowSize, s.cfg.TSize)
+		go func(conn *net.UDPConn) {
+			done <- s.serve(ctx, conn, &transfers)
+		}(conn)
+	}
 
+	var err error
+	remaining := len(conns)
 	select {
-	case <-done:
-		return nil
+	case err = <-done:
+		remaining--
 	case <-ctx.Done():
-		srv.Shutdown()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for ; remaining > 0; remaining-- {
 		<-done
+	}
+	transfers.Wait()
+	if ctx.Err() != nil {
 		return nil
 	}
+	return err
+}
+
+// listen opens a UDP socket for addr. IPv6 literals bind with udp6 so an
+// explicit "[::]:69" can sit alongside "0.0.0.0:69"; a bare ":69" listens on
+// both families.
+func listen(addr string) (*net.UDPConn, error) {
+	network := "udp"
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(strings.Split(host, "%")[0]); ip != nil {
+			if ip.To4() != nil {
+				network = "udp4"
+			} else {
+				network = "udp6"
+			}
+		}
+	}
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", addr, err)
+	}
+	conn, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// serve reads requests from the well-known port and starts a transfer for
+// each read request.
+func (s *Server) serve(ctx context.Context, conn *net.UDPConn, transfers *sync.WaitGroup) error {
+	buf := make([]byte, 65536)
+	for {
+		n, peer, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("read request: %w", err)
+		}
+		if n < 2 {
+			continue
+		}
+		switch binary.BigEndian.Uint16(buf) {
+		case opRRQ:
+			req, err := parseRequest(buf[:n])
+			if err != nil {
+				_, _ = conn.WriteToUDP(packError(errIllegalOperation, err.Error()), peer)
+				continue
+			}
+			local := conn.LocalAddr().(*net.UDPAddr)
+			transfers.Add(1)
+			go func() {
+				defer transfers.Done()
+				s.handleRead(ctx, local, peer, req)
+			}()
+		case opWRQ:
+			_, _ = conn.WriteToUDP(packError(errAccessViolation, "server is read-only"), peer)
+		default:
+			_, _ = conn.WriteToUDP(packError(errIllegalOperation, "expected read request"), peer)
+		}
+	}
 }
 
-func (s *Server) readHandler(filename string, rf io.ReaderFrom) error {
-	clean := filepath.Clean(filename)
-	for strings.HasPrefix(clean, string(filepath.Separator)) {
-		clean = strings.TrimPrefix(clean, string(filepath.Separator))
+func (s *Server) handleRead(ctx context.Context, local, peer *net.UDPAddr, req request) {
+	network := "udp4"
+	if peer.IP.To4() == nil {
+		network = "udp6"
+	}
+	bind := &net.UDPAddr{IP: local.IP, Zone: local.Zone}
+	if local.IP.IsUnspecified() {
+		// A dual-stack listener reports "::"; let the kernel pick the
+		// source for the peer's family.
+		bind = nil
 	}
-	path := filepath.Join(s.cfg.RootDir, clean)
-	f, err := os.Open(path)
+	conn, err := net.ListenUDP(network, bind)
 	if err != nil {
-		return err
+		s.logger.Printf("ERROR tftp open transfer socket for %s: %v", peer, err)
+		return
+	}
+	defer conn.Close()
+
+	t := &transfer{
+		conn:    conn,
+		peer:    peer,
+		blksize: defaultBlockSize,
+		window:  1,
+		timeout: time.Duration(s.cfg.TimeoutSec) * time.Second,
+		retries: s.cfg.Retries,
+	}
+	if t.timeout <= 0 {
+		t.timeout = 5 * time.Second
+	}
+
+	f, size, err := s.open(bootcfg.WithClientIP(ctx, peer.IP), req.filename)
+	if err != nil {
+		code := errAccessViolation
+		msg := "access denied"
+		if errors.Is(err, fs.ErrNotExist) {
+			code, msg = errFileNotFound, "file not found"
+		}
+		t.sendError(code, msg)
+		s.logger.Printf("WARN tftp %s requested %s: %v", peer.IP, req.filename, err)
+		observeTransfer(t, false)
+		return
 	}
 	defer f.Close()
 
-	if _, err := rf.ReadFrom(f); err != nil {
-		return err
+	limits := options{maxBlockSize: s.cfg.MaxBlockSize, maxWindowSize: s.cfg.MaxWindowSize, tsize: s.cfg.TSize}
+	names, values := t.negotiate(req, limits, size)
+	if err := t.send(ctx, f, names, values); err != nil {
+		s.logger.Printf("WARN tftp transfer of %s to %s failed after %d bytes: %v", req.filename, peer.IP, t.bytes, err)
+		observeTransfer(t, false)
+		return
+	}
+	observeTransfer(t, true)
+
+	s.logger.Printf("INFO served %s via TFTP to %s (%d bytes in %s, blksize %d, windowsize %d, %d retransmits)",
+		req.filename, peer.IP, t.bytes, time.Since(t.started).Round(time.Millisecond), t.blksize, t.window, t.retransmits)
+	s.events.Emit(events.SubjectTFTPServed, events.Boot{IP: peer.IP.String(), BootFile: req.filename})
+}
+
+// open resolves filename against the configured sources and returns the file
+// with its size, or -1 if the size is unknown.
+func (s *Server) open(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	name, err := cleanName(filename)
+	if err != nil {
+		return nil, 0, err
 	}
-	s.logger.Printf("INFO served %s via TFTP", filename)
-	return nil
+	return openFirst(ctx, s.sources, name)
 }
@@ -0,0 +1,151 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"goosed/services/pxe-stack/internal/config"
+)
+
+// startTestServer serves root on a loopback port and returns its address.
+func startTestServer(t *testing.T, root string) *net.UDPAddr {
+	t.Helper()
+	conn, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s, err := NewServer(config.TFTPConfig{
+		RootDir:       root,
+		TimeoutSec:    1,
+		Retries:       3,
+		MaxBlockSize:  1024,
+		MaxWindowSize: 4,
+		TSize:         true,
+	}, log.New(io.Discard, "", 0), nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var transfers sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.serve(ctx, conn, &transfers)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		conn.Close()
+		<-done
+		transfers.Wait()
+	})
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func rrq(filename string, opts ...string) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, opRRQ)
+	for _, f := range append([]string{filename, "octet"}, opts...) {
+		b.WriteString(f)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func ack(block uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, opACK)
+	binary.BigEndian.PutUint16(b[2:], block)
+	return b
+}
+
+func TestReadNegotiatesOptionsAndStreamsWindows(t *testing.T) {
+	root := t.TempDir()
+	want := bytes.Repeat([]byte("goosed-pxe"), 500) // 5000 bytes
+	if err := os.WriteFile(filepath.Join(root, "ipxe.efi"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server := startTestServer(t, root)
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.WriteToUDP(rrq("/ipxe.efi", "blksize", "4096", "tsize", "0", "windowsize", "8"), server); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 65536)
+	n, peer, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read oack: %v", err)
+	}
+	if op := binary.BigEndian.Uint16(buf); op != opOACK {
+		t.Fatalf("opcode = %d, want OACK", op)
+	}
+	if got, want := string(buf[2:n]), "blksize\x001024\x00tsize\x005000\x00windowsize\x004\x00"; got != want {
+		t.Fatalf("oack = %q, want %q", got, want)
+	}
+	if _, err := client.WriteToUDP(ack(0), peer); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	for block := uint16(1); ; block++ {
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("read block %d: %v", block, err)
+		}
+		if op, b := binary.BigEndian.Uint16(buf), binary.BigEndian.Uint16(buf[2:]); op != opDATA || b != block {
+			t.Fatalf("got opcode %d block %d, want DATA %d", op, b, block)
+		}
+		got = append(got, buf[4:n]...)
+		last := n-4 < 1024
+		// The window is four blocks; acknowledge only at its end.
+		if last || block%4 == 0 {
+			if _, err := client.WriteToUDP(ack(block), peer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if last {
+			break
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestReadMissingFile(t *testing.T) {
+	server := startTestServer(t, t.TempDir())
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.WriteToUDP(rrq("missing.efi"), server); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 516)
+	if _, _, err := client.ReadFromUDP(buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if op, code := binary.BigEndian.Uint16(buf), binary.BigEndian.Uint16(buf[2:]); op != opERROR || code != errFileNotFound {
+		t.Fatalf("got opcode %d code %d, want ERROR %d", op, code, errFileNotFound)
+	}
+}
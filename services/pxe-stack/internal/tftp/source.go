@@ -0,0 +1,67 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// source resolves a cleaned, slash-separated TFTP path to file contents. Open
+// returns an error wrapping fs.ErrNotExist when the source has no such file,
+// letting the server fall through to the next source. The size is -1 when it
+// is not known up front.
+type source interface {
+	Open(ctx context.Context, name string) (io.ReadCloser, int64, error)
+}
+
+// cleanName normalises a requested filename into a path relative to the TFTP
+// root. Leading slashes and ".." segments cannot escape the root, and
+// backslashes from Windows clients are treated as separators.
+func cleanName(filename string) (string, error) {
+	name := strings.TrimLeft(path.Clean("/"+strings.ReplaceAll(filename, `\`, "/")), "/")
+	if name == "" || name == "." {
+		return "", fmt.Errorf("invalid filename %q", filename)
+	}
+	return name, nil
+}
+
+// dirSource serves files from a local directory.
+type dirSource struct {
+	root string
+}
+
+func (d dirSource) Open(_ context.Context, name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(d.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return f, -1, nil
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s is a directory", name)
+	}
+	return f, info.Size(), nil
+}
+
+// openFirst tries each source in turn and returns the first match.
+func openFirst(ctx context.Context, sources []source, name string) (io.ReadCloser, int64, error) {
+	for _, src := range sources {
+		rc, size, err := src.Open(ctx, name)
+		if err == nil {
+			return rc, size, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+}
@@ -0,0 +1,207 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gos3 "goosed/pkg/s3"
+	"goosed/services/pxe-stack/internal/bootcfg"
+)
+
+type fakeStore struct {
+	objects map[string]string
+	etags   map[string]string
+	gets    int
+}
+
+func (f *fakeStore) GetObject(_ context.Context, _, key string) (io.ReadCloser, gos3.ObjectInfo, error) {
+	f.gets++
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, gos3.ObjectInfo{}, gos3.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader([]byte(data))), gos3.ObjectInfo{Size: int64(len(data)), ETag: f.etags[key]}, nil
+}
+
+func (f *fakeStore) HeadObject(_ context.Context, _, key string) (gos3.ObjectInfo, error) {
+	data, ok := f.objects[key]
+	if !ok {
+		return gos3.ObjectInfo{}, gos3.ErrNotFound
+	}
+	return gos3.ObjectInfo{Size: int64(len(data)), ETag: f.etags[key]}, nil
+}
+
+func readAll(t *testing.T, src source, name string) string {
+	t.Helper()
+	rc, _, err := src.Open(context.Background(), name)
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestS3SourceCachesAndRevalidates(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		store := &fakeStore{
+			objects: map[string]string{"tftp/ipxe.efi": "v1", "tftp/undionly.kpxe": "bios"},
+			etags:   map[string]string{"tftp/ipxe.efi": "a", "tftp/undionly.kpxe": "b"},
+		}
+		c, err := newCache(dir, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := &s3Source{store: store, bucket: "artifacts", prefix: "tftp/", cache: c, ttl: time.Hour, logger: log.New(io.Discard, "", 0)}
+
+		if got := readAll(t, src, "ipxe.efi"); got != "v1" {
+			t.Fatalf("got %q", got)
+		}
+		readAll(t, src, "ipxe.efi")
+		if store.gets != 1 {
+			t.Fatalf("gets = %d, want 1 (second read should hit the cache)", store.gets)
+		}
+
+		// Caching a second object evicts the first to stay within 4 bytes.
+		readAll(t, src, "undionly.kpxe")
+		if _, ok := c.get("tftp/ipxe.efi"); ok {
+			t.Fatal("expected ipxe.efi to be evicted")
+		}
+
+		// A changed ETag is picked up once the entry is older than the TTL.
+		store.objects["tftp/undionly.kpxe"], store.etags["tftp/undionly.kpxe"] = "new", "c"
+		src.ttl = 0
+		if got := readAll(t, src, "undionly.kpxe"); got != "new" {
+			t.Fatalf("got %q after revalidation, want new", got)
+		}
+
+		if _, _, err := src.Open(context.Background(), "missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("missing object error = %v, want fs.ErrNotExist", err)
+		}
+	}
+}
+
+// pipeStore serves one object whose body is written by the test.
+type pipeStore struct {
+	body *io.PipeReader
+	size int64
+	gets atomic.Int32
+}
+
+func (p *pipeStore) GetObject(context.Context, string, string) (io.ReadCloser, gos3.ObjectInfo, error) {
+	p.gets.Add(1)
+	return p.body, gos3.ObjectInfo{Size: p.size, ETag: "a"}, nil
+}
+
+func (p *pipeStore) HeadObject(context.Context, string, string) (gos3.ObjectInfo, error) {
+	return gos3.ObjectInfo{Size: p.size, ETag: "a"}, nil
+}
+
+func TestS3SourceStreamsAndCoalescesMisses(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		pr, pw := io.Pipe()
+		store := &pipeStore{body: pr, size: 8}
+		c, err := newCache(dir, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := &s3Source{store: store, bucket: "artifacts", prefix: "tftp/", cache: c, ttl: time.Hour, logger: log.New(io.Discard, "", 0)}
+
+		first, size, err := src.Open(context.Background(), "ipxe.efi")
+		if err != nil || size != 8 {
+			t.Fatalf("open: size %d, %v", size, err)
+		}
+		defer first.Close()
+		go func() { _, _ = pw.Write([]byte("abcd")) }()
+		head := make([]byte, 4)
+		if _, err := io.ReadFull(first, head); err != nil || string(head) != "abcd" {
+			t.Fatalf("first bytes = %q, %v; want them before the download completes", head, err)
+		}
+
+		second, _, err := src.Open(context.Background(), "ipxe.efi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer second.Close()
+		if n := store.gets.Load(); n != 1 {
+			t.Fatalf("gets = %d, want the second read to join the first", n)
+		}
+
+		go func() {
+			_, _ = pw.Write([]byte("efgh"))
+			pw.Close()
+		}()
+		rest, err := io.ReadAll(first)
+		if err != nil || string(rest) != "efgh" {
+			t.Fatalf("rest of first read = %q, %v", rest, err)
+		}
+		all, err := io.ReadAll(second)
+		if err != nil || string(all) != "abcdefgh" {
+			t.Fatalf("second read = %q, %v", all, err)
+		}
+
+		if got := readAll(t, src, "ipxe.efi"); got != "abcdefgh" || store.gets.Load() != 1 {
+			t.Fatalf("cached read = %q after %d gets", got, store.gets.Load())
+		}
+	}
+}
+
+func TestVirtualSourceRendersFromAPI(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("mac") != "aa:bb:cc:dd:ee:ff" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer api.Close()
+
+	sources := []source{
+		virtualSource{client: bootcfg.NewClient(api.URL)},
+		dirSource{root: t.TempDir()},
+	}
+	for name, want := range map[string]string{
+		"pxelinux.cfg/01-AA-BB-CC-DD-EE-FF":  "/v1/boot/pxelinux",
+		"grub/grub.cfg-01-aa-bb-cc-dd-ee-ff": "/v1/boot/grub",
+	} {
+		rc, size, err := openFirst(context.Background(), sources, name)
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		got, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(got) != want || size != int64(len(want)) {
+			t.Fatalf("%s rendered from %q (size %d), want %q", name, got, size, want)
+		}
+	}
+
+	for _, name := range []string{"pxelinux.cfg/01-00-11-22-33-44-55", "pxelinux.cfg/C0A87A", "ipxe.efi"} {
+		if _, _, err := openFirst(context.Background(), sources, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s: err = %v, want fs.ErrNotExist", name, err)
+		}
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	for in, want := range map[string]string{
+		"/pxelinux.0":        "pxelinux.0",
+		"../../etc/passwd":   "etc/passwd",
+		`boot\grub\grub.cfg`: "boot/grub/grub.cfg",
+	} {
+		if got, err := cleanName(in); err != nil || got != want {
+			t.Errorf("cleanName(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+}
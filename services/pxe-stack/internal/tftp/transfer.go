@@ -0,0 +1,200 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// transfer sends one file to one client over its own socket (the server-side
+// TID). Options are negotiated per RFC 2347-2349 and RFC 7440.
+type transfer struct {
+	conn    *net.UDPConn
+	peer    *net.UDPAddr
+	blksize int
+	window  int
+	timeout time.Duration
+	retries int
+
+	bytes       int64
+	retransmits int64
+	started     time.Time
+}
+
+// negotiate accepts the client's options within the server limits and
+// returns the option names to acknowledge in an OACK, in request order.
+func (t *transfer) negotiate(req request, limits options, size int64) ([]string, map[string]string) {
+	accepted := make(map[string]string)
+	if v, ok := req.options["blksize"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 8 {
+			t.blksize = min(n, limits.maxBlockSize)
+			accepted["blksize"] = strconv.Itoa(t.blksize)
+		}
+	}
+	if v, ok := req.options["windowsize"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 {
+			t.window = min(n, limits.maxWindowSize)
+			accepted["windowsize"] = strconv.Itoa(t.window)
+		}
+	}
+	if v, ok := req.options["timeout"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 255 {
+			t.timeout = time.Duration(n) * time.Second
+			accepted["timeout"] = v
+		}
+	}
+	if _, ok := req.options["tsize"]; ok && limits.tsize && size >= 0 {
+		accepted["tsize"] = strconv.FormatInt(size, 10)
+	}
+
+	names := make([]string, 0, len(accepted))
+	for _, name := range req.order {
+		if _, ok := accepted[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names, accepted
+}
+
+// send streams r to the client. When options were accepted the OACK is sent
+// first and must be acknowledged with block 0.
+func (t *transfer) send(ctx context.Context, r io.Reader, oackNames []string, oack map[string]string) error {
+	t.started = time.Now()
+	if len(oackNames) > 0 {
+		if err := t.sendOACK(ctx, packOACK(oackNames, oack)); err != nil {
+			return err
+		}
+	}
+
+	var (
+		pending [][]byte // unacknowledged blocks starting at base
+		base    = uint64(1)
+		sent    int // how many of pending have been transmitted at least once
+		eof     bool
+		tries   int
+		pkt     = make([]byte, 4+t.blksize)
+		readBuf = make([]byte, t.blksize)
+	)
+	for {
+		for len(pending) < t.window && !eof {
+			n, err := io.ReadFull(r, readBuf)
+			switch {
+			case err == nil:
+			case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+				eof = true
+			default:
+				t.sendError(errNotDefined, "read error")
+				return fmt.Errorf("read: %w", err)
+			}
+			pending = append(pending, append([]byte(nil), readBuf[:n]...))
+		}
+
+		for i, block := range pending {
+			if i < sent {
+				t.retransmits++
+			}
+			if _, err := t.conn.WriteToUDP(packData(pkt, uint16(base+uint64(i)), block), t.peer); err != nil {
+				return fmt.Errorf("send block %d: %w", base+uint64(i), err)
+			}
+		}
+		sent = len(pending)
+
+		acked, err := t.awaitAck(ctx, base, len(pending))
+		if err != nil && !errors.Is(err, errTimeout) {
+			return err
+		}
+		if acked == 0 {
+			tries++
+			if tries > t.retries {
+				return fmt.Errorf("no ack for block %d after %d retries", base, t.retries)
+			}
+			continue
+		}
+		tries = 0
+		for _, block := range pending[:acked] {
+			t.bytes += int64(len(block))
+		}
+		pending = pending[acked:]
+		sent -= acked
+		base += uint64(acked)
+		if eof && len(pending) == 0 {
+			return nil
+		}
+	}
+}
+
+func (t *transfer) sendOACK(ctx context.Context, oack []byte) error {
+	for tries := 0; ; tries++ {
+		if tries > 0 {
+			t.retransmits++
+		}
+		if _, err := t.conn.WriteToUDP(oack, t.peer); err != nil {
+			return fmt.Errorf("send oack: %w", err)
+		}
+		acked, err := t.awaitAck(ctx, 0, 1)
+		if err == nil && acked == 1 {
+			return nil
+		}
+		if err != nil && !errors.Is(err, errTimeout) {
+			return err
+		}
+		if tries >= t.retries {
+			return errors.New("no ack for oack")
+		}
+	}
+}
+
+var errTimeout = errors.New("timeout")
+
+// awaitAck waits for an ACK covering blocks base..base+count-1 and returns how
+// many of them were acknowledged. Stale and duplicate ACKs are ignored until
+// the timeout expires.
+func (t *transfer) awaitAck(ctx context.Context, base uint64, count int) (int, error) {
+	deadline := time.Now().Add(t.timeout)
+	buf := make([]byte, 516)
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := t.conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, errTimeout
+			}
+			return 0, err
+		}
+		if !addr.IP.Equal(t.peer.IP) || addr.Port != t.peer.Port {
+			_, _ = t.conn.WriteToUDP(packError(errUnknownTID, "unknown transfer id"), addr)
+			continue
+		}
+		block, err := parseAck(buf[:n])
+		if errors.Is(err, errUnexpectedPacket) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		for i := 0; i < count; i++ {
+			if uint16(base+uint64(i)) == block {
+				return i + 1, nil
+			}
+		}
+		// RFC 7440: a windowed client re-ACKs the last good block when it
+		// detects a gap, asking for the window to be resent straight away.
+		if t.window > 1 && base > 1 && block == uint16(base-1) {
+			return 0, nil
+		}
+	}
+}
+
+func (t *transfer) sendError(code uint16, msg string) {
+	_, _ = t.conn.WriteToUDP(packError(code, msg), t.peer)
+}
@@ -4,9 +4,13 @@ import (
 	"log"
 
 	"goosed/services/pxe-stack/internal/config"
+	"goosed/services/pxe-stack/internal/events"
 )
 
 type Server struct {
 	cfg    config.TFTPConfig
 	logger *log.Logger
+	events *events.Emitter
+	// sources are tried in order for every read request.
+	sources []source
 }
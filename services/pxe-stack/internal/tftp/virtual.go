@@ -0,0 +1,30 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+
+	"goosed/services/pxe-stack/internal/bootcfg"
+)
+
+// virtualSource serves pxelinux.cfg/01-<mac> and grub.cfg-01-<mac> rendered
+// on request by the API, so per-machine configs never have to be written to
+// the TFTP root. Other names, and MACs the API does not know, fall through to
+// the next source.
+type virtualSource struct {
+	client *bootcfg.Client
+}
+
+func (v virtualSource) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	kind, mac, ok := bootcfg.Match(name)
+	if !ok {
+		return nil, 0, fs.ErrNotExist
+	}
+	body, err := v.client.Fetch(ctx, kind, mac)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
+}